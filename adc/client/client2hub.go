@@ -28,6 +28,9 @@ type Config struct {
 	PID        adc.PID
 	Name       string
 	Extensions adcp.ExtFeatures
+	// Init is called when the handshake is complete, but before the connection starts reading messages.
+	// Callbacks like OnChatMessage should be set here, so no messages are missed.
+	Init func(c *Conn)
 }
 
 func (c *Config) validate() error {
@@ -74,6 +77,9 @@ func HubHandshake(conn *adc.Conn, conf *Config) (*Conn, error) {
 		conn.Close()
 		return nil, err
 	}
+	if conf.Init != nil {
+		conf.Init(c)
+	}
 	//c.conn.KeepAlive(time.Minute / 2)
 	go c.readLoop()
 	return c, nil
@@ -174,6 +180,7 @@ func identifyToHub(conn *adc.Conn, sid adc.SID, user *adcp.UserInfo) error {
 // Conn represents a Client-to-Hub connection.
 type Conn struct {
 	conn *adc.Conn
+	wmu  sync.Mutex
 	fea  adcp.ModFeatures
 
 	closing chan struct{}
@@ -198,6 +205,12 @@ type Conn struct {
 		sync.Mutex
 		tokens map[string]revConnToken
 	}
+
+	on struct {
+		chat   func(from *Peer, m adcp.ChatMessage) error
+		search func(from *Peer, req adcp.SearchRequest) error
+		result func(from *Peer, r adcp.SearchResult) error
+	}
 }
 
 type revConnToken struct {
@@ -237,12 +250,94 @@ func (c *Conn) Close() error {
 }
 
 func (c *Conn) writeDirect(to adc.SID, msg adcp.Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 	if err := c.conn.WriteDirect(c.SID(), to, msg); err != nil {
 		return err
 	}
 	return c.conn.Flush()
 }
 
+func (c *Conn) writeBroadcast(msg adcp.Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.conn.WriteBroadcast(c.SID(), msg); err != nil {
+		return err
+	}
+	return c.conn.Flush()
+}
+
+func (c *Conn) writeEcho(to adc.SID, msg adcp.Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.conn.WriteEcho(c.SID(), to, msg); err != nil {
+		return err
+	}
+	return c.conn.Flush()
+}
+
+// OnChatMessage sets a callback for chat messages. Private messages have a PM field set.
+// The peer is nil for messages sent by the hub.
+//
+// It should be called from Config.Init, so no messages are missed.
+func (c *Conn) OnChatMessage(fnc func(from *Peer, m adcp.ChatMessage) error) {
+	c.on.chat = fnc
+}
+
+// OnSearch sets a callback for search requests from other peers.
+//
+// It should be called from Config.Init, so no messages are missed.
+func (c *Conn) OnSearch(fnc func(from *Peer, req adcp.SearchRequest) error) {
+	c.on.search = fnc
+}
+
+// OnSearchResult sets a callback for search results sent to this client via the hub.
+//
+// It should be called from Config.Init, so no messages are missed.
+func (c *Conn) OnSearchResult(fnc func(from *Peer, r adcp.SearchResult) error) {
+	c.on.result = fnc
+}
+
+// SendChatMsg sends a message to the main chat.
+func (c *Conn) SendChatMsg(text string) error {
+	return c.writeBroadcast(adcp.ChatMessage{Text: text})
+}
+
+// SendPrivateMsg sends a private message to a given peer.
+func (c *Conn) SendPrivateMsg(to *Peer, text string) error {
+	sid := to.getSID()
+	if sid == nil {
+		return ErrPeerOffline
+	}
+	own := c.SID()
+	return c.writeEcho(*sid, adcp.ChatMessage{Text: text, PM: &own})
+}
+
+// Search sends a search request to all peers. Results are passed to OnSearchResult callback.
+func (c *Conn) Search(req adcp.SearchRequest) error {
+	return c.writeBroadcast(req)
+}
+
+// SendSearchResult sends a search result to a given peer via the hub.
+func (c *Conn) SendSearchResult(to *Peer, r adcp.SearchResult) error {
+	sid := to.getSID()
+	if sid == nil {
+		return ErrPeerOffline
+	}
+	return c.writeDirect(*sid, r)
+}
+
+// UpdateInfo changes user info and broadcasts it to other peers.
+func (c *Conn) UpdateInfo(fnc func(u *adcp.UserInfo)) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	fnc(&c.user)
+	if err := c.conn.WriteBroadcast(c.sid, &c.user); err != nil {
+		return err
+	}
+	return c.conn.Flush()
+}
+
 func (c *Conn) revConnToken(ctx context.Context, cid adc.CID) (token string, addr <-chan string, _ <-chan error) {
 	ch := make(chan string, 1)
 	errc := make(chan error, 1)
@@ -298,6 +393,16 @@ func (c *Conn) readLoop() {
 				log.Println(err)
 				return
 			}
+		case *adcp.EchoPacket:
+			// either our own message echoed back by the hub, or a message sent to us
+			if cmd.To != c.SID() && cmd.ID != c.SID() {
+				log.Println("echo command to a wrong destination:", cmd.To)
+				return
+			}
+			if err := c.handleDirect((*adcp.DirectPacket)(cmd)); err != nil {
+				log.Println(err)
+				return
+			}
 		default:
 			log.Printf("unhandled command: %T", cmd)
 		}
@@ -313,9 +418,16 @@ func (c *Conn) handleBroadcast(p *adcp.BroadcastPacket) error {
 		return c.peerUpdate(p.ID, p)
 	case (adcp.SearchRequest{}).Cmd():
 		peer := c.peerBySID(p.ID)
-		c.handleSearch(peer, p)
-		return nil
-	// TODO: MSG
+		return c.handleSearch(peer, p)
+	case (adcp.ChatMessage{}).Cmd():
+		if c.on.chat == nil {
+			return nil
+		}
+		var msg adcp.ChatMessage
+		if err := p.DecodeMessageTo(&msg); err != nil {
+			return err
+		}
+		return c.on.chat(c.peerBySID(p.ID), msg)
 	default:
 		log.Printf("unhandled broadcast command: %v", p.Msg.Cmd())
 		return nil
@@ -331,6 +443,9 @@ func (c *Conn) handleInfo(p *adcp.InfoPacket) error {
 	case adcp.ChatMessage:
 		// TODO: ADC: maybe hub should take a AAAA SID for itself
 		//       and this will become B-MSG AAAA, instead of I-MSG
+		if c.on.chat != nil {
+			return c.on.chat(nil, msg)
+		}
 		fmt.Printf("%s\n", msg.Text)
 		return nil
 	case adcp.Disconnect:
@@ -382,6 +497,16 @@ func (c *Conn) handleDirect(cmd *adcp.DirectPacket) error {
 		p := c.peerBySID(cmd.ID)
 		go c.handleConnReq(p, tok, msg)
 		return nil
+	case adcp.SearchResult:
+		if c.on.result != nil {
+			return c.on.result(c.peerBySID(cmd.ID), msg)
+		}
+		return nil
+	case adcp.ChatMessage:
+		if c.on.chat != nil {
+			return c.on.chat(c.peerBySID(cmd.ID), msg)
+		}
+		return nil
 	default:
 		log.Printf("unhandled direct command: %v", cmd.Msg.Cmd())
 		return nil
@@ -409,13 +534,17 @@ func (c *Conn) handleConnReq(p *Peer, tok revConnToken, s adcp.ConnectRequest) {
 	tok.addr <- addr + ":" + strconv.Itoa(s.Port)
 }
 
-func (c *Conn) handleSearch(p *Peer, pck adcp.Packet) {
+func (c *Conn) handleSearch(p *Peer, pck adcp.Packet) error {
 	var sch adcp.SearchRequest
 	if err := pck.DecodeMessageTo(&sch); err != nil {
 		log.Println("failed to decode search:", err)
-		return
+		return nil
+	}
+	if c.on.search != nil {
+		return c.on.search(p, sch)
 	}
 	log.Printf("search: %+v", sch)
+	return nil
 }
 
 func (c *Conn) OnlinePeers() []*Peer {
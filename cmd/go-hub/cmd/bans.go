@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/direct-connect/go-dcpp/hub"
+	"github.com/direct-connect/go-dcpp/hub/hubdb"
 )
 
 func init() {
@@ -105,4 +107,28 @@ func init() {
 		},
 	}
 	cmdBans.AddCommand(cmdClear)
+
+	cmdPurge := &cobra.Command{
+		Use:   "purge",
+		Short: "remove expired bans",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return errors.New("expected no arguments")
+			}
+			list, err := hubdb.ExpiredBans(hubDB, time.Now())
+			if err != nil {
+				return err
+			}
+			keys := make([]hub.BanKey, 0, len(list))
+			for _, b := range list {
+				keys = append(keys, b.Key)
+			}
+			if err = hubDB.DelBans(keys); err != nil {
+				return err
+			}
+			fmt.Printf("removed %d expired bans\n", len(keys))
+			return nil
+		},
+	}
+	cmdBans.AddCommand(cmdPurge)
 }
@@ -2,7 +2,12 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
+
+	"github.com/spf13/cobra"
 
 	"github.com/direct-connect/go-dcpp/hub"
 	"github.com/direct-connect/go-dcpp/hub/hubdb"
@@ -10,6 +15,144 @@ import (
 
 var hubDB hub.Database
 
+func init() {
+	cmdDB := &cobra.Command{
+		Use:   "db [command]",
+		Short: "database-related commands",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return OpenDB()
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			return CloseDB()
+		},
+	}
+	Root.AddCommand(cmdDB)
+
+	cmdExport := &cobra.Command{
+		Use:     "export [file]",
+		Aliases: []string{"dump"},
+		Short:   "export users, profiles and bans to a JSON file (or stdout)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return errors.New("expected at most one argument")
+			}
+			d, err := hubdb.Export(hubDB)
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 || args[0] == "-" {
+				return hubdb.WriteDump(os.Stdout, d)
+			}
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err = hubdb.WriteDump(f, d); err != nil {
+				return err
+			}
+			if err = f.Close(); err != nil {
+				return err
+			}
+			log.Printf("exported %d users, %d profiles and %d bans to %s",
+				len(d.Users), len(d.Profiles), len(d.Bans), args[0])
+			return nil
+		},
+	}
+	cmdDB.AddCommand(cmdExport)
+
+	cmdImport := &cobra.Command{
+		Use:     "import <file>",
+		Aliases: []string{"restore"},
+		Short:   "import users, profiles and bans from a JSON file (or stdin)",
+		Long: "Import merges the dump into the database by default, overwriting existing records with the same keys.\n" +
+			"With --replace, records that are not present in the dump are removed from the database.",
+	}
+	replace := cmdImport.Flags().Bool("replace", false, "remove records that are not in the dump")
+	dryRun := cmdImport.Flags().BoolP("dry-run", "n", false, "only print the changes")
+	cmdImport.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("expected one argument")
+		}
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		d, err := hubdb.ReadDump(r)
+		if err != nil {
+			return err
+		}
+		var c *hubdb.Changes
+		if *dryRun {
+			c, err = hubdb.Diff(hubDB, d, *replace)
+		} else {
+			c, err = hubdb.Import(hubDB, d, *replace)
+		}
+		if err != nil {
+			return err
+		}
+		printChanges(c)
+		return nil
+	}
+	cmdDB.AddCommand(cmdImport)
+
+	cmdCheck := &cobra.Command{
+		Use:   "check",
+		Short: "verify consistency of database indexes",
+	}
+	fix := cmdCheck.Flags().Bool("fix", false, "rebuild inconsistent indexes")
+	cmdCheck.RunE = func(cmd *cobra.Command, args []string) error {
+		problems, err := hubdb.Check(hubDB, *fix)
+		if err != nil {
+			return err
+		}
+		if len(problems) == 0 {
+			fmt.Println("ok")
+			return nil
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if *fix {
+			fmt.Println("indexes rebuilt")
+			return nil
+		}
+		return fmt.Errorf("found %d problems, run with --fix to rebuild indexes", len(problems))
+	}
+	cmdDB.AddCommand(cmdCheck)
+}
+
+func printChanges(c *hubdb.Changes) {
+	if c.Empty() {
+		fmt.Println("no changes")
+		return
+	}
+	for _, t := range []struct {
+		name string
+		c    *hubdb.TableChanges
+	}{
+		{"user", &c.Users},
+		{"profile", &c.Profiles},
+		{"ban", &c.Bans},
+		{"value", &c.Storage},
+	} {
+		for _, k := range t.c.Added {
+			fmt.Printf("+ %s %q\n", t.name, k)
+		}
+		for _, k := range t.c.Updated {
+			fmt.Printf("~ %s %q\n", t.name, k)
+		}
+		for _, k := range t.c.Removed {
+			fmt.Printf("- %s %q\n", t.name, k)
+		}
+	}
+}
+
 func OpenDB() error {
 	conf, _, err := readConfig(false)
 	if err != nil {
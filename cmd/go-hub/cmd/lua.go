@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/direct-connect/go-dcpp/hub/plugins/lua/luatest"
+)
+
+func init() {
+	cmdLua := &cobra.Command{
+		Use:   "lua [command]",
+		Short: "Lua-related commands",
+	}
+	Root.AddCommand(cmdLua)
+
+	cmdTest := &cobra.Command{
+		Use:   "test <script.lua> [scenario.yml]",
+		Short: "test a Lua script on an in-memory hub",
+		Long: `Load a Lua script on an in-memory hub and run a test scenario against it.
+
+Without a scenario, the script is only loaded. The command fails on the first failed step.
+The scenario is a list of steps, each step is either an action or an expectation:
+
+  timeout: 1s              # max time to wait for each expectation
+  config:                  # hub config used during the test
+    lua:
+      timeout: 1000
+  steps:
+    - join: alice          # connect a user
+      proto: adc           # nmdc (default), adc or bot
+    - chat: hello          # send a main chat message
+      user: alice
+    - pm: hi               # send a private message
+      user: alice
+      to: bob
+    - search: movie        # send a search
+      user: alice
+    - tick: 10s            # advance the fake clock, firing script timers
+    - expect:              # wait for a message received by the user
+        user: alice
+        from: Bot          # optional sender name
+        chat: welcome      # or pm; "/regexp/" is also accepted
+    - expect:
+        user: bob
+        none: true         # no new messages during the timeout
+        timeout: 200ms
+    - expect:
+        user: alice
+        disconnected: true # user was kicked by the script
+    - leave: alice         # disconnect the user`,
+	}
+	verbose := cmdTest.Flags().BoolP("verbose", "v", false, "print hub logs")
+	cmdTest.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("expected a script and an optional scenario file")
+		}
+		var sc *luatest.Scenario
+		if len(args) > 1 {
+			var err error
+			sc, err = luatest.LoadScenario(args[1])
+			if err != nil {
+				return err
+			}
+		}
+		if !*verbose {
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+		}
+		return luatest.Run(args[0], sc, os.Stdout)
+	}
+	cmdLua.AddCommand(cmdTest)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/direct-connect/go-dcpp/hub/hubdb"
+)
+
+func init() {
+	cmdMigrate := &cobra.Command{
+		Use:   "migrate [command]",
+		Short: "import users, profiles and bans from other hub software",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return OpenDB()
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			return CloseDB()
+		},
+	}
+	replace := cmdMigrate.PersistentFlags().Bool("replace", false, "remove records that are not in the imported data")
+	dryRun := cmdMigrate.PersistentFlags().BoolP("dry-run", "n", false, "only print the changes")
+	Root.AddCommand(cmdMigrate)
+
+	apply := func(d *hubdb.Dump, rep *hubdb.MigrateReport) error {
+		if len(rep.Skipped) != 0 {
+			fmt.Println("not migrated:")
+			for _, s := range rep.Skipped {
+				fmt.Println("\t" + s)
+			}
+		}
+		var (
+			c   *hubdb.Changes
+			err error
+		)
+		if *dryRun {
+			c, err = hubdb.Diff(hubDB, d, *replace)
+		} else {
+			c, err = hubdb.Import(hubDB, d, *replace)
+		}
+		if err != nil {
+			return err
+		}
+		printChanges(c)
+		return nil
+	}
+
+	cmdPtokaX := &cobra.Command{
+		Use:     "ptokax <dir>",
+		Aliases: []string{"px"},
+		Short:   "import data from the PtokaX cfg directory",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("expected one argument")
+			}
+			d, rep, err := hubdb.FromPtokaX(args[0])
+			if err != nil {
+				return err
+			}
+			return apply(d, rep)
+		},
+	}
+	cmdMigrate.AddCommand(cmdPtokaX)
+
+	cmdVerlihub := &cobra.Command{
+		Use:     "verlihub <dump.sql>",
+		Aliases: []string{"vh"},
+		Short:   "import data from the Verlihub MySQL dump",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("expected one argument")
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			d, rep, err := hubdb.FromVerlihub(f)
+			if err != nil {
+				return err
+			}
+			return apply(d, rep)
+		},
+	}
+	cmdMigrate.AddCommand(cmdVerlihub)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 
 	"github.com/spf13/cobra"
 
@@ -127,4 +128,88 @@ func init() {
 		},
 	}
 	cmdProf.AddCommand(cmdDel)
+
+	cmdPerms := &cobra.Command{
+		Use:     "perms",
+		Aliases: []string{"permissions"},
+		Short:   "list known permissions",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, p := range hub.Permissions() {
+				fmt.Printf("%s\t\t%s\n", p.Name, p.Short)
+			}
+			return nil
+		},
+	}
+	cmdProf.AddCommand(cmdPerms)
+
+	cmdSet := &cobra.Command{
+		Use:   "set <profile> <perm> [true|false]",
+		Short: "set a permission in the profile",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 || len(args) > 3 {
+				return errors.New("expected 2 or 3 arguments")
+			}
+			val := true
+			if len(args) > 2 {
+				v, err := strconv.ParseBool(args[2])
+				if err != nil {
+					return fmt.Errorf("invalid value: %q", args[2])
+				}
+				val = v
+			}
+			return updateProfile(args[0], func(m hub.Map) {
+				m[args[1]] = val
+			})
+		},
+	}
+	cmdProf.AddCommand(cmdSet)
+
+	cmdUnset := &cobra.Command{
+		Use:   "unset <profile> <perm>",
+		Short: "remove a permission from the profile, so it's inherited from the parent",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return errors.New("expected 2 arguments")
+			}
+			def := hub.DefaultProfiles()[args[0]]
+			return updateProfile(args[0], func(m hub.Map) {
+				if v, ok := def[args[1]]; ok {
+					m[args[1]] = v
+				} else {
+					delete(m, args[1])
+				}
+			})
+		},
+	}
+	cmdProf.AddCommand(cmdUnset)
+}
+
+// updateProfile loads the profile from the database (or defaults), applies changes,
+// validates and saves it back.
+func updateProfile(name string, fnc func(m hub.Map)) error {
+	if name == "" {
+		return errors.New("name should not be empty")
+	}
+	m, err := hubDB.GetProfile(name)
+	if err != nil {
+		return err
+	}
+	if dm, ok := hub.DefaultProfiles()[name]; ok {
+		if m == nil {
+			m = dm
+		} else {
+			for k, v := range dm {
+				if _, ok := m[k]; !ok {
+					m[k] = v
+				}
+			}
+		}
+	} else if m == nil {
+		return errors.New("profile does not exist")
+	}
+	fnc(m)
+	if err = hub.ValidateProfile(m); err != nil {
+		return err
+	}
+	return hubDB.PutProfile(name, m)
 }
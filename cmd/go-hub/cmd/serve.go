@@ -94,10 +94,32 @@ type Config struct {
 	Plugins struct {
 		Path string `yaml:"path"`
 	} `yaml:"plugins"`
+
+	Nicks struct {
+		Reserved []struct {
+			Pattern  string   `yaml:"pattern"`
+			Profiles []string `yaml:"profiles"`
+		} `yaml:"reserved"`
+		Blocked  []string `yaml:"blocked"`
+		Prefixes bool     `yaml:"prefixes"`
+	} `yaml:"nicks"`
 }
 
 const defaultConfig = "hub.yml"
 
+func nickPolicy(conf *Config) hub.NickPolicy {
+	p := hub.NickPolicy{
+		Blocked:  conf.Nicks.Blocked,
+		Prefixes: conf.Nicks.Prefixes,
+	}
+	for _, r := range conf.Nicks.Reserved {
+		p.Reserved = append(p.Reserved, hub.ReservedNick{
+			Pattern: r.Pattern, Profiles: r.Profiles,
+		})
+	}
+	return p
+}
+
 func initConfig(path string) error {
 	return confManager.WriteConfigAs(path)
 }
@@ -247,6 +269,7 @@ func init() {
 			Addr:             addr,
 			TLS:              tlsConf,
 			Keyprint:         kp,
+			Nicks:            nickPolicy(conf),
 		}, confManager)
 		if err != nil {
 			return err
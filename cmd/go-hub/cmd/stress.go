@@ -11,14 +11,34 @@ import (
 	"sync/atomic"
 	"time"
 
+	adcp "github.com/direct-connect/go-dc/adc"
 	"github.com/spf13/cobra"
-
-	"github.com/direct-connect/go-dcpp/nmdc/client"
 )
 
 var stressCmd = &cobra.Command{
 	Use:   "stress",
 	Short: "run the stress test against the hub",
+	Long: `Run the stress test against the hub.
+
+Both NMDC and ADC hubs are supported, the protocol is selected by the address scheme.
+
+The load can be described by a scenario file (--scenario) with the following fields:
+
+  users: 1000          # number of concurrent connections
+  duration: 1m         # test duration
+  join: 100            # new connections per second (0 - no limit)
+  lifetime: 30s        # average connection lifetime (0 - stay connected)
+  chat: 0.1            # chat messages per user per second
+  pm: 0.05             # private messages per user per second
+  info: 0.01           # user info updates per user per second
+  search:
+    tth: 0.05          # TTH searches per user per second
+    text: 0.05         # text searches per user per second
+  reconnect:
+    every: 20s         # interval between reconnect storms
+    fraction: 0.5      # fraction of users that reconnect during each storm
+
+If --n or --dur flags are set explicitly, they override the values in the scenario.`,
 }
 
 func init() {
@@ -29,9 +49,33 @@ func init() {
 	fMsg := stressCmd.Flags().Bool("msg", false, "send chat messages")
 	fDur := stressCmd.Flags().Duration("dur", time.Second*30, "test duration")
 	fAll := stressCmd.Flags().Bool("all", false, "do not disconnect, join from all routines")
+	fScenario := stressCmd.Flags().String("scenario", "", "scenario file to run")
 	Root.AddCommand(stressCmd)
 	stressCmd.RunE = func(cmd *cobra.Command, args []string) error {
-		var wg sync.WaitGroup
+		var sc stressScenario
+		if *fScenario != "" {
+			if err := loadStressScenario(*fScenario, &sc); err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("n") {
+				sc.Users = *fNum
+			}
+			if cmd.Flags().Changed("dur") {
+				sc.Duration = *fDur
+			}
+		} else {
+			sc.Users = *fNum
+			sc.Duration = *fDur
+			if *fMsg {
+				sc.Chat = 0.4
+			}
+			if !*fAll {
+				sc.Lifetime = 5 * time.Second
+			}
+		}
+		if err := sc.validate(); err != nil {
+			return err
+		}
 
 		f, err := os.Create(*fOut)
 		if err != nil {
@@ -39,100 +83,325 @@ func init() {
 		}
 		defer f.Close()
 
-		var (
-			success   int32
-			errors    int32
-			connected int32
-			max       int32
-		)
-
-		cw := csv.NewWriter(f)
-		defer cw.Flush()
-
-		sleep := func(done <-chan struct{}) bool {
-			dt := time.Duration(rand.Int63n(int64(time.Second * 5)))
-			t := time.NewTimer(dt)
-			defer t.Stop()
-			select {
-			case <-t.C:
-				return true
-			case <-done:
-				return false
-			}
+		r := &stressRunner{
+			sc:   sc,
+			addr: *fAddr, prefix: *fName,
+			done:      make(chan struct{}),
+			storm:     make(chan struct{}),
+			handshake: latencyStats{name: "handshake"},
+			chat:      latencyStats{name: "chat echo"},
+			search:    latencyStats{name: "search rtt"},
 		}
-
-		connect := func(done <-chan struct{}) bool {
-			name := fmt.Sprintf(*fName+"%x", rand.Int())
-
-			//start := time.Now()
-			c, err := client.DialHub(*fAddr, &client.Config{
-				Name: name,
-			})
-			//dt := time.Since(start)
-			if err != nil {
-				atomic.AddInt32(&errors, +1)
-				log.Println("handshake failed:", err)
-				return true
-			}
-			defer c.Close()
-			atomic.AddInt32(&success, +1)
-			cn := atomic.AddInt32(&connected, +1)
-			defer atomic.AddInt32(&connected, -1)
-			for old := atomic.LoadInt32(&max); old < cn && !atomic.CompareAndSwapInt32(&max, old, cn); old = atomic.LoadInt32(&max) {
-			}
-			if *fAll {
-				<-done
-				return false
-			}
-
-			for rand.Intn(10) < 5 {
-				if *fMsg {
-					_ = c.SendChatMsg(strconv.FormatUint(rand.Uint64(), 16))
-				}
-				if !sleep(done) {
-					return false
-				}
-			}
-			return true
+		if sc.Join > 0 {
+			r.join = make(chan struct{})
+			go r.joinLoop()
+		}
+		if sc.Reconnect.Every > 0 && sc.Reconnect.Fraction > 0 {
+			go r.stormLoop()
 		}
 
-		done := make(chan struct{})
+		cw := csv.NewWriter(f)
+		defer cw.Flush()
 
-		for i := 0; i < *fNum; i++ {
+		var wg sync.WaitGroup
+		for i := 0; i < sc.Users; i++ {
 			wg.Add(1)
-			go func() {
+			go func(i int) {
 				defer wg.Done()
-				if *fAll {
-					connect(done)
-					return
-				}
-				for connect(done) {
-				}
-			}()
+				r.worker(i)
+			}(i)
 		}
 		const dt = time.Second / 2
 		var (
 			oldSuccess int32
 			oldErrors  int32
 		)
-		for i := 0; i < int(*fDur/dt); i++ {
+		for i := 0; i < int(sc.Duration/dt); i++ {
 			time.Sleep(dt)
-			sn, en := atomic.LoadInt32(&success), atomic.LoadInt32(&errors)
+			sn, en := atomic.LoadInt32(&r.success), atomic.LoadInt32(&r.errors)
 			dsn, den := sn-oldSuccess, en-oldErrors
 			oldSuccess, oldErrors = sn, en
 			_ = cw.Write([]string{
-				strconv.FormatInt(int64(atomic.LoadInt32(&connected)), 10),
+				strconv.FormatInt(int64(atomic.LoadInt32(&r.connected)), 10),
 				strconv.FormatInt(int64(dsn), 10),
 				strconv.FormatInt(int64(den), 10),
 			})
 		}
-		close(done)
+		close(r.done)
 		wg.Wait()
-		sn, en := atomic.LoadInt32(&success), atomic.LoadInt32(&errors)
+		sn, en := atomic.LoadInt32(&r.success), atomic.LoadInt32(&r.errors)
 		fmt.Println("total:", sn+en)
 		fmt.Printf("success: %d (%.0f%%)\n", sn, float64(sn)/float64(sn+en)*100)
 		fmt.Printf("errors: %d (%.0f%%)\n", en, float64(en)/float64(sn+en)*100)
-		fmt.Println("max:", atomic.LoadInt32(&max))
+		fmt.Println("max:", atomic.LoadInt32(&r.max))
+		fmt.Println(r.handshake.String())
+		fmt.Println(r.chat.String())
+		fmt.Println(r.search.String())
 		return nil
 	}
 }
+
+// stressRunner runs a stress scenario against a single hub.
+type stressRunner struct {
+	sc     stressScenario
+	addr   string
+	prefix string
+
+	done chan struct{}
+	join chan struct{} // nil if join rate is not limited
+
+	smu   sync.Mutex
+	storm chan struct{} // closed on each reconnect storm
+
+	success   int32
+	errors    int32
+	connected int32
+	max       int32
+
+	handshake latencyStats
+	chat      latencyStats
+	search    latencyStats
+}
+
+// joinLoop issues join tokens according to the join rate.
+func (r *stressRunner) joinLoop() {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / r.sc.Join))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		select {
+		case <-r.done:
+			return
+		case r.join <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stormLoop periodically notifies all workers about reconnect storms.
+func (r *stressRunner) stormLoop() {
+	ticker := time.NewTicker(r.sc.Reconnect.Every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		r.smu.Lock()
+		close(r.storm)
+		r.storm = make(chan struct{})
+		r.smu.Unlock()
+	}
+}
+
+func (r *stressRunner) currentStorm() <-chan struct{} {
+	r.smu.Lock()
+	ch := r.storm
+	r.smu.Unlock()
+	return ch
+}
+
+// worker keeps a single connection slot busy until the test ends.
+func (r *stressRunner) worker(idx int) {
+	limit := true
+	for {
+		if limit && r.join != nil {
+			select {
+			case <-r.done:
+				return
+			case <-r.join:
+			}
+		}
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+		var ok bool
+		limit, ok = r.session(idx)
+		if !ok {
+			return
+		}
+	}
+}
+
+// stressSession tracks pending chat messages and searches of a single connection.
+type stressSession struct {
+	r    *stressRunner
+	idx  int
+	name string
+
+	mu       sync.Mutex
+	seq      uint64
+	chats    map[string]time.Time
+	searches map[string]time.Time
+}
+
+func (s *stressSession) events() stressEvents {
+	return stressEvents{
+		chat: func(text string) {
+			s.mu.Lock()
+			start, ok := s.chats[text]
+			delete(s.chats, text)
+			s.mu.Unlock()
+			if ok {
+				s.r.chat.Add(time.Since(start))
+			}
+		},
+		search: func(pattern string, tth *adcp.TTH) bool {
+			idx, ok := stressTTHWorker(tth)
+			if !ok {
+				idx, ok = stressPatternWorker(pattern)
+			}
+			return ok && idx == s.idx
+		},
+		result: func(key string) {
+			s.mu.Lock()
+			start, ok := s.searches[key]
+			delete(s.searches, key)
+			s.mu.Unlock()
+			if ok {
+				s.r.search.Add(time.Since(start))
+			}
+		},
+	}
+}
+
+func (s *stressSession) next() uint64 {
+	s.mu.Lock()
+	s.seq++
+	v := s.seq
+	s.mu.Unlock()
+	return v
+}
+
+func (s *stressSession) sendChat(c stressClient) error {
+	text := fmt.Sprintf("%s %s %d", stressPrefix, s.name, s.next())
+	s.mu.Lock()
+	s.chats[text] = time.Now()
+	s.mu.Unlock()
+	return c.SendChat(text)
+}
+
+func (s *stressSession) sendSearch(c stressClient, tth bool) error {
+	// ask a random worker to answer the search
+	target := rand.Intn(s.r.sc.Users)
+	seq := s.next()
+	var (
+		key     string
+		pattern string
+		hash    *adcp.TTH
+	)
+	if tth {
+		hash = stressTTH(target, seq)
+		key = hash.Base32()
+	} else {
+		pattern = stressPattern(target, seq)
+		key = pattern
+	}
+	s.mu.Lock()
+	s.searches[key] = time.Now()
+	s.mu.Unlock()
+	return c.Search(pattern, hash)
+}
+
+// session connects to the hub and generates the load until the connection should be closed.
+// It returns false if the test is done. If limit is false, the next connection should
+// ignore the join rate.
+func (r *stressRunner) session(idx int) (limit, ok bool) {
+	s := &stressSession{
+		r: r, idx: idx,
+		name:     fmt.Sprintf(r.prefix+"%x", rand.Int()),
+		chats:    make(map[string]time.Time),
+		searches: make(map[string]time.Time),
+	}
+	storm := r.currentStorm()
+
+	start := time.Now()
+	c, err := dialStressClient(r.addr, s.name, s.events())
+	if err != nil {
+		atomic.AddInt32(&r.errors, +1)
+		log.Println("handshake failed:", err)
+		return true, true
+	}
+	defer c.Close()
+	r.handshake.Add(time.Since(start))
+	atomic.AddInt32(&r.success, +1)
+	cn := atomic.AddInt32(&r.connected, +1)
+	defer atomic.AddInt32(&r.connected, -1)
+	for old := atomic.LoadInt32(&r.max); old < cn && !atomic.CompareAndSwapInt32(&r.max, old, cn); old = atomic.LoadInt32(&r.max) {
+	}
+
+	sc := &r.sc
+	var life <-chan time.Time
+	if sc.Lifetime > 0 {
+		t := time.NewTimer(time.Duration(rand.ExpFloat64() * float64(sc.Lifetime)))
+		defer t.Stop()
+		life = t.C
+	}
+	rates := []float64{sc.Chat, sc.PM, sc.Info, sc.Search.TTH, sc.Search.Text}
+	var total float64
+	for _, v := range rates {
+		total += v
+	}
+	var (
+		timer *time.Timer
+		next  <-chan time.Time
+	)
+	delay := func() time.Duration {
+		return time.Duration(rand.ExpFloat64() / total * float64(time.Second))
+	}
+	if total > 0 {
+		timer = time.NewTimer(delay())
+		defer timer.Stop()
+		next = timer.C
+	}
+	for {
+		select {
+		case <-r.done:
+			return false, false
+		case <-life:
+			return true, true
+		case <-storm:
+			if rand.Float64() < sc.Reconnect.Fraction {
+				return false, true
+			}
+			storm = r.currentStorm()
+		case <-next:
+			if err = s.event(c, rates, total); err != nil {
+				log.Println("send failed:", err)
+				return true, true
+			}
+			timer.Reset(delay())
+		}
+	}
+}
+
+// event sends a random event according to the rates.
+func (s *stressSession) event(c stressClient, rates []float64, total float64) error {
+	v := rand.Float64() * total
+	i := 0
+	for ; i < len(rates)-1; i++ {
+		if v < rates[i] {
+			break
+		}
+		v -= rates[i]
+	}
+	switch i {
+	case 0:
+		return s.sendChat(c)
+	case 1:
+		return c.SendPM(fmt.Sprintf("%s pm %d", stressPrefix, s.next()))
+	case 2:
+		return c.UpdateInfo(strconv.FormatUint(rand.Uint64(), 16))
+	case 3:
+		return s.sendSearch(c, true)
+	default:
+		return s.sendSearch(c, false)
+	}
+}
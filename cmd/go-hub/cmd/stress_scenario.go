@@ -0,0 +1,337 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	adcp "github.com/direct-connect/go-dc/adc"
+	"github.com/direct-connect/go-dc/adc/types"
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+	"github.com/spf13/viper"
+
+	adcc "github.com/direct-connect/go-dcpp/adc/client"
+	nmdcc "github.com/direct-connect/go-dcpp/nmdc/client"
+)
+
+// stressScenario describes the load generated by the stress command.
+//
+// All rates are in events per second. Chat, PM, search and info rates are per connected user.
+type stressScenario struct {
+	// Users is the number of concurrent connections.
+	Users int
+	// Duration of the test.
+	Duration time.Duration
+	// Join limits the rate of new connections. Zero means no limit.
+	Join float64
+	// Lifetime is an average connection lifetime. Zero means that users stay connected.
+	Lifetime time.Duration
+
+	Chat   float64
+	PM     float64
+	Info   float64
+	Search struct {
+		TTH  float64
+		Text float64
+	}
+
+	// Reconnect describes periodic reconnect storms.
+	Reconnect struct {
+		// Every is an interval between storms. Zero disables them.
+		Every time.Duration
+		// Fraction of users that reconnect during each storm.
+		Fraction float64
+	}
+}
+
+func (s *stressScenario) validate() error {
+	if s.Users <= 0 {
+		return errors.New("number of users should be positive")
+	} else if s.Duration <= 0 {
+		return errors.New("duration should be positive")
+	} else if s.Join < 0 || s.Chat < 0 || s.PM < 0 || s.Info < 0 || s.Search.TTH < 0 || s.Search.Text < 0 {
+		return errors.New("rates cannot be negative")
+	} else if s.Reconnect.Fraction < 0 || s.Reconnect.Fraction > 1 {
+		return errors.New("reconnect fraction should be in [0, 1] range")
+	}
+	return nil
+}
+
+// loadStressScenario reads a scenario from a file. Any format supported by viper can be used.
+func loadStressScenario(path string, sc *stressScenario) error {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	return v.Unmarshal(sc)
+}
+
+// latencyStats collects latency samples and reports percentiles.
+type latencyStats struct {
+	name string
+
+	mu  sync.Mutex
+	arr []time.Duration
+}
+
+func (l *latencyStats) Add(dt time.Duration) {
+	l.mu.Lock()
+	l.arr = append(l.arr, dt)
+	l.mu.Unlock()
+}
+
+func (l *latencyStats) String() string {
+	l.mu.Lock()
+	arr := append([]time.Duration{}, l.arr...)
+	l.mu.Unlock()
+	if len(arr) == 0 {
+		return l.name + ": no samples"
+	}
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i] < arr[j]
+	})
+	p := func(v float64) time.Duration {
+		return arr[int(float64(len(arr)-1)*v)]
+	}
+	return fmt.Sprintf("%s: n=%d p50=%v p90=%v p99=%v max=%v",
+		l.name, len(arr), p(0.50), p(0.90), p(0.99), arr[len(arr)-1])
+}
+
+// stressPrefix is added to all stress test search patterns to distinguish them from other searches.
+const stressPrefix = "stress"
+
+// stressTTH encodes a worker index and a sequence number into a TTH that can be searched for.
+func stressTTH(worker int, seq uint64) *adcp.TTH {
+	var h adcp.TTH
+	copy(h[:], stressPrefix)
+	binary.BigEndian.PutUint32(h[8:], uint32(worker))
+	binary.BigEndian.PutUint64(h[12:], seq)
+	return &h
+}
+
+// stressTTHWorker returns a worker index encoded into a TTH by stressTTH.
+func stressTTHWorker(h *adcp.TTH) (int, bool) {
+	if h == nil || string(h[:len(stressPrefix)]) != stressPrefix {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(h[8:])), true
+}
+
+// stressPattern returns a text search pattern for a given worker index and a sequence number.
+func stressPattern(worker int, seq uint64) string {
+	return stressPrefix + strconv.Itoa(worker) + "x" + strconv.FormatUint(seq, 10)
+}
+
+// stressPatternWorker returns a worker index encoded into a search pattern by stressPattern.
+func stressPatternWorker(s string) (int, bool) {
+	if !strings.HasPrefix(s, stressPrefix) {
+		return 0, false
+	}
+	s = strings.TrimPrefix(s, stressPrefix)
+	i := strings.IndexByte(s, 'x')
+	if i < 0 {
+		return 0, false
+	}
+	v, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// stressEvents is a set of callbacks for events received by the stress client.
+type stressEvents struct {
+	// chat is called for each main chat message.
+	chat func(text string)
+	// search is called for each search and returns true if a search should be answered.
+	search func(pattern string, tth *adcp.TTH) bool
+	// result is called for each search result with a search key (pattern or TTH).
+	result func(key string)
+}
+
+// stressClient is a protocol-independent client used in stress tests.
+type stressClient interface {
+	SendChat(text string) error
+	// SendPM sends a private message to a random online user.
+	SendPM(text string) error
+	// Search sends a search for a given pattern or TTH.
+	Search(pattern string, tth *adcp.TTH) error
+	// UpdateInfo changes the user description.
+	UpdateInfo(desc string) error
+	Close() error
+}
+
+// isADCAddr checks if the hub address uses ADC protocol.
+func isADCAddr(addr string) bool {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == adcp.SchemaADC || u.Scheme == adcp.SchemaADCS
+}
+
+func dialStressClient(addr, name string, ev stressEvents) (stressClient, error) {
+	if isADCAddr(addr) {
+		return dialStressADC(addr, name, ev)
+	}
+	return dialStressNMDC(addr, name, ev)
+}
+
+type stressNMDC struct {
+	c *nmdcc.Conn
+}
+
+func dialStressNMDC(addr, name string, ev stressEvents) (stressClient, error) {
+	// set the callbacks before the client starts reading messages
+	setup := func(c *nmdcc.Conn) {
+		c.OnChatMessage(func(m *nmdcp.ChatMessage) error {
+			ev.chat(m.Text)
+			return nil
+		})
+		c.OnUnhandled(func(m nmdcp.Message) error {
+			switch m := m.(type) {
+			case *nmdcp.Search:
+				if m.User == "" || !ev.search(m.Pattern, m.TTH) {
+					return nil
+				}
+				file := m.Pattern
+				if m.TTH != nil {
+					file = m.TTH.Base32()
+				}
+				go c.SendSearchResult(nmdcp.SR{
+					Path: []string{stressPrefix, file}, Size: 1,
+					FreeSlots: 1, TotalSlots: 1,
+					TTH: m.TTH, To: m.User,
+				})
+			case *nmdcp.SR:
+				if m.TTH != nil {
+					ev.result(m.TTH.Base32())
+				} else if len(m.Path) != 0 {
+					ev.result(m.Path[len(m.Path)-1])
+				}
+			}
+			return nil
+		})
+	}
+	c, err := nmdcc.DialHub(addr, &nmdcc.Config{Name: name, Init: setup})
+	if err != nil {
+		return nil, err
+	}
+	return &stressNMDC{c: c}, nil
+}
+
+func (c *stressNMDC) SendChat(text string) error {
+	return c.c.SendChatMsg(text)
+}
+
+func (c *stressNMDC) SendPM(text string) error {
+	peers := c.c.OnlinePeers()
+	if len(peers) == 0 {
+		return nil
+	}
+	to := peers[rand.Intn(len(peers))].Info().Name
+	return c.c.SendPrivateMsg(to, text)
+}
+
+func (c *stressNMDC) Search(pattern string, tth *adcp.TTH) error {
+	s := nmdcp.Search{Pattern: pattern, DataType: nmdcp.DataTypeAny}
+	if tth != nil {
+		s = nmdcp.Search{TTH: tth, DataType: nmdcp.DataTypeTTH}
+	}
+	return c.c.Search(s)
+}
+
+func (c *stressNMDC) UpdateInfo(desc string) error {
+	return c.c.UpdateInfo(func(u *nmdcp.MyINFO) {
+		u.Desc = desc
+	})
+}
+
+func (c *stressNMDC) Close() error {
+	return c.c.Close()
+}
+
+type stressADC struct {
+	c *adcc.Conn
+}
+
+func dialStressADC(addr, name string, ev stressEvents) (stressClient, error) {
+	pid, err := types.NewPID()
+	if err != nil {
+		return nil, err
+	}
+	// set the callbacks before the client starts reading messages
+	setup := func(c *adcc.Conn) {
+		c.OnChatMessage(func(_ *adcc.Peer, m adcp.ChatMessage) error {
+			if m.PM == nil {
+				ev.chat(m.Text)
+			}
+			return nil
+		})
+		c.OnSearch(func(from *adcc.Peer, req adcp.SearchRequest) error {
+			pattern := strings.Join(req.And, " ")
+			if from == nil || !ev.search(pattern, req.TTH) {
+				return nil
+			}
+			go c.SendSearchResult(from, adcp.SearchResult{
+				Token: req.Token, Path: path.Join("/", stressPrefix, pattern),
+				Size: 1, Slots: 1, TTH: req.TTH,
+			})
+			return nil
+		})
+		c.OnSearchResult(func(_ *adcc.Peer, r adcp.SearchResult) error {
+			ev.result(r.Token)
+			return nil
+		})
+	}
+	c, err := adcc.DialHub(addr, &adcc.Config{PID: pid, Name: name, Init: setup})
+	if err != nil {
+		return nil, err
+	}
+	return &stressADC{c: c}, nil
+}
+
+func (c *stressADC) SendChat(text string) error {
+	return c.c.SendChatMsg(text)
+}
+
+func (c *stressADC) SendPM(text string) error {
+	peers := c.c.OnlinePeers()
+	if len(peers) == 0 {
+		return nil
+	}
+	err := c.c.SendPrivateMsg(peers[rand.Intn(len(peers))], text)
+	if err == adcc.ErrPeerOffline {
+		err = nil
+	}
+	return err
+}
+
+func (c *stressADC) Search(pattern string, tth *adcp.TTH) error {
+	req := adcp.SearchRequest{Token: pattern, TTH: tth}
+	if tth != nil {
+		req.Token = tth.Base32()
+	} else {
+		req.And = []string{pattern}
+	}
+	return c.c.Search(req)
+}
+
+func (c *stressADC) UpdateInfo(desc string) error {
+	return c.c.UpdateInfo(func(u *adcp.UserInfo) {
+		u.Desc = desc
+	})
+}
+
+func (c *stressADC) Close() error {
+	return c.c.Close()
+}
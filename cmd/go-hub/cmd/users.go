@@ -4,10 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/direct-connect/go-dcpp/hub"
+	"github.com/direct-connect/go-dcpp/hub/hubdb"
 )
 
 func init() {
@@ -18,26 +21,35 @@ func init() {
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			return OpenDB()
 		},
-		RunE: func(cmd *cobra.Command, args []string) error {
-			list, err := hubDB.ListUsers()
-			if err != nil {
-				return err
-			}
-			fmt.Println("NAME\t\tPROFILE")
-			for _, u := range list {
-				q := strconv.Quote(u.Name)
-				if q == `"`+u.Name+`"` {
-					q = u.Name
-				}
-				fmt.Printf("%s\t\t%s\n", q, u.Profile)
-			}
-			return nil
-		},
 		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
 			return CloseDB()
 		},
 	}
 	Root.AddCommand(cmdUsers)
+	profile := cmdUsers.Flags().StringP("profile", "p", "", "only list users with a given profile")
+	cmdUsers.RunE = func(cmd *cobra.Command, args []string) error {
+		var (
+			list []hub.UserRecord
+			err  error
+		)
+		if *profile != "" {
+			list, err = hubdb.UsersByProfile(hubDB, *profile)
+		} else {
+			list, err = hubDB.ListUsers()
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("NAME\t\tPROFILE")
+		for _, u := range list {
+			q := strconv.Quote(u.Name)
+			if q == `"`+u.Name+`"` {
+				q = u.Name
+			}
+			fmt.Printf("%s\t\t%s\n", q, u.Profile)
+		}
+		return nil
+	}
 
 	cmdList := &cobra.Command{
 		Use:     "list",
@@ -45,6 +57,7 @@ func init() {
 		Short:   "list registered users",
 		RunE:    cmdUsers.RunE,
 	}
+	cmdList.Flags().AddFlag(cmdUsers.Flags().Lookup("profile"))
 	cmdUsers.AddCommand(cmdList)
 
 	cmdAdd := &cobra.Command{
@@ -78,6 +91,7 @@ func init() {
 			}
 			err := hubDB.CreateUser(hub.UserRecord{
 				Name: name, Pass: pass, Profile: profile,
+				Registered: time.Now().UTC(),
 			})
 			if err != nil {
 				return err
@@ -124,6 +138,138 @@ func init() {
 	}
 	cmdUsers.AddCommand(cmdPromote)
 
+	cmdKeyprint := &cobra.Command{
+		Use:     "keyprint <name> [keyprint]",
+		Aliases: []string{"kp"},
+		Short:   "bind a client certificate keyprint to the user, or remove it",
+	}
+	kpBoth := cmdKeyprint.Flags().Bool("both", false, "require both the keyprint and the password")
+	cmdKeyprint.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("expected 1 or 2 arguments")
+		}
+		name, kp := args[0], ""
+		if name == "" {
+			return errors.New("name should not be empty")
+		}
+		if len(args) > 1 {
+			kp = args[1]
+			if !strings.HasPrefix(kp, "SHA256/") {
+				return errors.New("expected SHA256 keyprint")
+			}
+		}
+		both := *kpBoth && kp != ""
+		return hubDB.UpdateUser(name, func(u *hub.UserRecord) (bool, error) {
+			if u == nil {
+				return false, errors.New("user does not exist")
+			}
+			if u.Keyprint == kp && u.KeyprintPass == both {
+				return false, nil
+			}
+			u.Keyprint, u.KeyprintPass = kp, both
+			return true, nil
+		})
+	}
+	cmdUsers.AddCommand(cmdKeyprint)
+
+	cmdShow := &cobra.Command{
+		Use:     "show <name>",
+		Aliases: []string{"info"},
+		Short:   "show user information",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("expected user name")
+			}
+			u, err := hubDB.GetUser(args[0])
+			if err != nil {
+				return err
+			} else if u == nil {
+				return errors.New("user does not exist")
+			}
+			fmtTime := func(t time.Time) string {
+				if t.IsZero() {
+					return "-"
+				}
+				return t.Local().Format(time.RFC3339)
+			}
+			profile := u.Profile
+			if profile == "" {
+				profile = hub.ProfileNameRegistered
+			}
+			fmt.Printf("name:\t\t%s\n", u.Name)
+			fmt.Printf("profile:\t%s\n", profile)
+			fmt.Printf("registered:\t%s\n", fmtTime(u.Registered))
+			fmt.Printf("registered by:\t%s\n", u.RegisteredBy)
+			fmt.Printf("last login:\t%s\n", fmtTime(u.LastLogin))
+			fmt.Printf("last seen:\t%s\n", fmtTime(u.LastSeen))
+			fmt.Printf("last IP:\t%s\n", u.LastIP)
+			fmt.Printf("last client:\t%s\n", u.LastClient)
+			fmt.Printf("email:\t\t%s\n", u.Email)
+			fmt.Printf("keyprint:\t%s\n", u.Keyprint)
+			fmt.Printf("notes:\t\t%s\n", u.Notes)
+			fmt.Printf("locked:\t\t%v\n", u.Locked)
+			fmt.Printf("locked until:\t%s\n", fmtTime(u.LockedUntil))
+			fmt.Printf("failed logins:\t%d\n", u.FailedLogins)
+			fmt.Printf("pass change:\t%v\n", u.PassChange)
+			return nil
+		},
+	}
+	cmdUsers.AddCommand(cmdShow)
+
+	cmdSet := &cobra.Command{
+		Use:   "set <name> <email|notes> [value]",
+		Short: "set user email or operator notes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return errors.New("expected at least 2 arguments")
+			}
+			name, field := args[0], args[1]
+			val := strings.Join(args[2:], " ")
+			return hubDB.UpdateUser(name, func(u *hub.UserRecord) (bool, error) {
+				if u == nil {
+					return false, errors.New("user does not exist")
+				}
+				switch field {
+				case "email":
+					u.Email = val
+				case "notes", "note":
+					u.Notes = val
+				default:
+					return false, fmt.Errorf("unsupported field: %q", field)
+				}
+				return true, nil
+			})
+		},
+	}
+	cmdUsers.AddCommand(cmdSet)
+
+	for _, lock := range []bool{true, false} {
+		lock := lock
+		use, short := "lock <name>", "lock user account"
+		if !lock {
+			use, short = "unlock <name>", "unlock user account and clear failed logins"
+		}
+		cmdUsers.AddCommand(&cobra.Command{
+			Use:   use,
+			Short: short,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if len(args) != 1 {
+					return errors.New("expected user name")
+				}
+				return hubDB.UpdateUser(args[0], func(u *hub.UserRecord) (bool, error) {
+					if u == nil {
+						return false, errors.New("user does not exist")
+					}
+					u.Locked = lock
+					if !lock {
+						u.LockedUntil, u.FailedLogins = time.Time{}, 0
+					}
+					return true, nil
+				})
+			},
+		})
+	}
+
 	cmdDel := &cobra.Command{
 		Use:     "delete <name>",
 		Aliases: []string{"del", "rm"},
@@ -0,0 +1,221 @@
+package hub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// ConfigLoginMaxFailed is the number of consecutive failed logins after which the account is locked (0 - never).
+	ConfigLoginMaxFailed = "login.failed.max"
+	// ConfigLoginLockout is the time in seconds for which the account is locked after too many failed logins.
+	ConfigLoginLockout = "login.lockout"
+
+	defaultLoginMaxFailed = 5
+	defaultLoginLockout   = 15 * time.Minute
+
+	// resetTokenTTL is the time during which a password reset token can be used.
+	resetTokenTTL = 24 * time.Hour
+)
+
+var (
+	errAccountLocked      = errors.New("account is locked")
+	errPassChangeRequired = errors.New("you must change your password first: !passwd <new password>")
+)
+
+func (h *Hub) loginMaxFailed() int {
+	if v, ok := h.GetConfigInt(ConfigLoginMaxFailed); ok {
+		return int(v)
+	}
+	return defaultLoginMaxFailed
+}
+
+func (h *Hub) loginLockout() time.Duration {
+	if v, ok := h.GetConfigInt(ConfigLoginLockout); ok && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return defaultLoginLockout
+}
+
+// checkUserLock returns an error if the account is locked.
+func checkUserLock(rec *UserRecord, now time.Time) error {
+	if rec.Locked {
+		return errAccountLocked
+	} else if now.Before(rec.LockedUntil) {
+		return fmt.Errorf("%v until %s", errAccountLocked, rec.LockedUntil.UTC().Format("2006-01-02 15:04:05 MST"))
+	}
+	return nil
+}
+
+// checkKeyprint checks the client certificate keyprint bound to the account.
+// It reports if the certificate alone is enough to log in, or returns an error if the account
+// requires both the keyprint and the password, but the keyprint doesn't match.
+func checkKeyprint(rec *UserRecord, c *ConnInfo) (bool, error) {
+	if rec.Keyprint == "" {
+		return false, nil
+	}
+	matched := c != nil && c.Keyprint == rec.Keyprint
+	if !matched && rec.KeyprintPass {
+		return false, errKeyprintInvalid
+	}
+	// if the keyprint doesn't match, fallback to the password
+	return matched && !rec.KeyprintPass, nil
+}
+
+// checkUserPass checks the password with a protocol-specific function and tracks failed logins.
+//
+// The password reset token is accepted instead of the password. It is consumed on use,
+// and the user must change the password after the login.
+func (h *Hub) checkUserPass(rec *UserRecord, check func(pass string) bool) (bool, error) {
+	if h.db == nil {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	if err := checkUserLock(rec, now); err != nil {
+		return false, err
+	}
+	ok := check(rec.Pass)
+	token := !ok && rec.ResetToken != "" && now.Before(rec.ResetExpires) && check(rec.ResetToken)
+	if ok && rec.FailedLogins == 0 {
+		return true, nil
+	}
+	max := h.loginMaxFailed()
+	lockout := h.loginLockout()
+	err := h.db.UpdateUser(rec.Name, func(u *UserRecord) (bool, error) {
+		if u == nil {
+			return false, ErrUserNotFound
+		}
+		switch {
+		case ok:
+			u.FailedLogins = 0
+		case token:
+			u.FailedLogins = 0
+			u.Pass = u.ResetToken
+			u.ResetToken, u.ResetExpires = "", time.Time{}
+			u.PassChange = true
+		default:
+			u.FailedLogins++
+			if max > 0 && u.FailedLogins >= max {
+				u.FailedLogins = 0
+				u.LockedUntil = now.Add(lockout)
+				h.Logf("account %q is locked after %d failed logins", u.Name, max)
+			}
+		}
+		*rec = *u
+		return true, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok || token, nil
+}
+
+// newResetToken generates a random one-time password.
+func newResetToken() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// ResetUserPass issues a one-time password reset token for the user.
+func (h *Hub) ResetUserPass(name string) (string, error) {
+	token, err := newResetToken()
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().UTC().Add(resetTokenTTL)
+	err = h.UpdateUser(name, func(u *UserRecord) (bool, error) {
+		u.ResetToken, u.ResetExpires = token, expires
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// LockUser locks or unlocks the user account. Unlocking also clears the temporary lockout.
+// Locked users are disconnected from the hub.
+func (h *Hub) LockUser(name string, lock bool) error {
+	err := h.UpdateUser(name, func(u *UserRecord) (bool, error) {
+		if !lock && !u.Locked && u.LockedUntil.IsZero() && u.FailedLogins == 0 {
+			return false, nil
+		}
+		u.Locked = lock
+		if !lock {
+			u.LockedUntil, u.FailedLogins = time.Time{}, 0
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if lock {
+		if p := h.PeerByName(name); p != nil {
+			_ = p.Close()
+		}
+	}
+	return nil
+}
+
+// ForcePassChange requires the user to change the password after the next login.
+func (h *Hub) ForcePassChange(name string) error {
+	err := h.UpdateUser(name, func(u *UserRecord) (bool, error) {
+		if u.PassChange {
+			return false, nil
+		}
+		u.PassChange = true
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if p := h.PeerByName(name); p != nil {
+		if u := p.User(); u != nil {
+			u.setPassChange(true)
+			h.cmdOutput(p, errPassChangeRequired.Error())
+		}
+	}
+	return nil
+}
+
+// changeUserPass sets a new password and clears the forced password change flag.
+func (h *Hub) changeUserPass(p Peer, pass string) error {
+	name := p.Name()
+	err := h.UpdateUser(name, func(u *UserRecord) (bool, error) {
+		if u.PassChange && pass == u.Pass {
+			return false, errors.New("new password should be different from the old one")
+		} else if pass == u.Pass {
+			return false, nil
+		}
+		u.Pass = pass
+		u.PassChange = false
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if u := p.User(); u != nil {
+		u.setPassChange(false)
+	}
+	return nil
+}
+
+// unregisterSelf deletes the account of the peer after checking the password.
+func (h *Hub) unregisterSelf(p Peer, pass string) error {
+	name := p.Name()
+	_, rec, err := h.getUser(name)
+	if err != nil {
+		return err
+	} else if rec == nil {
+		return ErrUserNotFound
+	} else if rec.Pass != pass {
+		return errors.New("wrong password")
+	}
+	return h.DeleteUser(name)
+}
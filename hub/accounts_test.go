@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountLockout(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	h.setConfigInt(ConfigLoginMaxFailed, 2)
+	require.NoError(t, h.RegisterUser("alice", "secret"))
+
+	login := func(pass string) (bool, error) {
+		_, rec, err := h.getUser("alice")
+		require.NoError(t, err)
+		return h.nmdcCheckUserPass(rec, pass)
+	}
+
+	ok, err := login("wrong")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = login("secret")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// counter is reset after a successful login
+	for i := 0; i < 2; i++ {
+		ok, err = login("wrong")
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+	_, err = login("secret")
+	require.Error(t, err)
+
+	require.NoError(t, h.LockUser("alice", false))
+	ok, err = login("secret")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, h.LockUser("alice", true))
+	_, err = login("secret")
+	require.Equal(t, errAccountLocked, err)
+	require.NoError(t, h.LockUser("alice", false))
+
+	// reset token works once and forces a password change
+	token, err := h.ResetUserPass("alice")
+	require.NoError(t, err)
+	ok, err = login(token)
+	require.NoError(t, err)
+	require.True(t, ok)
+	u, rec, err := h.getUser("alice")
+	require.NoError(t, err)
+	require.True(t, u.MustChangePass())
+	require.Empty(t, rec.ResetToken)
+	ok, err = login("secret")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestManageAccounts(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, h.db.PutProfile("admin", Map{ProfileParent: ProfileNameRegistered, PermOwner: true}))
+	require.NoError(t, h.db.PutProfile("helper", Map{ProfileParent: ProfileNameRegistered, PermDrop: true}))
+	require.NoError(t, h.loadProfiles())
+
+	require.NoError(t, h.RegisterUserProfile("op1", "secret", ProfileNameOperator))
+	require.NoError(t, h.RegisterUserProfile("op2", "secret", ProfileNameOperator))
+	require.NoError(t, h.RegisterUserProfile("admin", "secret", "admin"))
+	require.NoError(t, h.RegisterUserProfile("helper", "secret", "helper"))
+	require.NoError(t, h.RegisterUserProfile("root", "secret", ProfileNameRoot))
+	require.NoError(t, h.RegisterUser("user", "secret"))
+
+	peer := func(name string) Peer {
+		u, _, err := h.getUser(name)
+		require.NoError(t, err)
+		p := newTestNMDCPeer("10.0.0.1", 0)
+		p.setUser(u)
+		return p
+	}
+	op, owner := peer("op1"), peer("admin")
+
+	_, err = h.cmdManagedUser(op, "user")
+	require.NoError(t, err)
+	_, err = h.cmdManagedUser(op, "helper")
+	require.NoError(t, err)
+	for _, name := range []string{"op2", "op1", "admin", "root"} {
+		_, err = h.cmdManagedUser(op, name)
+		require.Error(t, err, name)
+	}
+	// has a permission the caller lacks
+	_, err = h.cmdManagedUser(peer("helper"), "user")
+	require.NoError(t, err)
+	require.NoError(t, h.SetProfilePerm(ProfileNameRegistered, PermUserManage, true))
+	require.NoError(t, h.SetProfilePerm("helper", PermUserManage, false))
+	_, err = h.cmdManagedUser(peer("helper"), "user")
+	require.Error(t, err)
+
+	for _, name := range []string{"op2", "root", "user"} {
+		_, err = h.cmdManagedUser(owner, name)
+		require.NoError(t, err, name)
+	}
+}
+
+func TestCheckKeyprint(t *testing.T) {
+	rec := &UserRecord{Name: "alice"}
+	ok, err := checkKeyprint(rec, &ConnInfo{Keyprint: "SHA256/AAA"})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	rec.Keyprint = "SHA256/AAA"
+	ok, err = checkKeyprint(rec, &ConnInfo{Keyprint: "SHA256/AAA"})
+	require.NoError(t, err)
+	require.True(t, ok)
+	// fallback to the password
+	ok, err = checkKeyprint(rec, &ConnInfo{})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	rec.KeyprintPass = true
+	ok, err = checkKeyprint(rec, &ConnInfo{Keyprint: "SHA256/AAA"})
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = checkKeyprint(rec, nil)
+	require.Equal(t, errKeyprintInvalid, err)
+}
@@ -0,0 +1,266 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban keys for nick and IP range bans. IP bans use a binary IP as a key (see MinIPKey).
+const (
+	banPrefixNick  = "nick:"
+	banPrefixRange = "range:"
+)
+
+// NickBanKey returns a ban key for a user name.
+func NickBanKey(name string) BanKey {
+	return BanKey(banPrefixNick + string(toNameKey(name)))
+}
+
+// RangeBanKey returns a ban key for an IP range. Both ends of the range are inclusive.
+func RangeBanKey(from, to net.IP) BanKey {
+	from, to = MinIPKey(from).ToIP(), MinIPKey(to).ToIP()
+	if from == nil || to == nil {
+		return ""
+	}
+	return BanKey(banPrefixRange + from.String() + "-" + to.String())
+}
+
+// Nick returns a user name for a nick ban key, or an empty string otherwise.
+func (k BanKey) Nick() string {
+	if !strings.HasPrefix(string(k), banPrefixNick) {
+		return ""
+	}
+	return string(k[len(banPrefixNick):])
+}
+
+// BanReason joins the ban reason and the name of the user who set the ban.
+func BanReason(reason, by string) string {
+	if by == "" {
+		return reason
+	}
+	return strings.TrimSpace(reason + " (by " + by + ")")
+}
+
+// SplitBanReason is the reverse of BanReason.
+func SplitBanReason(s string) (reason, by string) {
+	i := strings.LastIndex(s, "(by ")
+	if i < 0 || !strings.HasSuffix(s, ")") {
+		return s, ""
+	}
+	return strings.TrimSpace(s[:i]), s[i+4 : len(s)-1]
+}
+
+// Range returns an IP range for a range ban key, or nil otherwise.
+func (k BanKey) Range() (from, to net.IP) {
+	if !strings.HasPrefix(string(k), banPrefixRange) {
+		return nil, nil
+	}
+	s := string(k[len(banPrefixRange):])
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return nil, nil
+	}
+	from, to = net.ParseIP(s[:i]), net.ParseIP(s[i+1:])
+	if from == nil || to == nil {
+		return nil, nil
+	}
+	return MinIPKey(from).ToIP(), MinIPKey(to).ToIP()
+}
+
+// Expired checks if a temporary ban has expired.
+func (b *Ban) Expired(now time.Time) bool {
+	return !b.Until.IsZero() && !now.Before(b.Until)
+}
+
+// banList holds nick, range and temporary bans. Unlike hard IP bans, these are checked during the handshake,
+// so the user can be told the reason.
+type banList struct {
+	sync.RWMutex
+	m map[BanKey]Ban
+}
+
+func (h *Hub) addBanList(b Ban) {
+	h.banList.Lock()
+	if h.banList.m == nil {
+		h.banList.m = make(map[BanKey]Ban)
+	}
+	h.banList.m[b.Key] = b
+	h.banList.Unlock()
+}
+
+// AddBan adds a ban to the ban list and saves it to the database.
+// Permanent hard bans of IP addresses drop the connection right after it is accepted.
+func (h *Hub) AddBan(b Ban) error {
+	if b.Key == "" {
+		return errors.New("ban key is not set")
+	}
+	if ip := b.Key.ToIP(); ip != nil && b.Hard && b.Until.IsZero() {
+		h.bans.blockKey(b.Key)
+	} else {
+		h.addBanList(b)
+	}
+	h.saveBan(b)
+	return nil
+}
+
+// GetBan returns an active ban with a given key, or nil if it doesn't exist.
+func (h *Hub) GetBan(key BanKey) *Ban {
+	h.banList.RLock()
+	b, ok := h.banList.m[key]
+	h.banList.RUnlock()
+	if ok && !b.Expired(time.Now()) {
+		return &b
+	}
+	if _, ok := h.bans.blocked.Load(key); ok {
+		return &Ban{Key: key, Hard: true}
+	}
+	return nil
+}
+
+// RemoveBan removes the ban with a given key. It returns false if the ban doesn't exist.
+func (h *Hub) RemoveBan(key BanKey) bool {
+	h.banList.Lock()
+	_, ok := h.banList.m[key]
+	delete(h.banList.m, key)
+	h.banList.Unlock()
+	if _, blocked := h.bans.blocked.Load(key); blocked {
+		h.bans.unblockKey(key)
+		ok = true
+	}
+	if ok {
+		h.delBan(key)
+	}
+	return ok
+}
+
+// ListBans returns all active bans, sorted by the key.
+func (h *Hub) ListBans() []Ban {
+	now := time.Now()
+	var list []Ban
+	h.banList.RLock()
+	for _, b := range h.banList.m {
+		if !b.Expired(now) {
+			list = append(list, b)
+		}
+	}
+	h.banList.RUnlock()
+	h.bans.blocked.Range(func(key, _ interface{}) bool {
+		list = append(list, Ban{Key: key.(BanKey), Hard: true})
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// RemoveBans removes all bans that match the filter. It returns the number of bans removed.
+func (h *Hub) RemoveBans(filter func(b *Ban) bool) int {
+	var keys []BanKey
+	for _, b := range h.ListBans() {
+		if filter(&b) {
+			keys = append(keys, b.Key)
+		}
+	}
+	for _, k := range keys {
+		h.RemoveBan(k)
+	}
+	return len(keys)
+}
+
+// removeExpiredBans removes temporary bans that expired before a given time.
+func (h *Hub) removeExpiredBans(now time.Time) {
+	var keys []BanKey
+	h.banList.Lock()
+	for k, b := range h.banList.m {
+		if b.Expired(now) {
+			keys = append(keys, k)
+			delete(h.banList.m, k)
+		}
+	}
+	h.banList.Unlock()
+	if len(keys) != 0 && h.db != nil {
+		_ = h.db.DelBans(keys)
+	}
+}
+
+// expireBans periodically removes expired temporary bans.
+func (h *Hub) expireBans(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case t := <-ticker.C:
+			h.removeExpiredBans(t)
+		}
+	}
+}
+
+// findBan finds an active ban for a given user name and address.
+func (h *Hub) findBan(name string, a net.Addr, now time.Time) *Ban {
+	h.banList.RLock()
+	defer h.banList.RUnlock()
+	if len(h.banList.m) == 0 {
+		return nil
+	}
+	check := func(key BanKey) *Ban {
+		if b, ok := h.banList.m[key]; ok && !b.Expired(now) {
+			return &b
+		}
+		return nil
+	}
+	if name != "" {
+		if b := check(NickBanKey(name)); b != nil {
+			return b
+		}
+	}
+	addr, ok := a.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	key := MinIPKey(addr.IP)
+	if b := check(key); b != nil {
+		return b
+	}
+	ip := key.ToIP()
+	for k, b := range h.banList.m {
+		from, to := k.Range()
+		if from == nil || b.Expired(now) || len(from) != len(ip) {
+			continue
+		}
+		if bytes.Compare(ip, from) >= 0 && bytes.Compare(ip, to) <= 0 {
+			return &b
+		}
+	}
+	return nil
+}
+
+// FindBan finds an active nick, IP or IP range ban that applies to a given user name and address.
+// Hard IP bans are not checked.
+func (h *Hub) FindBan(name string, a net.Addr) *Ban {
+	return h.findBan(name, a, time.Now())
+}
+
+// checkBans checks if the user is banned by name, IP or IP range.
+func (h *Hub) checkBans(peer Peer) error {
+	b := h.findBan(peer.Name(), peer.RemoteAddr(), time.Now())
+	if b == nil {
+		return nil
+	}
+	cntConnBlocked.WithLabelValues(blockReasonBan).Add(1)
+	msg := "you are banned"
+	if !b.Until.IsZero() {
+		msg += " until " + b.Until.UTC().Format(time.RFC3339)
+	}
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+	return errors.New(msg)
+}
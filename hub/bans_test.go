@@ -0,0 +1,246 @@
+package hub
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBans(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 411}
+	}
+	now := time.Now()
+
+	require.NoError(t, h.AddBan(Ban{Key: NickBanKey("Bad"), Reason: "spam"}))
+	require.NoError(t, h.AddBan(Ban{Key: RangeBanKey(net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.255"))}))
+	require.NoError(t, h.AddBan(Ban{Key: MinIPKey(net.ParseIP("10.1.0.1")), Until: now.Add(time.Minute)}))
+	require.NoError(t, h.AddBan(Ban{Key: MinIPKey(net.ParseIP("10.2.0.1")), Hard: true}))
+
+	b := h.findBan("bad", addr("192.168.0.1"), now)
+	require.NotNil(t, b)
+	require.Equal(t, "spam", b.Reason)
+	require.Equal(t, "bad", b.Key.Nick())
+
+	require.NotNil(t, h.findBan("user", addr("10.0.0.10"), now))
+	require.Nil(t, h.findBan("user", addr("10.0.1.10"), now))
+	require.NotNil(t, h.findBan("user", addr("10.1.0.1"), now))
+	require.Nil(t, h.findBan("user", addr("10.1.0.1"), now.Add(time.Hour)))
+
+	// permanent hard IP bans are checked when the connection is accepted
+	require.Nil(t, h.findBan("user", addr("10.2.0.1"), now))
+	require.True(t, h.IsHardBlocked(addr("10.2.0.1")))
+
+	require.Len(t, h.ListBans(), 4)
+	h.removeExpiredBans(now.Add(time.Hour))
+	require.Len(t, h.ListBans(), 3)
+
+	require.True(t, h.RemoveBan(NickBanKey("BAD")))
+	require.False(t, h.RemoveBan(NickBanKey("bad")))
+	require.True(t, h.RemoveBan(MinIPKey(net.ParseIP("10.2.0.1"))))
+	require.False(t, h.IsHardBlocked(addr("10.2.0.1")))
+	require.Len(t, h.ListBans(), 1)
+}
+
+const testGeoCSV = `# comment
+"16777216","16777471","apnic","1313020800","AU","AUS","Australia"
+10.0.0.0/8,RU,Russia
+192.168.0.0,192.168.255.255,ZZ
+`
+
+func TestGeoIP(t *testing.T) {
+	db, err := readGeoCSV(strings.NewReader(testGeoCSV))
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		ip   string
+		code string
+		name string
+	}{
+		{"1.0.0.1", "AU", "Australia"},
+		{"10.20.30.40", "RU", "Russia"},
+		{"192.168.1.1", "ZZ", ""},
+		{"1.0.1.1", "", ""},
+		{"11.0.0.1", "", ""},
+		{"::1", "", ""},
+	} {
+		got, ok := db.lookup(net.ParseIP(c.ip))
+		require.Equal(t, c.code != "", ok, c.ip)
+		require.Equal(t, Country{Code: c.code, Name: c.name}, got, c.ip)
+	}
+}
+
+// mmdbEncode encodes a value in the MaxMind DB data section format.
+func mmdbEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append([]byte{2<<5 | byte(len(v))}, v...)
+	case uint64:
+		var b []byte
+		for ; v != 0; v >>= 8 {
+			b = append([]byte{byte(v)}, b...)
+		}
+		return append([]byte{6<<5 | byte(len(b))}, b...)
+	case map[string]interface{}:
+		b := []byte{7<<5 | byte(len(v))}
+		for k, e := range v {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(e)...)
+		}
+		return b
+	}
+	panic(v)
+}
+
+// buildTestMMDB builds an IPv6 MaxMind DB with 28 bit records mapping networks to data offsets.
+func buildTestMMDB(data []byte, nets map[string]int) []byte {
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	leafs := make(map[[2]int]int) // node and bit -> data offset
+	for cidr, off := range nets {
+		_, sub, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ip := sub.IP.To16()
+		ones, _ := sub.Mask.Size()
+		if len(sub.IP) == net.IPv4len {
+			ip = append(make(net.IP, 12), sub.IP...)
+			ones += 96
+		}
+		n := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> uint(7-i%8) & 1
+			if i == ones-1 {
+				leafs[[2]int{n, int(bit)}] = off
+				break
+			}
+			if nodes[n][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+	}
+	cnt := len(nodes)
+	var buf []byte
+	for i, n := range nodes {
+		var rec [2]int
+		for bit := range rec {
+			if off, ok := leafs[[2]int{i, bit}]; ok {
+				rec[bit] = cnt + 16 + off
+			} else if n[bit] == empty {
+				rec[bit] = cnt
+			} else {
+				rec[bit] = n[bit]
+			}
+		}
+		l, r := rec[0], rec[1]
+		buf = append(buf, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetaMarker...)
+	buf = append(buf, mmdbEncode(map[string]interface{}{
+		"node_count":  uint64(cnt),
+		"record_size": uint64(28),
+		"ip_version":  uint64(6),
+	})...)
+	return buf
+}
+
+func TestGeoIPMMDB(t *testing.T) {
+	data := mmdbEncode(map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": "US",
+			"names":    map[string]interface{}{"en": "United States"},
+		},
+	})
+	de := len(data)
+	data = append(data, mmdbEncode(map[string]interface{}{
+		"iso_code": "DE",
+		"names":    map[string]interface{}{"en": "Germany"},
+	})...)
+	reg := len(data)
+	data = append(data, 7<<5|1) // map with a single key
+	data = append(data, mmdbEncode("registered_country")...)
+	data = append(data, 1<<5|byte(de>>8), byte(de)) // pointer
+
+	buf := buildTestMMDB(data, map[string]int{
+		"1.0.0.0/8":     0,
+		"2001:db8::/32": reg,
+	})
+	require.True(t, isMMDB(buf))
+	m, err := readMMDB(buf)
+	require.NoError(t, err)
+	db := &geoDB{mmdb: m}
+
+	for _, c := range []struct {
+		ip   string
+		code string
+		name string
+	}{
+		{"1.2.3.4", "US", "United States"},
+		{"2001:db8::1", "DE", "Germany"},
+		{"2.0.0.1", "", ""},
+		{"2001:db9::1", "", ""},
+		{"::1", "", ""},
+	} {
+		got, ok := db.lookup(net.ParseIP(c.ip))
+		require.Equal(t, c.code != "", ok, c.ip)
+		require.Equal(t, Country{Code: c.code, Name: c.name}, got, c.ip)
+	}
+}
+
+func TestGeoIPMMDBCorrupted(t *testing.T) {
+	data := mmdbEncode(map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": "US",
+			"names":    map[string]interface{}{"en": "United States"},
+		},
+	})
+	orig := buildTestMMDB(data, map[string]int{
+		"1.0.0.0/8":     0,
+		"2001:db8::/32": 0,
+	})
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1"), net.ParseIP("::1")}
+	check := func(buf []byte) {
+		m, err := readMMDB(buf)
+		if err != nil {
+			return
+		}
+		for _, ip := range ips {
+			m.lookup(ip)
+		}
+	}
+
+	// record pointing before the data section
+	buf := append([]byte{}, orig...)
+	buf[0], buf[1], buf[2], buf[3] = 0, 0, 1, 0
+	check(buf)
+
+	// huge map and array sizes
+	for _, b := range [][]byte{
+		{7<<5 | 31, 0xff, 0xff, 0xff},
+		{31, 4, 0xff, 0xff, 0xff},
+	} {
+		_, _, err := mmdbData(b).decode(0, 0)
+		require.Equal(t, errMMDBCorrupted, err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		buf := append([]byte{}, orig...)
+		for j := r.Intn(4); j >= 0; j-- {
+			buf[r.Intn(len(buf))] = byte(r.Intn(256))
+		}
+		check(buf[:len(buf)-r.Intn(8)])
+	}
+}
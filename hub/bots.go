@@ -3,6 +3,7 @@ package hub
 import (
 	"context"
 	"net"
+	"sync"
 
 	"github.com/direct-connect/go-dc/types"
 )
@@ -51,8 +52,110 @@ func (b *Bot) SendPrivate(to Peer, m Message) error {
 	return nil
 }
 
+// Close removes the bot from the hub.
 func (b *Bot) Close() error {
-	return b.p.closeWith(b.p)
+	return b.p.closeWith(b.p, func() error {
+		b.h.leave(b.p, b.p.SID(), nil)
+		return nil
+	})
+}
+
+// SearchHandler answers search requests on behalf of a bot.
+//
+// It should return results that match the request. The Peer field of the results is set by the hub.
+type SearchHandler func(ctx context.Context, req SearchRequest) []SearchResult
+
+// SetSearchHandler makes the bot searchable and sets a function that answers search requests.
+// Setting nil handler makes the bot unsearchable.
+func (b *Bot) SetSearchHandler(fn SearchHandler) {
+	b.p.search.Lock()
+	b.p.search.fn = fn
+	b.p.search.Unlock()
+}
+
+// Search starts a search on behalf of the bot. See Hub.SearchFrom.
+func (b *Bot) Search(ctx context.Context, req SearchRequest) <-chan SearchResult {
+	return b.h.SearchFrom(ctx, b, req)
+}
+
+// ShareSearch returns a search handler that answers searches from a virtual share.
+func ShareSearch(share []SearchResult) SearchHandler {
+	return func(ctx context.Context, req SearchRequest) []SearchResult {
+		var out []SearchResult
+		for _, r := range share {
+			if req.Match(r) {
+				out = append(out, r)
+			}
+		}
+		return out
+	}
+}
+
+// SearchFrom starts a search on behalf of the bot and returns a channel with search results.
+//
+// The search is sent to all searchable peers and the results are routed back to the bot.
+// The channel is closed when the context is cancelled or when the search times out.
+// Results are dropped if the channel buffer is full, thus the caller should read them without delays.
+// Note that NMDC peers only track one active search per user, thus starting a new search
+// may stop the results of the previous one from being delivered.
+func (h *Hub) SearchFrom(ctx context.Context, b *Bot, req SearchRequest) <-chan SearchResult {
+	s := &botSearch{
+		p: b.p,
+		// should fit all results from the cache
+		out: make(chan SearchResult, searchCacheResults),
+	}
+	sctx := h.startSearch(ctx, req, s, nil)
+	if sctx == nil {
+		close(s.out)
+		return s.out
+	}
+	go func() {
+		<-sctx.Done()
+		s.mu.Lock()
+		s.closed = true
+		close(s.out)
+		s.mu.Unlock()
+	}()
+	return s.out
+}
+
+var _ Search = (*botSearch)(nil)
+
+type botSearch struct {
+	p *botPeer
+	searchRun
+
+	mu     sync.Mutex
+	closed bool
+	out    chan SearchResult
+}
+
+func (s *botSearch) Peer() Peer {
+	return s.p
+}
+
+func (s *botSearch) SendResult(r SearchResult) error {
+	if ok, err := s.acceptResult(r); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errConnectionClosed
+	}
+	select {
+	case s.out <- r:
+	default:
+		// never block the peer that sends results
+		cntSearchBotDropped.Add(1)
+	}
+	return nil
+}
+
+func (s *botSearch) Close() error {
+	return nil // closed when the search context is done
 }
 
 func (h *Hub) newBot(name, desc, email string, kind UserKind, soft types.Software) (*Bot, error) {
@@ -61,7 +164,7 @@ func (h *Hub) newBot(name, desc, email string, kind UserKind, soft types.Softwar
 	} else if !h.nameAvailable(name, nil) {
 		return nil, errNickTaken
 	}
-	if _, ok := h.reserveName(name, nil, nil); !ok {
+	if _, ok := h.bindName(name, nil, nil); !ok {
 		return nil, errNickTaken
 	}
 	if soft.Name == "" {
@@ -104,10 +207,21 @@ type botPeer struct {
 	email string
 	kind  UserKind
 	soft  types.Software
+
+	search struct {
+		sync.RWMutex
+		fn SearchHandler
+	}
+}
+
+func (p *botPeer) searchHandler() SearchHandler {
+	p.search.RLock()
+	defer p.search.RUnlock()
+	return p.search.fn
 }
 
-func (*botPeer) Searchable() bool {
-	return false
+func (p *botPeer) Searchable() bool {
+	return p.searchHandler() != nil
 }
 
 func (p *botPeer) UserInfo() UserInfo {
@@ -163,7 +277,31 @@ func (p *botPeer) RevConnectTo(peer Peer, token string, secure bool) error {
 }
 
 func (p *botPeer) Search(ctx context.Context, req SearchRequest, out Search) error {
-	_ = out.Close()
+	fn := p.searchHandler()
+	if fn == nil {
+		_ = out.Close()
+		return nil
+	}
+	go func() {
+		for _, r := range fn(ctx, req) {
+			if ctx.Err() != nil {
+				return
+			}
+			switch rr := r.(type) {
+			case File:
+				rr.Peer = p
+				r = rr
+			case Dir:
+				rr.Peer = p
+				r = rr
+			default:
+				continue
+			}
+			if err := out.SendResult(r); err != nil {
+				return
+			}
+		}
+	}()
 	return nil
 }
 
@@ -0,0 +1,52 @@
+package hub
+
+import "time"
+
+// Clock is a source of time for timers registered by plugins and scripts.
+// It can be replaced to control timers in tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a ticker that delivers ticks with a given period.
+	NewTicker(dt time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals. See time.Ticker.
+type Ticker interface {
+	// C returns a channel on which the ticks are delivered.
+	C() <-chan time.Time
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// SystemClock returns a clock based on the system time.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(dt time.Duration) Ticker {
+	return systemTicker{time.NewTicker(dt)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
+
+// Clock returns the clock used for plugin timers.
+func (h *Hub) Clock() Clock {
+	return h.clock
+}
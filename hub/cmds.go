@@ -29,6 +29,8 @@ type Command struct {
 	Func    interface{}
 	run     func(p Peer, args string)
 	opt     cmdOptions
+	// prev holds commands overridden by this one, by name or alias
+	prev map[string]*Command
 }
 
 type cmdOptions struct {
@@ -57,6 +59,10 @@ const (
 	PermRegisterProfile = "user.register_profile"
 	PermIP              = "user.ip"
 	PermBanIP           = "ban.ip"
+	PermProtos          = "hub.protos"
+	PermUserInfo        = "user.info"
+	PermUserManage      = "user.manage"
+	PermLimitsBypass    = "limits.bypass"
 )
 
 func (h *Hub) initCommands() {
@@ -88,6 +94,21 @@ func (h *Hub) initCommands() {
 		Short: "registers a user or change a password",
 		Func:  h.cmdRegister,
 	})
+	h.RegisterCommand(Command{
+		Name: "unreg", Aliases: []string{"unregister"},
+		Short: "deletes your account",
+		Long:  "Usage: unreg <password>\n\nThe current password is required to confirm the deletion.",
+		Func:  h.cmdUnregister,
+	})
+	h.RegisterCommand(Command{
+		Name: "keyprint", Aliases: []string{"kp"},
+		Short: "binds the client certificate to the account",
+		Long: "Usage: keyprint [on|both|off]\n\n" +
+			"on   - login with the current client certificate, without a password (default)\n" +
+			"both - require both the current client certificate and the password\n" +
+			"off  - remove the certificate binding",
+		Func: h.cmdKeyprint,
+	})
 
 	// Rooms
 	h.RegisterCommand(Command{
@@ -150,6 +171,59 @@ func (h *Hub) initCommands() {
 		Func:    h.cmdRegisterUser,
 	})
 
+	h.RegisterCommand(Command{
+		Name: "userinfo", Aliases: []string{"ui"},
+		Short:   "shows information about a registered user",
+		Long:    "userinfo <name>",
+		Require: PermUserInfo,
+		Func:    h.cmdUserInfo,
+	})
+	h.RegisterCommand(Command{
+		Name:    "usernote",
+		Short:   "sets operator notes for a registered user",
+		Long:    "usernote <name> [text]\nCalling the command without the text clears the notes.",
+		Require: PermUserInfo,
+		Func:    h.cmdUserNote,
+	})
+
+	h.RegisterCommand(Command{
+		Name:    "lock",
+		Short:   "locks a registered account and drops the user",
+		Long:    "Usage: lock <name>",
+		Require: PermUserManage,
+		Func:    h.cmdLockUser,
+	})
+	h.RegisterCommand(Command{
+		Name:    "unlock",
+		Short:   "unlocks a registered account",
+		Long:    "Usage: unlock <name>\n\nAlso clears the lockout caused by failed logins.",
+		Require: PermUserManage,
+		Func:    h.cmdUnlockUser,
+	})
+	h.RegisterCommand(Command{
+		Name:    "forcepass",
+		Short:   "requires a user to change the password on the next login",
+		Long:    "Usage: forcepass <name>",
+		Require: PermUserManage,
+		Func:    h.cmdForcePass,
+	})
+	h.RegisterCommand(Command{
+		Name:  "resetpass",
+		Short: "issues a one-time password for a registered user",
+		Long: "Usage: resetpass <name>\n\n" +
+			"The user can login with a one-time password instead of the current one,\n" +
+			"and will be asked to change the password after the login.",
+		Require: PermUserManage,
+		Func:    h.cmdResetPass,
+	})
+
+	h.RegisterCommand(Command{
+		Name:    "protos",
+		Short:   "shows protocols used by users and how many of them can be upgraded",
+		Require: PermProtos,
+		Func:    h.cmdProtos,
+	})
+
 	// Bans
 	h.RegisterCommand(Command{
 		Name:    "drop",
@@ -191,6 +265,28 @@ func (h *Hub) initCommands() {
 		Require: PermBanIP,
 		Func:    h.cmdListBanIP,
 	})
+	h.RegisterCommand(Command{
+		Name:  "attack",
+		Short: "show or change \"under attack\" mode",
+		Long: "Usage: attack [on [duration]|off]\n\n" +
+			"In this mode only registered users can join the hub.",
+		Require: PermBanIP,
+		Func:    h.cmdAttack,
+	})
+
+	// profiles
+	h.RegisterCommand(Command{
+		Name:    "profile",
+		Aliases: []string{"prof"},
+		Short:   "view or edit user profiles",
+		Long: "Usage: profile [name [set|unset <perm> [true|false]]]\n\n" +
+			"without arguments - list profiles\n" +
+			"<name>            - show profile permissions\n" +
+			"set <perm>        - set a permission (true by default)\n" +
+			"unset <perm>      - inherit a permission from the parent profile",
+		Require: PermOwner,
+		Func:    h.cmdProfile,
+	})
 
 	// hub control
 	h.RegisterCommand(Command{
@@ -233,7 +329,7 @@ func (h *Hub) cmdHelp(p Peer, args string) error {
 	u := p.User()
 	if args != "" {
 		name := args
-		cmd := h.cmds.byName[name]
+		cmd := h.getCommand(name)
 		if cmd == nil || !u.HasPerm(cmd.Require) {
 			return errors.New("unsupported command: " + name)
 		}
@@ -246,21 +342,21 @@ func (h *Hub) cmdHelp(p Peer, args string) error {
 		)
 		return nil
 	}
-	names := make([]string, 0, len(h.cmds.names))
-	for name := range h.cmds.names {
-		c := h.cmds.byName[name]
+	var list []*Command
+	for _, c := range h.listCommands() {
 		if !u.HasPerm(c.Require) {
 			continue
 		}
-		names = append(names, name)
+		list = append(list, c)
 	}
-	sort.Strings(names)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
 
 	buf := bytes.NewBuffer(nil)
 	buf.WriteString("available commands:\n\n")
-	for _, name := range names {
-		c := h.cmds.byName[name]
-		buf.WriteString("- " + name)
+	for _, c := range list {
+		buf.WriteString("- " + c.Name)
 		if len(c.Aliases) != 0 {
 			buf.WriteString("  (")
 			buf.WriteString(strings.Join(c.Aliases, ", "))
@@ -305,24 +401,158 @@ func (h *Hub) cmdRegister(p Peer, args string) error {
 	name := p.Name()
 	ok, err := h.IsRegistered(name)
 	if ok {
-		err = h.UpdateUser(name, func(u *UserRecord) (bool, error) {
-			if pass == u.Pass {
+		if err = h.changeUserPass(p, pass); err != nil {
+			return err
+		}
+		h.cmdOutputf(p, "password changed")
+		return nil
+	}
+	err = h.registerUser(UserRecord{Name: name, Pass: pass, RegisteredBy: name})
+	if err != nil {
+		return err
+	}
+	h.cmdOutputf(p, "user %s registered, please reconnect", name)
+	return nil
+}
+
+func (h *Hub) cmdUnregister(p Peer, args string) error {
+	if c := p.ConnInfo(); c != nil && !c.Secure {
+		return errConnInsecure
+	}
+	pass, _, err := cmdParseString(args)
+	if err != nil {
+		return err
+	} else if pass == "" {
+		return errCmdInvalidArg
+	}
+	if err = h.unregisterSelf(p, pass); err != nil {
+		return err
+	}
+	h.cmdOutput(p, "your account was deleted")
+	return nil
+}
+
+// cmdManagedUser parses the user name and checks if the peer is allowed to manage this account.
+func (h *Hub) cmdManagedUser(p Peer, args string) (string, error) {
+	name, _, err := cmdParseString(args)
+	if err != nil {
+		return "", err
+	}
+	u, rec, err := h.getUser(name)
+	if err != nil {
+		return "", err
+	} else if rec == nil {
+		return "", ErrUserNotFound
+	}
+	if !p.User().Profile().CanManage(u.Profile()) {
+		return "", errors.New("you are not allowed to manage this account")
+	}
+	return rec.Name, nil
+}
+
+func (h *Hub) cmdLockUser(p Peer, args string) error {
+	name, err := h.cmdManagedUser(p, args)
+	if err != nil {
+		return err
+	}
+	if err = h.LockUser(name, true); err != nil {
+		return err
+	}
+	h.cmdOutputf(p, "user %s locked", name)
+	return nil
+}
+
+func (h *Hub) cmdUnlockUser(p Peer, args string) error {
+	name, err := h.cmdManagedUser(p, args)
+	if err != nil {
+		return err
+	}
+	if err = h.LockUser(name, false); err != nil {
+		return err
+	}
+	h.cmdOutputf(p, "user %s unlocked", name)
+	return nil
+}
+
+func (h *Hub) cmdForcePass(p Peer, args string) error {
+	name, err := h.cmdManagedUser(p, args)
+	if err != nil {
+		return err
+	}
+	if err = h.ForcePassChange(name); err != nil {
+		return err
+	}
+	h.cmdOutputf(p, "user %s must change the password on the next login", name)
+	return nil
+}
+
+func (h *Hub) cmdResetPass(p Peer, args string) error {
+	if c := p.ConnInfo(); c != nil && !c.Secure {
+		return errConnInsecure
+	}
+	name, err := h.cmdManagedUser(p, args)
+	if err != nil {
+		return err
+	}
+	token, err := h.ResetUserPass(name)
+	if err != nil {
+		return err
+	}
+	h.cmdOutputf(p, "one-time password for %s: %s (valid for %v)", name, token, resetTokenTTL)
+	return nil
+}
+
+func (h *Hub) cmdKeyprint(p Peer, args string) error {
+	c := p.ConnInfo()
+	if c != nil && !c.Secure {
+		return errConnInsecure
+	}
+	name := p.Name()
+	if ok, err := h.IsRegistered(name); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("only registered users can bind a keyprint")
+	}
+	both := false
+	switch args {
+	case "", "on":
+	case "both":
+		both = true
+	case "off":
+		err := h.UpdateUser(name, func(u *UserRecord) (bool, error) {
+			if u.Keyprint == "" {
 				return false, nil
 			}
-			u.Pass = pass
+			u.Keyprint, u.KeyprintPass = "", false
 			return true, nil
 		})
 		if err != nil {
 			return err
 		}
-		h.cmdOutputf(p, "password changed")
+		h.cmdOutput(p, "keyprint removed")
 		return nil
+	default:
+		return errCmdInvalidArg
+	}
+	if c == nil || c.Keyprint == "" {
+		return errors.New("no client certificate provided")
 	}
-	err = h.RegisterUser(name, args)
+	kp := c.Keyprint
+	err := h.UpdateUser(name, func(u *UserRecord) (bool, error) {
+		if u.Keyprint == kp && u.KeyprintPass == both {
+			return false, nil
+		}
+		u.Keyprint, u.KeyprintPass = kp, both
+		return true, nil
+	})
 	if err != nil {
 		return err
 	}
-	h.cmdOutputf(p, "user %s registered, please reconnect", name)
+	if both {
+		h.cmdOutputf(p, "keyprint %s bound, password is still required", kp)
+	} else {
+		h.cmdOutputf(p, "keyprint %s bound, password is no longer required", kp)
+	}
 	return nil
 }
 
@@ -366,7 +596,7 @@ func (h *Hub) cmdRegisterUser(p Peer, args string) error {
 			return errors.New("there is no such profile")
 		}
 	}
-	err = h.RegisterUser(name, pass)
+	err = h.registerUser(UserRecord{Name: name, Pass: pass, Profile: prof, RegisteredBy: p.Name()})
 	if err != nil {
 		return err
 	}
@@ -374,14 +604,167 @@ func (h *Hub) cmdRegisterUser(p Peer, args string) error {
 		h.cmdOutputf(p, "user %s registered", name)
 		return nil
 	}
+	h.cmdOutputf(p, "user %s with profile %s registered", name, prof)
+	return nil
+}
+
+func (h *Hub) cmdUserInfo(p Peer, args string) error {
+	name, _, err := cmdParseString(args)
+	if err != nil {
+		return err
+	}
+	_, rec, err := h.getUser(name)
+	if err != nil {
+		return err
+	} else if rec == nil {
+		return ErrUserNotFound
+	}
+	fmtTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.UTC().Format("2006-01-02 15:04:05 MST")
+	}
+	profile := rec.Profile
+	if profile == "" {
+		profile = ProfileNameRegistered
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "user: %s\n", rec.Name)
+	fmt.Fprintf(buf, "- profile: %s\n", profile)
+	if p2 := h.PeerByName(rec.Name); p2 != nil {
+		fmt.Fprintf(buf, "- online: %s\n", addrString(p2.RemoteAddr()))
+	}
+	fmt.Fprintf(buf, "- registered: %s\n", fmtTime(rec.Registered))
+	if rec.RegisteredBy != "" {
+		fmt.Fprintf(buf, "- registered by: %s\n", rec.RegisteredBy)
+	}
+	fmt.Fprintf(buf, "- last login: %s\n", fmtTime(rec.LastLogin))
+	fmt.Fprintf(buf, "- last seen: %s\n", fmtTime(rec.LastSeen))
+	if rec.LastIP != "" {
+		fmt.Fprintf(buf, "- last IP: %s\n", rec.LastIP)
+	}
+	if rec.LastClient != "" {
+		fmt.Fprintf(buf, "- last client: %s\n", rec.LastClient)
+	}
+	if err := checkUserLock(rec, time.Now()); err != nil {
+		fmt.Fprintf(buf, "- %v\n", err)
+	} else if rec.FailedLogins != 0 {
+		fmt.Fprintf(buf, "- failed logins: %d\n", rec.FailedLogins)
+	}
+	if rec.PassChange {
+		fmt.Fprintf(buf, "- must change the password\n")
+	}
+	if rec.Email != "" {
+		fmt.Fprintf(buf, "- email: %s\n", rec.Email)
+	}
+	if rec.Keyprint != "" {
+		fmt.Fprintf(buf, "- keyprint: %s\n", rec.Keyprint)
+	}
+	if rec.Notes != "" {
+		fmt.Fprintf(buf, "- notes: %s\n", rec.Notes)
+	}
+	h.cmdOutput(p, buf.String())
+	return nil
+}
+
+func (h *Hub) cmdUserNote(p Peer, args string) error {
+	name, args, err := cmdParseString(args)
+	if err != nil {
+		return err
+	}
+	notes := strings.TrimSpace(args)
 	err = h.UpdateUser(name, func(u *UserRecord) (bool, error) {
-		u.Profile = prof
+		if u.Notes == notes {
+			return false, nil
+		}
+		u.Notes = notes
 		return true, nil
 	})
 	if err != nil {
 		return err
 	}
-	h.cmdOutputf(p, "user %s with profile %s registered", name, prof)
+	if notes == "" {
+		h.cmdOutputf(p, "notes for %s cleared", name)
+	} else {
+		h.cmdOutputf(p, "notes for %s updated", name)
+	}
+	return nil
+}
+
+func (h *Hub) cmdProfile(p Peer, args string) error {
+	args = strings.TrimSpace(args)
+	if args == "" {
+		buf := bytes.NewBuffer(nil)
+		buf.WriteString("profiles:\n")
+		for _, id := range h.Profiles() {
+			if par := h.Profile(id).Parent(); par != nil {
+				fmt.Fprintf(buf, "- %s (%s)\n", id, par.ID())
+			} else {
+				fmt.Fprintf(buf, "- %s\n", id)
+			}
+		}
+		h.cmdOutput(p, buf.String())
+		return nil
+	}
+	name, args, err := cmdParseString(args)
+	if err != nil {
+		return err
+	}
+	prof := h.Profile(name)
+	if prof == nil {
+		return fmt.Errorf("profile %q does not exist", name)
+	}
+	if args == "" {
+		own := prof.Map()
+		buf := bytes.NewBuffer(nil)
+		fmt.Fprintf(buf, "profile: %s\n", name)
+		if par := prof.Parent(); par != nil {
+			fmt.Fprintf(buf, "- parent: %s\n", par.ID())
+		}
+		for _, perm := range Permissions() {
+			mark := " "
+			if prof.Has(perm.Name) {
+				mark = "+"
+			}
+			src := ""
+			if _, ok := own[perm.Name]; !ok {
+				src = " (inherited)"
+			}
+			fmt.Fprintf(buf, "%s %s - %s%s\n", mark, perm.Name, perm.Short, src)
+		}
+		h.cmdOutput(p, buf.String())
+		return nil
+	}
+	op, args, err := cmdParseString(args)
+	if err != nil {
+		return err
+	}
+	perm, args, err := cmdParseString(args)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "set":
+		val := true
+		if args = strings.TrimSpace(args); args != "" {
+			val, err = strconv.ParseBool(args)
+			if err != nil {
+				return errCmdInvalidArg
+			}
+		}
+		if err = h.SetProfilePerm(name, perm, val); err != nil {
+			return err
+		}
+		h.cmdOutputf(p, "profile %s: %s = %v", name, perm, val)
+	case "unset":
+		if err = h.UnsetProfilePerm(name, perm); err != nil {
+			return err
+		}
+		h.cmdOutputf(p, "profile %s: %s unset", name, perm)
+	default:
+		return errCmdInvalidArg
+	}
 	return nil
 }
 
@@ -525,6 +908,30 @@ func (h *Hub) cmdUserIP(p, p2 Peer) error {
 	return nil
 }
 
+func (h *Hub) cmdProtos(p Peer) error {
+	st := h.protoStats()
+	pct := func(n int) string {
+		if st.Total == 0 {
+			return "0%"
+		}
+		return strconv.Itoa(n*100/st.Total) + "%"
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "users: %d\n", st.Total)
+	fmt.Fprintf(buf, "- NMDC: %d (%s)\n", st.NMDC, pct(st.NMDC))
+	fmt.Fprintf(buf, "- NMDCS: %d (%s)\n", st.NMDCS, pct(st.NMDCS))
+	fmt.Fprintf(buf, "- ADC: %d (%s)\n", st.ADC, pct(st.ADC))
+	fmt.Fprintf(buf, "- ADCS: %d (%s)\n", st.ADCS, pct(st.ADCS))
+	if st.Other != 0 {
+		fmt.Fprintf(buf, "- other: %d (%s)\n", st.Other, pct(st.Other))
+	}
+	buf.WriteString("\ncan be upgraded:\n")
+	fmt.Fprintf(buf, "- to TLS: %d (%s)\n", st.ToTLS, pct(st.ToTLS))
+	fmt.Fprintf(buf, "- NMDC to ADC: %d (%s)\n", st.NMDCToADC, pct(st.NMDCToADC))
+	h.cmdOutput(p, buf.String())
+	return nil
+}
+
 func (h *Hub) cmdDrop(p, p2 Peer) error {
 	if IsBot(p2) {
 		return errors.New("refusing to kick a bot")
@@ -597,6 +1004,44 @@ func (h *Hub) cmdUnBanIP(p Peer, args string) error {
 	return nil
 }
 
+func (h *Hub) cmdAttack(p Peer, args string) error {
+	if args == "" {
+		if h.UnderAttack() {
+			h.cmdOutput(p, "under attack mode is on")
+		} else {
+			h.cmdOutput(p, "under attack mode is off")
+		}
+		return nil
+	}
+	mode, args, err := cmdParseString(args)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case "on":
+		dt := h.attackDuration()
+		if args != "" {
+			dt, _, err = cmdParseDur(args)
+			if err != nil {
+				return err
+			}
+		}
+		if dt <= 0 {
+			dt = defaultThrottleAttack
+		}
+		h.SetUnderAttack(dt)
+		h.OpLogf("%s enabled under attack mode for %v", p.Name(), dt)
+		h.cmdOutputf(p, "under attack mode is on for %v", dt)
+	case "off":
+		h.SetUnderAttack(0)
+		h.OpLogf("%s disabled under attack mode", p.Name())
+		h.cmdOutput(p, "under attack mode is off")
+	default:
+		return errCmdInvalidArg
+	}
+	return nil
+}
+
 func (h *Hub) cmdListBanIP(p Peer, args string) error {
 	buf := bytes.NewBuffer(nil)
 	buf.WriteString("blocked IPs:\n")
@@ -916,6 +1361,10 @@ func (h *Hub) toCommandFunc(o interface{}, opt *cmdOptions) CommandFunc {
 }
 
 func (h *Hub) RegisterCommand(cmd Command) {
+	h.registerCommand(cmd)
+}
+
+func (h *Hub) registerCommand(cmd Command) *Command {
 	fnc := h.toCommandFunc(cmd.Func, &cmd.opt)
 	cmd.run = func(p Peer, args string) {
 		err := fnc(p, args)
@@ -923,11 +1372,79 @@ func (h *Hub) RegisterCommand(cmd Command) {
 			h.cmdOutput(p, "error: "+err.Error())
 		}
 	}
+	h.cmds.Lock()
+	defer h.cmds.Unlock()
 	h.cmds.names[cmd.Name] = struct{}{}
-	h.cmds.byName[cmd.Name] = &cmd
-	for _, name := range cmd.Aliases {
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if old := h.cmds.byName[name]; old != nil && old != &cmd {
+			if cmd.prev == nil {
+				cmd.prev = make(map[string]*Command)
+			}
+			cmd.prev[name] = old
+		}
 		h.cmds.byName[name] = &cmd
 	}
+	return &cmd
+}
+
+// unregisterCommand removes the command and its aliases.
+// Commands that were overridden by this one are restored.
+func (h *Hub) unregisterCommand(c *Command) {
+	h.cmds.Lock()
+	defer h.cmds.Unlock()
+	for _, name := range append([]string{c.Name}, c.Aliases...) {
+		cur := h.cmds.byName[name]
+		if cur == c {
+			if prev := c.prev[name]; prev != nil {
+				h.cmds.byName[name] = prev
+			} else {
+				delete(h.cmds.byName, name)
+			}
+			continue
+		}
+		// the command was overridden as well, remove it from the chain
+		for cur != nil {
+			prev := cur.prev[name]
+			if prev == c {
+				if c.prev[name] != nil {
+					cur.prev[name] = c.prev[name]
+				} else {
+					delete(cur.prev, name)
+				}
+				break
+			}
+			cur = prev
+		}
+	}
+	if cur := h.cmds.byName[c.Name]; cur == nil || cur.Name != c.Name {
+		delete(h.cmds.names, c.Name)
+	}
+}
+
+// UnregisterCommand removes the command with a given name.
+func (h *Hub) UnregisterCommand(name string) {
+	if c := h.getCommand(name); c != nil {
+		h.unregisterCommand(c)
+	}
+}
+
+func (h *Hub) getCommand(name string) *Command {
+	h.cmds.RLock()
+	defer h.cmds.RUnlock()
+	return h.cmds.byName[name]
+}
+
+// listCommands returns all the commands, excluding aliases.
+func (h *Hub) listCommands() []*Command {
+	h.cmds.RLock()
+	defer h.cmds.RUnlock()
+	list := make([]*Command, 0, len(h.cmds.names))
+	for name := range h.cmds.names {
+		if c := h.cmds.byName[name]; c != nil {
+			list = append(list, c)
+		}
+	}
+	return list
 }
 
 func (h *Hub) isCommand(peer Peer, text string) bool {
@@ -972,18 +1489,21 @@ func (h *Hub) peerHasPerm(peer Peer, perm string) bool {
 }
 
 func (h *Hub) command(peer Peer, cmd string, args string) {
-	c, ok := h.cmds.byName[cmd]
-	if !ok || !h.peerHasPerm(peer, c.Require) {
+	c := h.getCommand(cmd)
+	if c == nil || !h.peerHasPerm(peer, c.Require) {
 		h.cmdOutput(peer, "unsupported command: "+cmd)
 		return
 	}
+	if peer.User().MustChangePass() && c.Name != "reg" && c.Name != "help" {
+		h.cmdOutput(peer, errPassChangeRequired.Error())
+		return
+	}
 	c.run(peer, args)
 }
 
 func (h *Hub) ListCommands(u *User) []*Command {
-	command := make([]*Command, 0, len(h.cmds.names))
-	for name := range h.cmds.names {
-		c := h.cmds.byName[name]
+	var command []*Command
+	for _, c := range h.listCommands() {
 		if len(c.Menu) == 0 {
 			continue
 		} else if c.Require != "" && !u.IsOwner() && !u.HasPerm(c.Require) {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -32,6 +33,18 @@ const (
 	ConfigNMDCRedirectTLS = "nmdc.redirect.tls"
 	ConfigNMDCRedirectADC = "nmdc.redirect.adc"
 	ConfigADCRedirectTLS  = "adc.redirect.tls"
+	// ConfigRedirectForce disables client capability checks for redirects.
+	ConfigRedirectForce = "redirect.force"
+	// ConfigTLSAllowInsecure allows registered users to log in without a secure connection,
+	// even if their profile requires TLS.
+	ConfigTLSAllowInsecure = "tls.allow_insecure"
+
+	// ConfigSearchTimeout is the time in seconds after which an active search is cancelled.
+	ConfigSearchTimeout = "search.timeout"
+	// ConfigSearchMaxResults is the max number of results returned for a single search (0 - no limit).
+	ConfigSearchMaxResults = "search.results.max"
+	// ConfigSearchMaxPerSource is the max number of results returned from a single user (0 - no limit).
+	ConfigSearchMaxPerSource = "search.results.per_user"
 )
 
 var confManager *viper.Viper // pointer to config manager
@@ -60,6 +73,9 @@ var configIgnored = map[string]struct{}{
 	"chat.log.max":   {},
 	"database.path":  {},
 	"database.type":  {},
+	"nicks.blocked":  {},
+	"nicks.prefixes": {},
+	"nicks.reserved": {},
 	"plugins.path":   {},
 	"serve.host":     {},
 	"serve.port":     {},
@@ -182,6 +198,11 @@ func (h *Hub) ConfigKeys() []string {
 		ConfigNMDCRedirectTLS,
 		ConfigNMDCRedirectADC,
 		ConfigADCRedirectTLS,
+		ConfigRedirectForce,
+		ConfigTLSAllowInsecure,
+		ConfigSearchTimeout,
+		ConfigSearchMaxResults,
+		ConfigSearchMaxPerSource,
 	}
 	h.conf.RLock()
 	for k := range h.conf.m {
@@ -218,7 +239,10 @@ func (h *Hub) GetConfig(key string) (interface{}, bool) {
 			return nil, false
 		}
 		return v, true
-	case ConfigZlibLevel:
+	case ConfigZlibLevel,
+		ConfigSearchTimeout,
+		ConfigSearchMaxResults,
+		ConfigSearchMaxPerSource:
 		v, ok := h.GetConfigInt(key)
 		if !ok {
 			return nil, false
@@ -228,7 +252,9 @@ func (h *Hub) GetConfig(key string) (interface{}, bool) {
 		ConfigChatGlobalEnabled,
 		ConfigNMDCRedirectTLS,
 		ConfigNMDCRedirectADC,
-		ConfigADCRedirectTLS:
+		ConfigADCRedirectTLS,
+		ConfigRedirectForce,
+		ConfigTLSAllowInsecure:
 		v, ok := h.GetConfigBool(key)
 		if !ok {
 			return nil, false
@@ -346,6 +372,10 @@ func (h *Hub) setConfigBool(key string, val bool) {
 		h.setRedirectNMDCToADC(val)
 	case ConfigADCRedirectTLS:
 		h.setRedirectADCToTLS(val)
+	case ConfigRedirectForce:
+		h.setRedirectForce(val)
+	case ConfigTLSAllowInsecure:
+		h.setAllowInsecure(val)
 	default:
 		h.setConfigMap(key, val)
 	}
@@ -371,6 +401,10 @@ func (h *Hub) GetConfigBool(key string) (bool, bool) {
 		return h.getRedirectNMDCToADC(), true
 	case ConfigADCRedirectTLS:
 		return h.getRedirectADCToTLS(), true
+	case ConfigRedirectForce:
+		return h.getRedirectForce(), true
+	case ConfigTLSAllowInsecure:
+		return h.getAllowInsecure(), true
 	default:
 		v, ok := h.getConfigMap(key)
 		if !ok || v == nil {
@@ -404,6 +438,14 @@ func (h *Hub) setConfigInt(key string, val int64) {
 	switch key {
 	case ConfigZlibLevel:
 		h.setZlibLevel(int(val))
+	case ConfigSearchTimeout:
+		h.setSearchTimeout(time.Duration(val) * time.Second)
+	case ConfigSearchMaxResults:
+		_, maxSource := h.getSearchLimits()
+		h.setSearchLimits(int(val), maxSource)
+	case ConfigSearchMaxPerSource:
+		max, _ := h.getSearchLimits()
+		h.setSearchLimits(max, int(val))
 	default:
 		h.setConfigMap(key, val)
 	}
@@ -421,6 +463,14 @@ func (h *Hub) GetConfigInt(key string) (int64, bool) {
 	switch key {
 	case ConfigZlibLevel:
 		return int64(h.zlibLevel()), true
+	case ConfigSearchTimeout:
+		return int64(h.getSearchTimeout() / time.Second), true
+	case ConfigSearchMaxResults:
+		max, _ := h.getSearchLimits()
+		return int64(max), true
+	case ConfigSearchMaxPerSource:
+		_, maxSource := h.getSearchLimits()
+		return int64(maxSource), true
 	default:
 		v, ok := h.getConfigMap(key)
 		if !ok || v == nil {
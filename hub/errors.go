@@ -16,6 +16,8 @@ var (
 	errConnInsecure    = errors.New("connection is insecure")
 	errCmdInvalidArg   = errors.New("invalid argument")
 	errServerIsPrivate = errors.New("server is private")
+	errKeyprintInvalid = errors.New("client certificate keyprint mismatch")
+	errRejected        = errors.New("connection rejected")
 )
 
 type ErrUnknownProtocol struct {
@@ -3,69 +3,313 @@ package hub
 import (
 	"net"
 	"sync"
+
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
 )
 
 type hooks struct {
 	sync.RWMutex
+	lastID uint64
 
 	// connection events
-	onConnected    []func(c net.Conn) bool
-	onConnectedIP4 []func(c net.Conn, ip net.IP) bool
-	onConnectedIP6 []func(c net.Conn, ip net.IP) bool
-	onDisconnected []func(c net.Conn)
+	onConnected    connHooks
+	onConnectedIP4 connIPHooks
+	onConnectedIP6 connIPHooks
+	onDisconnected disconnHooks
 
 	// peer state events
-	onJoined []func(p Peer) bool
-	onLeave  []func(p Peer)
+	onJoined joinHooks
+	onLeave  leaveHooks
 
 	// chat events
-	onGlobalChat []func(p Peer, m Message) bool
-	onChat       []func(r *Room, p Peer, m Message) bool
-	onPM         []func(from, to Peer, m Message) bool
+	onGlobalChat globalChatHooks
+	onChat       chatHooks
+	onPM         pmHooks
+
+	// protocol events
+	onNMDCHandshake nmdcHandshakeHooks
+	onNMDCMessage   nmdcMessageHooks
 }
 
-// OnConnected registers a trigger for a moment when a new connection is accepted, but before the protocol detection.
-// The function returns a flag indicating if a connection should be accepted or not.
-func (h *Hub) OnConnected(fnc func(c net.Conn) bool) {
+// addHook assigns an id to a new hook and adds it with the add function.
+// It returns a function that removes the hook with the remove function.
+//
+// Hook lists are copy-on-write. They are never modified in place, thus callers
+// can iterate over a snapshot of the list without holding the lock.
+func (h *Hub) addHook(add, remove func(id uint64)) func() {
 	h.hooks.Lock()
-	h.hooks.onConnected = append(h.hooks.onConnected, fnc)
+	h.hooks.lastID++
+	id := h.hooks.lastID
+	add(id)
 	h.hooks.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.hooks.Lock()
+			remove(id)
+			h.hooks.Unlock()
+		})
+	}
+}
+
+type connHook struct {
+	id  uint64
+	fnc func(c net.Conn) bool
+}
+
+type connHooks []connHook
+
+func (l connHooks) add(id uint64, fnc func(c net.Conn) bool) connHooks {
+	return append(l[:len(l):len(l)], connHook{id: id, fnc: fnc})
+}
+
+func (l connHooks) remove(id uint64) connHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(connHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type connIPHook struct {
+	id  uint64
+	fnc func(c net.Conn, ip net.IP) bool
+}
+
+type connIPHooks []connIPHook
+
+func (l connIPHooks) add(id uint64, fnc func(c net.Conn, ip net.IP) bool) connIPHooks {
+	return append(l[:len(l):len(l)], connIPHook{id: id, fnc: fnc})
+}
+
+func (l connIPHooks) remove(id uint64) connIPHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(connIPHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type disconnHook struct {
+	id  uint64
+	fnc func(c net.Conn)
+}
+
+type disconnHooks []disconnHook
+
+func (l disconnHooks) add(id uint64, fnc func(c net.Conn)) disconnHooks {
+	return append(l[:len(l):len(l)], disconnHook{id: id, fnc: fnc})
+}
+
+func (l disconnHooks) remove(id uint64) disconnHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(disconnHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type joinHook struct {
+	id  uint64
+	fnc func(p Peer) bool
+}
+
+type joinHooks []joinHook
+
+func (l joinHooks) add(id uint64, fnc func(p Peer) bool) joinHooks {
+	return append(l[:len(l):len(l)], joinHook{id: id, fnc: fnc})
+}
+
+func (l joinHooks) remove(id uint64) joinHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(joinHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type leaveHook struct {
+	id  uint64
+	fnc func(p Peer)
+}
+
+type leaveHooks []leaveHook
+
+func (l leaveHooks) add(id uint64, fnc func(p Peer)) leaveHooks {
+	return append(l[:len(l):len(l)], leaveHook{id: id, fnc: fnc})
+}
+
+func (l leaveHooks) remove(id uint64) leaveHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(leaveHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type globalChatHook struct {
+	id  uint64
+	fnc func(p Peer, m Message) bool
+}
+
+type globalChatHooks []globalChatHook
+
+func (l globalChatHooks) add(id uint64, fnc func(p Peer, m Message) bool) globalChatHooks {
+	return append(l[:len(l):len(l)], globalChatHook{id: id, fnc: fnc})
+}
+
+func (l globalChatHooks) remove(id uint64) globalChatHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(globalChatHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type chatHook struct {
+	id  uint64
+	fnc func(r *Room, p Peer, m Message) bool
+}
+
+type chatHooks []chatHook
+
+func (l chatHooks) add(id uint64, fnc func(r *Room, p Peer, m Message) bool) chatHooks {
+	return append(l[:len(l):len(l)], chatHook{id: id, fnc: fnc})
+}
+
+func (l chatHooks) remove(id uint64) chatHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(chatHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type pmHook struct {
+	id  uint64
+	fnc func(from, to Peer, m Message) bool
+}
+
+type pmHooks []pmHook
+
+func (l pmHooks) add(id uint64, fnc func(from, to Peer, m Message) bool) pmHooks {
+	return append(l[:len(l):len(l)], pmHook{id: id, fnc: fnc})
+}
+
+func (l pmHooks) remove(id uint64) pmHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(pmHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type nmdcHandshakeHook struct {
+	id  uint64
+	fnc func(c *ConnInfo, name string, m nmdcp.Message) bool
+}
+
+type nmdcHandshakeHooks []nmdcHandshakeHook
+
+func (l nmdcHandshakeHooks) add(id uint64, fnc func(c *ConnInfo, name string, m nmdcp.Message) bool) nmdcHandshakeHooks {
+	return append(l[:len(l):len(l)], nmdcHandshakeHook{id: id, fnc: fnc})
+}
+
+func (l nmdcHandshakeHooks) remove(id uint64) nmdcHandshakeHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(nmdcHandshakeHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+type nmdcMessageHook struct {
+	id  uint64
+	fnc func(p Peer, m nmdcp.Message) bool
+}
+
+type nmdcMessageHooks []nmdcMessageHook
+
+func (l nmdcMessageHooks) add(id uint64, fnc func(p Peer, m nmdcp.Message) bool) nmdcMessageHooks {
+	return append(l[:len(l):len(l)], nmdcMessageHook{id: id, fnc: fnc})
+}
+
+func (l nmdcMessageHooks) remove(id uint64) nmdcMessageHooks {
+	for i, e := range l {
+		if e.id == id {
+			return append(append(nmdcMessageHooks{}, l[:i]...), l[i+1:]...)
+		}
+	}
+	return l
+}
+
+// OnConnected registers a trigger for a moment when a new connection is accepted, but before the protocol detection.
+// The function returns a flag indicating if a connection should be accepted or not.
+// Calling the returned function removes the trigger.
+func (h *Hub) OnConnected(fnc func(c net.Conn) bool) func() {
+	l := &h.hooks.onConnected
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
 }
 
 // OnConnectedIP4 registers a trigger for a moment when a new connection from IPv4 is accepted, but before the protocol detection.
 // The function returns a flag indicating if a connection should be accepted or not.
-func (h *Hub) OnConnectedIP4(fnc func(c net.Conn, ip net.IP) bool) {
-	h.hooks.Lock()
-	h.hooks.onConnectedIP4 = append(h.hooks.onConnectedIP4, fnc)
-	h.hooks.Unlock()
+func (h *Hub) OnConnectedIP4(fnc func(c net.Conn, ip net.IP) bool) func() {
+	l := &h.hooks.onConnectedIP4
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
 }
 
 // OnConnectedIP6 registers a trigger for a moment when a new connection from IPv6 is accepted, but before the protocol detection.
 // The function returns a flag indicating if a connection should be accepted or not.
-func (h *Hub) OnConnectedIP6(fnc func(c net.Conn, ip net.IP) bool) {
-	h.hooks.Lock()
-	h.hooks.onConnectedIP6 = append(h.hooks.onConnectedIP6, fnc)
-	h.hooks.Unlock()
+func (h *Hub) OnConnectedIP6(fnc func(c net.Conn, ip net.IP) bool) func() {
+	l := &h.hooks.onConnectedIP6
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
 }
 
 // OnDisconnected registers a trigger for a moment when the connection is closed.
-func (h *Hub) OnDisconnected(fnc func(c net.Conn)) {
-	h.hooks.Lock()
-	h.hooks.onDisconnected = append(h.hooks.onDisconnected, fnc)
-	h.hooks.Unlock()
+func (h *Hub) OnDisconnected(fnc func(c net.Conn)) func() {
+	l := &h.hooks.onDisconnected
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
 }
 
 // OnJoined is triggered when the peer successfully joins the hub, after all the checks and right before the client event loop.
 // The function returns a flag if a peer should be accepted or not.
-func (h *Hub) OnJoined(fnc func(p Peer) bool) {
-	h.hooks.Lock()
-	h.hooks.onJoined = append(h.hooks.onJoined, fnc)
-	h.hooks.Unlock()
+func (h *Hub) OnJoined(fnc func(p Peer) bool) func() {
+	l := &h.hooks.onJoined
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
 }
 
 // OnPermJoined is an analog of OnJoined, but triggers only when a user with a specified permission joins.
-func (h *Hub) OnPermJoined(perm string, fnc func(p Peer) bool) {
-	h.OnJoined(func(p Peer) bool {
+func (h *Hub) OnPermJoined(perm string, fnc func(p Peer) bool) func() {
+	return h.OnJoined(func(p Peer) bool {
 		if !p.User().HasPerm(perm) {
 			return true
 		}
@@ -74,15 +318,18 @@ func (h *Hub) OnPermJoined(perm string, fnc func(p Peer) bool) {
 }
 
 // OnLeave is triggered when the peer disconnects from the hub, after he was unregistered from the users list.
-func (h *Hub) OnLeave(fnc func(p Peer)) {
-	h.hooks.Lock()
-	h.hooks.onLeave = append(h.hooks.onLeave, fnc)
-	h.hooks.Unlock()
+func (h *Hub) OnLeave(fnc func(p Peer)) func() {
+	l := &h.hooks.onLeave
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
 }
 
 // OnPermLeave is an analog of OnLeave, but triggers only when a user with a specified permission leaves.
-func (h *Hub) OnPermLeave(perm string, fnc func(p Peer)) {
-	h.OnLeave(func(p Peer) {
+func (h *Hub) OnPermLeave(perm string, fnc func(p Peer)) func() {
+	return h.OnLeave(func(p Peer) {
 		if p.User().HasPerm(perm) {
 			fnc(p)
 		}
@@ -91,51 +338,95 @@ func (h *Hub) OnPermLeave(perm string, fnc func(p Peer)) {
 
 // OnGlobalChat is triggered when the message is sent in the global chat.
 // The function returns a flag if a message should be accepted or not.
-func (h *Hub) OnGlobalChat(fnc func(p Peer, m Message) bool) {
-	h.hooks.Lock()
-	h.hooks.onGlobalChat = append(h.hooks.onGlobalChat, fnc)
-	h.hooks.Unlock()
+func (h *Hub) OnGlobalChat(fnc func(p Peer, m Message) bool) func() {
+	l := &h.hooks.onGlobalChat
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
 }
 
 // OnChat is triggered when the message is sent in any of the chat rooms.
 // The function returns a flag if a message should be accepted or not.
-func (h *Hub) OnChat(fnc func(r *Room, p Peer, m Message) bool) {
-	h.hooks.Lock()
-	h.hooks.onChat = append(h.hooks.onChat, fnc)
-	h.hooks.Unlock()
+func (h *Hub) OnChat(fnc func(r *Room, p Peer, m Message) bool) func() {
+	l := &h.hooks.onChat
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
 }
 
 // OnPM is triggered when the private message is sent through the hub.
 // The function returns a flag if a message should be accepted or not.
-func (h *Hub) OnPM(fnc func(from, to Peer, m Message) bool) {
-	h.hooks.Lock()
-	h.hooks.onPM = append(h.hooks.onPM, fnc)
-	h.hooks.Unlock()
+func (h *Hub) OnPM(fnc func(from, to Peer, m Message) bool) func() {
+	l := &h.hooks.onPM
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
+}
+
+// OnNMDCHandshake is triggered for each command received during the handshake, before the hub processes it.
+// The name is empty until the client sends its nick. ADC commands are translated to their NMDC equivalents.
+// The function returns a flag if the connection should continue or not.
+func (h *Hub) OnNMDCHandshake(fnc func(c *ConnInfo, name string, m nmdcp.Message) bool) func() {
+	l := &h.hooks.onNMDCHandshake
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
+}
+
+// OnNMDCMessage is triggered for each command received from the peer after the handshake, before the hub processes it.
+// ADC commands are translated to their NMDC equivalents.
+// The function returns a flag if the command should be processed or dropped.
+func (h *Hub) OnNMDCMessage(fnc func(p Peer, m nmdcp.Message) bool) func() {
+	l := &h.hooks.onNMDCMessage
+	return h.addHook(func(id uint64) {
+		*l = l.add(id, fnc)
+	}, func(id uint64) {
+		*l = l.remove(id)
+	})
+}
+
+// hasNMDCMessageHooks checks if any triggers are registered for NMDC messages.
+func (h *Hub) hasNMDCMessageHooks() bool {
+	h.hooks.RLock()
+	n := len(h.hooks.onNMDCMessage)
+	h.hooks.RUnlock()
+	return n != 0
 }
 
 func (h *Hub) callOnConnected(c net.Conn) bool {
 	h.hooks.RLock()
-	defer h.hooks.RUnlock()
-	for _, fnc := range h.hooks.onConnected {
-		if !fnc(c) {
+	on := h.hooks.onConnected
+	on4 := h.hooks.onConnectedIP4
+	on6 := h.hooks.onConnectedIP6
+	h.hooks.RUnlock()
+	for _, e := range on {
+		if !e.fnc(c) {
 			return false
 		}
 	}
-	if len(h.hooks.onConnectedIP4)+len(h.hooks.onConnectedIP6) == 0 {
+	if len(on4)+len(on6) == 0 {
 		return true
 	}
 	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
 		if len(addr.IP) == net.IPv6len {
 			ip6 := addr.IP.To16()
-			for _, fnc := range h.hooks.onConnectedIP6 {
-				if !fnc(c, ip6) {
+			for _, e := range on6 {
+				if !e.fnc(c, ip6) {
 					return false
 				}
 			}
 		}
 		if ip4 := addr.IP.To4(); ip4 != nil {
-			for _, fnc := range h.hooks.onConnectedIP4 {
-				if !fnc(c, ip4) {
+			for _, e := range on4 {
+				if !e.fnc(c, ip4) {
 					return false
 				}
 			}
@@ -146,17 +437,19 @@ func (h *Hub) callOnConnected(c net.Conn) bool {
 
 func (h *Hub) callOnDisconnected(c net.Conn) {
 	h.hooks.RLock()
-	defer h.hooks.RUnlock()
-	for _, fnc := range h.hooks.onDisconnected {
-		fnc(c)
+	list := h.hooks.onDisconnected
+	h.hooks.RUnlock()
+	for _, e := range list {
+		e.fnc(c)
 	}
 }
 
 func (h *Hub) callOnJoined(p Peer) bool {
 	h.hooks.RLock()
-	defer h.hooks.RUnlock()
-	for _, fnc := range h.hooks.onJoined {
-		if !fnc(p) {
+	list := h.hooks.onJoined
+	h.hooks.RUnlock()
+	for _, e := range list {
+		if !e.fnc(p) {
 			return false
 		}
 	}
@@ -165,17 +458,19 @@ func (h *Hub) callOnJoined(p Peer) bool {
 
 func (h *Hub) callOnLeave(p Peer) {
 	h.hooks.RLock()
-	defer h.hooks.RUnlock()
-	for _, fnc := range h.hooks.onLeave {
-		fnc(p)
+	list := h.hooks.onLeave
+	h.hooks.RUnlock()
+	for _, e := range list {
+		e.fnc(p)
 	}
 }
 
 func (h *Hub) callOnGlobalChat(p Peer, m Message) bool {
 	h.hooks.RLock()
-	defer h.hooks.RUnlock()
-	for _, fnc := range h.hooks.onGlobalChat {
-		if !fnc(p, m) {
+	list := h.hooks.onGlobalChat
+	h.hooks.RUnlock()
+	for _, e := range list {
+		if !e.fnc(p, m) {
 			return false
 		}
 	}
@@ -184,9 +479,10 @@ func (h *Hub) callOnGlobalChat(p Peer, m Message) bool {
 
 func (h *Hub) callOnChat(r *Room, p Peer, m Message) bool {
 	h.hooks.RLock()
-	defer h.hooks.RUnlock()
-	for _, fnc := range h.hooks.onChat {
-		if !fnc(r, p, m) {
+	list := h.hooks.onChat
+	h.hooks.RUnlock()
+	for _, e := range list {
+		if !e.fnc(r, p, m) {
 			return false
 		}
 	}
@@ -195,9 +491,34 @@ func (h *Hub) callOnChat(r *Room, p Peer, m Message) bool {
 
 func (h *Hub) callOnPM(from, to Peer, m Message) bool {
 	h.hooks.RLock()
-	defer h.hooks.RUnlock()
-	for _, fnc := range h.hooks.onPM {
-		if !fnc(from, to, m) {
+	list := h.hooks.onPM
+	h.hooks.RUnlock()
+	for _, e := range list {
+		if !e.fnc(from, to, m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Hub) callOnNMDCHandshake(c *ConnInfo, name string, m nmdcp.Message) bool {
+	h.hooks.RLock()
+	list := h.hooks.onNMDCHandshake
+	h.hooks.RUnlock()
+	for _, e := range list {
+		if !e.fnc(c, name, m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Hub) callOnNMDCMessage(p Peer, m nmdcp.Message) bool {
+	h.hooks.RLock()
+	list := h.hooks.onNMDCMessage
+	h.hooks.RUnlock()
+	for _, e := range list {
+		if !e.fnc(p, m) {
 			return false
 		}
 	}
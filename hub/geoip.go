@@ -0,0 +1,231 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// ConfigGeoIPFile is a path to a MaxMind DB file (GeoLite2 or GeoIP2) or a CSV file with IP ranges and countries.
+	//
+	// Each line of the CSV contains the first and the last IP of the range (or a CIDR subnet), followed by a two-letter
+	// country code and optionally the country name. Software77 IpToCountry format is accepted as well.
+	ConfigGeoIPFile = "geoip.file"
+)
+
+// Country is the result of a GeoIP lookup.
+type Country struct {
+	Code string // ISO 3166 two-letter code
+	Name string
+}
+
+type geoRange struct {
+	from, to net.IP // 16 bytes
+	country  int
+}
+
+type geoDB struct {
+	ranges    []geoRange // sorted by the first IP
+	countries []Country
+	mmdb      *mmdb // set if the database was loaded from a MaxMind DB file
+}
+
+type geoIP struct {
+	sync.Mutex
+	path string
+	db   *geoDB
+}
+
+// parseGeoIP parses an IP either in a text form or as a decimal IPv4 number.
+func parseGeoIP(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.To16()
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return nil
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(v))
+	return ip.To16()
+}
+
+func isCountryCode(s string) bool {
+	if len(s) != 2 {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// readGeoCSV reads IP ranges from a CSV file.
+func readGeoCSV(r io.Reader) (*geoDB, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	db := &geoDB{}
+	byCode := make(map[string]int)
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(rec) < 2 {
+			continue
+		}
+		var (
+			from, to net.IP
+			rest     []string
+		)
+		if strings.Contains(rec[0], "/") {
+			_, sub, err := net.ParseCIDR(rec[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			from = sub.IP.To16()
+			to = make(net.IP, len(sub.IP))
+			for i := range sub.IP {
+				to[i] = sub.IP[i] | ^sub.Mask[i]
+			}
+			to = to.To16()
+			rest = rec[1:]
+		} else {
+			from, to = parseGeoIP(rec[0]), parseGeoIP(rec[1])
+			if from == nil || to == nil {
+				return nil, fmt.Errorf("line %d: invalid IP range: %q - %q", line, rec[0], rec[1])
+			}
+			rest = rec[2:]
+		}
+		ci := -1
+		for i, v := range rest {
+			if isCountryCode(v) {
+				ci = i
+				break
+			}
+		}
+		if ci < 0 {
+			return nil, fmt.Errorf("line %d: no country code", line)
+		}
+		c := Country{Code: rest[ci]}
+		if n := len(rest) - 1; n > ci {
+			c.Name = rest[n]
+		}
+		id, ok := byCode[c.Code]
+		if !ok {
+			id = len(db.countries)
+			byCode[c.Code] = id
+			db.countries = append(db.countries, c)
+		}
+		db.ranges = append(db.ranges, geoRange{from: from, to: to, country: id})
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].from, db.ranges[j].from) < 0
+	})
+	return db, nil
+}
+
+func (db *geoDB) lookup(ip net.IP) (Country, bool) {
+	if db.mmdb != nil {
+		return db.mmdb.lookup(ip)
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return Country{}, false
+	}
+	// find the last range that starts before the IP
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].from, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, db.ranges[i].to) > 0 {
+		return Country{}, false
+	}
+	return db.countries[db.ranges[i].country], true
+}
+
+func loadGeoFile(path string) (*geoDB, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if isMMDB(data) {
+		m, err := readMMDB(data)
+		if err != nil {
+			return nil, err
+		}
+		return &geoDB{mmdb: m}, nil
+	}
+	return readGeoCSV(bytes.NewReader(data))
+}
+
+// ReloadGeoIP reloads the GeoIP database from the file set in the config.
+func (h *Hub) ReloadGeoIP() error {
+	path, _ := h.GetConfigString(ConfigGeoIPFile)
+	var (
+		db  *geoDB
+		err error
+	)
+	if path != "" {
+		db, err = loadGeoFile(path)
+		if err != nil {
+			return err
+		}
+		if db.mmdb != nil {
+			h.Logf("loaded GeoIP database from %s", path)
+		} else {
+			h.Logf("loaded %d GeoIP ranges from %s", len(db.ranges), path)
+		}
+	}
+	h.geoip.Lock()
+	h.geoip.path, h.geoip.db = path, db
+	h.geoip.Unlock()
+	return nil
+}
+
+func (h *Hub) getGeoIP() *geoDB {
+	path, _ := h.GetConfigString(ConfigGeoIPFile)
+	h.geoip.Lock()
+	db, cur := h.geoip.db, h.geoip.path
+	h.geoip.Unlock()
+	if path == cur {
+		return db
+	}
+	if err := h.ReloadGeoIP(); err != nil {
+		h.Logf("cannot load GeoIP database: %v", err)
+		// do not retry on each lookup
+		h.geoip.Lock()
+		h.geoip.path, h.geoip.db = path, nil
+		h.geoip.Unlock()
+		return nil
+	}
+	h.geoip.Lock()
+	db = h.geoip.db
+	h.geoip.Unlock()
+	return db
+}
+
+// LookupCountry returns the country of a given IP. It returns false if the GeoIP database is not configured
+// or the IP is not in the database.
+func (h *Hub) LookupCountry(ip net.IP) (Country, bool) {
+	db := h.getGeoIP()
+	if db == nil {
+		return Country{}, false
+	}
+	return db.lookup(ip)
+}
@@ -0,0 +1,269 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// mmdbMetaMarker separates the data section from the metadata in MaxMind DB files.
+var mmdbMetaMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errMMDBCorrupted = errors.New("mmdb: corrupted data section")
+
+// isMMDB checks if the file contents look like a MaxMind DB file.
+func isMMDB(data []byte) bool {
+	return bytes.Contains(data, mmdbMetaMarker)
+}
+
+// mmdbData is a data section of MaxMind DB file.
+type mmdbData []byte
+
+// decode decodes a single value at a given offset and returns an offset of the next value.
+func (d mmdbData) decode(off, depth int) (interface{}, int, error) {
+	if depth > 32 || off < 0 || off >= len(d) {
+		return nil, 0, errMMDBCorrupted
+	}
+	ctrl := d[off]
+	off++
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		// pointer
+		n := int(ctrl>>3)&3 + 1
+		if off+n > len(d) {
+			return nil, 0, errMMDBCorrupted
+		}
+		v := int(ctrl & 7)
+		for _, b := range d[off : off+n] {
+			v = v<<8 | int(b)
+		}
+		switch n {
+		case 2:
+			v += 2048
+		case 3:
+			v += 526336
+		case 4:
+			v = int(binary.BigEndian.Uint32(d[off:]))
+		}
+		val, _, err := d.decode(v, depth+1)
+		return val, off + n, err
+	}
+	if typ == 0 {
+		// extended type
+		if off >= len(d) {
+			return nil, 0, errMMDBCorrupted
+		}
+		typ = 7 + int(d[off])
+		off++
+	}
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(d) {
+			return nil, 0, errMMDBCorrupted
+		}
+		v := 0
+		for _, b := range d[off : off+n] {
+			v = v<<8 | int(b)
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		case 3:
+			size = 65821 + v
+		}
+	}
+	switch typ {
+	case 7, 11:
+		// each element takes at least one byte, thus the size cannot exceed the remaining data
+		if size > len(d)-off {
+			return nil, 0, errMMDBCorrupted
+		}
+	}
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupted
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], off = v, next
+		}
+		return m, off, nil
+	case 11: // array
+		arr := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr, off = append(arr, v), next
+		}
+		return arr, off, nil
+	case 14: // boolean
+		return size != 0, off, nil
+	}
+	if size > len(d)-off {
+		return nil, 0, errMMDBCorrupted
+	}
+	b := d[off : off+size]
+	off += size
+	switch typ {
+	case 2: // string
+		return string(b), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupted
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4, 10: // bytes, uint128
+		return append([]byte{}, b...), off, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		if size > 8 {
+			return nil, 0, errMMDBCorrupted
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errMMDBCorrupted
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupted
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type: %d", typ)
+}
+
+// mmdb is a minimal reader for MaxMind DB files (GeoLite2/GeoIP2 Country and City).
+type mmdb struct {
+	tree       []byte
+	data       mmdbData
+	nodes      int
+	recordSize int
+	ipVersion  int
+}
+
+func readMMDB(buf []byte) (*mmdb, error) {
+	i := bytes.LastIndex(buf, mmdbMetaMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: metadata not found")
+	}
+	v, _, err := mmdbData(buf[i+len(mmdbMetaMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("mmdb: invalid metadata")
+	}
+	metaInt := func(k string) int {
+		v, _ := meta[k].(uint64)
+		return int(v)
+	}
+	db := &mmdb{
+		nodes:      metaInt("node_count"),
+		recordSize: metaInt("record_size"),
+		ipVersion:  metaInt("ip_version"),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size: %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported IP version: %d", db.ipVersion)
+	}
+	if db.nodes <= 0 || db.nodes > i {
+		return nil, fmt.Errorf("mmdb: invalid node count: %d", db.nodes)
+	}
+	treeSize := db.nodes * db.recordSize / 4
+	if treeSize+16 > i {
+		return nil, errors.New("mmdb: search tree is truncated")
+	}
+	db.tree = buf[:treeSize]
+	db.data = mmdbData(buf[treeSize+16 : i])
+	return db, nil
+}
+
+// record returns the left (bit = 0) or the right (bit = 1) record of the node.
+func (db *mmdb) record(node int, bit byte) int {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[3*int(bit):]
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	case 28:
+		if bit == 0 {
+			return int(b[3]&0xf0)<<20 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		}
+		return int(b[3]&0x0f)<<24 | int(b[4])<<16 | int(b[5])<<8 | int(b[6])
+	default:
+		return int(binary.BigEndian.Uint32(b[4*int(bit):]))
+	}
+}
+
+func (db *mmdb) lookup(ip net.IP) (Country, bool) {
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		if db.ipVersion == 4 {
+			bits = ip4
+		} else {
+			// IPv4 addresses are stored in the ::/96 subtree
+			bits = append(make(net.IP, 12), ip4...)
+		}
+	} else if bits == nil || db.ipVersion == 4 {
+		return Country{}, false
+	}
+	node := 0
+	for i := 0; i < len(bits)*8 && node < db.nodes; i++ {
+		node = db.record(node, bits[i/8]>>uint(7-i%8)&1)
+	}
+	if node <= db.nodes {
+		return Country{}, false
+	}
+	// a malformed tree may point outside of the data section, decode checks the offset
+	v, _, err := db.data.decode(node-db.nodes-16, 0)
+	if err != nil {
+		return Country{}, false
+	}
+	rec, _ := v.(map[string]interface{})
+	for _, k := range []string{"country", "registered_country"} {
+		m, _ := rec[k].(map[string]interface{})
+		code, _ := m["iso_code"].(string)
+		if code == "" {
+			continue
+		}
+		c := Country{Code: code}
+		if names, ok := m["names"].(map[string]interface{}); ok {
+			c.Name, _ = names["en"].(string)
+		}
+		return c, true
+	}
+	return Country{}, false
+}
@@ -16,6 +16,7 @@ import (
 	"golang.org/x/text/encoding/htmlindex"
 	"github.com/spf13/viper"
 
+	"github.com/direct-connect/go-dc/keyprint"
 	"github.com/direct-connect/go-dc/types"
 	"github.com/direct-connect/go-dcpp/internal/safe"
 	"github.com/direct-connect/go-dcpp/version"
@@ -44,6 +45,9 @@ type Config struct {
 	ChatLogJoin      int
 	FallbackEncoding string
 	TLS              *tls.Config
+	Nicks            NickPolicy
+	// Clock is used for plugin timers. System clock is used by default.
+	Clock Clock
 }
 
 func NewHub(conf Config, v *viper.Viper) (*Hub, error) {
@@ -61,6 +65,11 @@ func NewHub(conf Config, v *viper.Viper) (*Hub, error) {
 	}
 	if conf.TLS != nil {
 		conf.TLS.NextProtos = []string{"adc", "nmdc"}
+		if conf.TLS.ClientAuth == tls.NoClientCert {
+			// ask for client certs to allow keyprint logins,
+			// but don't require them
+			conf.TLS.ClientAuth = tls.RequestClientCert
+		}
 	}
 	if conf.Desc == "" {
 		conf.Desc = "Hybrid hub"
@@ -93,16 +102,23 @@ func NewHub(conf Config, v *viper.Viper) (*Hub, error) {
 		conf.Icon = "icon.png"
 	}
 
+	if conf.Clock == nil {
+		conf.Clock = SystemClock()
+	}
+
 	h := &Hub{
 		created: time.Now(),
 		closed:  make(chan struct{}),
 		tls:     conf.TLS,
+		clock:   conf.Clock,
 	}
 
 	h.setConfigManager(v)
 	h.conf.Config = conf
 	h.conf.private = conf.Private
 	h.setZlibLevel(-1)
+	h.setSearchTimeout(searchTimeout)
+	h.setSearchLimits(defaultSearchResults, defaultSearchPerSource)
 	h.setGlobalChatEnabled(true) // TODO(dennwc): read from the config
 	if conf.FallbackEncoding != "" {
 		enc, err := htmlindex.Get(conf.FallbackEncoding)
@@ -111,6 +127,9 @@ func NewHub(conf Config, v *viper.Viper) (*Hub, error) {
 		}
 		h.fallback = enc
 	}
+	if err := h.SetNickPolicy(conf.Nicks); err != nil {
+		return nil, err
+	}
 	h.peers.reserved = make(map[nameKey]struct{})
 	h.peers.byName = make(map[nameKey]Peer)
 	h.peers.bySID = make(map[SID]Peer)
@@ -155,6 +174,7 @@ func toNameKey(name string) nameKey {
 type Hub struct {
 	created time.Time
 	closed  chan struct{}
+	clock   Clock
 
 	conf struct {
 		private bool
@@ -193,6 +213,7 @@ type Hub struct {
 	}
 
 	cmds struct {
+		sync.RWMutex
 		names  map[string]struct{} // no aliases
 		byName map[string]*Command
 	}
@@ -203,6 +224,8 @@ type Hub struct {
 		nmdcToTLS safe.Bool
 		nmdcToADC safe.Bool
 		adcToTLS  safe.Bool
+		force     safe.Bool
+		insecure  safe.Bool
 	}
 
 	global     safe.Bool
@@ -210,10 +233,22 @@ type Hub struct {
 	opChat     *Room
 	rooms      rooms
 
+	search     searchCache
+	searchConf struct {
+		timeout   int64 // atomic, sec
+		results   int32 // atomic
+		perSource int32 // atomic
+	}
+
 	plugins  plugins
 	hooks    hooks
 	bans     bans
+	banList  banList
+	geoip    geoIP
 	profiles profiles
+	nicks    atomic.Value // *nickPolicy
+	limits   connLimits
+	throttle throttle
 }
 
 func (h *Hub) SetDatabase(db Database) {
@@ -272,6 +307,10 @@ func (h *Hub) getRedirectADCToTLS() bool {
 	return h.redirect.adcToTLS.Get()
 }
 
+func (h *Hub) getRedirectForce() bool {
+	return h.redirect.force.Get()
+}
+
 func (h *Hub) setRedirectNMDCToTLS(v bool) {
 	h.redirect.nmdcToTLS.Set(v)
 }
@@ -284,6 +323,49 @@ func (h *Hub) setRedirectADCToTLS(v bool) {
 	h.redirect.adcToTLS.Set(v)
 }
 
+func (h *Hub) setRedirectForce(v bool) {
+	h.redirect.force.Set(v)
+}
+
+func (h *Hub) getAllowInsecure() bool {
+	return h.redirect.insecure.Get()
+}
+
+func (h *Hub) setAllowInsecure(v bool) {
+	h.redirect.insecure.Set(v)
+}
+
+func (h *Hub) getSearchTimeout() time.Duration {
+	sec := atomic.LoadInt64(&h.searchConf.timeout)
+	if sec <= 0 {
+		return searchTimeout
+	}
+	return time.Duration(sec) * time.Second
+}
+
+func (h *Hub) setSearchTimeout(dt time.Duration) {
+	atomic.StoreInt64(&h.searchConf.timeout, int64(dt/time.Second))
+}
+
+// getSearchLimits returns the max number of results for a single search and the max number of results
+// from a single source. Zero means no limit.
+func (h *Hub) getSearchLimits() (max, maxSource int) {
+	max = int(atomic.LoadInt32(&h.searchConf.results))
+	maxSource = int(atomic.LoadInt32(&h.searchConf.perSource))
+	return
+}
+
+func (h *Hub) setSearchLimits(max, maxSource int) {
+	if max < 0 {
+		max = 0
+	}
+	if maxSource < 0 {
+		maxSource = 0
+	}
+	atomic.StoreInt32(&h.searchConf.results, int32(max))
+	atomic.StoreInt32(&h.searchConf.perSource, int32(maxSource))
+}
+
 type Stats struct {
 	Name     string         `json:"name"`
 	Desc     string         `json:"desc,omitempty"`
@@ -634,14 +716,11 @@ func (h *Hub) ListenAndServe(addr string) error {
 		remote := conn.RemoteAddr()
 		if h.IsHardBlocked(remote) {
 			_ = conn.Close()
-			cntConnBlocked.Add(1)
+			cntConnBlocked.WithLabelValues(blockReasonBan).Add(1)
 			continue
 		}
-		cntConnAccepted.Add(1)
-		cntConnOpen.Add(1)
 		go func() {
 			defer func() {
-				cntConnOpen.Add(-1)
 				_ = conn.Close()
 			}()
 			if err := h.Serve(conn); err != nil && err != io.EOF {
@@ -668,6 +747,7 @@ func (h *Hub) Start() error {
 		return err
 	}
 	go h.bans.run(h.closed)
+	go h.expireBans(h.closed)
 	return nil
 }
 
@@ -730,6 +810,9 @@ func (h *Hub) serve(conn net.Conn, cinfo *ConnInfo) error {
 		st := tconn.ConnectionState()
 		cinfo.Secure = true
 		cinfo.TLSVers = st.Version
+		if len(st.PeerCertificates) != 0 {
+			cinfo.Keyprint = keyprint.FromBytes(st.PeerCertificates[0].Raw)
+		}
 
 		// protocol negotiated by ALPN
 		proto := st.NegotiatedProtocol
@@ -777,17 +860,30 @@ func (h *Hub) serve(conn net.Conn, cinfo *ConnInfo) error {
 }
 
 // Serve automatically detects the protocol and start the hub-client handshake.
+//
+// Connections over the accept rate limit are closed before the protocol is detected,
+// and are only counted as blocked.
 func (h *Hub) Serve(conn net.Conn) error {
+	if reason := h.throttleAccept(conn.RemoteAddr(), time.Now()); reason != "" {
+		cntConnBlocked.WithLabelValues(reason).Add(1)
+		_ = conn.Close()
+		return nil
+	}
+	cntConnAccepted.Add(1)
+	cntConnOpen.Add(1)
+	defer cntConnOpen.Add(-1)
 	if !h.callOnConnected(conn) {
-		cntConnBlocked.Add(1)
+		cntConnBlocked.WithLabelValues(blockReasonPlugin).Add(1)
 		_ = conn.Close()
 		return nil
 	}
 	defer h.callOnDisconnected(conn)
-	return h.serve(conn, &ConnInfo{
+	cinfo := &ConnInfo{
 		Local:  conn.LocalAddr(),
 		Remote: conn.RemoteAddr(),
-	})
+	}
+	defer h.trackConn(cinfo)()
+	return h.serve(conn, cinfo)
 }
 
 func (h *Hub) Peers() []Peer {
@@ -853,7 +949,20 @@ func (h *Hub) nameAvailable(name string, fnc func()) bool {
 	return !sameName1 && !sameName2
 }
 
-// reserveName bind a provided name or return false otherwise.
+// reserveName checks the name against the nick policy and temporarily binds it.
+// It returns errNickTaken if the name is already in use. See bindName for the description of callbacks.
+func (h *Hub) reserveName(name string, bind func() bool, unbind func()) (func(), error) {
+	if err := h.checkNickPolicy(name); err != nil {
+		return nil, err
+	}
+	release, ok := h.bindName(name, bind, unbind)
+	if !ok {
+		return nil, errNickTaken
+	}
+	return release, nil
+}
+
+// bindName bind a provided name or return false otherwise.
 //
 // A pair of callbacks can be passed to be executed under peers write lock.
 //
@@ -862,7 +971,7 @@ func (h *Hub) nameAvailable(name string, fnc func()) bool {
 // and the function will return false.
 //
 // The second callback is executed after the name is unbound.
-func (h *Hub) reserveName(name string, bind func() bool, unbind func()) (func(), bool) {
+func (h *Hub) bindName(name string, bind func() bool, unbind func()) (func(), bool) {
 	key := toNameKey(name)
 	h.peers.Lock()
 	_, sameName1 := h.peers.reserved[key]
@@ -934,6 +1043,7 @@ func (h *Hub) broadcastTopic(topic string) {
 
 func (h *Hub) broadcastUserJoin(peer Peer, notify []Peer) {
 	h.Logf("%s: connected: %s %s", peer.RemoteAddr(), peer.SID(), peer.Name())
+	h.userLogin(peer)
 	if notify == nil {
 		notify = h.Peers()
 	}
@@ -955,6 +1065,7 @@ func (h *Hub) broadcastUserUpdate(peer Peer, notify []Peer) {
 
 func (h *Hub) broadcastUserLeave(peer Peer, notify []Peer) {
 	h.Logf("%s: disconnected: %s %s", peer.RemoteAddr(), peer.SID(), peer.Name())
+	h.userLeave(peer)
 	if notify == nil {
 		notify = h.Peers()
 	}
@@ -965,6 +1076,11 @@ func (h *Hub) broadcastUserLeave(peer Peer, notify []Peer) {
 }
 
 func (h *Hub) privateChat(from, to Peer, m Message) {
+	if from.User().MustChangePass() {
+		h.cmdOutput(from, errPassChangeRequired.Error())
+		cntChatMsgPMDropped.Add(1)
+		return
+	}
 	if !h.callOnPM(from, to, m) {
 		cntChatMsgPMDropped.Add(1)
 		return
@@ -1093,6 +1209,14 @@ func (h *Hub) SendGlobalChat(text string) {
 	}
 }
 
+// SendOpChat sends a message from the hub bot to the operator chat.
+func (h *Hub) SendOpChat(text string) {
+	if h.opChat == nil || h.hubUser == nil {
+		return
+	}
+	h.opChat.SendChat(h.hubUser.p, Message{Text: text})
+}
+
 type UserKind int
 
 const (
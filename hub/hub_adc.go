@@ -7,6 +7,7 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,6 +15,7 @@ import (
 
 	adcp "github.com/direct-connect/go-dc/adc"
 	"github.com/direct-connect/go-dc/adc/types"
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
 	"github.com/direct-connect/go-dc/tiger"
 	dctypes "github.com/direct-connect/go-dc/types"
 	"github.com/direct-connect/go-dcpp/adc"
@@ -44,6 +46,10 @@ func (h *Hub) ServeADC(conn net.Conn, cinfo *ConnInfo) error {
 	cntConnADC.Add(1)
 	cntConnADCOpen.Add(1)
 	defer cntConnADCOpen.Add(-1)
+
+	if cinfo == nil {
+		cinfo = &ConnInfo{Local: conn.LocalAddr(), Remote: conn.RemoteAddr()}
+	}
 	if cinfo.TLSVers != 0 {
 		cntConnADCS.Add(1)
 	}
@@ -87,26 +93,10 @@ func (h *Hub) adcHandshake(c *adc.Conn, cinfo *ConnInfo) (*adcPeer, error) {
 	if err != nil {
 		return nil, err
 	}
-	// if configured, redirect insecure connections to ADCS
-	// TODO(dennwc): this crashes some clients :(
-	if !cinfo.Secure && h.getRedirectADCToTLS() {
-		err = c.WriteInfoMsg(&adcp.Disconnect{
-			ID: peer.SID(),
-			// TODO: use the hostname somehow?
-			// TODO: use the keyprint
-			Redirect: "adcs://" + cinfo.Local.String(),
-		})
-		if err != nil {
-			return nil, err
-		}
-		err = c.Flush()
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
-	}
 	// connection is not yet valid and we haven't added the client to the hub yet
-	if err = h.adcStageIdentity(peer); err != nil {
+	if err = h.adcStageIdentity(peer); err == errRedirected {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
 	// TODO: identify pingers
@@ -214,11 +204,17 @@ func (h *Hub) adcStageProtocol(c *adc.Conn, cinfo *ConnInfo) (*adcPeer, error) {
 	if err := hp.DecodeMessageTo(&sup); err != nil {
 		return nil, err
 	}
-	for ext, on := range sup.Features {
+	var ext []string
+	for f, on := range sup.Features {
 		if !on {
 			continue
 		}
-		cntADCExtensions.WithLabelValues(ext.String()).Add(1)
+		cntADCExtensions.WithLabelValues(f.String()).Add(1)
+		ext = append(ext, f.String())
+	}
+	sort.Strings(ext)
+	if !h.callOnNMDCHandshake(cinfo, "", &nmdcp.Supports{Ext: ext}) {
+		return nil, errRejected
 	}
 	hubFeatures := adcp.ModFeatures{
 		// should always be set for ADC
@@ -305,6 +301,19 @@ func (h *Hub) adcStageIdentity(peer *adcPeer) error {
 		_ = peer.sendErrorNow(adcp.Fatal, 21, err)
 		return err
 	}
+	if !h.callOnNMDCHandshake(peer.ConnInfo(), u.Name, &nmdcp.ValidateNick{Name: nmdcp.Name(u.Name)}) {
+		_ = peer.sendErrorNow(adcp.Fatal, 20, errRejected)
+		return errRejected
+	}
+
+	// if configured, redirect insecure connections to ADCS, if the client supports it
+	// TODO(dennwc): this crashes some clients :(
+	if addr := h.adcRedirectAddr(peer.ConnInfo(), adcClientCaps(&u)); addr != "" {
+		if err = h.adcRedirect(peer, addr); err != nil {
+			return err
+		}
+		return errRedirected
+	}
 
 	// do not lock for writes first
 	sameCID := false
@@ -327,7 +336,7 @@ func (h *Hub) adcStageIdentity(peer *adcPeer) error {
 
 	// ok, now lock for writes and try to bind nick and CID
 	// still, no one will see the user yet
-	unbind, ok := h.reserveName(u.Name, func() bool {
+	unbind, err := h.reserveName(u.Name, func() bool {
 		_, sameCID1 := h.peers.loggingCID[u.Id]
 		_, sameCID2 := h.peers.byCID[u.Id]
 		if sameCID1 || sameCID2 {
@@ -339,15 +348,16 @@ func (h *Hub) adcStageIdentity(peer *adcPeer) error {
 	}, func() {
 		delete(h.peers.loggingCID, u.Id)
 	})
-	if !ok {
-		if sameCID {
-			err = errors.New("CID taken")
-			_ = peer.sendErrorNow(adcp.Fatal, 24, err)
-			return err
-		}
-		err = errNickTaken
+	if sameCID {
+		err = errors.New("CID taken")
+		_ = peer.sendErrorNow(adcp.Fatal, 24, err)
+		return err
+	} else if err == errNickTaken {
 		_ = peer.sendErrorNow(adcp.Fatal, 22, err)
 		return err
+	} else if err != nil {
+		_ = peer.sendErrorNow(adcp.Fatal, 21, err)
+		return err
 	}
 
 	if u.Ip4 == "0.0.0.0" {
@@ -374,6 +384,11 @@ func (h *Hub) adcStageIdentity(peer *adcPeer) error {
 		unbind()
 		return err
 	}
+	if err := h.checkConnLimits(peer); err != nil {
+		unbind()
+		_ = peer.sendErrorNow(adcp.Fatal, 20, err)
+		return err
+	}
 	deadline = time.Now().Add(time.Second * 5)
 
 	// send hub info
@@ -432,17 +447,39 @@ func (h *Hub) adcStageIdentity(peer *adcPeer) error {
 }
 
 func (h *Hub) adcStageVerify(peer *adcPeer) error {
-	user, rec, err := h.getUser(peer.Name())
+	user, rec, err := h.getLoginUser(peer.Name())
 	if err != nil {
 		return err
-	} else if user == nil || rec == nil {
-		if h.IsPrivate() {
-			return errServerIsPrivate
-		}
+	} else if user == nil && h.IsPrivate() {
+		return errServerIsPrivate
+	} else if rec == nil {
 		return nil
 	}
-	if c := peer.ConnInfo(); c != nil && !c.Secure {
-		return errConnInsecure
+	c := peer.ConnInfo()
+	if user != nil && h.tlsRequired(c, user.Profile()) {
+		if !h.canRedirectTLS(peer.clientCaps()) {
+			return errConnInsecure
+		}
+		if err = h.adcRedirect(peer, redirectAddr("adcs", c)); err != nil {
+			return err
+		}
+		return errRedirected
+	}
+	if err = checkUserLock(rec, time.Now()); err != nil {
+		_ = peer.sendErrorNow(adcp.Fatal, 23, err)
+		return err
+	}
+	if user != nil {
+		kpOnly, err := checkKeyprint(rec, c)
+		if err != nil {
+			_ = peer.sendErrorNow(adcp.Fatal, 23, err)
+			return err
+		} else if kpOnly {
+			// client certificate is enough, no need for a password
+			user.setPassChange(rec.PassChange)
+			peer.setUser(user)
+			return nil
+		}
 	}
 	// give the user a minute to enter a password
 	deadline := time.Now().Add(time.Minute)
@@ -472,27 +509,46 @@ func (h *Hub) adcStageVerify(peer *adcPeer) error {
 	if err := hp.DecodeMessageTo(&pass); err != nil {
 		return err
 	}
+	if !h.callOnNMDCHandshake(c, peer.Name(), &nmdcp.MyPass{String: nmdcp.String(pass.Hash.Base32())}) {
+		_ = peer.sendErrorNow(adcp.Fatal, 20, errRejected)
+		return errRejected
+	}
 	ok, err = h.adcCheckUserPass(rec, salt[:], pass.Hash)
 	if err != nil {
+		_ = peer.sendErrorNow(adcp.Fatal, 23, err)
 		return err
 	} else if !ok {
 		err = errors.New("wrong password")
 		_ = peer.sendErrorNow(adcp.Fatal, 23, err)
 		return err
 	}
-	peer.setUser(user)
+	if user != nil {
+		user.setPassChange(rec.PassChange)
+		peer.setUser(user)
+	}
 	return nil
 }
 
+// adcRedirect redirects the peer that is not yet accepted to the hub.
+func (h *Hub) adcRedirect(peer *adcPeer, addr string) error {
+	err := peer.c.WriteInfoMsg(&adcp.Disconnect{
+		ID:       peer.SID(),
+		Redirect: addr,
+	})
+	if err != nil {
+		return err
+	}
+	return peer.c.Flush()
+}
+
 func (h *Hub) adcCheckUserPass(rec *UserRecord, salt []byte, hash tiger.Hash) (bool, error) {
-	if h.db == nil {
-		return false, nil
-	}
-	check := make([]byte, len(rec.Pass)+len(salt))
-	i := copy(check, rec.Pass)
-	copy(check[i:], salt)
-	exp := tiger.HashBytes(check)
-	return exp == hash, nil
+	return h.checkUserPass(rec, func(pass string) bool {
+		check := make([]byte, len(pass)+len(salt))
+		i := copy(check, pass)
+		copy(check[i:], salt)
+		exp := tiger.HashBytes(check)
+		return exp == hash
+	})
 }
 
 func (h *Hub) adcHub(p *adcp.HubPacket, from Peer) {
@@ -548,6 +604,9 @@ func (h *Hub) adcBroadcast(p *adcp.BroadcastPacket, from *adcPeer) {
 		h.Logf("cannot parse ADC message: %v", err)
 		return
 	}
+	if m := h.adcToNMDC(from, nil, p.Msg); m != nil && !h.callOnNMDCMessage(from, m) {
+		return
+	}
 	// TODO: read INF, update peer info
 	// TODO: update nick, make sure there is no duplicates
 	// TODO: disallow STA and some others
@@ -590,6 +649,12 @@ func (h *Hub) adcDirect(p *adcp.DirectPacket, from *adcPeer) {
 		}
 		switch msg := p.Msg.(type) {
 		case adcp.ChatMessage:
+			if h.hasNMDCMessageHooks() {
+				m := &nmdcp.PrivateMessage{To: r.Name(), From: from.Name(), Name: from.Name(), Text: msg.Text}
+				if !h.callOnNMDCMessage(from, m) {
+					return
+				}
+			}
 			r.SendChat(from, Message{
 				Text: msg.Text,
 				Me:   msg.Me,
@@ -602,6 +667,9 @@ func (h *Hub) adcDirect(p *adcp.DirectPacket, from *adcPeer) {
 		h.Logf("cannot parse ADC message: %v", err)
 		return
 	}
+	if m := h.adcToNMDC(from, peer, p.Msg); m != nil && !h.callOnNMDCMessage(from, m) {
+		return
+	}
 	switch msg := p.Msg.(type) {
 	case adcp.ChatMessage:
 		h.privateChat(from, peer, Message{
@@ -609,16 +677,12 @@ func (h *Hub) adcDirect(p *adcp.DirectPacket, from *adcPeer) {
 			Text: string(msg.Text),
 		})
 	case adcp.ConnectRequest:
-		info := from.Info()
-		ip := info.Ip4
-		if info.Ip6 != "" {
-			ip = info.Ip6
-		}
+		ip := from.adcIP()
 		if ip == "" {
 			return
 		}
 		secure := strings.HasPrefix(msg.Proto, "ADCS")
-		h.connectReq(from, peer, ip+":"+strconv.Itoa(msg.Port), msg.Token, secure)
+		h.connectReq(from, peer, net.JoinHostPort(ip, strconv.Itoa(msg.Port)), msg.Token, secure)
 	case adcp.RevConnectRequest:
 		secure := strings.HasPrefix(msg.Proto, "ADCS")
 		h.revConnectReq(from, peer, msg.Token, secure)
@@ -636,10 +700,15 @@ func (h *Hub) adcDirect(p *adcp.DirectPacket, from *adcPeer) {
 
 func (h *Hub) adcHandleSearch(peer *adcPeer, req *adcp.SearchRequest, peers []Peer) {
 	s := peer.newSearch(req.Token)
+	peer.setOwnSearch(s)
+	h.Search(adcSearchRequest(req), s, peers)
+}
+
+// adcSearchRequest converts an ADC search to a search request.
+func adcSearchRequest(req *adcp.SearchRequest) SearchRequest {
 	if req.TTH != nil {
 		// ignore other parameters
-		h.Search(TTHSearch(*req.TTH), s, peers)
-		return
+		return TTHSearch(*req.TTH)
 	}
 	name := NameSearch{
 		And: req.And,
@@ -677,11 +746,153 @@ func (h *Hub) adcHandleSearch(peer *adcPeer, req *adcp.SearchRequest, peers []Pe
 		}
 		sr = freq
 	}
-	h.Search(sr, s, peers)
+	return sr
+}
+
+// isActive checks if the peer can receive search results via UDP.
+func (p *adcPeer) isActive() bool {
+	p.info.RLock()
+	defer p.info.RUnlock()
+	return p.info.user.Features.Has(adcp.FeaUDP4) || p.info.user.Features.Has(adcp.FeaUDP6)
+}
+
+// adcIP returns the IP address announced by the peer, preferring IPv6.
+func (p *adcPeer) adcIP() string {
+	info := p.Info()
+	if info.Ip6 != "" {
+		return info.Ip6
+	}
+	return info.Ip4
+}
+
+// adcToNMDC translates a message from an ADC peer to the NMDC equivalent, so plugins can handle both protocols
+// the same way. The target is nil for broadcasts. It returns nil if there is no equivalent or no plugin is
+// interested in NMDC messages.
+func (h *Hub) adcToNMDC(from *adcPeer, to Peer, msg adcp.Message) nmdcp.Message {
+	if !h.hasNMDCMessageHooks() {
+		return nil
+	}
+	switch msg := msg.(type) {
+	case adcp.ChatMessage:
+		if to == nil {
+			return ToNMDCChatMsg(from, Message{Name: from.Name(), Text: msg.Text, Me: msg.Me})
+		}
+		return &nmdcp.PrivateMessage{To: to.Name(), From: from.Name(), Name: from.Name(), Text: msg.Text}
+	case adcp.SearchRequest:
+		req := adcSearchRequest(&msg)
+		if tth, ok := req.(TTHSearch); ok {
+			return &nmdcp.Search{
+				User:     from.Name(),
+				DataType: nmdcp.DataTypeTTH, TTH: (*TTH)(&tth),
+			}
+		}
+		if m := nmdcSearchCmd(from, req); m != nil {
+			return m
+		}
+		return nil
+	case adcp.SearchResult:
+		if to == nil {
+			return nil
+		}
+		sr := &nmdcp.SR{
+			From:       from.Name(),
+			To:         to.Name(),
+			Path:       strings.Split(strings.TrimPrefix(msg.Path, "/"), "/"),
+			FreeSlots:  msg.Slots,
+			TotalSlots: from.UserInfo().Slots,
+			HubName:    h.Stats().Name,
+		}
+		if msg.TTH != nil {
+			sr.Size = uint64(msg.Size)
+			sr.TTH = msg.TTH
+			sr.HubName = ""
+		} else {
+			sr.IsDir = true
+		}
+		return sr
+	case adcp.ConnectRequest:
+		ip := from.adcIP()
+		if to == nil || ip == "" {
+			return nil
+		}
+		return &nmdcp.ConnectToMe{
+			Targ:    to.Name(),
+			Address: net.JoinHostPort(ip, strconv.Itoa(msg.Port)),
+			Secure:  strings.HasPrefix(msg.Proto, "ADCS"),
+		}
+	case adcp.RevConnectRequest:
+		if to == nil {
+			return nil
+		}
+		return &nmdcp.RevConnectToMe{From: from.Name(), To: to.Name()}
+	case *adcp.UserInfoMod:
+		// the update is not yet applied to the peer
+		u := from.UserInfo()
+		applyUserInfoMod(&u, *msg)
+		info := u.toNMDC()
+		return &info
+	}
+	return nil
+}
+
+// applyUserInfoMod applies ADC INF update fields to the user info.
+// Name changes are not allowed by the hub, thus the NI field is ignored.
+func applyUserInfoMod(u *UserInfo, mod adcp.UserInfoMod) {
+	atoi := func(s string) int {
+		v, _ := strconv.Atoi(s)
+		return v
+	}
+	for _, f := range mod {
+		switch f.Tag {
+		case [2]byte{'D', 'E'}:
+			u.Desc = f.Value
+		case [2]byte{'E', 'M'}:
+			u.Email = f.Value
+		case [2]byte{'S', 'S'}:
+			u.Share, _ = strconv.ParseUint(f.Value, 10, 64)
+		case [2]byte{'S', 'L'}:
+			u.Slots = atoi(f.Value)
+		case [2]byte{'H', 'N'}:
+			u.HubsNormal = atoi(f.Value)
+		case [2]byte{'H', 'R'}:
+			u.HubsRegistered = atoi(f.Value)
+		case [2]byte{'H', 'O'}:
+			u.HubsOperator = atoi(f.Value)
+		case [2]byte{'A', 'P'}:
+			u.App.Name = f.Value
+		case [2]byte{'V', 'E'}:
+			u.App.Version = f.Value
+		case [2]byte{'S', 'U'}:
+			u.IPv4, u.IPv6, u.TLS = false, false, false
+			for _, fea := range strings.Split(f.Value, ",") {
+				switch fea {
+				case "TCP4":
+					u.IPv4 = true
+				case "TCP6":
+					u.IPv6 = true
+				case "ADC0":
+					u.TLS = true
+				}
+			}
+		}
+	}
 }
 
 func (h *Hub) adcHandleResult(peer *adcPeer, to Peer, res *adcp.SearchResult) {
+	path := strings.TrimPrefix(res.Path, "/")
+	var sr SearchResult
+	if res.TTH != nil {
+		sr = File{Peer: peer, Path: path, Size: uint64(res.Size), TTH: res.TTH}
+	} else {
+		sr = Dir{Peer: peer, Path: path}
+	}
 	if to, ok := to.(*adcPeer); ok {
+		// results are sent directly, but we still want to apply limits and cache them
+		if s := to.ownSearch(res.Token); s != nil {
+			if ok, err := s.acceptResult(sr); err != nil || !ok {
+				return
+			}
+		}
 		_ = to.SendADCDirect(peer.SID(), *res)
 		return
 	}
@@ -690,13 +901,11 @@ func (h *Hub) adcHandleResult(peer *adcPeer, to Peer, res *adcp.SearchResult) {
 	peer.search.RUnlock()
 	if s == nil {
 		return
-	}
-	res.Path = strings.TrimPrefix(res.Path, "/")
-	var sr SearchResult
-	if res.TTH != nil {
-		sr = File{Peer: peer, Path: res.Path, Size: uint64(res.Size), TTH: res.TTH}
-	} else {
-		sr = Dir{Peer: peer, Path: res.Path}
+	} else if s.ctx.Err() != nil {
+		peer.search.Lock()
+		delete(peer.search.tokens, res.Token)
+		peer.search.Unlock()
+		return
 	}
 	if err := s.s.SendResult(sr); err != nil {
 		_ = s.s.Close()
@@ -745,6 +954,7 @@ type adcPeer struct {
 	search struct {
 		sync.RWMutex
 		tokens map[string]*adcSearchToken
+		own    map[string]*adcSearch // searches started by this peer
 	}
 }
 
@@ -757,6 +967,7 @@ func (p *adcPeer) Searchable() bool {
 
 type adcSearchToken struct {
 	last safe.Time
+	ctx  context.Context
 	s    Search
 }
 
@@ -1204,13 +1415,14 @@ func (p *adcPeer) RevConnectTo(peer Peer, token string, secure bool) error {
 	})
 }
 
-func (p *adcPeer) newSearch(token string) Search {
+func (p *adcPeer) newSearch(token string) *adcSearch {
 	return &adcSearch{p: p, token: token}
 }
 
 type adcSearch struct {
 	p     *adcPeer
 	token string
+	searchRun
 }
 
 func (s *adcSearch) Peer() Peer {
@@ -1221,6 +1433,11 @@ func (s *adcSearch) SendResult(r SearchResult) error {
 	if !s.p.Online() {
 		return errConnectionClosed
 	}
+	if ok, err := s.acceptResult(r); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
 	sr := adcp.SearchResult{
 		Token: s.token,
 		Slots: 1, // TODO
@@ -1248,19 +1465,46 @@ func (s *adcSearch) Close() error {
 	return nil // TODO: block new results
 }
 
-// gcTokens removes unused search tokens.
+// maxOwnSearches is the max number of recent searches tracked for each ADC peer.
+const maxOwnSearches = 64
+
+func (p *adcPeer) setOwnSearch(s *adcSearch) {
+	p.search.Lock()
+	defer p.search.Unlock()
+	if p.search.own == nil {
+		p.search.own = make(map[string]*adcSearch)
+	}
+	for token, s2 := range p.search.own {
+		if s2.Context().Err() != nil {
+			delete(p.search.own, token)
+		}
+	}
+	if len(p.search.own) >= maxOwnSearches {
+		p.search.own = make(map[string]*adcSearch)
+	}
+	p.search.own[s.token] = s
+}
+
+func (p *adcPeer) ownSearch(token string) *adcSearch {
+	p.search.RLock()
+	s := p.search.own[token]
+	p.search.RUnlock()
+	return s
+}
+
+// gcTokens removes unused search tokens and tokens of searches that are no longer active.
 // Should be called under the search write lock.
 func (p *adcPeer) gcTokens() {
 	now := time.Now()
 	for token, s := range p.search.tokens {
-		if now.Sub(s.last.Get()) > searchTimeout {
+		if s.ctx.Err() != nil || now.Sub(s.last.Get()) > searchTimeout {
 			delete(p.search.tokens, token)
 			_ = s.s.Close()
 		}
 	}
 }
 
-func (p *adcPeer) searchToken(out Search) string {
+func (p *adcPeer) searchToken(ctx context.Context, out Search) string {
 	token := strconv.FormatUint(rand.Uint64(), 16)
 	p.search.Lock()
 	defer p.search.Unlock()
@@ -1269,7 +1513,7 @@ func (p *adcPeer) searchToken(out Search) string {
 	} else {
 		p.gcTokens()
 	}
-	s := &adcSearchToken{s: out}
+	s := &adcSearchToken{ctx: ctx, s: out}
 	s.last.SetNow()
 	p.search.tokens[token] = s
 	return token
@@ -1283,7 +1527,7 @@ func (p *adcPeer) Search(ctx context.Context, req SearchRequest, out Search) err
 	if as, ok := out.(*adcSearch); ok {
 		token = as.token
 	} else {
-		token = p.searchToken(out)
+		token = p.searchToken(ctx, out)
 	}
 	msg := adcp.SearchRequest{
 		Token: token,
@@ -0,0 +1,58 @@
+package hub
+
+import (
+	"testing"
+
+	adcp "github.com/direct-connect/go-dc/adc"
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestADCToNMDC(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+
+	from := newTestADCPeer("10.0.0.1", 1, 0)
+	from.setName("from")
+	from.info.user.Ip6 = "2001:db8::1"
+	to := newTestNMDCPeer("10.0.0.2", 0)
+	to.info.user.Name = "to"
+
+	msg := adcp.ConnectRequest{Proto: "ADC/1.0", Port: 1412, Token: "1"}
+	require.Nil(t, h.adcToNMDC(from, to, msg), "no hooks")
+
+	unbind := h.OnNMDCMessage(func(p Peer, m nmdcp.Message) bool { return true })
+	defer unbind()
+
+	require.Equal(t, &nmdcp.ConnectToMe{
+		Targ:    "to",
+		Address: "[2001:db8::1]:1412",
+	}, h.adcToNMDC(from, to, msg))
+}
+
+func TestADCToNMDCUserInfo(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	unbind := h.OnNMDCMessage(func(p Peer, m nmdcp.Message) bool { return true })
+	defer unbind()
+
+	from := newTestADCPeer("10.0.0.1", 1, 100)
+	from.setName("from")
+	from.info.user.Name = "from"
+	from.info.user.Desc = "old"
+
+	m := h.adcToNMDC(from, nil, &adcp.UserInfoMod{
+		{Tag: [2]byte{'S', 'S'}, Value: "200"},
+		{Tag: [2]byte{'D', 'E'}, Value: "new"},
+		{Tag: [2]byte{'S', 'U'}, Value: "TCP4,ADC0"},
+	})
+	info, ok := m.(*nmdcp.MyINFO)
+	require.True(t, ok)
+	require.Equal(t, "from", info.Name)
+	require.Equal(t, uint64(200), info.ShareSize)
+	require.Equal(t, "new", info.Desc)
+	require.True(t, info.Flag&nmdcp.FlagIPv4 != 0)
+	require.True(t, info.Flag&nmdcp.FlagTLS != 0)
+	// the peer itself is not modified
+	require.Equal(t, int64(100), from.Info().ShareSize)
+}
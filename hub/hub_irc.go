@@ -138,10 +138,11 @@ func (h *Hub) ircHandshake(conn net.Conn, cinfo *ConnInfo) (*ircPeer, error) {
 			continue
 		}
 
-		var ok bool
-		unbind, ok = h.reserveName(name, nil, nil)
-		if ok {
+		unbind, err = h.reserveName(name, nil, nil)
+		if err == nil {
 			break
+		} else if err != errNickTaken {
+			return nil, err
 		}
 		_ = c.WriteMessage(&irc.Message{
 			Prefix:  pref,
@@ -150,12 +151,12 @@ func (h *Hub) ircHandshake(conn net.Conn, cinfo *ConnInfo) (*ircPeer, error) {
 		})
 	}
 
-	usr, rec, err := h.getUser(name)
+	_, rec, err := h.getLoginUser(name)
 	if err != nil {
 		unbind()
 		return nil, err
 	}
-	if usr != nil && rec != nil {
+	if rec != nil {
 		if cinfo != nil && !cinfo.Secure {
 			unbind()
 			return nil, errConnInsecure
@@ -184,6 +185,10 @@ func (h *Hub) ircHandshake(conn net.Conn, cinfo *ConnInfo) (*ircPeer, error) {
 	h.newBasePeer(&peer.BasePeer, cinfo)
 	peer.setName(name)
 
+	if err = h.checkConnLimits(peer); err != nil {
+		unbind()
+		return nil, err
+	}
 	err = h.ircAccept(peer)
 	if err != nil {
 		unbind()
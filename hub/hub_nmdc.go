@@ -113,7 +113,7 @@ func (h *Hub) ServeNMDC(conn net.Conn, cinfo *ConnInfo) error {
 	return h.nmdcServePeer(peer)
 }
 
-func (h *Hub) nmdcLock(deadline time.Time, c *nmdc.Conn) (nmdcp.Extensions, string, error) {
+func (h *Hub) nmdcLock(deadline time.Time, c *nmdc.Conn, cinfo *ConnInfo) (nmdcp.Extensions, string, error) {
 	soft := h.getSoft()
 	lock := &nmdcp.Lock{
 		Lock: "_godcpp", // TODO: randomize
@@ -132,6 +132,9 @@ func (h *Hub) nmdcLock(deadline time.Time, c *nmdc.Conn) (nmdcp.Extensions, stri
 	for _, ext := range sup.Ext {
 		cntNMDCExtensions.WithLabelValues(ext).Add(1)
 	}
+	if !h.callOnNMDCHandshake(cinfo, "", &sup) {
+		return nil, "", errRejected
+	}
 	var key nmdcp.Key
 	err = c.ReadMsgTo(deadline, &key)
 	if err != nil {
@@ -139,6 +142,9 @@ func (h *Hub) nmdcLock(deadline time.Time, c *nmdc.Conn) (nmdcp.Extensions, stri
 	} else if key.Key != lock.Key().Key {
 		return nil, "", errors.New("wrong key")
 	}
+	if !h.callOnNMDCHandshake(cinfo, "", &key) {
+		return nil, "", errRejected
+	}
 	fea := make(nmdcp.Extensions, len(sup.Ext))
 	for _, f := range sup.Ext {
 		fea[f] = struct{}{}
@@ -160,6 +166,9 @@ func (h *Hub) nmdcLock(deadline time.Time, c *nmdc.Conn) (nmdcp.Extensions, stri
 	if err != nil {
 		return nil, "", err
 	}
+	if !h.callOnNMDCHandshake(cinfo, string(nick.Name), nick) {
+		return nil, "", errRejected
+	}
 	return nmdcFeatures.Intersect(fea), string(nick.Name), nil
 }
 
@@ -179,7 +188,7 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn, cinfo *ConnInfo) (*nmdcPeer, error) {
 	defer measure(durNMDCHandshake)()
 	deadline := time.Now().Add(time.Second * 5)
 
-	fea, nick, err := h.nmdcLock(deadline, c)
+	fea, nick, err := h.nmdcLock(deadline, c, cinfo)
 	if err != nil {
 		_ = c.WriteOneMsg(&nmdcp.ChatMessage{Text: err.Error()})
 		return nil, err
@@ -197,33 +206,6 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn, cinfo *ConnInfo) (*nmdcPeer, error) {
 		return nil, err
 	}
 
-	// if configured, redirect connections to ADC
-	if h.getRedirectNMDCToADC() {
-		proto := "adc://"
-		// account for currently set TLS redirects
-		if cinfo.Secure || h.getRedirectNMDCToTLS() || h.getRedirectADCToTLS() {
-			proto = "adcs://"
-		}
-		err = c.WriteOneMsg(&nmdcp.ForceMove{
-			Address: proto + cinfo.Local.String(),
-		})
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
-	}
-
-	// if configured, redirect insecure connections to NMDCS
-	if !cinfo.Secure && h.getRedirectNMDCToTLS() {
-		err = c.WriteOneMsg(&nmdcp.ForceMove{
-			Address: "nmdcs://" + cinfo.Local.String(),
-		})
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
-	}
-
 	peer := newNMDC(h, cinfo, c, fea, nick, addr.IP)
 
 	if peer.fea.Has(nmdcp.ExtBotINFO) { // its a pinger
@@ -284,14 +266,21 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn, cinfo *ConnInfo) (*nmdcPeer, error) {
 
 	// ok, now lock for writes and try to bind nick
 	// still, no one will see the user yet
-	unbind, ok := h.reserveName(name, nil, nil)
-	if !ok {
+	unbind, err := h.reserveName(name, nil, nil)
+	if err == errNickTaken {
 		_ = peer.c.WriteOneMsg(&nmdcp.ValidateDenide{nmdcp.Name(nick)})
-		return nil, errNickTaken
+		return nil, err
+	} else if err != nil {
+		_ = peer.c.WriteMsg(&nmdcp.ChatMessage{Text: err.Error()})
+		_ = peer.c.WriteOneMsg(&nmdcp.ValidateDenide{Name: nmdcp.Name(nick)})
+		return nil, err
 	}
 
 	err = h.nmdcAccept(peer)
-	if err != nil || !peer.Online() {
+	if err == errRedirected {
+		unbind()
+		return nil, nil
+	} else if err != nil || !peer.Online() {
 		unbind()
 
 		str := "connection is closed"
@@ -301,6 +290,11 @@ func (h *Hub) nmdcHandshake(c *nmdc.Conn, cinfo *ConnInfo) (*nmdcPeer, error) {
 		_ = peer.c.WriteOneMsg(&nmdcp.ChatMessage{Text: "handshake failed: " + str})
 		return nil, err
 	}
+	if err = h.checkConnLimits(peer); err != nil {
+		unbind()
+		_ = peer.c.WriteOneMsg(&nmdcp.ChatMessage{Text: "handshake failed: " + err.Error()})
+		return nil, err
+	}
 
 	var list []Peer
 	// finally accept the user on the hub
@@ -343,41 +337,47 @@ func (h *Hub) nmdcAccept(peer *nmdcPeer) error {
 		return err
 	}
 
-	user, rec, err := h.getUser(peer.Name())
+	user, rec, err := h.getLoginUser(peer.Name())
 	if err != nil {
 		return err
 	}
-	if user != nil && rec != nil {
-		if c := peer.ConnInfo(); c != nil && !c.Secure {
-			return errConnInsecure
-		}
-		// give the user a minute to enter a password
-		deadline = time.Now().Add(time.Minute)
-		_ = c.SetWriteDeadline(deadline)
-		err = c.WriteOneMsg(&nmdcp.GetPass{})
-		if err != nil {
-			return err
+	if user == nil && h.IsPrivate() {
+		return errServerIsPrivate
+	}
+	if rec != nil {
+		ci := peer.ConnInfo()
+		if user != nil && h.tlsRequired(ci, user.Profile()) {
+			// MyINFO is not yet available, so rely only on $Supports
+			if !h.canRedirectTLS(nmdcClientCaps(peer.fea, nil)) {
+				return errConnInsecure
+			}
+			err = c.WriteOneMsg(&nmdcp.ForceMove{
+				Address: redirectAddr("nmdcs", ci),
+			})
+			if err != nil {
+				return err
+			}
+			return errRedirected
 		}
-		var pass nmdcp.MyPass
-		err = c.ReadMsgTo(deadline, &pass)
-		if err != nil {
-			return fmt.Errorf("expected password got: %v", err)
+		kpOnly := false
+		if user != nil {
+			if kpOnly, err = checkKeyprint(rec, ci); err != nil {
+				return err
+			}
 		}
-
-		ok, err := h.nmdcCheckUserPass(rec, string(pass.String))
-		if err != nil {
-			return err
-		} else if !ok {
-			err = c.WriteOneMsg(&nmdcp.BadPass{})
-			if err != nil {
+		if kpOnly {
+			// client certificate is enough, no need for a password
+			if err = checkUserLock(rec, time.Now()); err != nil {
 				return err
 			}
-			return errors.New("wrong password")
+		} else if err = h.nmdcCheckPass(peer, rec); err != nil {
+			return err
+		}
+		if user != nil {
+			user.setPassChange(rec.PassChange)
+			peer.setUser(user)
 		}
-		peer.setUser(user)
 		deadline = time.Now().Add(time.Second * 5)
-	} else if h.IsPrivate() {
-		return errServerIsPrivate
 	}
 
 	_ = c.SetWriteDeadline(deadline)
@@ -428,8 +428,22 @@ func (h *Hub) nmdcAccept(peer *nmdcPeer) error {
 		return errors.New("nick mismatch")
 	}
 
+	peer.info.orig = peer.info.user
 	peer.setUserInfo(&peer.info.user)
 
+	// if configured, redirect connections to ADC or NMDCS, if the client supports it
+	if ci := peer.ConnInfo(); ci != nil && !peer.fea.Has(nmdcp.ExtBotINFO) {
+		if addr := h.nmdcRedirectAddr(ci, peer.clientCaps()); addr != "" {
+			err = c.WriteOneMsg(&nmdcp.ForceMove{
+				Address: addr,
+			})
+			if err != nil {
+				return err
+			}
+			return errRedirected
+		}
+	}
+
 	err = c.WriteMsg(&nmdcp.HubTopic{
 		Text: h.getTopic(),
 	})
@@ -540,11 +554,42 @@ func (h *Hub) nmdcAccept(peer *nmdcPeer) error {
 	return c.Flush()
 }
 
-func (h *Hub) nmdcCheckUserPass(rec *UserRecord, pass string) (bool, error) {
-	if h.db == nil {
-		return false, nil
+// nmdcCheckPass asks the peer for a password and checks it.
+func (h *Hub) nmdcCheckPass(peer *nmdcPeer, rec *UserRecord) error {
+	c := peer.c
+	// give the user a minute to enter a password
+	deadline := time.Now().Add(time.Minute)
+	_ = c.SetWriteDeadline(deadline)
+	err := c.WriteOneMsg(&nmdcp.GetPass{})
+	if err != nil {
+		return err
+	}
+	var pass nmdcp.MyPass
+	err = c.ReadMsgTo(deadline, &pass)
+	if err != nil {
+		return fmt.Errorf("expected password got: %v", err)
+	}
+	if !h.callOnNMDCHandshake(peer.ConnInfo(), peer.Name(), &pass) {
+		return errRejected
 	}
-	return rec.Pass == pass, nil
+
+	ok, err := h.nmdcCheckUserPass(rec, string(pass.String))
+	if err != nil {
+		return err
+	} else if !ok {
+		err = c.WriteOneMsg(&nmdcp.BadPass{})
+		if err != nil {
+			return err
+		}
+		return errors.New("wrong password")
+	}
+	return nil
+}
+
+func (h *Hub) nmdcCheckUserPass(rec *UserRecord, pass string) (bool, error) {
+	return h.checkUserPass(rec, func(exp string) bool {
+		return exp == pass
+	})
 }
 
 func (h *Hub) nmdcServePeer(peer *nmdcPeer) error {
@@ -571,6 +616,8 @@ func (h *Hub) nmdcServePeer(peer *nmdcPeer) error {
 		}
 		typ := msg.Type()
 		if !nmdcp.IsRegistered(typ) {
+			// still let plugins see unknown commands
+			h.callOnNMDCMessage(peer, msg)
 			countM(cntNMDCCommandsDrop, typ, 1)
 			continue
 		}
@@ -608,6 +655,11 @@ func (h *Hub) nmdcHandle(peer *nmdcPeer, msg nmdcp.Message) error {
 	typ := msg.Type()
 	defer measureM(durNMDCHandle, typ)()
 
+	if !h.callOnNMDCMessage(peer, msg) {
+		countM(cntNMDCCommandsDrop, typ, 1)
+		return nil
+	}
+
 	switch msg := msg.(type) {
 	case *nmdcp.ChatMessage:
 		if string(msg.Name) != peer.Name() {
@@ -817,6 +869,9 @@ func (h *Hub) nmdcHandleResult(peer *nmdcPeer, to Peer, msg *nmdcp.SR) {
 	if cur == nil || cur.out == nil {
 		// not searching for anything
 		return
+	} else if cur.ctx.Err() != nil {
+		// search is no longer active
+		return
 	}
 	atomic.StoreInt64(&cur.last, time.Now().Unix())
 	var res SearchResult
@@ -831,7 +886,11 @@ func (h *Hub) nmdcHandleResult(peer *nmdcPeer, to Peer, msg *nmdcp.SR) {
 	}
 	if err := cur.out.SendResult(res); err != nil {
 		_ = cur.out.Close()
-		// TODO: remove from the map?
+		peer.search.Lock()
+		if peer.search.peers[to] == cur {
+			delete(peer.search.peers, to)
+		}
+		peer.search.Unlock()
 	}
 }
 
@@ -858,22 +917,27 @@ func (h *Hub) nmdcSendUserCommand(peer *nmdcPeer) error {
 }
 
 func (h *Hub) sendNMDCTo(p Peer, m nmdcp.Message) error {
+	if np, ok := p.(*nmdcPeer); ok {
+		return np.SendNMDC(m)
+	}
 	switch m := m.(type) {
 	case *nmdcp.ChatMessage:
+		msg := Message{Time: time.Now(), Name: m.Name, Text: m.Text}
 		from := h.PeerByName(m.Name)
 		if from == nil {
-			return fmt.Errorf("cannot find the message author: '%s'", m.Name)
+			// author is not a user, for example a virtual bot of the script
+			return p.HubChatMsg(msg)
 		}
-		if np, ok := p.(*nmdcPeer); ok {
-			return np.SendNMDC(m)
-		}
-		msg := Message{Time: time.Now(), Name: m.Name, Text: m.Text}
 		_ = p.ChatMsg(nil, from, msg)
 		return nil
-	default:
-		if np, ok := p.(*nmdcPeer); ok {
-			return np.SendNMDC(m)
+	case *nmdcp.PrivateMessage:
+		msg := Message{Time: time.Now(), Name: m.Name, Text: m.Text}
+		from := h.PeerByName(m.From)
+		if from == nil {
+			return p.HubChatMsg(msg)
 		}
+		return p.PrivateMsg(from, msg)
+	default:
 		h.Logf("TODO: Hub.SendNMDC(%T, %T)", p, m)
 		return nil
 	}
@@ -932,6 +996,9 @@ type nmdcPeer struct {
 		user nmdcp.MyINFO
 		buf  *bytes.Buffer
 		raw  *nmdcp.RawMessage
+
+		orig  nmdcp.MyINFO // as sent by the user
+		fixes []infoFix
 	}
 	ext struct {
 		userip2 bool
@@ -952,6 +1019,7 @@ func (p *nmdcPeer) Searchable() bool {
 
 type nmdcSearchRun struct {
 	last int64 // sec
+	ctx  context.Context
 	req  SearchRequest
 	out  Search
 }
@@ -959,18 +1027,81 @@ type nmdcSearchRun struct {
 func (p *nmdcPeer) SetInfo(u *nmdcp.MyINFO) {
 	p.info.Lock()
 	defer p.info.Unlock()
-	p.setUserInfo(u)
+	p.info.orig = *u
+	if len(p.info.fixes) == 0 {
+		p.setUserInfo(u)
+		return
+	}
+	p.applyInfoFixes()
+}
+
+// infoFix is a persistent change of the user info made by the hub.
+type infoFix struct {
+	key string
+	fnc func(u *nmdcp.MyINFO)
+}
+
+// applyInfoFixes applies all the changes to the info sent by the user.
+func (p *nmdcPeer) applyInfoFixes() {
+	u := p.info.orig
+	if u.Extra != nil {
+		extra := make(map[string]string, len(u.Extra))
+		for k, v := range u.Extra {
+			extra[k] = v
+		}
+		u.Extra = extra
+	}
+	for _, f := range p.info.fixes {
+		f.fnc(&u)
+	}
+	p.setUserInfo(&u)
+}
+
+func (p *nmdcPeer) updateInfo(key string, fnc func(u *nmdcp.MyINFO)) {
+	if key == "" {
+		if fnc != nil {
+			u := p.info.user
+			fnc(&u)
+			p.setUserInfo(&u)
+		}
+		return
+	}
+	fixes := p.info.fixes[:0]
+	for _, f := range p.info.fixes {
+		if f.key != key {
+			fixes = append(fixes, f)
+		}
+	}
+	if fnc != nil {
+		fixes = append(fixes, infoFix{key: key, fnc: fnc})
+	}
+	p.info.fixes = fixes
+	p.applyInfoFixes()
+}
+
+// UpdateNMDCInfo changes the NMDC user info of the peer and broadcasts it to other users.
+//
+// If the key is empty, the change is applied once and will be overwritten by the next info sent by the user.
+// Otherwise, the change is re-applied each time the user sends a new info. A nil function removes
+// the change with a given key and restores the value sent by the user.
+func (h *Hub) UpdateNMDCInfo(p Peer, key string, fnc func(u *nmdcp.MyINFO)) error {
+	np, ok := p.(*nmdcPeer)
+	if !ok {
+		return errors.New("user info can only be changed for NMDC users")
+	}
+	np.info.Lock()
+	np.updateInfo(key, fnc)
+	np.info.Unlock()
+	h.broadcastUserUpdate(p, nil)
+	return nil
 }
 
 func (p *nmdcPeer) setUserInfo(u *nmdcp.MyINFO) {
 	if u != &p.info.user {
 		p.info.user = *u
 	}
-	if p.info.buf == nil {
-		p.info.buf = bytes.NewBuffer(nil)
-	} else {
-		p.info.buf.Reset()
-	}
+	// the raw info may still be queued for other peers, so the buffer cannot be reused
+	p.info.buf = bytes.NewBuffer(nil)
 	err := u.MarshalNMDC(p.c.TextEncoder(), p.info.buf)
 	if err != nil {
 		panic(err)
@@ -1561,6 +1692,7 @@ func (p *nmdcPeer) newSearch() Search {
 
 type nmdcSearch struct {
 	p *nmdcPeer
+	searchRun
 
 	rawSP     nmdcRaw
 	rawSearch nmdcRaw
@@ -1574,6 +1706,11 @@ func (s *nmdcSearch) SendResult(r SearchResult) error {
 	if !s.p.Online() {
 		return errConnectionClosed
 	}
+	if ok, err := s.acceptResult(r); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
 	h := s.p.hub
 	// TODO: additional filtering?
 	sr := &nmdcp.SR{
@@ -1607,7 +1744,7 @@ func (p *nmdcPeer) gcSearches() {
 	now := time.Now().Unix()
 	last := -1
 	for i, s := range p.search.sorted {
-		if now-atomic.LoadInt64(&s.last) > int64(searchTimeout/time.Second) {
+		if now-atomic.LoadInt64(&s.last) > int64(searchTimeout/time.Second) || s.ctx.Err() != nil {
 			last = i
 		} else {
 			break
@@ -1629,7 +1766,7 @@ func (p *nmdcPeer) dropSearches() {
 	p.search.Unlock()
 }
 
-func (p *nmdcPeer) setActiveSearch(out Search, req SearchRequest) {
+func (p *nmdcPeer) setActiveSearch(ctx context.Context, out Search, req SearchRequest) {
 	p2 := out.Peer()
 	p.search.Lock()
 	defer p.search.Unlock()
@@ -1642,7 +1779,7 @@ func (p *nmdcPeer) setActiveSearch(out Search, req SearchRequest) {
 	} else {
 		p.gcSearches()
 	}
-	s := &nmdcSearchRun{out: out, req: req}
+	s := &nmdcSearchRun{ctx: ctx, out: out, req: req}
 	atomic.StoreInt64(&s.last, time.Now().Unix())
 	p.search.peers[p2] = s
 	p.search.sorted = append(p.search.sorted, s)
@@ -1662,6 +1799,11 @@ func (p *nmdcPeer) searchCmdTTH(from Peer, req TTH) nmdcp.Message {
 }
 
 func (p *nmdcPeer) searchCmdOther(from Peer, req SearchRequest) *nmdcp.Search {
+	return nmdcSearchCmd(from, req)
+}
+
+// nmdcSearchCmd converts a search request to a passive NMDC search from a given peer.
+func nmdcSearchCmd(from Peer, req SearchRequest) *nmdcp.Search {
 	msg := &nmdcp.Search{
 		User:     from.Name(),
 		DataType: nmdcp.DataTypeAny,
@@ -1710,7 +1852,7 @@ func (p *nmdcPeer) Search(ctx context.Context, req SearchRequest, out Search) er
 	if !p.Online() {
 		return errConnectionClosed
 	}
-	p.setActiveSearch(out, req)
+	p.setActiveSearch(ctx, out, req)
 	if req, ok := req.(TTHSearch); ok {
 		if ns, ok := out.(*nmdcSearch); ok {
 			enc := ns.p.c.TextEncoder()
@@ -57,7 +57,10 @@ func (c addrOverride) RemoteAddr() net.Addr {
 }
 
 func TestHubEnterNMDC(t *testing.T) {
-	h, err := NewHub(Config{})
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	h, err := NewHub(Config{}, nil)
 	require.NoError(t, err)
 
 	var (
@@ -0,0 +1,573 @@
+package hubdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+// DumpVersion is the current version of the database dump format.
+const DumpVersion = 1
+
+// Dump is a backend-independent snapshot of the hub database.
+type Dump struct {
+	Version  int                `json:"version"`
+	Created  time.Time          `json:"created,omitempty"`
+	Users    []DumpUser         `json:"users,omitempty"`
+	Profiles map[string]hub.Map `json:"profiles,omitempty"`
+	Bans     []DumpBan          `json:"bans,omitempty"`
+	// Storage is a plugin storage, indexed by namespace and key.
+	Storage map[string]map[string]string `json:"storage,omitempty"`
+}
+
+// DumpUser is a serialized user record.
+type DumpUser struct {
+	Name         string `json:"name"`
+	Pass         string `json:"pass,omitempty"`
+	Profile      string `json:"profile,omitempty"`
+	Keyprint     string `json:"keyprint,omitempty"`
+	KeyprintPass bool   `json:"keyprint_pass,omitempty"`
+
+	Registered   *time.Time `json:"registered,omitempty"`
+	RegisteredBy string     `json:"registered_by,omitempty"`
+	LastLogin    *time.Time `json:"last_login,omitempty"`
+	LastSeen     *time.Time `json:"last_seen,omitempty"`
+	LastIP       string     `json:"last_ip,omitempty"`
+	LastClient   string     `json:"last_client,omitempty"`
+	Email        string     `json:"email,omitempty"`
+	Notes        string     `json:"notes,omitempty"`
+
+	Locked       bool       `json:"locked,omitempty"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+	FailedLogins int        `json:"failed_logins,omitempty"`
+	PassChange   bool       `json:"pass_change,omitempty"`
+	ResetToken   string     `json:"reset_token,omitempty"`
+	ResetExpires *time.Time `json:"reset_expires,omitempty"`
+}
+
+func dumpTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+func loadTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func sameTime(t1, t2 *time.Time) bool {
+	if t1 == nil || t2 == nil {
+		return t1 == t2
+	}
+	return t1.Equal(*t2)
+}
+
+func sameUser(u1, u2 *DumpUser) bool {
+	return u1.Name == u2.Name && u1.Pass == u2.Pass && u1.Profile == u2.Profile &&
+		u1.Keyprint == u2.Keyprint && u1.KeyprintPass == u2.KeyprintPass &&
+		sameTime(u1.Registered, u2.Registered) && u1.RegisteredBy == u2.RegisteredBy &&
+		sameTime(u1.LastLogin, u2.LastLogin) && sameTime(u1.LastSeen, u2.LastSeen) &&
+		u1.LastIP == u2.LastIP && u1.LastClient == u2.LastClient &&
+		u1.Email == u2.Email && u1.Notes == u2.Notes &&
+		u1.Locked == u2.Locked && sameTime(u1.LockedUntil, u2.LockedUntil) &&
+		u1.FailedLogins == u2.FailedLogins && u1.PassChange == u2.PassChange &&
+		u1.ResetToken == u2.ResetToken && sameTime(u1.ResetExpires, u2.ResetExpires)
+}
+
+func dumpUser(u *hub.UserRecord) DumpUser {
+	return DumpUser{
+		Name:         u.Name,
+		Pass:         u.Pass,
+		Profile:      u.Profile,
+		Keyprint:     u.Keyprint,
+		KeyprintPass: u.KeyprintPass,
+		Registered:   dumpTime(u.Registered),
+		RegisteredBy: u.RegisteredBy,
+		LastLogin:    dumpTime(u.LastLogin),
+		LastSeen:     dumpTime(u.LastSeen),
+		LastIP:       u.LastIP,
+		LastClient:   u.LastClient,
+		Email:        u.Email,
+		Notes:        u.Notes,
+		Locked:       u.Locked,
+		LockedUntil:  dumpTime(u.LockedUntil),
+		FailedLogins: u.FailedLogins,
+		PassChange:   u.PassChange,
+		ResetToken:   u.ResetToken,
+		ResetExpires: dumpTime(u.ResetExpires),
+	}
+}
+
+func (u *DumpUser) record() hub.UserRecord {
+	return hub.UserRecord{
+		Name:         u.Name,
+		Pass:         u.Pass,
+		Profile:      u.Profile,
+		Keyprint:     u.Keyprint,
+		KeyprintPass: u.KeyprintPass,
+		Registered:   loadTime(u.Registered),
+		RegisteredBy: u.RegisteredBy,
+		LastLogin:    loadTime(u.LastLogin),
+		LastSeen:     loadTime(u.LastSeen),
+		LastIP:       u.LastIP,
+		LastClient:   u.LastClient,
+		Email:        u.Email,
+		Notes:        u.Notes,
+		Locked:       u.Locked,
+		LockedUntil:  loadTime(u.LockedUntil),
+		FailedLogins: u.FailedLogins,
+		PassChange:   u.PassChange,
+		ResetToken:   u.ResetToken,
+		ResetExpires: loadTime(u.ResetExpires),
+	}
+}
+
+// DumpBan is a serialized ban. Only one of IP, Key or Raw is set.
+type DumpBan struct {
+	IP     string     `json:"ip,omitempty"`
+	Key    string     `json:"key,omitempty"`
+	Raw    string     `json:"raw,omitempty"` // base64
+	Hard   bool       `json:"hard,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+func dumpBan(b *hub.Ban) DumpBan {
+	var d DumpBan
+	if ip := b.Key.ToIP(); ip != nil {
+		d.IP = ip.String()
+	} else if utf8.ValidString(string(b.Key)) {
+		d.Key = string(b.Key)
+	} else {
+		d.Raw = base64.StdEncoding.EncodeToString([]byte(b.Key))
+	}
+	d.Hard = b.Hard
+	d.Until = dumpTime(b.Until)
+	d.Reason = b.Reason
+	return d
+}
+
+func (d *DumpBan) ban() (hub.Ban, error) {
+	b := hub.Ban{Hard: d.Hard, Reason: d.Reason}
+	switch {
+	case d.IP != "":
+		ip := net.ParseIP(d.IP)
+		if ip == nil {
+			return b, fmt.Errorf("invalid IP in ban: %q", d.IP)
+		}
+		b.Key = hub.MinIPKey(ip)
+	case d.Raw != "":
+		data, err := base64.StdEncoding.DecodeString(d.Raw)
+		if err != nil {
+			return b, fmt.Errorf("invalid raw ban key: %v", err)
+		}
+		b.Key = hub.BanKey(data)
+	case d.Key != "":
+		b.Key = hub.BanKey(d.Key)
+	default:
+		return b, fmt.Errorf("ban key is not set")
+	}
+	b.Until = loadTime(d.Until)
+	return b, nil
+}
+
+// Export reads all the records from the database.
+func Export(db hub.Database) (*Dump, error) {
+	d := &Dump{
+		Version:  DumpVersion,
+		Created:  time.Now().UTC(),
+		Profiles: make(map[string]hub.Map),
+	}
+	users, err := db.ListUsers()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list users: %v", err)
+	}
+	for i := range users {
+		d.Users = append(d.Users, dumpUser(&users[i]))
+	}
+	sort.Slice(d.Users, func(i, j int) bool {
+		return d.Users[i].Name < d.Users[j].Name
+	})
+	profiles, err := db.ListProfiles()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list profiles: %v", err)
+	}
+	for _, id := range profiles {
+		m, err := db.GetProfile(id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read profile %q: %v", id, err)
+		}
+		if m == nil {
+			m = make(hub.Map)
+		}
+		d.Profiles[id] = m
+	}
+	bans, err := db.ListBans()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list bans: %v", err)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Key < bans[j].Key
+	})
+	for i := range bans {
+		d.Bans = append(d.Bans, dumpBan(&bans[i]))
+	}
+	spaces, err := db.ListNamespaces()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list storage namespaces: %v", err)
+	}
+	for _, ns := range spaces {
+		list, err := db.ListValues(ns, "")
+		if err != nil {
+			return nil, fmt.Errorf("cannot read storage %q: %v", ns, err)
+		}
+		if len(list) == 0 {
+			continue
+		}
+		if d.Storage == nil {
+			d.Storage = make(map[string]map[string]string)
+		}
+		m := make(map[string]string, len(list))
+		for _, kv := range list {
+			m[kv.Key] = kv.Value
+		}
+		d.Storage[ns] = m
+	}
+	return d, nil
+}
+
+// WriteDump writes the database dump as JSON.
+func WriteDump(w io.Writer, d *Dump) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// ReadDump reads and validates the database dump.
+func ReadDump(r io.Reader) (*Dump, error) {
+	var d Dump
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return nil, err
+	}
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Validate checks that all the records in the dump can be written to the database.
+func (d *Dump) Validate() error {
+	if d.Version <= 0 || d.Version > DumpVersion {
+		return fmt.Errorf("unsupported dump version: %d", d.Version)
+	}
+	names := make(map[string]struct{}, len(d.Users))
+	for _, u := range d.Users {
+		if u.Name == "" {
+			return fmt.Errorf("user name should not be empty")
+		} else if _, ok := names[u.Name]; ok {
+			return fmt.Errorf("duplicate user: %q", u.Name)
+		}
+		names[u.Name] = struct{}{}
+	}
+	for _, b := range d.Bans {
+		if _, err := b.ban(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes describes differences between the database and the dump.
+type Changes struct {
+	Users    TableChanges
+	Profiles TableChanges
+	Bans     TableChanges
+	Storage  TableChanges
+}
+
+// Empty checks if there are no changes.
+func (c *Changes) Empty() bool {
+	return c.Users.Empty() && c.Profiles.Empty() && c.Bans.Empty() && c.Storage.Empty()
+}
+
+// TableChanges lists keys of records that will be added, updated or removed from the table.
+type TableChanges struct {
+	Added   []string
+	Updated []string
+	Removed []string
+}
+
+// Empty checks if there are no changes.
+func (c *TableChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Updated) == 0 && len(c.Removed) == 0
+}
+
+func (c *TableChanges) sort() {
+	sort.Strings(c.Added)
+	sort.Strings(c.Updated)
+	sort.Strings(c.Removed)
+}
+
+// banName returns a human-readable ban key.
+func banName(b *DumpBan) string {
+	switch {
+	case b.IP != "":
+		return b.IP
+	case b.Key != "":
+		return b.Key
+	}
+	return b.Raw
+}
+
+// storageName returns a human-readable name of the storage record.
+func storageName(ns, key string) string {
+	return ns + "/" + key
+}
+
+// sameProfile compares profiles by their serialized form, since this is how they are stored.
+func sameProfile(m1, m2 hub.Map) bool {
+	b1, err1 := json.Marshal(m1)
+	b2, err2 := json.Marshal(m2)
+	return err1 == nil && err2 == nil && bytes.Equal(b1, b2)
+}
+
+func sameBan(b1, b2 *DumpBan) bool {
+	if b1.Hard != b2.Hard || b1.Reason != b2.Reason {
+		return false
+	}
+	return sameTime(b1.Until, b2.Until)
+}
+
+// Diff compares the database with the dump. If replace is set, records that are not in the dump
+// will be reported as removed. Built-in profiles are never removed.
+func Diff(db hub.Database, d *Dump, replace bool) (*Changes, error) {
+	cur, err := Export(db)
+	if err != nil {
+		return nil, err
+	}
+	var c Changes
+
+	users := make(map[string]DumpUser, len(cur.Users))
+	for _, u := range cur.Users {
+		users[u.Name] = u
+	}
+	for _, u := range d.Users {
+		if old, ok := users[u.Name]; !ok {
+			c.Users.Added = append(c.Users.Added, u.Name)
+		} else if !sameUser(&old, &u) {
+			c.Users.Updated = append(c.Users.Updated, u.Name)
+		}
+		delete(users, u.Name)
+	}
+	if replace {
+		for name := range users {
+			c.Users.Removed = append(c.Users.Removed, name)
+		}
+	}
+
+	for id, m := range d.Profiles {
+		if old, ok := cur.Profiles[id]; !ok {
+			c.Profiles.Added = append(c.Profiles.Added, id)
+		} else if !sameProfile(old, m) {
+			c.Profiles.Updated = append(c.Profiles.Updated, id)
+		}
+	}
+	if replace {
+		builtin := hub.DefaultProfiles()
+		for id := range cur.Profiles {
+			if _, ok := builtin[id]; ok {
+				// built-in profiles cannot be removed
+				continue
+			}
+			if _, ok := d.Profiles[id]; !ok {
+				c.Profiles.Removed = append(c.Profiles.Removed, id)
+			}
+		}
+	}
+
+	bans := make(map[string]DumpBan, len(cur.Bans))
+	for _, b := range cur.Bans {
+		bans[banName(&b)] = b
+	}
+	for _, b := range d.Bans {
+		// normalize the key
+		nb, _ := b.ban()
+		b = dumpBan(&nb)
+		name := banName(&b)
+		if old, ok := bans[name]; !ok {
+			c.Bans.Added = append(c.Bans.Added, name)
+		} else if !sameBan(&old, &b) {
+			c.Bans.Updated = append(c.Bans.Updated, name)
+		}
+		delete(bans, name)
+	}
+	if replace {
+		for name := range bans {
+			c.Bans.Removed = append(c.Bans.Removed, name)
+		}
+	}
+
+	for ns, m := range d.Storage {
+		for k, v := range m {
+			if old, ok := cur.Storage[ns][k]; !ok {
+				c.Storage.Added = append(c.Storage.Added, storageName(ns, k))
+			} else if old != v {
+				c.Storage.Updated = append(c.Storage.Updated, storageName(ns, k))
+			}
+		}
+	}
+	if replace {
+		for ns, m := range cur.Storage {
+			for k := range m {
+				if _, ok := d.Storage[ns][k]; !ok {
+					c.Storage.Removed = append(c.Storage.Removed, storageName(ns, k))
+				}
+			}
+		}
+	}
+
+	c.Users.sort()
+	c.Profiles.sort()
+	c.Bans.sort()
+	c.Storage.sort()
+	return &c, nil
+}
+
+// Import writes the dump to the database. If replace is set, records that are not in the dump are removed.
+// Otherwise, the dump is merged into the database, overwriting records with the same keys.
+//
+// The dump is validated before anything is written, so an invalid dump leaves the database unchanged.
+// The database has no transactions spanning multiple tables, thus if a write fails, the records written
+// before it are kept and the error is returned. Records from the dump are written before any records
+// are removed, so a failed import never loses data, and running it again applies the remaining changes.
+//
+// It returns the list of applied changes.
+func Import(db hub.Database, d *Dump, replace bool) (*Changes, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	c, err := Diff(db, d, replace)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*DumpUser, len(d.Users))
+	for i := range d.Users {
+		byName[d.Users[i].Name] = &d.Users[i]
+	}
+	bans := make([]hub.Ban, 0, len(d.Bans))
+	for _, b := range d.Bans {
+		nb, err := b.ban()
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, nb)
+	}
+
+	for _, name := range c.Users.Added {
+		if err := db.CreateUser(byName[name].record()); err != nil {
+			return nil, fmt.Errorf("cannot create user %q: %v", name, err)
+		}
+	}
+	for _, name := range c.Users.Updated {
+		rec := byName[name].record()
+		err := db.UpdateUser(name, func(u *hub.UserRecord) (bool, error) {
+			if u == nil {
+				return false, fmt.Errorf("user %q was removed", name)
+			}
+			*u = rec
+			return true, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot update user %q: %v", name, err)
+		}
+	}
+	for _, list := range [][]string{c.Profiles.Added, c.Profiles.Updated} {
+		for _, id := range list {
+			if err := db.PutProfile(id, d.Profiles[id]); err != nil {
+				return nil, fmt.Errorf("cannot write profile %q: %v", id, err)
+			}
+		}
+	}
+	if len(c.Bans.Added) != 0 || len(c.Bans.Updated) != 0 {
+		if err := db.PutBans(bans); err != nil {
+			return nil, fmt.Errorf("cannot write bans: %v", err)
+		}
+	}
+	changed := make(map[string]struct{}, len(c.Storage.Added)+len(c.Storage.Updated))
+	for _, list := range [][]string{c.Storage.Added, c.Storage.Updated} {
+		for _, name := range list {
+			changed[name] = struct{}{}
+		}
+	}
+	for ns, m := range d.Storage {
+		for k, v := range m {
+			if _, ok := changed[storageName(ns, k)]; !ok {
+				continue
+			}
+			if err := db.PutValue(ns, k, v); err != nil {
+				return nil, fmt.Errorf("cannot write %q: %v", storageName(ns, k), err)
+			}
+		}
+	}
+
+	for _, name := range c.Users.Removed {
+		if err := db.DeleteUser(name); err != nil {
+			return nil, fmt.Errorf("cannot delete user %q: %v", name, err)
+		}
+	}
+	for _, id := range c.Profiles.Removed {
+		if err := db.DelProfile(id); err != nil {
+			return nil, fmt.Errorf("cannot delete profile %q: %v", id, err)
+		}
+	}
+	if len(c.Bans.Removed) != 0 {
+		keys := make([]hub.BanKey, 0, len(c.Bans.Removed))
+		cur, err := db.ListBans()
+		if err != nil {
+			return nil, err
+		}
+		removed := make(map[string]struct{}, len(c.Bans.Removed))
+		for _, name := range c.Bans.Removed {
+			removed[name] = struct{}{}
+		}
+		for i := range cur {
+			b := dumpBan(&cur[i])
+			if _, ok := removed[banName(&b)]; ok {
+				keys = append(keys, cur[i].Key)
+			}
+		}
+		if err := db.DelBans(keys); err != nil {
+			return nil, fmt.Errorf("cannot delete bans: %v", err)
+		}
+	}
+	if len(c.Storage.Removed) != 0 {
+		cur, err := Export(db)
+		if err != nil {
+			return nil, err
+		}
+		for ns, m := range cur.Storage {
+			for k := range m {
+				if _, ok := d.Storage[ns][k]; ok {
+					continue
+				}
+				if err := db.DelValue(ns, k); err != nil {
+					return nil, fmt.Errorf("cannot delete %q: %v", storageName(ns, k), err)
+				}
+			}
+		}
+	}
+	return c, nil
+}
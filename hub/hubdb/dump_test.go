@@ -0,0 +1,84 @@
+package hubdb
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+func TestDumpImport(t *testing.T) {
+	src := hub.NewDatabase()
+	require.NoError(t, src.CreateUser(hub.UserRecord{Name: "alice", Pass: "a", Profile: "op"}))
+	require.NoError(t, src.CreateUser(hub.UserRecord{Name: "bob", Pass: "b"}))
+	require.NoError(t, src.PutProfile("op", hub.Map{"parent": "user"}))
+	require.NoError(t, src.PutBans([]hub.Ban{
+		{Key: hub.MinIPKey(net.ParseIP("10.0.0.1")), Hard: true},
+		{Key: "spammer", Until: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), Reason: "spam"},
+	}))
+	require.NoError(t, src.PutValue("lua:seen", "alice", "1"))
+
+	d, err := Export(src)
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, WriteDump(buf, d))
+	d, err = ReadDump(buf)
+	require.NoError(t, err)
+
+	dst := hub.NewDatabase()
+	require.NoError(t, dst.CreateUser(hub.UserRecord{Name: "bob", Pass: "old"}))
+	require.NoError(t, dst.CreateUser(hub.UserRecord{Name: "carol", Pass: "c"}))
+	require.NoError(t, dst.PutValue("lua:seen", "carol", "2"))
+	require.NoError(t, dst.PutProfile("user", hub.Map{"parent": "guest"}))
+	require.NoError(t, dst.PutProfile("vip", hub.Map{"parent": "user"}))
+
+	c, err := Diff(dst, d, false)
+	require.NoError(t, err)
+	require.Equal(t, TableChanges{Added: []string{"alice"}, Updated: []string{"bob"}}, c.Users)
+	require.Equal(t, []string{"op"}, c.Profiles.Added)
+	require.Equal(t, []string{"10.0.0.1", "spammer"}, c.Bans.Added)
+	require.Equal(t, []string{"lua:seen/alice"}, c.Storage.Added)
+
+	_, err = Import(dst, d, true)
+	require.NoError(t, err)
+	c, err = Diff(dst, d, true)
+	require.NoError(t, err)
+	require.True(t, c.Empty(), "%+v", c)
+
+	u, err := dst.GetUser("carol")
+	require.NoError(t, err)
+	require.Nil(t, u)
+	u, err = dst.GetUser("bob")
+	require.NoError(t, err)
+	require.Equal(t, "b", u.Pass)
+	// built-in profiles are kept
+	ids, err := dst.ListProfiles()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"op", "user"}, ids)
+	list, err := dst.ListValues("lua:seen", "")
+	require.NoError(t, err)
+	require.Equal(t, []hub.KeyValue{{Key: "alice", Value: "1"}}, list)
+}
+
+func TestDumpImportInvalid(t *testing.T) {
+	db := hub.NewDatabase()
+	require.NoError(t, db.CreateUser(hub.UserRecord{Name: "carol", Pass: "c"}))
+
+	d := &Dump{
+		Version: DumpVersion,
+		Users:   []DumpUser{{Name: "alice", Pass: "a"}},
+		Bans:    []DumpBan{{IP: "not an ip"}},
+	}
+	_, err := Import(db, d, true)
+	require.Error(t, err)
+
+	// nothing is written if the dump is invalid
+	list, err := db.ListUsers()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, "carol", list[0].Name)
+}
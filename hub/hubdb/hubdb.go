@@ -12,6 +12,7 @@ import (
 
 	_ "github.com/hidal-go/hidalgo/kv/all"
 
+	"github.com/hidal-go/hidalgo/filter"
 	"github.com/hidal-go/hidalgo/kv"
 	"github.com/hidal-go/hidalgo/kv/kvdebug"
 	"github.com/hidal-go/hidalgo/tuple"
@@ -22,10 +23,16 @@ import (
 const (
 	debug = false
 
-	tableUsers       = "users"
-	tableUsersByName = "usersByName" // TODO: replace with secondary index once it's supported
-	tableProfiles    = "profiles"
-	tableBans        = "bans"
+	tableUsers          = "users"
+	tableUsersByName    = "usersByName"
+	tableUsersByProfile = "usersByProfile"
+	tableProfiles       = "profiles"
+	tableBans           = "bans"
+	tableBansByExpiry   = "bansByExpiry"
+	tableStorage        = "storage"
+
+	// usersFields is the number of data fields in the current version of the users table
+	usersFields = 19
 )
 
 func Open(typ, path string) (hub.Database, error) {
@@ -51,12 +58,91 @@ func Open(typ, path string) (hub.Database, error) {
 	return db, nil
 }
 
+var (
+	usersKey = []tuple.KeyField{
+		{Name: "id", Type: values.UIntType{}},
+	}
+	bansKey = []tuple.KeyField{
+		{Name: "key", Type: values.BytesType{}},
+	}
+
+	usersByName = &tableIndex{
+		name:   tableUsersByName,
+		unique: true,
+		fields: []tuple.KeyField{
+			{Name: "name", Type: values.StringType{}},
+		},
+		pkey: usersKey,
+		values: func(data tuple.Data) []tuple.Sortable {
+			return sortableFields(data, 0)
+		},
+	}
+	usersByProfile = &tableIndex{
+		name: tableUsersByProfile,
+		fields: []tuple.KeyField{
+			{Name: "profile", Type: values.StringType{}},
+		},
+		pkey: usersKey,
+		values: func(data tuple.Data) []tuple.Sortable {
+			if len(data) > 2 && data[2] == values.String("") {
+				// empty values cannot be used as a part of the key in some backends,
+				// so users without a profile are not indexed
+				return nil
+			}
+			return sortableFields(data, 2)
+		},
+	}
+	usersTable = &indexedTable{
+		name:    tableUsers,
+		indexes: []*tableIndex{usersByName, usersByProfile},
+	}
+
+	bansByExpiry = &tableIndex{
+		name: tableBansByExpiry,
+		fields: []tuple.KeyField{
+			{Name: "until", Type: values.TimeType{}},
+		},
+		pkey: bansKey,
+		values: func(data tuple.Data) []tuple.Sortable {
+			if len(data) > 1 {
+				if t, ok := data[1].(values.Time); ok && time.Time(t).IsZero() {
+					return nil // permanent ban
+				}
+			}
+			return sortableFields(data, 1)
+		},
+	}
+	bansTable = &indexedTable{
+		name:    tableBans,
+		indexes: []*tableIndex{bansByExpiry},
+	}
+
+	indexedTables = []*indexedTable{usersTable, bansTable}
+)
+
+// sortableFields returns data fields with given indexes as a key.
+// It returns nil if any of the fields is missing or cannot be used in a key.
+func sortableFields(data tuple.Data, inds ...int) []tuple.Sortable {
+	out := make([]tuple.Sortable, 0, len(inds))
+	for _, i := range inds {
+		if i >= len(data) {
+			return nil
+		}
+		v, ok := data[i].(tuple.Sortable)
+		if !ok {
+			return nil
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
 type tupleDatabase struct {
-	db          tuple.Store
-	users       tuple.TableInfo
-	usersByName tuple.TableInfo
-	profiles    tuple.TableInfo
-	bans        tuple.TableInfo
+	db       tuple.Store
+	users    tuple.TableInfo
+	profiles tuple.TableInfo
+	bans     tuple.TableInfo
+	storage  tuple.TableInfo
 }
 
 func (db *tupleDatabase) Close() error {
@@ -68,15 +154,20 @@ func (db *tupleDatabase) openTables() error {
 	if err := db.openUsers(ctx); err != nil {
 		return err
 	}
-	if err := db.openUsersIndex(ctx); err != nil {
-		return err
-	}
 	if err := db.openProfiles(ctx); err != nil {
 		return err
 	}
 	if err := db.openBans(ctx); err != nil {
 		return err
 	}
+	if err := db.openStorage(ctx); err != nil {
+		return err
+	}
+	for _, t := range indexedTables {
+		if err := t.upgrade(ctx, db); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -94,10 +185,128 @@ func (db *tupleDatabase) upgradeUsers(ctx context.Context) error {
 		if err := db.migrateUsersV2(ctx); err != nil {
 			return err
 		}
+		if err := db.reopenUsers(ctx); err != nil {
+			return err
+		}
 	}
+	if h := db.users.Header(); len(h.Data) == 3 {
+		// no keyprint fields
+		if err := db.migrateUsersV3(ctx); err != nil {
+			return err
+		}
+		if err := db.reopenUsers(ctx); err != nil {
+			return err
+		}
+	}
+	if h := db.users.Header(); len(h.Data) == 5 {
+		// no registration metadata
+		if err := db.migrateUsersV4(ctx); err != nil {
+			return err
+		}
+		if err := db.reopenUsers(ctx); err != nil {
+			return err
+		}
+	}
+	if h := db.users.Header(); len(h.Data) == 13 {
+		// no account state
+		if err := db.migrateUsersV5(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *tupleDatabase) reopenUsers(ctx context.Context) error {
+	users, err := db.db.Table(ctx, tableUsers)
+	if err != nil {
+		return err
+	}
+	db.users = users
 	return nil
 }
 
+func (db *tupleDatabase) migrateUsersV3(ctx context.Context) error {
+	log.Println("migrating users table to v3")
+	return db.rewriteUsers(ctx, db.createUsersV3, func(data tuple.Data) tuple.Data {
+		// keyprint, keyprint + pass
+		return append(data, values.String(""), values.Bool(false))
+	})
+}
+
+func (db *tupleDatabase) migrateUsersV4(ctx context.Context) error {
+	log.Println("migrating users table to v4")
+	return db.rewriteUsers(ctx, db.createUsersV4, func(data tuple.Data) tuple.Data {
+		// registered, registered by, last login, last seen, last ip, last client, email, notes
+		return append(data,
+			values.Time(time.Time{}), values.String(""),
+			values.Time(time.Time{}), values.Time(time.Time{}),
+			values.String(""), values.String(""),
+			values.String(""), values.String(""),
+		)
+	})
+}
+
+func (db *tupleDatabase) migrateUsersV5(ctx context.Context) error {
+	log.Println("migrating users table to v5")
+	return db.rewriteUsers(ctx, db.createUsersV5, func(data tuple.Data) tuple.Data {
+		// locked, locked until, failed logins, pass change, reset token, reset expires
+		return append(data,
+			values.Bool(false), values.Time(time.Time{}),
+			values.UInt(0), values.Bool(false),
+			values.String(""), values.Time(time.Time{}),
+		)
+	})
+}
+
+// rewriteUsers reads all user records, recreates the users table and its indexes with a new schema
+// and writes records back, converting them with the conv function.
+func (db *tupleDatabase) rewriteUsers(ctx context.Context, create func(ctx context.Context, tx tuple.Tx) error, conv func(data tuple.Data) tuple.Data) error {
+	var users []tuple.Data
+	err := db.inTx(ctx, false, func(ctx context.Context, tx tuple.Tx) error {
+		tbl, err := db.users.Open(tx)
+		if err != nil {
+			return err
+		}
+		it := tbl.Scan(nil)
+		defer it.Close()
+		for it.Next(ctx) {
+			data := it.Data()
+			users = append(users, append(tuple.Data{}, data...))
+		}
+		return it.Err()
+	})
+	if err != nil {
+		return err
+	}
+	return db.inTx(ctx, true, func(ctx context.Context, tx tuple.Tx) error {
+		if err := usersTable.drop(ctx, tx); err != nil {
+			return err
+		}
+		if err := create(ctx, tx); err != nil {
+			return err
+		}
+		if err := usersTable.createIndexes(ctx, tx); err != nil {
+			return err
+		}
+		tbl, err := usersTable.open(ctx, tx)
+		if err != nil {
+			return err
+		}
+		for _, data := range users {
+			_, err := tbl.InsertTuple(ctx, tuple.Tuple{
+				Key:  tuple.AutoKey(),
+				Data: conv(data),
+			})
+			if err == errIndexConflict {
+				return fmt.Errorf("duplicate user name: %v", data[0])
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (db *tupleDatabase) migrateUsersV2(ctx context.Context) error {
 	log.Println("migrating users table to v2")
 	// read all users and their passwords
@@ -197,6 +406,82 @@ func (db *tupleDatabase) createUsersV2(ctx context.Context, tx tuple.Tx) error {
 	})
 }
 
+func (db *tupleDatabase) createUsersV3(ctx context.Context, tx tuple.Tx) error {
+	return db.createTable(ctx, tx, tuple.Header{
+		Name: tableUsers,
+		Key: []tuple.KeyField{
+			{Name: "id", Type: values.UIntType{}, Auto: true},
+		},
+		Data: []tuple.Field{
+			{Name: "name", Type: values.StringType{}},
+			// TODO: unfortunately we have to store it in plain text
+			//       due to the protocol limitations
+			{Name: "pass", Type: values.StringType{}},
+			{Name: "profile", Type: values.StringType{}},
+			{Name: "keyprint", Type: values.StringType{}},
+			{Name: "keyprint_pass", Type: values.BoolType{}},
+		},
+	})
+}
+
+func (db *tupleDatabase) createUsersV4(ctx context.Context, tx tuple.Tx) error {
+	return db.createTable(ctx, tx, tuple.Header{
+		Name: tableUsers,
+		Key: []tuple.KeyField{
+			{Name: "id", Type: values.UIntType{}, Auto: true},
+		},
+		Data: []tuple.Field{
+			{Name: "name", Type: values.StringType{}},
+			// TODO: unfortunately we have to store it in plain text
+			//       due to the protocol limitations
+			{Name: "pass", Type: values.StringType{}},
+			{Name: "profile", Type: values.StringType{}},
+			{Name: "keyprint", Type: values.StringType{}},
+			{Name: "keyprint_pass", Type: values.BoolType{}},
+			{Name: "registered", Type: values.TimeType{}},
+			{Name: "registered_by", Type: values.StringType{}},
+			{Name: "last_login", Type: values.TimeType{}},
+			{Name: "last_seen", Type: values.TimeType{}},
+			{Name: "last_ip", Type: values.StringType{}},
+			{Name: "last_client", Type: values.StringType{}},
+			{Name: "email", Type: values.StringType{}},
+			{Name: "notes", Type: values.StringType{}},
+		},
+	})
+}
+
+func (db *tupleDatabase) createUsersV5(ctx context.Context, tx tuple.Tx) error {
+	return db.createTable(ctx, tx, tuple.Header{
+		Name: tableUsers,
+		Key: []tuple.KeyField{
+			{Name: "id", Type: values.UIntType{}, Auto: true},
+		},
+		Data: []tuple.Field{
+			{Name: "name", Type: values.StringType{}},
+			// TODO: unfortunately we have to store it in plain text
+			//       due to the protocol limitations
+			{Name: "pass", Type: values.StringType{}},
+			{Name: "profile", Type: values.StringType{}},
+			{Name: "keyprint", Type: values.StringType{}},
+			{Name: "keyprint_pass", Type: values.BoolType{}},
+			{Name: "registered", Type: values.TimeType{}},
+			{Name: "registered_by", Type: values.StringType{}},
+			{Name: "last_login", Type: values.TimeType{}},
+			{Name: "last_seen", Type: values.TimeType{}},
+			{Name: "last_ip", Type: values.StringType{}},
+			{Name: "last_client", Type: values.StringType{}},
+			{Name: "email", Type: values.StringType{}},
+			{Name: "notes", Type: values.StringType{}},
+			{Name: "locked", Type: values.BoolType{}},
+			{Name: "locked_until", Type: values.TimeType{}},
+			{Name: "failed_logins", Type: values.UIntType{}},
+			{Name: "pass_change", Type: values.BoolType{}},
+			{Name: "reset_token", Type: values.StringType{}},
+			{Name: "reset_expires", Type: values.TimeType{}},
+		},
+	})
+}
+
 func (db *tupleDatabase) createUsersIndexV2(ctx context.Context, tx tuple.Tx) error {
 	return db.createTable(ctx, tx, tuple.Header{
 		Name: tableUsersByName,
@@ -257,19 +542,14 @@ func (db *tupleDatabase) openUsers(ctx context.Context) error {
 		if err = db.upgradeUsers(ctx); err != nil {
 			return err
 		}
-		users, err = db.db.Table(ctx, tableUsers)
-		if err != nil {
-			return err
-		}
-		db.users = users
-		return nil
+		return db.reopenUsers(ctx)
 	} else if err != tuple.ErrTableNotFound {
 		return err
 	}
-	if err := db.inTx(ctx, true, db.createUsersV2); err != nil {
+	if err := db.inTx(ctx, true, db.createUsersV5); err != nil {
 		return err
 	}
-	if err := db.inTx(ctx, true, db.createUsersIndexV2); err != nil {
+	if err := db.inTx(ctx, true, usersTable.createIndexes); err != nil {
 		return err
 	}
 	users, err = db.db.Table(ctx, tableUsers)
@@ -280,15 +560,6 @@ func (db *tupleDatabase) openUsers(ctx context.Context) error {
 	return nil
 }
 
-func (db *tupleDatabase) openUsersIndex(ctx context.Context) error {
-	users, err := db.db.Table(ctx, tableUsersByName)
-	if err != nil {
-		return err
-	}
-	db.usersByName = users
-	return nil
-}
-
 func (db *tupleDatabase) openProfiles(ctx context.Context) error {
 	prof, err := db.db.Table(ctx, tableProfiles)
 	if err == nil {
@@ -319,6 +590,9 @@ func (db *tupleDatabase) openBans(ctx context.Context) error {
 	if err := db.inTx(ctx, true, db.createBansV2); err != nil {
 		return err
 	}
+	if err := db.inTx(ctx, true, bansTable.createIndexes); err != nil {
+		return err
+	}
 	bans, err = db.db.Table(ctx, tableBans)
 	if err != nil {
 		return err
@@ -328,19 +602,17 @@ func (db *tupleDatabase) openBans(ctx context.Context) error {
 }
 
 func (db *tupleDatabase) lookupUser(ctx context.Context, tx tuple.Tx, name string) (tuple.Key, error) {
-	index, err := db.usersByName.Open(tx)
+	index, err := usersByName.open(ctx, tx)
 	if err != nil {
 		return nil, err
 	}
-	data, err := index.GetTuple(ctx, tuple.SKey(name))
+	keys, err := usersByName.lookup(ctx, index, values.String(name))
 	if err != nil {
 		return nil, err
+	} else if len(keys) == 0 {
+		return nil, tuple.ErrNotFound
 	}
-	id, ok := data[0].(tuple.Sortable)
-	if !ok {
-		return nil, errors.New("invalid user name index")
-	}
-	return tuple.Key{id}, nil
+	return keys[0], nil
 }
 
 func (db *tupleDatabase) IsRegistered(name string) (bool, error) {
@@ -359,6 +631,9 @@ func (db *tupleDatabase) IsRegistered(name string) (bool, error) {
 }
 
 func asUserRec(data tuple.Data) (*hub.UserRecord, error) {
+	if len(data) < usersFields {
+		return nil, fmt.Errorf("expected %d user fields, got: %d", usersFields, len(data))
+	}
 	rname, ok := data[0].(values.String)
 	if !ok {
 		return nil, fmt.Errorf("expected string name, got: %T", data[0])
@@ -369,17 +644,99 @@ func asUserRec(data tuple.Data) (*hub.UserRecord, error) {
 	}
 	prof, ok := data[2].(values.String)
 	if !ok {
-		return nil, fmt.Errorf("expected string pass, got: %T", data[2])
+		return nil, fmt.Errorf("expected string profile, got: %T", data[2])
+	}
+	kp, ok := data[3].(values.String)
+	if !ok {
+		return nil, fmt.Errorf("expected string keyprint, got: %T", data[3])
+	}
+	kpPass, ok := data[4].(values.Bool)
+	if !ok {
+		return nil, fmt.Errorf("expected bool keyprint flag, got: %T", data[4])
+	}
+	rec := &hub.UserRecord{
+		Name:         string(rname),
+		Pass:         string(pass),
+		Profile:      string(prof),
+		Keyprint:     string(kp),
+		KeyprintPass: bool(kpPass),
+	}
+	for _, f := range []struct {
+		i int
+		p *time.Time
+	}{
+		{5, &rec.Registered},
+		{7, &rec.LastLogin},
+		{8, &rec.LastSeen},
+		{14, &rec.LockedUntil},
+		{18, &rec.ResetExpires},
+	} {
+		t, ok := data[f.i].(values.Time)
+		if !ok {
+			return nil, fmt.Errorf("expected time value, got: %T", data[f.i])
+		}
+		*f.p = time.Time(t)
+	}
+	for _, f := range []struct {
+		i int
+		p *string
+	}{
+		{6, &rec.RegisteredBy},
+		{9, &rec.LastIP},
+		{10, &rec.LastClient},
+		{11, &rec.Email},
+		{12, &rec.Notes},
+		{17, &rec.ResetToken},
+	} {
+		str, ok := data[f.i].(values.String)
+		if !ok {
+			return nil, fmt.Errorf("expected string value, got: %T", data[f.i])
+		}
+		*f.p = string(str)
+	}
+	for _, f := range []struct {
+		i int
+		p *bool
+	}{
+		{13, &rec.Locked},
+		{16, &rec.PassChange},
+	} {
+		b, ok := data[f.i].(values.Bool)
+		if !ok {
+			return nil, fmt.Errorf("expected bool value, got: %T", data[f.i])
+		}
+		*f.p = bool(b)
+	}
+	failed, ok := data[15].(values.UInt)
+	if !ok {
+		return nil, fmt.Errorf("expected uint failed logins, got: %T", data[15])
 	}
-	return &hub.UserRecord{
-		Name:    string(rname),
-		Pass:    string(pass),
-		Profile: string(prof),
-	}, nil
+	rec.FailedLogins = int(failed)
+	return rec, nil
 }
 
 func fromUserRec(u *hub.UserRecord) tuple.Data {
-	return tuple.SData(u.Name, u.Pass, u.Profile)
+	return tuple.Data{
+		values.String(u.Name),
+		values.String(u.Pass),
+		values.String(u.Profile),
+		values.String(u.Keyprint),
+		values.Bool(u.KeyprintPass),
+		values.Time(u.Registered),
+		values.String(u.RegisteredBy),
+		values.Time(u.LastLogin),
+		values.Time(u.LastSeen),
+		values.String(u.LastIP),
+		values.String(u.LastClient),
+		values.String(u.Email),
+		values.String(u.Notes),
+		values.Bool(u.Locked),
+		values.Time(u.LockedUntil),
+		values.UInt(u.FailedLogins),
+		values.Bool(u.PassChange),
+		values.String(u.ResetToken),
+		values.Time(u.ResetExpires),
+	}
 }
 
 func (db *tupleDatabase) GetUser(name string) (*hub.UserRecord, error) {
@@ -433,7 +790,7 @@ func (db *tupleDatabase) ListUsers() ([]hub.UserRecord, error) {
 	var out []hub.UserRecord
 	for it.Next(ctx) {
 		data := it.Data()
-		if len(data) != 3 {
+		if len(data) != usersFields {
 			if err = it.Err(); err != nil {
 				return nil, err
 			}
@@ -456,43 +813,20 @@ func (db *tupleDatabase) CreateUser(u hub.UserRecord) error {
 	defer tx.Close()
 
 	ctx := context.TODO()
-	key, err := db.lookupUser(ctx, tx, u.Name)
-	if err == nil {
-		return hub.ErrNameTaken
-	} else if err != tuple.ErrNotFound {
-		return err
-	}
-
-	users, err := db.users.Open(tx)
+	users, err := usersTable.open(ctx, tx)
 	if err != nil {
 		return err
 	}
-	key, err = users.InsertTuple(ctx, tuple.Tuple{
+	_, err = users.InsertTuple(ctx, tuple.Tuple{
 		Key:  tuple.AutoKey(),
 		Data: fromUserRec(&u),
 	})
-	if err != nil {
-		return err
-	}
-
-	index, err := db.usersByName.Open(tx)
-	if err != nil {
-		return err
-	}
-	_, err = index.InsertTuple(ctx, tuple.Tuple{
-		Key:  tuple.SKey(u.Name),
-		Data: tuple.Data{key[0]},
-	})
-	if err == tuple.ErrExists {
+	if err == errIndexConflict {
 		return hub.ErrNameTaken
 	} else if err != nil {
 		return err
 	}
-	err = tx.Commit(ctx)
-	if err != nil {
-		return err
-	}
-	return nil
+	return tx.Commit(ctx)
 }
 
 func (db *tupleDatabase) DeleteUser(name string) error {
@@ -510,28 +844,13 @@ func (db *tupleDatabase) DeleteUser(name string) error {
 		return err
 	}
 
-	index, err := db.usersByName.Open(tx)
+	users, err := usersTable.open(ctx, tx)
 	if err != nil {
 		return err
 	}
-	err = index.DeleteTuples(ctx, &tuple.Filter{
-		KeyFilter: tuple.Keys{tuple.SKey(name)},
-	})
-	if err != nil {
-		return err
-	}
-
-	users, err := db.users.Open(tx)
-	if err != nil {
+	if err = users.DeleteTuple(ctx, key); err != nil {
 		return err
 	}
-	err = users.DeleteTuples(ctx, &tuple.Filter{
-		KeyFilter: tuple.Keys{key},
-	})
-	if err != nil {
-		return err
-	}
-
 	return tx.Commit(ctx)
 }
 
@@ -551,7 +870,7 @@ func (db *tupleDatabase) UpdateUser(name string, fnc func(u *hub.UserRecord) (bo
 		return err
 	}
 
-	users, err := db.users.Open(tx)
+	users, err := usersTable.open(ctx, tx)
 	if err != nil {
 		return err
 	}
@@ -574,12 +893,53 @@ func (db *tupleDatabase) UpdateUser(name string, fnc func(u *hub.UserRecord) (bo
 	err = users.UpdateTuple(ctx, tuple.Tuple{
 		Key: key, Data: fromUserRec(rec),
 	}, nil)
-	if err != nil {
+	if err == errIndexConflict {
+		return hub.ErrNameTaken
+	} else if err != nil {
 		return err
 	}
 	return tx.Commit(ctx)
 }
 
+// UsersByProfile returns all users with a given profile.
+func (db *tupleDatabase) UsersByProfile(profile string) ([]hub.UserRecord, error) {
+	if profile == "" {
+		// not indexed
+		return filterUsers(db, profile)
+	}
+	tx, err := db.db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	ctx := context.TODO()
+	users, err := usersTable.open(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	_, index := users.index(tableUsersByProfile)
+	keys, err := usersByProfile.lookup(ctx, index, values.String(profile))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]hub.UserRecord, 0, len(keys))
+	for _, key := range keys {
+		data, err := users.GetTuple(ctx, key)
+		if err == tuple.ErrNotFound {
+			return nil, errors.New("inconsistent user profile index")
+		} else if err != nil {
+			return nil, err
+		}
+		rec, err := asUserRec(data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *rec)
+	}
+	return out, nil
+}
+
 func (db *tupleDatabase) GetProfile(id string) (hub.Map, error) {
 	tx, err := db.db.Tx(false)
 	if err != nil {
@@ -603,7 +963,7 @@ func (db *tupleDatabase) GetProfile(id string) (hub.Map, error) {
 		return nil, fmt.Errorf("expected string profile data, got: %T", data[0])
 	}
 	m := make(hub.Map)
-	err = json.Unmarshal([]byte(s), m)
+	err = json.Unmarshal([]byte(s), &m)
 	if err != nil {
 		return nil, err
 	}
@@ -736,7 +1096,7 @@ func (db *tupleDatabase) ListBans() ([]hub.Ban, error) {
 	it := tbl.Scan(nil)
 
 	var list []hub.Ban
-	if it.Next(ctx) {
+	for it.Next(ctx) {
 		b, err := decodeBan(it.Key(), it.Data())
 		if err != nil {
 			return nil, err
@@ -788,13 +1148,13 @@ func (db *tupleDatabase) PutBans(bans []hub.Ban) error {
 	}
 	defer tx.Close()
 
-	tbl, err := db.bans.Open(tx)
+	ctx := context.TODO()
+
+	tbl, err := bansTable.open(ctx, tx)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.TODO()
-
 	for _, b := range bans {
 		t := tuple.Tuple{
 			Key: tuple.Key{values.Bytes(b.Key)},
@@ -822,22 +1182,17 @@ func (db *tupleDatabase) DelBans(keys []hub.BanKey) error {
 	}
 	defer tx.Close()
 
-	tbl, err := db.bans.Open(tx)
+	ctx := context.TODO()
+
+	tbl, err := bansTable.open(ctx, tx)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.TODO()
-
-	tkeys := make(tuple.Keys, 0, len(keys))
 	for _, k := range keys {
-		tkeys = append(tkeys, tuple.Key{values.Bytes(k)})
-	}
-	err = tbl.DeleteTuples(ctx, &tuple.Filter{
-		KeyFilter: tkeys,
-	})
-	if err != nil {
-		return err
+		if err = tbl.DeleteTuple(ctx, tuple.Key{values.Bytes(k)}); err != nil {
+			return err
+		}
 	}
 	return tx.Commit(ctx)
 }
@@ -849,15 +1204,142 @@ func (db *tupleDatabase) ClearBans() error {
 	}
 	defer tx.Close()
 
-	tbl, err := db.bans.Open(tx)
+	ctx := context.TODO()
+
+	tbl, err := bansTable.open(ctx, tx)
 	if err != nil {
 		return err
 	}
+	if err = tbl.Clear(ctx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ExpiredBans returns all temporary bans that expired before a given time.
+func (db *tupleDatabase) ExpiredBans(now time.Time) ([]hub.Ban, error) {
+	tx, err := db.db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
 
 	ctx := context.TODO()
-	err = tbl.DeleteTuples(ctx, nil)
+
+	tbl, err := bansTable.open(ctx, tx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return tx.Commit(ctx)
+	_, index := tbl.index(tableBansByExpiry)
+	keys, err := bansByExpiry.scan(ctx, index, &tuple.Filter{
+		KeyFilter: tuple.KeyFilters{filter.LT(values.Time(now))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []hub.Ban
+	for _, key := range keys {
+		data, err := tbl.GetTuple(ctx, key)
+		if err == tuple.ErrNotFound {
+			return nil, errors.New("inconsistent ban expiry index")
+		} else if err != nil {
+			return nil, err
+		}
+		b, err := decodeBan(key, data)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *b)
+	}
+	return list, nil
+}
+
+// CheckIndexes verifies that all secondary indexes are consistent with their tables.
+// If fix is set, inconsistent indexes are rebuilt. It returns a list of problems found.
+func (db *tupleDatabase) CheckIndexes(fix bool) ([]string, error) {
+	ctx := context.TODO()
+	var problems []string
+	for _, t := range indexedTables {
+		for _, ix := range t.indexes {
+			var cur []string
+			err := db.inTx(ctx, false, func(ctx context.Context, tx tuple.Tx) error {
+				var err error
+				cur, err = t.check(ctx, tx, ix)
+				return err
+			})
+			if err != nil {
+				return problems, err
+			}
+			problems = append(problems, cur...)
+			if !fix || len(cur) == 0 {
+				continue
+			}
+			err = db.inTx(ctx, true, func(ctx context.Context, tx tuple.Tx) error {
+				if _, err := tx.Table(ctx, ix.name); err == tuple.ErrTableNotFound {
+					if err = ix.create(ctx, tx); err != nil {
+						return err
+					}
+				} else if err != nil {
+					return err
+				}
+				return t.rebuild(ctx, tx, ix)
+			})
+			if err != nil {
+				return problems, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// UsersByProfile returns all users with a given profile.
+// It uses a secondary index if the database supports it and falls back to a full scan otherwise.
+func UsersByProfile(db hub.Database, profile string) ([]hub.UserRecord, error) {
+	if tdb, ok := db.(*tupleDatabase); ok {
+		return tdb.UsersByProfile(profile)
+	}
+	return filterUsers(db, profile)
+}
+
+func filterUsers(db hub.Database, profile string) ([]hub.UserRecord, error) {
+	list, err := db.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	var out []hub.UserRecord
+	for _, u := range list {
+		if u.Profile == profile {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+// ExpiredBans returns all temporary bans that expired before a given time.
+// It uses a secondary index if the database supports it and falls back to a full scan otherwise.
+func ExpiredBans(db hub.Database, now time.Time) ([]hub.Ban, error) {
+	if tdb, ok := db.(*tupleDatabase); ok {
+		return tdb.ExpiredBans(now)
+	}
+	list, err := db.ListBans()
+	if err != nil {
+		return nil, err
+	}
+	var out []hub.Ban
+	for _, b := range list {
+		if !b.Until.IsZero() && b.Until.Before(now) {
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+// Check verifies the consistency of secondary indexes and returns a list of problems.
+// If fix is set, inconsistent indexes are rebuilt from the data tables.
+func Check(db hub.Database, fix bool) ([]string, error) {
+	tdb, ok := db.(*tupleDatabase)
+	if !ok {
+		return nil, nil
+	}
+	return tdb.CheckIndexes(fix)
 }
@@ -0,0 +1,440 @@
+package hubdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/hidal-go/hidalgo/filter"
+	"github.com/hidal-go/hidalgo/tuple"
+	"github.com/hidal-go/hidalgo/values"
+)
+
+// errIndexConflict is returned when a row violates a unique index.
+var errIndexConflict = errors.New("unique index conflict")
+
+// tableIndex is a secondary index of a table, stored in a separate table.
+//
+// For non-unique indexes, the key of the index table consists of indexed values followed by the primary key
+// of the indexed row. Unique indexes use indexed values as a key and store the primary key in the data fields.
+type tableIndex struct {
+	name   string           // index table name
+	unique bool             // only one row can be indexed by the same values
+	fields []tuple.KeyField // indexed fields
+	pkey   []tuple.KeyField // primary key of the indexed table
+	// values extracts indexed values from the data of the indexed row.
+	// It returns nil if the row should not be indexed.
+	values func(data tuple.Data) []tuple.Sortable
+}
+
+func (ix *tableIndex) header() tuple.Header {
+	h := tuple.Header{Name: ix.name}
+	h.Key = append(h.Key, ix.fields...)
+	if ix.unique {
+		for _, f := range ix.pkey {
+			h.Data = append(h.Data, tuple.Field{Name: f.Name, Type: f.Type})
+		}
+	} else {
+		for _, f := range ix.pkey {
+			h.Key = append(h.Key, tuple.KeyField{Name: f.Name, Type: f.Type})
+		}
+	}
+	return h
+}
+
+func (ix *tableIndex) create(ctx context.Context, tx tuple.Tx) error {
+	_, err := tx.CreateTable(ctx, ix.header())
+	if err != nil {
+		return fmt.Errorf("cannot create index '%s': %v", ix.name, err)
+	}
+	return nil
+}
+
+func (ix *tableIndex) open(ctx context.Context, tx tuple.Tx) (tuple.Table, error) {
+	tbl, err := tx.Table(ctx, ix.name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open index '%s': %v", ix.name, err)
+	}
+	return tbl, nil
+}
+
+// entry returns the index tuple for a given row. It returns false if the row is not indexed.
+func (ix *tableIndex) entry(pk tuple.Key, data tuple.Data) (tuple.Tuple, bool) {
+	vals := ix.values(data)
+	if vals == nil {
+		return tuple.Tuple{}, false
+	}
+	key := append(tuple.Key{}, vals...)
+	if ix.unique {
+		d := make(tuple.Data, 0, len(pk))
+		for _, v := range pk {
+			d = append(d, v)
+		}
+		return tuple.Tuple{Key: key, Data: d}, true
+	}
+	key = append(key, pk...)
+	return tuple.Tuple{Key: key, Data: tuple.Data{}}, true
+}
+
+func (ix *tableIndex) insert(ctx context.Context, tbl tuple.Table, pk tuple.Key, data tuple.Data) error {
+	t, ok := ix.entry(pk, data)
+	if !ok {
+		return nil
+	}
+	_, err := tbl.InsertTuple(ctx, t)
+	if err == tuple.ErrExists && ix.unique {
+		return errIndexConflict
+	}
+	return err
+}
+
+func (ix *tableIndex) delete(ctx context.Context, tbl tuple.Table, pk tuple.Key, data tuple.Data) error {
+	t, ok := ix.entry(pk, data)
+	if !ok {
+		return nil
+	}
+	return tbl.DeleteTuples(ctx, &tuple.Filter{
+		KeyFilter: tuple.Keys{t.Key},
+	})
+}
+
+// lookup returns primary keys of all rows indexed by given values.
+// The number of values may be less than the number of indexed fields.
+func (ix *tableIndex) lookup(ctx context.Context, tbl tuple.Table, vals ...tuple.Sortable) ([]tuple.Key, error) {
+	if ix.unique && len(vals) == len(ix.fields) {
+		data, err := tbl.GetTuple(ctx, tuple.Key(vals))
+		if err == tuple.ErrNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		pk, err := ix.primaryKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return []tuple.Key{pk}, nil
+	}
+	kf := make(tuple.KeyFilters, 0, len(vals))
+	for _, v := range vals {
+		kf = append(kf, filter.EQ(v))
+	}
+	return ix.scan(ctx, tbl, &tuple.Filter{KeyFilter: kf})
+}
+
+// scan returns primary keys of all rows in the index that match the filter.
+func (ix *tableIndex) scan(ctx context.Context, tbl tuple.Table, f *tuple.Filter) ([]tuple.Key, error) {
+	it := tbl.Scan(&tuple.ScanOptions{Filter: f})
+	defer it.Close()
+	var out []tuple.Key
+	for it.Next(ctx) {
+		var (
+			pk  tuple.Key
+			err error
+		)
+		if ix.unique {
+			pk, err = ix.primaryKey(it.Data())
+		} else {
+			pk = append(tuple.Key{}, it.Key()[len(ix.fields):]...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pk)
+	}
+	return out, it.Err()
+}
+
+func (ix *tableIndex) primaryKey(data tuple.Data) (tuple.Key, error) {
+	if len(data) != len(ix.pkey) {
+		return nil, fmt.Errorf("invalid index '%s': expected %d fields, got %d", ix.name, len(ix.pkey), len(data))
+	}
+	pk := make(tuple.Key, 0, len(data))
+	for _, v := range data {
+		s, ok := v.(tuple.Sortable)
+		if !ok {
+			return nil, fmt.Errorf("invalid index '%s': unexpected key type: %T", ix.name, v)
+		}
+		pk = append(pk, s)
+	}
+	return pk, nil
+}
+
+// indexedTable is a table with a set of secondary indexes.
+// All modifications of the table should go through its methods to keep indexes consistent.
+type indexedTable struct {
+	name    string
+	indexes []*tableIndex
+}
+
+type openIndexedTable struct {
+	tuple.Table
+	t       *indexedTable
+	indexes []tuple.Table
+}
+
+// open the table and all its indexes in a given transaction.
+func (t *indexedTable) open(ctx context.Context, tx tuple.Tx) (*openIndexedTable, error) {
+	tbl, err := tx.Table(ctx, t.name)
+	if err != nil {
+		return nil, err
+	}
+	ot := &openIndexedTable{Table: tbl, t: t}
+	for _, ix := range t.indexes {
+		itbl, err := ix.open(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		ot.indexes = append(ot.indexes, itbl)
+	}
+	return ot, nil
+}
+
+// index returns an opened index table by name.
+func (ot *openIndexedTable) index(name string) (*tableIndex, tuple.Table) {
+	for i, ix := range ot.t.indexes {
+		if ix.name == name {
+			return ix, ot.indexes[i]
+		}
+	}
+	panic(fmt.Errorf("unknown index: %q", name))
+}
+
+func (ot *openIndexedTable) InsertTuple(ctx context.Context, t tuple.Tuple) (tuple.Key, error) {
+	key, err := ot.Table.InsertTuple(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	for i, ix := range ot.t.indexes {
+		if err = ix.insert(ctx, ot.indexes[i], key, t.Data); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (ot *openIndexedTable) UpdateTuple(ctx context.Context, t tuple.Tuple, opt *tuple.UpdateOpt) error {
+	old, err := ot.Table.GetTuple(ctx, t.Key)
+	if err == tuple.ErrNotFound {
+		old = nil
+		if opt == nil || !opt.Upsert {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err = ot.Table.UpdateTuple(ctx, t, opt); err != nil {
+		return err
+	}
+	for i, ix := range ot.t.indexes {
+		if old != nil {
+			t1, ok1 := ix.entry(t.Key, old)
+			t2, ok2 := ix.entry(t.Key, t.Data)
+			if ok1 == ok2 && (!ok1 || t1.Key.Compare(t2.Key) == 0) {
+				continue // not changed
+			}
+			if err = ix.delete(ctx, ot.indexes[i], t.Key, old); err != nil {
+				return err
+			}
+		}
+		if err = ix.insert(ctx, ot.indexes[i], t.Key, t.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteTuple removes a single tuple and its index entries.
+func (ot *openIndexedTable) DeleteTuple(ctx context.Context, key tuple.Key) error {
+	old, err := ot.Table.GetTuple(ctx, key)
+	if err == tuple.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i, ix := range ot.t.indexes {
+		if err = ix.delete(ctx, ot.indexes[i], key, old); err != nil {
+			return err
+		}
+	}
+	return ot.Table.DeleteTuples(ctx, &tuple.Filter{
+		KeyFilter: tuple.Keys{key},
+	})
+}
+
+// DeleteTuples removes all tuples matching the filter and their index entries.
+func (ot *openIndexedTable) DeleteTuples(ctx context.Context, f *tuple.Filter) error {
+	if f.IsAny() {
+		return ot.Clear(ctx)
+	}
+	keys, ok := f.KeyFilter.(tuple.Keys)
+	if !ok || f.DataFilter != nil {
+		keys = nil
+		it := ot.Table.Scan(&tuple.ScanOptions{KeysOnly: true, Filter: f})
+		for it.Next(ctx) {
+			keys = append(keys, append(tuple.Key{}, it.Key()...))
+		}
+		err := it.Err()
+		it.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := ot.DeleteTuple(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear removes all tuples from the table and its indexes.
+func (ot *openIndexedTable) Clear(ctx context.Context) error {
+	for _, itbl := range ot.indexes {
+		if err := itbl.Clear(ctx); err != nil {
+			return err
+		}
+	}
+	return ot.Table.Clear(ctx)
+}
+
+// upgrade creates missing index tables and populates them.
+func (t *indexedTable) upgrade(ctx context.Context, db *tupleDatabase) error {
+	for _, ix := range t.indexes {
+		_, err := db.db.Table(ctx, ix.name)
+		if err == nil {
+			continue
+		} else if err != tuple.ErrTableNotFound {
+			return err
+		}
+		log.Printf("creating index '%s'", ix.name)
+		ix := ix
+		err = db.inTx(ctx, true, func(ctx context.Context, tx tuple.Tx) error {
+			if err := ix.create(ctx, tx); err != nil {
+				return err
+			}
+			return t.rebuild(ctx, tx, ix)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop removes the table and all its indexes, if they exist.
+func (t *indexedTable) drop(ctx context.Context, tx tuple.Tx) error {
+	names := []string{t.name}
+	for _, ix := range t.indexes {
+		names = append(names, ix.name)
+	}
+	for _, name := range names {
+		tbl, err := tx.Table(ctx, name)
+		if err == tuple.ErrTableNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = tbl.Drop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIndexes creates all index tables.
+func (t *indexedTable) createIndexes(ctx context.Context, tx tuple.Tx) error {
+	for _, ix := range t.indexes {
+		if err := ix.create(ctx, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuild clears the index and populates it from the table.
+func (t *indexedTable) rebuild(ctx context.Context, tx tuple.Tx, ix *tableIndex) error {
+	tbl, err := tx.Table(ctx, t.name)
+	if err != nil {
+		return err
+	}
+	itbl, err := ix.open(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err = itbl.Clear(ctx); err != nil {
+		return err
+	}
+	it := tbl.Scan(nil)
+	defer it.Close()
+	for it.Next(ctx) {
+		if err = ix.insert(ctx, itbl, it.Key(), it.Data()); err == errIndexConflict {
+			return fmt.Errorf("cannot rebuild index '%s': duplicate entry for %v", ix.name, it.Key())
+		} else if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// check compares the content of the index with the table and returns a list of inconsistencies.
+func (t *indexedTable) check(ctx context.Context, tx tuple.Tx, ix *tableIndex) ([]string, error) {
+	tbl, err := tx.Table(ctx, t.name)
+	if err != nil {
+		return nil, err
+	}
+	itbl, err := ix.open(ctx, tx)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	var problems []string
+	// collect expected index entries
+	expected := make(map[string]tuple.Tuple)
+	it := tbl.Scan(nil)
+	for it.Next(ctx) {
+		e, ok := ix.entry(it.Key(), it.Data())
+		if !ok {
+			continue
+		}
+		k := keyString(e.Key)
+		if _, ok := expected[k]; ok {
+			problems = append(problems, fmt.Sprintf("%s: duplicate entry %s", ix.name, k))
+		}
+		expected[k] = e
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+	it = itbl.Scan(nil)
+	defer it.Close()
+	for it.Next(ctx) {
+		k := keyString(it.Key())
+		e, ok := expected[k]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: stale entry %s", ix.name, k))
+			continue
+		}
+		delete(expected, k)
+		if ix.unique && dataString(e.Data) != dataString(it.Data()) {
+			problems = append(problems, fmt.Sprintf("%s: entry %s points to %s instead of %s",
+				ix.name, k, dataString(it.Data()), dataString(e.Data)))
+		}
+	}
+	if err = it.Err(); err != nil {
+		return nil, err
+	}
+	for k := range expected {
+		problems = append(problems, fmt.Sprintf("%s: missing entry %s", ix.name, k))
+	}
+	return problems, nil
+}
+
+func keyString(k tuple.Key) string {
+	return fmt.Sprint([]tuple.Sortable(k))
+}
+
+func dataString(d tuple.Data) string {
+	return fmt.Sprint([]values.Value(d))
+}
@@ -0,0 +1,128 @@
+package hubdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hidal-go/hidalgo/tuple"
+	"github.com/hidal-go/hidalgo/values"
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+func openTestDB(t testing.TB) (hub.Database, func()) {
+	dir, err := ioutil.TempDir("", "hubdb_")
+	require.NoError(t, err)
+	db, err := Open("bolt", filepath.Join(dir, "hub.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		require.NoError(t, err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func userNames(list []hub.UserRecord) []string {
+	var out []string
+	for _, u := range list {
+		out = append(out, u.Name)
+	}
+	return out
+}
+
+func TestIndexes(t *testing.T) {
+	db, closer := openTestDB(t)
+	defer closer()
+
+	require.NoError(t, db.CreateUser(hub.UserRecord{Name: "alice", Pass: "a", Profile: "op"}))
+	require.NoError(t, db.CreateUser(hub.UserRecord{Name: "bob", Pass: "b", Profile: "op"}))
+	require.NoError(t, db.CreateUser(hub.UserRecord{Name: "carol", Pass: "c"}))
+	require.Equal(t, hub.ErrNameTaken, db.CreateUser(hub.UserRecord{Name: "bob", Pass: "x"}))
+
+	list, err := UsersByProfile(db, "op")
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "bob"}, userNames(list))
+
+	// profile change and rename should update both indexes
+	err = db.UpdateUser("bob", func(u *hub.UserRecord) (bool, error) {
+		u.Name, u.Profile = "robert", "user"
+		return true, nil
+	})
+	require.NoError(t, err)
+	ok, err := db.IsRegistered("bob")
+	require.NoError(t, err)
+	require.False(t, ok)
+	list, err = UsersByProfile(db, "user")
+	require.NoError(t, err)
+	require.Equal(t, []string{"robert"}, userNames(list))
+
+	err = db.UpdateUser("robert", func(u *hub.UserRecord) (bool, error) {
+		u.Name = "alice"
+		return true, nil
+	})
+	require.Equal(t, hub.ErrNameTaken, err)
+
+	require.NoError(t, db.DeleteUser("alice"))
+	list, err = UsersByProfile(db, "op")
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	now := time.Now()
+	require.NoError(t, db.PutBans([]hub.Ban{
+		{Key: "perm"},
+		{Key: "old", Until: now.Add(-time.Hour)},
+		{Key: "new", Until: now.Add(time.Hour)},
+	}))
+	bans, err := ExpiredBans(db, now)
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	require.Equal(t, hub.BanKey("old"), bans[0].Key)
+
+	// extending the ban should remove it from the expiry index
+	require.NoError(t, db.PutBans([]hub.Ban{{Key: "old", Until: now.Add(2 * time.Hour)}}))
+	bans, err = ExpiredBans(db, now.Add(90*time.Minute))
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	require.Equal(t, hub.BanKey("new"), bans[0].Key)
+
+	problems, err := Check(db, false)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// break the profile index and let the check fix it
+	tdb := db.(*tupleDatabase)
+	ctx := context.Background()
+	err = tdb.inTx(ctx, true, func(ctx context.Context, tx tuple.Tx) error {
+		tbl, err := tx.Table(ctx, tableUsersByProfile)
+		if err != nil {
+			return err
+		}
+		if err = tbl.Clear(ctx); err != nil {
+			return err
+		}
+		_, err = tbl.InsertTuple(ctx, tuple.Tuple{
+			Key:  tuple.Key{values.String("op"), values.UInt(100)},
+			Data: tuple.Data{},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	problems, err = Check(db, true)
+	require.NoError(t, err)
+	require.Len(t, problems, 2)
+
+	problems, err = Check(db, false)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	list, err = UsersByProfile(db, "user")
+	require.NoError(t, err)
+	require.Equal(t, []string{"robert"}, userNames(list))
+}
@@ -0,0 +1,48 @@
+package hubdb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+// MigrateReport lists records from other hub software that cannot be mapped to go-hub.
+type MigrateReport struct {
+	Skipped []string
+}
+
+func (r *MigrateReport) skipf(format string, args ...interface{}) {
+	r.Skipped = append(r.Skipped, fmt.Sprintf(format, args...))
+}
+
+// newMigrateDump creates an empty dump that will be populated by a migration.
+func newMigrateDump() *Dump {
+	return &Dump{
+		Version:  DumpVersion,
+		Profiles: make(map[string]hub.Map),
+	}
+}
+
+// addUser adds a user to the dump, skipping duplicates.
+func (d *Dump) addUser(rep *MigrateReport, u DumpUser) {
+	for _, u2 := range d.Users {
+		if strings.EqualFold(u2.Name, u.Name) {
+			rep.skipf("user %q: duplicate name", u.Name)
+			return
+		}
+	}
+	d.Users = append(d.Users, u)
+}
+
+// charsetReader is used to decode XML files with legacy encodings.
+func charsetReader(charset string, r io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(r), nil
+}
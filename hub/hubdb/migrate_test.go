@@ -0,0 +1,97 @@
+package hubdb
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+func TestFromPtokaX(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ptokax")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		ptokaxProfilesFile: `<?xml version="1.0" encoding="windows-1252" standalone="yes" ?>
+<Profiles>
+	<Profile><Name>Master</Name><Permissions>1111111111111111111111111111111111</Permissions></Profile>
+	<Profile><Name>Operator</Name><Permissions>1111111111111111111111111111111111</Permissions></Profile>
+	<Profile><Name>VIP</Name><Permissions>0111110000000000000000000000100000</Permissions></Profile>
+	<Profile><Name>Reg</Name><Permissions>0000000000000000000000000000000000</Permissions></Profile>
+</Profiles>`,
+		ptokaxUsersFile: `<?xml version="1.0" encoding="windows-1252" standalone="yes" ?>
+<RegisteredUsers>
+	<RegisteredUser><Nick>admin</Nick><Password>secret</Password><Profile>0</Profile></RegisteredUser>
+	<RegisteredUser><Nick>vip</Nick><Password>p</Password><Profile>2</Profile></RegisteredUser>
+	<RegisteredUser><Nick>hashed</Nick><PasswordHash>abcd</PasswordHash><Profile>3</Profile></RegisteredUser>
+</RegisteredUsers>`,
+		ptokaxBansFile: `<?xml version="1.0" encoding="windows-1252" standalone="yes" ?>
+<BanList>
+	<PermBans>
+		<Ban><IP>10.0.0.1</IP><Reason>spam</Reason><By>admin</By><IpBan>1</IpBan><FullIpBan>1</FullIpBan></Ban>
+		<Ban><Nick>troll</Nick><NickBan>1</NickBan></Ban>
+	</PermBans>
+	<TempBans>
+		<Ban><IP>10.0.0.2</IP><IpBan>1</IpBan><Expire>1</Expire></Ban>
+	</TempBans>
+	<PermRangeBans>
+		<Ban><IpFrom>10.1.0.0</IpFrom><IpTo>10.1.255.255</IpTo><Reason>range</Reason></Ban>
+	</PermRangeBans>
+</BanList>`,
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		require.NoError(t, err)
+	}
+
+	d, rep, err := FromPtokaX(dir)
+	require.NoError(t, err)
+	require.Equal(t, []DumpUser{
+		{Name: "admin", Pass: "secret", Profile: hub.ProfileNameRoot},
+		{Name: "vip", Pass: "p", Profile: "vip"},
+	}, d.Users)
+	require.Equal(t, map[string]hub.Map{
+		"vip": {hub.ProfileParent: hub.ProfileNameRegistered},
+	}, d.Profiles)
+	require.Equal(t, []DumpBan{
+		{IP: "10.0.0.1", Reason: "spam (by admin)"},
+		{Key: string(hub.NickBanKey("troll"))},
+		{Key: string(hub.RangeBanKey(net.ParseIP("10.1.0.0"), net.ParseIP("10.1.255.255"))), Reason: "range"},
+	}, d.Bans)
+	require.Len(t, rep.Skipped, 2, "%q", rep.Skipped)
+}
+
+func TestFromVerlihub(t *testing.T) {
+	const dump = `-- MySQL dump
+/*!40101 SET NAMES utf8 */;
+DROP TABLE IF EXISTS ` + "`reglist`" + `;
+CREATE TABLE ` + "`reglist`" + ` (
+  ` + "`nick`" + ` varchar(64) NOT NULL,
+  ` + "`class`" + ` int(2) DEFAULT '1',
+  ` + "`pwd_crypt`" + ` tinyint(1) DEFAULT '1',
+  ` + "`login_pwd`" + ` varchar(60) DEFAULT NULL,
+  ` + "`enabled`" + ` tinyint(1) DEFAULT '1',
+  PRIMARY KEY (` + "`nick`" + `)
+) ENGINE=MyISAM DEFAULT CHARSET=utf8;
+INSERT INTO ` + "`reglist`" + ` VALUES ('admin',10,0,'it''s\'secret',1),('op',3,0,'pass',1),('hashed',1,2,'$1$abc',1),('off',1,0,'x',0);
+INSERT INTO ` + "`banlist`" + ` (` + "`ip`,`nick`,`date_limit`,`reason`,`nick_op`" + `) VALUES ('10.0.0.1','spammer',0,'spam','admin'),('','troll',0,NULL,NULL);
+`
+	d, rep, err := FromVerlihub(strings.NewReader(dump))
+	require.NoError(t, err)
+	require.Equal(t, []DumpUser{
+		{Name: "admin", Pass: "it's'secret", Profile: hub.ProfileNameRoot},
+		{Name: "op", Pass: "pass", Profile: hub.ProfileNameOperator},
+	}, d.Users)
+	require.Equal(t, []DumpBan{
+		{IP: "10.0.0.1", Reason: "spam (by admin)"},
+		{Key: string(hub.NickBanKey("troll"))},
+	}, d.Bans)
+	require.Len(t, rep.Skipped, 2, "%q", rep.Skipped)
+}
@@ -0,0 +1,257 @@
+package hubdb
+
+import (
+	"encoding/xml"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+const (
+	ptokaxUsersFile    = "RegisteredUsers.xml"
+	ptokaxProfilesFile = "Profiles.xml"
+	ptokaxBansFile     = "BanList.xml"
+)
+
+// ptokaxProfile maps built-in PtokaX profiles to go-hub profiles.
+func ptokaxProfile(name string) string {
+	switch strings.ToLower(name) {
+	case "master":
+		return hub.ProfileNameRoot
+	case "operator":
+		return hub.ProfileNameOperator
+	case "reg", "registered":
+		return hub.ProfileNameRegistered
+	}
+	return ""
+}
+
+type ptokaxProfileXML struct {
+	Name        string `xml:"Name"`
+	Permissions string `xml:"Permissions"`
+}
+
+type ptokaxUserXML struct {
+	Nick     string `xml:"Nick"`
+	Password string `xml:"Password"`
+	PassHash string `xml:"PasswordHash"`
+	Profile  int    `xml:"Profile"`
+}
+
+type ptokaxBanXML struct {
+	Type      int    `xml:"Type"`
+	IP        string `xml:"IP"`
+	Nick      string `xml:"Nick"`
+	Reason    string `xml:"Reason"`
+	By        string `xml:"By"`
+	IPBan     int    `xml:"IpBan"`
+	NickBan   int    `xml:"NickBan"`
+	FullIPBan int    `xml:"FullIpBan"`
+	Expire    int64  `xml:"Expire"`
+	IPFrom    string `xml:"IpFrom"`
+	IPTo      string `xml:"IpTo"`
+}
+
+// decodeXMLElems calls fnc for each element with a given name in the XML file.
+// The name of the parent element is passed to the function.
+func decodeXMLElems(r io.Reader, name string, fnc func(dec *xml.Decoder, parent string, start xml.StartElement) error) error {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charsetReader
+	var stack []string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if tok.Name.Local == name {
+				parent := ""
+				if len(stack) != 0 {
+					parent = stack[len(stack)-1]
+				}
+				if err = fnc(dec, parent, tok); err != nil {
+					return err
+				}
+				continue
+			}
+			stack = append(stack, tok.Name.Local)
+		case xml.EndElement:
+			if len(stack) != 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+}
+
+func openXML(dir, name string, fnc func(r io.Reader) error) error {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fnc(f)
+}
+
+// FromPtokaX reads users, profiles and bans from the PtokaX config directory.
+//
+// Built-in PtokaX profiles are mapped to go-hub profiles; custom profiles are created with permissions
+// that have go-hub equivalents. Everything else is listed in the report.
+func FromPtokaX(dir string) (*Dump, *MigrateReport, error) {
+	d := newMigrateDump()
+	rep := &MigrateReport{}
+
+	var profiles []string // by PtokaX index
+	err := openXML(dir, ptokaxProfilesFile, func(r io.Reader) error {
+		profiles = nil
+		return readPtokaXProfiles(r, d, rep, &profiles)
+	})
+	if os.IsNotExist(err) {
+		rep.skipf("%s not found, using default profiles", ptokaxProfilesFile)
+		profiles = []string{hub.ProfileNameRoot, hub.ProfileNameOperator, "vip", hub.ProfileNameRegistered}
+		d.Profiles["vip"] = hub.Map{hub.ProfileParent: hub.ProfileNameRegistered}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	err = openXML(dir, ptokaxUsersFile, func(r io.Reader) error {
+		return readPtokaXUsers(r, d, rep, profiles)
+	})
+	if os.IsNotExist(err) {
+		rep.skipf("%s not found", ptokaxUsersFile)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	err = openXML(dir, ptokaxBansFile, func(r io.Reader) error {
+		return readPtokaXBans(r, d, rep, time.Now())
+	})
+	if os.IsNotExist(err) {
+		rep.skipf("%s not found", ptokaxBansFile)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return d, rep, nil
+}
+
+func readPtokaXProfiles(r io.Reader, d *Dump, rep *MigrateReport, ids *[]string) error {
+	return decodeXMLElems(r, "Profile", func(dec *xml.Decoder, _ string, start xml.StartElement) error {
+		var p ptokaxProfileXML
+		if err := dec.DecodeElement(&p, &start); err != nil {
+			return err
+		}
+		id := ptokaxProfile(p.Name)
+		if id != "" {
+			// built-in go-hub profiles have their own set of permissions
+			*ids = append(*ids, id)
+			return nil
+		}
+		id = strings.ToLower(strings.TrimSpace(p.Name))
+		if id == "" {
+			id = "profile" + strconv.Itoa(len(*ids))
+		}
+		*ids = append(*ids, id)
+		m := hub.Map{hub.ProfileParent: hub.ProfileNameRegistered}
+		var unmapped []string
+		for i, c := range strings.TrimSpace(p.Permissions) {
+			if c != '1' {
+				continue
+			}
+			if i >= len(hub.PtokaXPermissions) {
+				unmapped = append(unmapped, "#"+strconv.Itoa(i))
+				continue
+			}
+			pp := hub.PtokaXPermissions[i]
+			if pp.Perm == "" {
+				unmapped = append(unmapped, pp.Name)
+				continue
+			}
+			m[pp.Perm] = true
+		}
+		if _, ok := m[hub.FlagOpIcon]; ok {
+			m[hub.ProfileParent] = hub.ProfileNameOperator
+		}
+		if len(unmapped) != 0 {
+			rep.skipf("profile %q: unmapped permissions: %s", id, strings.Join(unmapped, ", "))
+		}
+		d.Profiles[id] = m
+		return nil
+	})
+}
+
+func readPtokaXUsers(r io.Reader, d *Dump, rep *MigrateReport, profiles []string) error {
+	return decodeXMLElems(r, "RegisteredUser", func(dec *xml.Decoder, _ string, start xml.StartElement) error {
+		var u ptokaxUserXML
+		if err := dec.DecodeElement(&u, &start); err != nil {
+			return err
+		}
+		if u.Nick == "" {
+			rep.skipf("user without a name")
+			return nil
+		} else if u.Password == "" && u.PassHash != "" {
+			rep.skipf("user %q: hashed passwords cannot be migrated", u.Nick)
+			return nil
+		} else if u.Password == "" {
+			rep.skipf("user %q: no password", u.Nick)
+			return nil
+		} else if u.Profile < 0 || u.Profile >= len(profiles) {
+			rep.skipf("user %q: unknown profile %d", u.Nick, u.Profile)
+			return nil
+		}
+		d.addUser(rep, DumpUser{
+			Name:    u.Nick,
+			Pass:    u.Password,
+			Profile: profiles[u.Profile],
+		})
+		return nil
+	})
+}
+
+func readPtokaXBans(r io.Reader, d *Dump, rep *MigrateReport, now time.Time) error {
+	return decodeXMLElems(r, "Ban", func(dec *xml.Decoder, parent string, start xml.StartElement) error {
+		var b ptokaxBanXML
+		if err := dec.DecodeElement(&b, &start); err != nil {
+			return err
+		}
+		var until *time.Time
+		if b.Expire != 0 {
+			t := time.Unix(b.Expire, 0).UTC()
+			if t.Before(now) {
+				return nil // expired
+			}
+			until = &t
+		}
+		// FullIpBan only means that the ban applies to registered users as well, which is always the case
+		// for the hub, so it's not mapped to a hard ban
+		reason := hub.BanReason(b.Reason, b.By)
+		if strings.Contains(parent, "Range") || b.IPFrom != "" {
+			from, to := net.ParseIP(strings.TrimSpace(b.IPFrom)), net.ParseIP(strings.TrimSpace(b.IPTo))
+			key := hub.RangeBanKey(from, to)
+			if from == nil || to == nil || key == "" {
+				rep.skipf("range ban %s-%s: invalid range", b.IPFrom, b.IPTo)
+				return nil
+			}
+			d.Bans = append(d.Bans, DumpBan{Key: string(key), Until: until, Reason: reason})
+			return nil
+		}
+		ip := net.ParseIP(strings.TrimSpace(b.IP))
+		nick := strings.TrimSpace(b.Nick)
+		if b.NickBan != 0 && nick != "" {
+			d.Bans = append(d.Bans, DumpBan{Key: string(hub.NickBanKey(nick)), Until: until, Reason: reason})
+		}
+		if ip != nil && (b.IPBan != 0 || b.NickBan == 0) {
+			d.Bans = append(d.Bans, DumpBan{IP: ip.String(), Until: until, Reason: reason})
+		} else if ip == nil && (b.NickBan == 0 || nick == "") {
+			rep.skipf("ban %q: no IP or nick", b.IP)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,301 @@
+package hubdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// sqlRow is a single row from the SQL dump, indexed by the column name.
+type sqlRow map[string]string
+
+// sqlNull is used for NULL values in sqlRow.
+const sqlNull = "\x00NULL"
+
+// readSQLDump reads INSERT statements for given tables from a MySQL dump.
+// Column names are taken either from the INSERT statement, or from the corresponding CREATE TABLE statement.
+func readSQLDump(r io.Reader, tables []string, fnc func(table string, row sqlRow) error) error {
+	want := make(map[string]struct{}, len(tables))
+	for _, t := range tables {
+		want[t] = struct{}{}
+	}
+	p := &sqlParser{r: bufio.NewReader(r)}
+	columns := make(map[string][]string)
+	for {
+		stmt, err := p.statement()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(stmt) < 3 {
+			continue
+		}
+		switch {
+		case strings.EqualFold(stmt[0], "CREATE") && strings.EqualFold(stmt[1], "TABLE"):
+			name, cols := sqlCreateTable(stmt)
+			if _, ok := want[name]; ok {
+				columns[name] = cols
+			}
+		case strings.EqualFold(stmt[0], "INSERT"), strings.EqualFold(stmt[0], "REPLACE"):
+			if err = sqlInsert(stmt, want, columns, fnc); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sqlCreateTable returns the table name and column names from CREATE TABLE statement.
+func sqlCreateTable(stmt []string) (string, []string) {
+	i := 2
+	for i < len(stmt) && isSQLKeyword(stmt[i]) {
+		i++ // IF NOT EXISTS
+	}
+	if i >= len(stmt) {
+		return "", nil
+	}
+	name := sqlIdent(stmt[i])
+	i++
+	if i >= len(stmt) || stmt[i] != "(" {
+		return name, nil
+	}
+	var cols []string
+	depth := 0
+	start := true
+	for i++; i < len(stmt); i++ {
+		switch t := stmt[i]; t {
+		case "(":
+			depth++
+		case ")":
+			if depth == 0 {
+				return name, cols
+			}
+			depth--
+		case ",":
+			if depth == 0 {
+				start = true
+			}
+		default:
+			if start && depth == 0 {
+				start = false
+				if strings.HasPrefix(t, "`") || !isSQLKeyword(t) {
+					cols = append(cols, sqlIdent(t))
+				}
+			}
+		}
+	}
+	return name, cols
+}
+
+func isSQLKeyword(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IF", "NOT", "EXISTS", "PRIMARY", "KEY", "UNIQUE", "INDEX", "CONSTRAINT", "FULLTEXT", "FOREIGN":
+		return true
+	}
+	return false
+}
+
+func sqlIdent(s string) string {
+	return strings.Trim(s, "`\"")
+}
+
+func sqlInsert(stmt []string, want map[string]struct{}, columns map[string][]string, fnc func(table string, row sqlRow) error) error {
+	i := 1
+	for i < len(stmt) && !strings.EqualFold(stmt[i], "INTO") {
+		i++
+	}
+	i++
+	if i >= len(stmt) {
+		return nil
+	}
+	name := sqlIdent(stmt[i])
+	if _, ok := want[name]; !ok {
+		return nil
+	}
+	i++
+	cols := columns[name]
+	if i < len(stmt) && stmt[i] == "(" {
+		cols = nil
+		for i++; i < len(stmt) && stmt[i] != ")"; i++ {
+			if stmt[i] != "," {
+				cols = append(cols, sqlIdent(stmt[i]))
+			}
+		}
+		i++
+	}
+	if i >= len(stmt) || !strings.EqualFold(stmt[i], "VALUES") {
+		return fmt.Errorf("unsupported insert statement for %q", name)
+	} else if len(cols) == 0 {
+		return fmt.Errorf("unknown columns for %q", name)
+	}
+	for i++; i < len(stmt); i++ {
+		if stmt[i] == "," {
+			continue
+		} else if stmt[i] != "(" {
+			return fmt.Errorf("unexpected token in %q values: %q", name, stmt[i])
+		}
+		row := make(sqlRow, len(cols))
+		col := 0
+		for i++; i < len(stmt) && stmt[i] != ")"; i++ {
+			if stmt[i] == "," {
+				col++
+				continue
+			}
+			if col < len(cols) {
+				row[cols[col]] = sqlValue(stmt[i])
+			}
+		}
+		if err := fnc(name, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlValue unquotes a value token.
+func sqlValue(t string) string {
+	if strings.HasPrefix(t, "'") {
+		return t[1:]
+	} else if strings.EqualFold(t, "NULL") {
+		return sqlNull
+	}
+	return t
+}
+
+// sqlParser splits MySQL dump into statements and tokens.
+// String tokens are returned unescaped with a single quote prefix.
+type sqlParser struct {
+	r *bufio.Reader
+}
+
+func (p *sqlParser) statement() ([]string, error) {
+	var (
+		toks []string
+		buf  strings.Builder
+	)
+	flush := func() {
+		if buf.Len() != 0 {
+			toks = append(toks, buf.String())
+			buf.Reset()
+		}
+	}
+	for {
+		c, _, err := p.r.ReadRune()
+		if err == io.EOF {
+			flush()
+			if len(toks) == 0 {
+				return nil, io.EOF
+			}
+			return toks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == ';':
+			flush()
+			return toks, nil
+		case c == '-' && buf.Len() == 0:
+			if next, err := p.r.Peek(1); err == nil && next[0] == '-' {
+				if _, err = p.r.ReadString('\n'); err != nil && err != io.EOF {
+					return nil, err
+				}
+				continue
+			}
+			buf.WriteRune(c)
+		case c == '#' && buf.Len() == 0:
+			if _, err = p.r.ReadString('\n'); err != nil && err != io.EOF {
+				return nil, err
+			}
+		case c == '/' && buf.Len() == 0:
+			if next, err := p.r.Peek(1); err == nil && next[0] == '*' {
+				if err = p.skipComment(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			buf.WriteRune(c)
+		case c == '\'' || c == '"':
+			flush()
+			s, err := p.quoted(c)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, "'"+s)
+		case c == '`':
+			flush()
+			s, err := p.r.ReadString('`')
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, "`"+s)
+		case c == '(' || c == ')' || c == ',':
+			flush()
+			toks = append(toks, string(c))
+		case unicode.IsSpace(c):
+			flush()
+		default:
+			buf.WriteRune(c)
+		}
+	}
+}
+
+func (p *sqlParser) skipComment() error {
+	prev := rune(0)
+	for {
+		c, _, err := p.r.ReadRune()
+		if err == io.EOF {
+			return errors.New("unterminated comment")
+		} else if err != nil {
+			return err
+		}
+		if prev == '*' && c == '/' {
+			return nil
+		}
+		prev = c
+	}
+}
+
+func (p *sqlParser) quoted(q rune) (string, error) {
+	var buf strings.Builder
+	for {
+		c, _, err := p.r.ReadRune()
+		if err == io.EOF {
+			return "", errors.New("unterminated string")
+		} else if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\\':
+			c, _, err = p.r.ReadRune()
+			if err != nil {
+				return "", err
+			}
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case '0':
+				c = 0
+			case 'Z':
+				c = 26
+			}
+			buf.WriteRune(c)
+		case q:
+			if next, err := p.r.Peek(1); err == nil && rune(next[0]) == q {
+				// doubled quote
+				_, _, _ = p.r.ReadRune()
+				buf.WriteRune(q)
+				continue
+			}
+			return buf.String(), nil
+		default:
+			buf.WriteRune(c)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package hubdb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/direct-connect/go-dcpp/hub"
+
+	"github.com/hidal-go/hidalgo/filter"
+	"github.com/hidal-go/hidalgo/tuple"
+	"github.com/hidal-go/hidalgo/values"
+)
+
+func (db *tupleDatabase) createStorageV1(ctx context.Context, tx tuple.Tx) error {
+	return db.createTable(ctx, tx, tuple.Header{
+		Name: tableStorage,
+		Key: []tuple.KeyField{
+			{Name: "ns", Type: values.StringType{}},
+			{Name: "key", Type: values.StringType{}},
+		},
+		Data: []tuple.Field{
+			{Name: "value", Type: values.StringType{}},
+		},
+	})
+}
+
+func (db *tupleDatabase) openStorage(ctx context.Context) error {
+	tbl, err := db.db.Table(ctx, tableStorage)
+	if err == nil {
+		db.storage = tbl
+		return nil
+	} else if err != tuple.ErrTableNotFound {
+		return err
+	}
+	if err := db.inTx(ctx, true, db.createStorageV1); err != nil {
+		return err
+	}
+	tbl, err = db.db.Table(ctx, tableStorage)
+	if err != nil {
+		return err
+	}
+	db.storage = tbl
+	return nil
+}
+
+func decodeValue(data tuple.Data) (string, error) {
+	if len(data) != 1 {
+		return "", fmt.Errorf("invalid storage table format (%d)", len(data))
+	}
+	v, ok := data[0].(values.String)
+	if !ok {
+		return "", fmt.Errorf("expected string value, got: %T", data[0])
+	}
+	return string(v), nil
+}
+
+func (db *tupleDatabase) GetValue(ns, key string) (string, bool, error) {
+	tx, err := db.db.Tx(false)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Close()
+
+	tbl, err := db.storage.Open(tx)
+	if err != nil {
+		return "", false, err
+	}
+	data, err := tbl.GetTuple(context.TODO(), tuple.SKey(ns, key))
+	if err == tuple.ErrNotFound {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	v, err := decodeValue(data)
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+func (db *tupleDatabase) PutValue(ns, key, val string) error {
+	return db.UpdateValue(ns, key, func(_ string, _ bool) (string, error) {
+		return val, nil
+	})
+}
+
+func (db *tupleDatabase) UpdateValue(ns, key string, fnc func(val string, ok bool) (string, error)) error {
+	return db.inTx(context.TODO(), true, func(ctx context.Context, tx tuple.Tx) error {
+		tbl, err := db.storage.Open(tx)
+		if err != nil {
+			return err
+		}
+		var (
+			cur   string
+			exist bool
+		)
+		data, err := tbl.GetTuple(ctx, tuple.SKey(ns, key))
+		if err == nil {
+			cur, err = decodeValue(data)
+			if err != nil {
+				return err
+			}
+			exist = true
+		} else if err != tuple.ErrNotFound {
+			return err
+		}
+		val, err := fnc(cur, exist)
+		if err != nil {
+			return err
+		}
+		return tbl.UpdateTuple(ctx, tuple.Tuple{
+			Key:  tuple.SKey(ns, key),
+			Data: tuple.SData(val),
+		}, &tuple.UpdateOpt{Upsert: true})
+	})
+}
+
+func (db *tupleDatabase) DelValue(ns, key string) error {
+	return db.inTx(context.TODO(), true, func(ctx context.Context, tx tuple.Tx) error {
+		tbl, err := db.storage.Open(tx)
+		if err != nil {
+			return err
+		}
+		return tbl.DeleteTuples(ctx, &tuple.Filter{
+			KeyFilter: tuple.Keys{tuple.SKey(ns, key)},
+		})
+	})
+}
+
+func (db *tupleDatabase) ListValues(ns, prefix string) ([]hub.KeyValue, error) {
+	tx, err := db.db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	tbl, err := db.storage.Open(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	kf := tuple.KeyFilters{filter.EQ(values.String(ns))}
+	if prefix != "" {
+		kf = append(kf, filter.Prefix(values.String(prefix)))
+	}
+	ctx := context.TODO()
+	it := tbl.Scan(&tuple.ScanOptions{
+		Sort:   tuple.SortAsc,
+		Filter: &tuple.Filter{KeyFilter: kf},
+	})
+	defer it.Close()
+	var out []hub.KeyValue
+	for it.Next(ctx) {
+		k, ok := it.Key()[1].(values.String)
+		if !ok {
+			return nil, fmt.Errorf("expected string key, got: %T", it.Key()[1])
+		}
+		v, err := decodeValue(it.Data())
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, hub.KeyValue{Key: string(k), Value: v})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (db *tupleDatabase) ListNamespaces() ([]string, error) {
+	tx, err := db.db.Tx(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	tbl, err := db.storage.Open(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.TODO()
+	it := tbl.Scan(&tuple.ScanOptions{
+		KeysOnly: true,
+		Sort:     tuple.SortAsc,
+	})
+	defer it.Close()
+	var out []string
+	for it.Next(ctx) {
+		ns, ok := it.Key()[0].(values.String)
+		if !ok {
+			return nil, fmt.Errorf("expected string namespace, got: %T", it.Key()[0])
+		}
+		if len(out) == 0 || out[len(out)-1] != string(ns) {
+			out = append(out, string(ns))
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,59 @@
+package hubdb
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+func TestStorage(t *testing.T) {
+	db, closer := openTestDB(t)
+	defer closer()
+
+	require.NoError(t, db.PutValue("a", "seen:bob", "1"))
+	require.NoError(t, db.PutValue("a", "seen:alice", "2"))
+	require.NoError(t, db.PutValue("a", "karma:bob", "3"))
+	require.NoError(t, db.PutValue("b", "seen:bob", "4"))
+
+	v, ok, err := db.GetValue("a", "seen:bob")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "1", v)
+
+	_, ok, err = db.GetValue("a", "seen:carol")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	list, err := db.ListValues("a", "seen:")
+	require.NoError(t, err)
+	require.Equal(t, []hub.KeyValue{
+		{Key: "seen:alice", Value: "2"},
+		{Key: "seen:bob", Value: "1"},
+	}, list)
+
+	incr := func(v string, ok bool) (string, error) {
+		n, _ := strconv.Atoi(v)
+		return strconv.Itoa(n + 1), nil
+	}
+	require.NoError(t, db.UpdateValue("a", "karma:bob", incr))
+	require.NoError(t, db.UpdateValue("a", "karma:alice", incr))
+	list, err = db.ListValues("a", "karma:")
+	require.NoError(t, err)
+	require.Equal(t, []hub.KeyValue{
+		{Key: "karma:alice", Value: "1"},
+		{Key: "karma:bob", Value: "4"},
+	}, list)
+
+	require.NoError(t, db.DelValue("a", "seen:bob"))
+	require.NoError(t, db.DelValue("a", "seen:carol"))
+	list, err = db.ListValues("a", "seen:")
+	require.NoError(t, err)
+	require.Equal(t, []hub.KeyValue{{Key: "seen:alice", Value: "2"}}, list)
+
+	spaces, err := db.ListNamespaces()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, spaces)
+}
@@ -0,0 +1,122 @@
+package hubdb
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+const (
+	verlihubRegList = "reglist"
+	verlihubBanList = "banlist"
+)
+
+// verlihubProfile maps Verlihub user classes to go-hub profiles.
+func verlihubProfile(class int) string {
+	switch {
+	case class >= 5: // admin, master
+		return hub.ProfileNameRoot
+	case class >= 3: // operator, cheef
+		return hub.ProfileNameOperator
+	case class == 2:
+		return "vip"
+	case class == 1:
+		return hub.ProfileNameRegistered
+	}
+	return ""
+}
+
+// FromVerlihub reads registered users and bans from a MySQL dump of the Verlihub database.
+// Only reglist and banlist tables are used.
+func FromVerlihub(r io.Reader) (*Dump, *MigrateReport, error) {
+	d := newMigrateDump()
+	rep := &MigrateReport{}
+	now := time.Now()
+	err := readSQLDump(r, []string{verlihubRegList, verlihubBanList}, func(table string, row sqlRow) error {
+		switch table {
+		case verlihubRegList:
+			verlihubUser(d, rep, row)
+		case verlihubBanList:
+			verlihubBan(d, rep, row, now)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, rep, nil
+}
+
+func verlihubUser(d *Dump, rep *MigrateReport, row sqlRow) {
+	name := row["nick"]
+	if name == "" || name == sqlNull {
+		rep.skipf("user without a name")
+		return
+	}
+	class, _ := strconv.Atoi(row["class"])
+	profile := verlihubProfile(class)
+	if profile == "" {
+		rep.skipf("user %q: unsupported class %d", name, class)
+		return
+	}
+	if enabled, ok := row["enabled"]; ok && enabled == "0" {
+		rep.skipf("user %q: account is disabled", name)
+		return
+	}
+	pass := row["login_pwd"]
+	if pass == "" || pass == sqlNull {
+		rep.skipf("user %q: no password", name)
+		return
+	} else if crypt := row["pwd_crypt"]; crypt != "" && crypt != "0" {
+		rep.skipf("user %q: hashed passwords cannot be migrated", name)
+		return
+	}
+	if profile == "vip" {
+		if _, ok := d.Profiles[profile]; !ok {
+			d.Profiles[profile] = hub.Map{hub.ProfileParent: hub.ProfileNameRegistered}
+		}
+	}
+	d.addUser(rep, DumpUser{
+		Name:    name,
+		Pass:    pass,
+		Profile: profile,
+	})
+}
+
+func verlihubBan(d *Dump, rep *MigrateReport, row sqlRow, now time.Time) {
+	var until time.Time
+	if v, _ := strconv.ParseInt(row["date_limit"], 10, 64); v > 0 {
+		until = time.Unix(v, 0).UTC()
+		if until.Before(now) {
+			return // expired
+		}
+	}
+	if from, to := row["range_fr"], row["range_to"]; from != "" && from != "0" && from != sqlNull && from != to {
+		rep.skipf("range ban %s-%s: not supported", from, to)
+		return
+	}
+	reason := row["reason"]
+	if reason == sqlNull {
+		reason = ""
+	}
+	if op := row["nick_op"]; op != sqlNull {
+		reason = hub.BanReason(reason, op)
+	}
+	b := DumpBan{Reason: reason}
+	if ip := net.ParseIP(strings.TrimSpace(row["ip"])); ip != nil {
+		b.IP = ip.String()
+	} else if nick := strings.TrimSpace(row["nick"]); nick != "" && nick != sqlNull {
+		b.Key = string(hub.NickBanKey(nick))
+	} else {
+		rep.skipf("ban %q: not supported", row["host"])
+		return
+	}
+	if !until.IsZero() {
+		b.Until = &until
+	}
+	d.Bans = append(d.Bans, b)
+}
@@ -182,8 +182,19 @@ func (h *Hub) loadBans() error {
 	if err != nil {
 		return err
 	}
+	now := time.Now()
+	var expired []BanKey
 	for _, b := range bans {
-		h.hardBlockKey(BanKey(b.Key))
+		if b.Expired(now) {
+			expired = append(expired, b.Key)
+		} else if b.Hard && b.Until.IsZero() && b.Key.ToIP() != nil {
+			h.hardBlockKey(b.Key)
+		} else {
+			h.addBanList(b)
+		}
+	}
+	if len(expired) != 0 {
+		_ = h.db.DelBans(expired)
 	}
 	if len(bans) != 0 {
 		h.Logf("loaded %d bans", len(bans))
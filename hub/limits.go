@@ -0,0 +1,186 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	// ConfigLimitIP is the max number of concurrent connections from a single IP (0 - no limit).
+	ConfigLimitIP = "limits.ip"
+	// ConfigLimitSubnet is the max number of concurrent connections from a single /24 IPv4 or /64 IPv6 subnet (0 - no limit).
+	ConfigLimitSubnet = "limits.subnet"
+	// ConfigLimitAction is an action for connections over the limit: reject, notify or allow.
+	ConfigLimitAction = "limits.action"
+	// ConfigCloneAction is an action for clones (users with the same share size and CID): reject, notify or allow.
+	ConfigCloneAction = "clones.action"
+	// ConfigCloneIP enables detection of clones with the same share size and IP.
+	// NMDC users have no CID, thus they are only detected as clones if this option is set.
+	ConfigCloneIP = "clones.ip"
+
+	limitReject = "reject"
+	limitNotify = "notify"
+	limitAllow  = "allow"
+
+	subnetBitsIPv4 = 24
+	subnetBitsIPv6 = 64
+)
+
+var (
+	errTooManyConns = errors.New("too many connections from your address")
+	errCloneUser    = errors.New("clones are not allowed")
+)
+
+type connLimits struct {
+	sync.Mutex
+	byIP     map[string]int
+	bySubnet map[string]int
+}
+
+// connKeys returns IP and subnet keys for the address.
+func connKeys(a net.Addr) (ip, subnet string, ok bool) {
+	addr, ok := a.(*net.TCPAddr)
+	if !ok || addr.IP == nil {
+		return "", "", false
+	}
+	var mask net.IPMask
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		mask = net.CIDRMask(subnetBitsIPv4, 32)
+	} else {
+		mask = net.CIDRMask(subnetBitsIPv6, 128)
+	}
+	return addr.IP.String(), addr.IP.Mask(mask).String(), true
+}
+
+// trackConn counts a new connection and marks it if the connection is over the limit.
+// It returns a function that must be called when the connection is closed.
+func (h *Hub) trackConn(cinfo *ConnInfo) func() {
+	ip, subnet, ok := connKeys(cinfo.Remote)
+	if !ok {
+		return func() {}
+	}
+	maxIP, _ := h.GetConfigInt(ConfigLimitIP)
+	maxSubnet, _ := h.GetConfigInt(ConfigLimitSubnet)
+
+	l := &h.limits
+	l.Lock()
+	if l.byIP == nil {
+		l.byIP = make(map[string]int)
+		l.bySubnet = make(map[string]int)
+	}
+	l.byIP[ip]++
+	l.bySubnet[subnet]++
+	if maxIP > 0 && int64(l.byIP[ip]) > maxIP {
+		cinfo.overLimit = fmt.Sprintf("%d connections from %s", l.byIP[ip], ip)
+	} else if maxSubnet > 0 && int64(l.bySubnet[subnet]) > maxSubnet {
+		cinfo.overLimit = fmt.Sprintf("%d connections from %s subnet", l.bySubnet[subnet], subnet)
+	}
+	l.Unlock()
+	return func() {
+		l.Lock()
+		if l.byIP[ip]--; l.byIP[ip] <= 0 {
+			delete(l.byIP, ip)
+		}
+		if l.bySubnet[subnet]--; l.bySubnet[subnet] <= 0 {
+			delete(l.bySubnet, subnet)
+		}
+		l.Unlock()
+	}
+}
+
+func (h *Hub) limitAction(key, def string) string {
+	v, ok := h.GetConfigString(key)
+	switch v {
+	case limitReject, limitNotify, limitAllow:
+		return v
+	}
+	if ok && v != "" {
+		h.Logf("invalid value for %s: %q", key, v)
+	}
+	return def
+}
+
+// findClone returns an online peer with the same share size and the same CID.
+// If ConfigCloneIP is set, peers with the same share size and the same IP are matched as well.
+func (h *Hub) findClone(peer Peer) Peer {
+	share := peer.UserInfo().Share
+	if share == 0 {
+		return nil
+	}
+	var (
+		ip    string
+		hasIP bool
+	)
+	if v, _ := h.GetConfigBool(ConfigCloneIP); v {
+		ip, _, hasIP = connKeys(peer.RemoteAddr())
+	}
+	cid, hasCID := peerCID(peer)
+	if !hasIP && !hasCID {
+		return nil
+	}
+	for _, p2 := range h.Peers() {
+		if p2 == peer || IsBot(p2) || p2.UserInfo().Share != share {
+			continue
+		}
+		if cid2, ok := peerCID(p2); hasCID && ok && cid2 == cid {
+			return p2
+		}
+		if ip2, _, ok := connKeys(p2.RemoteAddr()); hasIP && ok && ip2 == ip {
+			return p2
+		}
+	}
+	return nil
+}
+
+// peerCID returns the CID of ADC peers.
+func peerCID(p Peer) (CID, bool) {
+	ap, ok := p.(*adcPeer)
+	if !ok || ap.info.cid == (CID{}) {
+		return CID{}, false
+	}
+	return ap.info.cid, true
+}
+
+// checkConnLimits applies bans, connection limits and clone detection to a peer during the handshake.
+// Users with the bypass permission are not affected by limits.
+func (h *Hub) checkConnLimits(peer Peer) error {
+	if err := h.checkBans(peer); err != nil {
+		return err
+	}
+	if peer.User().HasPerm(PermLimitsBypass) {
+		return nil
+	}
+	if peer.User() == nil && h.UnderAttack() {
+		cntConnBlocked.WithLabelValues(blockReasonAttack).Add(1)
+		return errUnderAttack
+	}
+	if c := peer.ConnInfo(); c != nil && c.overLimit != "" {
+		switch h.limitAction(ConfigLimitAction, limitReject) {
+		case limitReject:
+			cntConnLimited.Add(1)
+			h.Logf("%s: rejected %q: %s", peer.RemoteAddr(), peer.Name(), c.overLimit)
+			return errTooManyConns
+		case limitNotify:
+			h.SendOpChat(fmt.Sprintf("connection limit: %s (%s)", peer.Name(), c.overLimit))
+		}
+	}
+	action := h.limitAction(ConfigCloneAction, limitAllow)
+	if action == limitAllow {
+		return nil
+	}
+	clone := h.findClone(peer)
+	if clone == nil {
+		return nil
+	}
+	switch action {
+	case limitReject:
+		cntConnClones.Add(1)
+		h.Logf("%s: rejected %q: clone of %q", peer.RemoteAddr(), peer.Name(), clone.Name())
+		return errCloneUser
+	case limitNotify:
+		h.SendOpChat(fmt.Sprintf("clone detected: %s is a clone of %s", peer.Name(), clone.Name()))
+	}
+	return nil
+}
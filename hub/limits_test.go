@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimits(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	h.setConfigInt(ConfigLimitIP, 2)
+	h.setConfigInt(ConfigLimitSubnet, 2)
+
+	conn := func(ip string) (*ConnInfo, func()) {
+		c := &ConnInfo{Remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 411}}
+		return c, h.trackConn(c)
+	}
+
+	c1, done1 := conn("10.0.0.1")
+	require.Empty(t, c1.overLimit)
+	c2, done2 := conn("10.0.0.1")
+	require.Empty(t, c2.overLimit)
+	c3, done3 := conn("10.0.0.1")
+	require.NotEmpty(t, c3.overLimit)
+	done3()
+
+	c4, done4 := conn("10.0.0.2")
+	require.NotEmpty(t, c4.overLimit)
+	done4()
+
+	done1()
+	done2()
+	c5, done5 := conn("10.0.0.1")
+	require.Empty(t, c5.overLimit)
+	done5()
+
+	require.Empty(t, h.limits.byIP)
+	require.Empty(t, h.limits.bySubnet)
+}
+
+func newTestADCPeer(ip string, cid byte, share uint64) *adcPeer {
+	p := &adcPeer{BasePeer: BasePeer{
+		cinfo: &ConnInfo{Remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 411}},
+	}}
+	p.info.cid[0] = cid
+	p.info.user.ShareSize = int64(share)
+	return p
+}
+
+func newTestNMDCPeer(ip string, share uint64) *nmdcPeer {
+	p := &nmdcPeer{BasePeer: BasePeer{
+		cinfo: &ConnInfo{Remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 411}},
+	}}
+	p.info.user.ShareSize = share
+	return p
+}
+
+func TestFindClone(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+
+	a1 := newTestADCPeer("10.0.0.1", 1, 100)
+	n1 := newTestNMDCPeer("10.0.0.2", 200)
+	h.cacheList([]Peer{a1, n1})
+
+	var cases = []struct {
+		name  string
+		byIP  bool
+		peer  Peer
+		clone Peer
+	}{
+		{name: "same cid", peer: newTestADCPeer("10.0.0.3", 1, 100), clone: a1},
+		{name: "same ip", peer: newTestADCPeer("10.0.0.1", 2, 100)},
+		{name: "different share", peer: newTestADCPeer("10.0.0.1", 1, 101)},
+		{name: "different cid and ip", peer: newTestADCPeer("10.0.0.3", 2, 100)},
+		{name: "empty share", peer: newTestNMDCPeer("10.0.0.2", 0)},
+		{name: "nmdc same ip", peer: newTestNMDCPeer("10.0.0.2", 200)},
+		{name: "same ip by ip", byIP: true, peer: newTestADCPeer("10.0.0.1", 2, 100), clone: a1},
+		{name: "same cid by ip", byIP: true, peer: newTestADCPeer("10.0.0.3", 1, 100), clone: a1},
+		{name: "nmdc same ip by ip", byIP: true, peer: newTestNMDCPeer("10.0.0.2", 200), clone: n1},
+		{name: "nmdc different ip by ip", byIP: true, peer: newTestNMDCPeer("10.0.0.3", 200)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h.setConfigBool(ConfigCloneIP, c.byIP)
+			require.Equal(t, c.clone, h.findClone(c.peer))
+		})
+	}
+}
+
+func TestCheckConnLimits(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	h.cacheList([]Peer{newTestNMDCPeer("10.0.0.1", 100), newTestADCPeer("10.0.0.2", 1, 300)})
+
+	over := newTestNMDCPeer("10.0.0.2", 200)
+	over.cinfo.overLimit = "3 connections from 10.0.0.2"
+	require.Equal(t, errTooManyConns, h.checkConnLimits(over))
+	h.setConfigString(ConfigLimitAction, limitNotify)
+	require.NoError(t, h.checkConnLimits(over))
+
+	// clones are allowed by default
+	clone := newTestADCPeer("10.0.0.3", 1, 300)
+	require.NoError(t, h.checkConnLimits(clone))
+	h.setConfigString(ConfigCloneAction, limitReject)
+	require.Equal(t, errCloneUser, h.checkConnLimits(clone))
+	h.setConfigString(ConfigCloneAction, limitNotify)
+	require.NoError(t, h.checkConnLimits(clone))
+	require.NoError(t, h.checkConnLimits(newTestADCPeer("10.0.0.3", 1, 301)))
+
+	// NMDC clones are only detected by IP
+	h.setConfigString(ConfigCloneAction, limitReject)
+	nclone := newTestNMDCPeer("10.0.0.1", 100)
+	require.NoError(t, h.checkConnLimits(nclone))
+	h.setConfigBool(ConfigCloneIP, true)
+	require.Equal(t, errCloneUser, h.checkConnLimits(nclone))
+}
@@ -49,9 +49,17 @@ var (
 		Name: "dc_conn_accepted",
 		Help: "The total number of accepted connections",
 	})
-	cntConnBlocked = promauto.NewCounter(prometheus.CounterOpts{
+	cntConnBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "dc_conn_blocked",
 		Help: "The total number of blocked connections",
+	}, []string{"reason"})
+	cntConnLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dc_conn_limited",
+		Help: "The total number of connections rejected by per-IP and per-subnet limits",
+	})
+	cntConnClones = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dc_conn_clones",
+		Help: "The total number of rejected clones",
 	})
 	cntConnError = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "dc_conn_error",
@@ -206,6 +214,26 @@ var (
 		Name: "dc_search_dur",
 		Help: "The time to send the search request",
 	})
+	cntSearchDup = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dc_search_dup",
+		Help: "The total number of duplicate search requests ignored",
+	})
+	cntSearchCacheHit = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dc_search_cache_hit",
+		Help: "The total number of search requests served from the cache",
+	})
+	cntSearchCacheMiss = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dc_search_cache_miss",
+		Help: "The total number of search requests not found in the cache",
+	})
+	cntSearchResultsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dc_search_results_dropped",
+		Help: "The total number of search results dropped because of the limits",
+	})
+	cntSearchBotDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dc_search_bot_results_dropped",
+		Help: "The total number of search results dropped because the bot did not read them in time",
+	})
 
 	sizeNMDCLinesR = promauto.NewHistogram(prometheus.HistogramOpts{
 		Name: "dc_nmdc_lines_read",
@@ -0,0 +1,164 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	errNickBlocked  = errors.New("name is not allowed")
+	errNickReserved = errors.New("name is reserved")
+)
+
+// NickPolicy restricts names that users can use on the hub.
+type NickPolicy struct {
+	// Reserved is a list of name patterns that only specific profiles can use.
+	Reserved []ReservedNick
+	// Blocked is a list of regular expressions for names that cannot be used.
+	Blocked []string
+	// Prefixes requires the password of a registered account for names starting with its name.
+	Prefixes bool
+}
+
+// ReservedNick is a name pattern reserved for specific profiles.
+type ReservedNick struct {
+	// Pattern is a case-insensitive name pattern. '*' matches any sequence of characters
+	// and '?' matches a single character. All other characters match themselves.
+	Pattern string
+	// Profiles allowed to use names matching the pattern. Child profiles are allowed as well.
+	Profiles []string
+}
+
+type reservedNick struct {
+	re       *regexp.Regexp
+	profiles []string
+}
+
+type nickPolicy struct {
+	reserved []reservedNick
+	blocked  []*regexp.Regexp
+	prefixes bool
+}
+
+// compileNickPattern converts a wildcard pattern to a regexp.
+func compileNickPattern(pattern string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("(?i)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+// SetNickPolicy validates and applies the name policy.
+func (h *Hub) SetNickPolicy(p NickPolicy) error {
+	np := &nickPolicy{prefixes: p.Prefixes}
+	for _, r := range p.Reserved {
+		if r.Pattern == "" {
+			return errors.New("reserved name pattern should not be empty")
+		}
+		re, err := compileNickPattern(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid reserved name pattern %q: %v", r.Pattern, err)
+		}
+		np.reserved = append(np.reserved, reservedNick{
+			re: re, profiles: append([]string{}, r.Profiles...),
+		})
+	}
+	for _, s := range p.Blocked {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid blocked name regexp %q: %v", s, err)
+		}
+		np.blocked = append(np.blocked, re)
+	}
+	h.nicks.Store(np)
+	return nil
+}
+
+func (h *Hub) getNickPolicy() *nickPolicy {
+	p, _ := h.nicks.Load().(*nickPolicy)
+	return p
+}
+
+// checkNickPolicy checks if the name can be used according to the nick policy.
+func (h *Hub) checkNickPolicy(name string) error {
+	np := h.getNickPolicy()
+	if np == nil {
+		return nil
+	}
+	for _, re := range np.blocked {
+		if re.MatchString(name) {
+			return errNickBlocked
+		}
+	}
+	var prof *UserProfile
+	for _, r := range np.reserved {
+		if !r.re.MatchString(name) {
+			continue
+		}
+		if prof == nil {
+			u, _, err := h.getUser(name)
+			if err != nil {
+				return err
+			} else if u == nil {
+				return errNickReserved
+			}
+			prof = u.Profile()
+		}
+		allowed := prof.IsOwner()
+		for _, id := range r.profiles {
+			if allowed {
+				break
+			}
+			allowed = prof.HasParent(id)
+		}
+		if !allowed {
+			return errNickReserved
+		}
+	}
+	return nil
+}
+
+// prefixOwner finds a registered account which name is a prefix of a given name.
+// It returns nil if the name prefix protection is disabled.
+func (h *Hub) prefixOwner(name string) (*UserRecord, error) {
+	if np := h.getNickPolicy(); np == nil || !np.prefixes || h.db == nil {
+		return nil, nil
+	}
+	// prefer the longest registered name
+	for n := len(name) - 1; n >= userNameMin; n-- {
+		if !utf8.RuneStart(name[n]) {
+			continue
+		}
+		rec, err := h.db.GetUser(name[:n])
+		if err != nil {
+			return nil, err
+		} else if rec != nil {
+			return rec, nil
+		}
+	}
+	return nil, nil
+}
+
+// getLoginUser returns the user and the account record that must be used to verify
+// the password. The user is nil if the name is protected by a registered name prefix.
+func (h *Hub) getLoginUser(name string) (*User, *UserRecord, error) {
+	u, rec, err := h.getUser(name)
+	if err != nil || rec != nil {
+		return u, rec, err
+	}
+	rec, err = h.prefixOwner(name)
+	return nil, rec, err
+}
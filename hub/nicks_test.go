@@ -0,0 +1,44 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNickPolicy(t *testing.T) {
+	h, err := NewHub(Config{
+		Nicks: NickPolicy{
+			Reserved: []ReservedNick{
+				{Pattern: "[OP]*", Profiles: []string{ProfileNameOperator}},
+			},
+			Blocked:  []string{`(?i)badword`},
+			Prefixes: true,
+		},
+	}, nil)
+	require.NoError(t, err)
+	require.NoError(t, h.loadProfiles())
+
+	require.NoError(t, h.registerUser(UserRecord{Name: "[OP]alice", Pass: "secret", Profile: ProfileNameOperator}))
+	require.NoError(t, h.registerUser(UserRecord{Name: "[OP]bob", Pass: "secret"}))
+	require.NoError(t, h.registerUser(UserRecord{Name: "carol", Pass: "secret"}))
+
+	require.NoError(t, h.checkNickPolicy("[OP]alice"))
+	require.Equal(t, errNickReserved, h.checkNickPolicy("[OP]bob"))
+	require.Equal(t, errNickReserved, h.checkNickPolicy("[op]dave"))
+	require.NoError(t, h.checkNickPolicy("OPdave"))
+	require.Equal(t, errNickBlocked, h.checkNickPolicy("xBadWordx"))
+
+	u, rec, err := h.getLoginUser("carol_away")
+	require.NoError(t, err)
+	require.Nil(t, u)
+	require.NotNil(t, rec)
+	require.Equal(t, "carol", rec.Name)
+
+	u, rec, err = h.getLoginUser("dave")
+	require.NoError(t, err)
+	require.Nil(t, u)
+	require.Nil(t, rec)
+
+	require.Error(t, h.SetNickPolicy(NickPolicy{Blocked: []string{"("}}))
+}
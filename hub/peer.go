@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/direct-connect/go-dcpp/internal/safe"
 )
@@ -20,6 +21,13 @@ type ConnInfo struct {
 	TLSVers uint16
 	ALPN    string
 	Proto   string
+	// Keyprint of the client TLS certificate, if it was provided.
+	Keyprint string
+	// Login is the time when the user started the login.
+	Login time.Time
+
+	// overLimit is set if the connection exceeds per-IP or per-subnet limits.
+	overLimit string
 }
 
 type Peer interface {
@@ -111,6 +119,9 @@ type PeersLeaveEvent struct {
 }
 
 func (h *Hub) newBasePeer(p *BasePeer, c *ConnInfo) {
+	if c.Login.IsZero() {
+		c.Login = time.Now()
+	}
 	*p = BasePeer{
 		hub:   h,
 		cinfo: c,
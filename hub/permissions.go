@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Permission describes a permission or a flag that can be set in a user profile.
+type Permission struct {
+	// Name is a unique key of the permission in the profile map.
+	Name string
+	// Short is a one-line description of the permission.
+	Short string
+}
+
+var permissions struct {
+	sync.RWMutex
+	byName map[string]Permission
+}
+
+func init() {
+	for _, p := range []Permission{
+		{PermOwner, "full access to the hub"},
+		{FlagOpIcon, "show the operator icon"},
+		{FlagRegIcon, "show the registered user icon"},
+		{FlagTLSRequired, "require TLS connection"},
+
+		{PermRoomsJoin, "join chat rooms"},
+		{PermRoomsNew, "create new chat rooms"},
+		{PermRoomsList, "list chat rooms"},
+		{PermRoomsOpChat, "access the operator chat"},
+
+		{PermBroadcast, "send broadcast messages"},
+		{PermConfigWrite, "change hub settings"},
+		{PermConfigRead, "read hub settings"},
+		{PermTopic, "change the hub topic"},
+		{PermDrop, "drop users"},
+		{PermDropAll, "drop all users"},
+		{PermRedirect, "redirect users"},
+		{PermRedirectAll, "redirect all users"},
+		{PermRegister, "register users"},
+		{PermRegisterProfile, "register users with a specific profile"},
+		{PermIP, "view user IPs"},
+		{PermBanIP, "ban IPs"},
+		{PermProtos, "view protocol statistics"},
+		{PermUserInfo, "view and annotate registered accounts"},
+		{PermUserManage, "lock accounts and reset passwords"},
+		{PermLimitsBypass, "ignore connection limits and clone detection"},
+	} {
+		RegisterPermission(p)
+	}
+}
+
+// RegisterPermission declares a new profile permission. Registered permissions are used
+// to validate profiles and are listed in profile editing commands.
+//
+// Plugins should call this function in their init() function.
+func RegisterPermission(p Permission) {
+	if p.Name == "" || p.Name != strings.TrimSpace(p.Name) {
+		panic(fmt.Errorf("invalid permission name: %q", p.Name))
+	} else if p.Name == ProfileParent {
+		panic(fmt.Errorf("%q is a reserved profile key", p.Name))
+	}
+	permissions.Lock()
+	defer permissions.Unlock()
+	if permissions.byName == nil {
+		permissions.byName = make(map[string]Permission)
+	}
+	if p2, ok := permissions.byName[p.Name]; ok && p2 != p {
+		panic(fmt.Errorf("permission %q is already registered", p.Name))
+	}
+	permissions.byName[p.Name] = p
+}
+
+// LookupPermission returns a registered permission with a given name.
+func LookupPermission(name string) (Permission, bool) {
+	permissions.RLock()
+	p, ok := permissions.byName[name]
+	permissions.RUnlock()
+	return p, ok
+}
+
+// Permissions returns all registered permissions, sorted by name.
+func Permissions() []Permission {
+	permissions.RLock()
+	list := make([]Permission, 0, len(permissions.byName))
+	for _, p := range permissions.byName {
+		list = append(list, p)
+	}
+	permissions.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// ValidateProfile checks that all keys in the profile map are registered permissions
+// with boolean values.
+func ValidateProfile(m Map) error {
+	for k, v := range m {
+		if k == ProfileParent {
+			if _, ok := v.(string); !ok {
+				return fmt.Errorf("profile parent should be a string, got: %T", v)
+			}
+			continue
+		}
+		if _, ok := LookupPermission(k); !ok {
+			return fmt.Errorf("unknown permission: %q", k)
+		}
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("permission %q should be a boolean, got: %T", k, v)
+		}
+	}
+	return nil
+}
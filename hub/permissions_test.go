@@ -0,0 +1,33 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfilePerms(t *testing.T) {
+	require.NoError(t, ValidateProfile(Map{ProfileParent: ProfileNameOperator, PermBanIP: true}))
+	require.Error(t, ValidateProfile(Map{"unknown.perm": true}))
+	require.Error(t, ValidateProfile(Map{PermBanIP: "yes"}))
+
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, h.loadProfiles())
+
+	require.Error(t, h.SetProfilePerm(ProfileNameRegistered, "unknown.perm", true))
+	require.NoError(t, h.SetProfilePerm(ProfileNameRegistered, PermTopic, true))
+	require.True(t, h.Profile(ProfileNameOperator).Has(PermTopic))
+	m, err := h.db.GetProfile(ProfileNameRegistered)
+	require.NoError(t, err)
+	require.Equal(t, true, m[PermTopic])
+
+	// built-in permissions are reset to defaults
+	require.NoError(t, h.SetProfilePerm(ProfileNameRegistered, PermRoomsJoin, false))
+	require.False(t, h.Profile(ProfileNameRegistered).Has(PermRoomsJoin))
+	require.NoError(t, h.UnsetProfilePerm(ProfileNameRegistered, PermRoomsJoin))
+	require.True(t, h.Profile(ProfileNameRegistered).Has(PermRoomsJoin))
+
+	require.NoError(t, h.UnsetProfilePerm(ProfileNameRegistered, PermTopic))
+	require.False(t, h.Profile(ProfileNameOperator).Has(PermTopic))
+}
@@ -9,6 +9,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type Version struct {
@@ -71,6 +72,35 @@ func RegisterPlugin(p Plugin) {
 type plugins struct {
 	loaded []Plugin
 	paths  map[string]string
+
+	mu     sync.Mutex
+	scopes map[string]*Scope
+}
+
+// PluginScope returns a scope for a plugin with a given name. Everything registered in this scope
+// is removed from the hub after the plugin is closed.
+func (h *Hub) PluginScope(name string) *Scope {
+	h.plugins.mu.Lock()
+	defer h.plugins.mu.Unlock()
+	if s := h.plugins.scopes[name]; s != nil {
+		return s
+	}
+	if h.plugins.scopes == nil {
+		h.plugins.scopes = make(map[string]*Scope)
+	}
+	s := h.NewScope(name)
+	h.plugins.scopes[name] = s
+	return s
+}
+
+func (h *Hub) closePluginScope(name string) {
+	h.plugins.mu.Lock()
+	s := h.plugins.scopes[name]
+	delete(h.plugins.scopes, name)
+	h.plugins.mu.Unlock()
+	if s != nil {
+		_ = s.Close()
+	}
 }
 
 func (h *Hub) initPlugins() error {
@@ -79,6 +109,7 @@ func (h *Hub) initPlugins() error {
 		h.Logf("loading plugin: %s (%v)\n", p.Name(), p.Version())
 		err := p.Init(h, h.plugins.paths[name])
 		if err != nil {
+			h.closePluginScope(name)
 			h.stopPlugins()
 			return err
 		}
@@ -88,12 +119,15 @@ func (h *Hub) initPlugins() error {
 }
 
 func (h *Hub) stopPlugins() {
-	for _, p := range h.plugins.loaded {
+	for i := len(h.plugins.loaded) - 1; i >= 0; i-- {
+		p := h.plugins.loaded[i]
 		err := p.Close()
 		if err != nil {
 			h.Logf("error stopping the plugin %s: %v\n", p.Name(), err)
 		}
+		h.closePluginScope(p.Name())
 	}
+	h.plugins.loaded = nil
 }
 
 func (h *Hub) isPluginLoaded(n string) bool {
@@ -28,19 +28,20 @@ func (*hubStats) Version() hub.Version {
 
 func (p *hubStats) Init(h *hub.Hub, path string) error {
 	p.h = h
-	h.RegisterCommand(hub.Command{
+	sc := h.PluginScope(p.Name())
+	sc.RegisterCommand(hub.Command{
 		Menu:    []string{"Stats"},
 		Name:    "stats",
 		Aliases: []string{"hubinfo"},
 		Short:   "show hub stats",
 		Func:    p.cmdStats,
 	})
-	h.RegisterCommand(hub.Command{
+	sc.RegisterCommand(hub.Command{
 		Name:  "tlsinfo",
 		Short: "show info about TLS connections",
 		Func:  p.cmdTLSStats,
 	})
-	h.RegisterCommand(hub.Command{
+	sc.RegisterCommand(hub.Command{
 		Name:    "protos",
 		Aliases: []string{"protoinfo"},
 		Short:   "show protocol info about peer connections",
@@ -0,0 +1,81 @@
+package lua
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+// maxScriptErrors is the number of recent errors kept for each script.
+const maxScriptErrors = 10
+
+type scriptError struct {
+	time time.Time
+	err  string
+}
+
+// errorLog keeps recent load and runtime errors of each script.
+// The history is kept when the script is reloaded.
+type errorLog struct {
+	sync.Mutex
+	m map[string][]scriptError
+}
+
+// recordError adds the error to the history of the script.
+func (p *plugin) recordError(path string, err error) {
+	e := scriptError{time: p.h.Clock().Now(), err: err.Error()}
+	p.errlog.Lock()
+	defer p.errlog.Unlock()
+	if p.errlog.m == nil {
+		p.errlog.m = make(map[string][]scriptError)
+	}
+	list := append(p.errlog.m[path], e)
+	if len(list) > maxScriptErrors {
+		list = append([]scriptError{}, list[len(list)-maxScriptErrors:]...)
+	}
+	p.errlog.m[path] = list
+}
+
+// scriptErrors returns recent errors of a given script, or all the scripts if the path is empty.
+func (p *plugin) scriptErrors(path string) map[string][]scriptError {
+	p.errlog.Lock()
+	defer p.errlog.Unlock()
+	out := make(map[string][]scriptError)
+	for name, list := range p.errlog.m {
+		if path == "" || name == path {
+			out[name] = append([]scriptError{}, list...)
+		}
+	}
+	return out
+}
+
+func (p *plugin) cmdLuaErrors(peer hub.Peer, args string) error {
+	path := args
+	if path != "" {
+		path = p.scriptPath(path)
+	}
+	m := p.scriptErrors(path)
+	if len(m) == 0 {
+		_ = peer.HubChatMsg(hub.Message{Text: "No Lua script errors."})
+		return nil
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	buf.WriteString("Recent Lua script errors:\r\n")
+	for _, name := range names {
+		buf.WriteString("\r\n " + name + ":\r\n")
+		for _, e := range m[name] {
+			buf.WriteString("  [" + e.time.Format("2006-01-02 15:04:05") + "] " + e.err + "\r\n")
+		}
+	}
+	_ = peer.HubChatMsg(hub.Message{Text: buf.String()})
+	return nil
+}
@@ -0,0 +1,458 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lua "github.com/Shopify/go-lua"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+const (
+	// ConfigLuaMaxInstructions is the max number of Lua instructions a single script callback can execute (0 - no limit).
+	ConfigLuaMaxInstructions = "lua.limits.instructions"
+	// ConfigLuaMaxMemory is the approximate amount of memory in MB a single script callback can allocate (0 - no limit).
+	ConfigLuaMaxMemory = "lua.limits.memory"
+	// ConfigLuaMaxTime is the max time in milliseconds a single script callback can run (0 - no limit).
+	ConfigLuaMaxTime = "lua.limits.time"
+	// ConfigLuaMaxFailures is the number of limit violations after which the script is disabled (0 - never).
+	ConfigLuaMaxFailures = "lua.limits.failures"
+	// ConfigLuaTrusted is a comma-separated list of script file names that can access os and io libraries,
+	// and load other files with dofile and loadfile.
+	ConfigLuaTrusted = "lua.trusted"
+
+	defaultLuaMaxInstructions = 10000000
+	defaultLuaMaxMemory       = 64 // MB
+	defaultLuaMaxTime         = time.Second
+	defaultLuaMaxFailures     = 5
+
+	// hookInstructions is the number of instructions between limit checks.
+	// Sizes of strings are checked on each instruction if the memory limit is set.
+	hookInstructions = 1000
+	// memCheckEvery is the number of limit checks between memory checks.
+	// Walking the script state is expensive, thus it is only done for long-running callbacks.
+	memCheckEvery = 100
+	// memMaxDepth is the max depth of nested values checked by memory accounting.
+	memMaxDepth = 100
+)
+
+var (
+	errInstructionLimit = errors.New("instruction limit exceeded")
+	errMemoryLimit      = errors.New("memory limit exceeded")
+	errTimeLimit        = errors.New("time limit exceeded")
+)
+
+// limits tracks resources used by a single script callback.
+type limits struct {
+	maxInstr int64
+	maxMem   uint64
+	maxTime  time.Duration
+
+	start   time.Time
+	instr   int64
+	checks  int
+	memBase uint64
+	ticks   int // instructions since the last check
+
+	// violation is set when the callback exceeds one of the limits
+	violation error
+	failures  int
+	// every is the number of instructions between hook calls
+	every int
+}
+
+// configInt returns a non-negative int value from the config, or the default value if it's not set.
+func configInt(h *hub.Hub, key string, def int64) int64 {
+	if v, ok := h.GetConfigInt(key); ok && v >= 0 {
+		return v
+	}
+	return def
+}
+
+// reset prepares the limits for a new callback.
+func (l *limits) reset(h *hub.Hub) {
+	l.maxInstr = configInt(h, ConfigLuaMaxInstructions, defaultLuaMaxInstructions)
+	l.maxMem = uint64(configInt(h, ConfigLuaMaxMemory, defaultLuaMaxMemory)) * 1024 * 1024
+	l.maxTime = time.Duration(configInt(h, ConfigLuaMaxTime, int64(defaultLuaMaxTime/time.Millisecond))) * time.Millisecond
+	l.start = time.Now()
+	l.instr = 0
+	l.checks = 0
+	l.memBase = 0
+	l.ticks = 0
+	l.violation = nil
+}
+
+// hook is called each l.every instructions while the callback runs.
+func (l *limits) hook(st *lua.State) error {
+	if err := l.checkStrings(st); err != nil {
+		return err
+	}
+	l.ticks += l.every
+	if l.ticks < hookInstructions {
+		return nil
+	}
+	l.ticks = 0
+	return l.check(st)
+}
+
+// check is called periodically while the callback runs.
+func (l *limits) check(st *lua.State) error {
+	if l.violation != nil {
+		// the script may try to catch the error with pcall
+		return l.violation
+	}
+	l.instr += hookInstructions
+	l.checks++
+	if l.maxInstr > 0 && l.instr > l.maxInstr {
+		l.violation = errInstructionLimit
+	} else if l.maxTime > 0 && time.Since(l.start) > l.maxTime {
+		l.violation = errTimeLimit
+	} else if l.maxMem > 0 && l.checks%memCheckEvery == 1 {
+		// first check only records the baseline
+		if l.memBase == 0 {
+			l.memBase = memUsage(st, 0)
+		} else if memUsage(st, l.memBase+l.maxMem) > l.memBase+l.maxMem {
+			l.violation = errMemoryLimit
+		}
+	}
+	return l.violation
+}
+
+// checkAlloc checks if a single allocation of a given size is allowed.
+func (l *limits) checkAlloc(n int64) error {
+	if l.maxMem > 0 && n > 0 && uint64(n) > l.maxMem {
+		l.violation = errMemoryLimit
+	}
+	return l.violation
+}
+
+// checkStrings checks the total size of strings in the current function frame.
+// Concatenation can double the size of a string in a single instruction, so it's checked
+// on each instruction, long before the memory check of the whole state is done.
+func (l *limits) checkStrings(st *lua.State) error {
+	if l.violation != nil || l.maxMem == 0 {
+		return l.violation
+	}
+	var size int64
+	for i := st.Top(); i > 0; i-- {
+		if st.TypeOf(i) == lua.TypeString {
+			str, _ := st.ToString(i)
+			size += int64(len(str))
+		}
+	}
+	if err := l.checkAlloc(size); err != nil {
+		// go-lua doesn't clear the stack, drop the strings so they don't fail the next callbacks
+		for i := st.Top(); i > 0; i-- {
+			if st.TypeOf(i) == lua.TypeString {
+				st.PushNil()
+				st.Replace(i)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// joinSize returns the size of n strings of a given total size joined with a separator.
+// The result is capped at math.MaxInt64 instead of overflowing.
+func joinSize(n, size, sep int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	if sep > 0 && n-1 > (math.MaxInt64-size)/sep {
+		return math.MaxInt64
+	}
+	return size + (n-1)*sep
+}
+
+// repSize returns the size of the string s repeated n times with a separator.
+// The result is capped at math.MaxInt64 instead of overflowing.
+func repSize(n, s, sep int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	if s > 0 && n > math.MaxInt64/s {
+		return math.MaxInt64
+	}
+	return joinSize(n, n*s, sep)
+}
+
+// memWalker estimates the amount of memory used by the values reachable from the script state.
+type memWalker struct {
+	st   *lua.State
+	seen map[interface{}]struct{}
+	size uint64
+	max  uint64
+}
+
+// memUsage returns an approximate amount of memory used by the script state. Since go-lua allocates
+// all values on the Go heap shared by the whole process, the usage is estimated by walking the registry
+// (globals and loaded modules) and the functions on the call stack. Local variables are not counted.
+// The walk stops as soon as the usage exceeds max (0 - no limit).
+func memUsage(st *lua.State, max uint64) uint64 {
+	w := &memWalker{st: st, seen: make(map[interface{}]struct{}), max: max}
+	top := st.Top()
+	defer st.SetTop(top)
+	st.PushValue(lua.RegistryIndex)
+	w.walk(0)
+	for level := 0; !w.full(); level++ {
+		f, ok := lua.Stack(st, level)
+		if !ok {
+			break
+		}
+		lua.Info(st, "f", f)
+		w.walk(0)
+	}
+	return w.size
+}
+
+func (w *memWalker) full() bool {
+	return w.max > 0 && w.size > w.max
+}
+
+// walk accounts the value on top of the stack and pops it.
+func (w *memWalker) walk(depth int) {
+	st := w.st
+	defer st.Pop(1)
+	if w.full() || depth > memMaxDepth || !st.CheckStack(4) {
+		return
+	}
+	switch st.TypeOf(-1) {
+	case lua.TypeString:
+		str, _ := st.ToString(-1)
+		w.size += 16 + uint64(len(str))
+	case lua.TypeUserData:
+		w.size += 32
+		if st.MetaTable(-1) {
+			w.walk(depth + 1)
+		}
+	case lua.TypeTable:
+		if !w.markSeen(st.ToValue(-1)) {
+			return
+		}
+		w.size += 64
+		if st.MetaTable(-1) {
+			w.walk(depth + 1)
+		}
+		st.PushNil()
+		for st.Next(-2) {
+			w.size += 32
+			w.walk(depth + 1) // value
+			st.PushValue(-1)
+			w.walk(depth + 1) // key
+			if w.full() {
+				st.Pop(1)
+				return
+			}
+		}
+	case lua.TypeFunction:
+		if !w.markSeen(st.ToValue(-1)) {
+			return
+		}
+		w.size += 32
+		for i := 1; ; i++ {
+			if _, ok := lua.UpValue(st, -1, i); !ok {
+				break
+			}
+			w.walk(depth + 1)
+		}
+	default:
+		w.size += 16
+	}
+}
+
+// markSeen marks the table or function as visited. It returns false if it was already visited.
+func (w *memWalker) markSeen(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	if _, ok := w.seen[v]; ok {
+		return false
+	}
+	w.seen[v] = struct{}{}
+	return true
+}
+
+// IsTrusted checks if the script is allowed to access os and io libraries.
+func (s *Script) IsTrusted() bool {
+	list, _ := s.h.GetConfigString(ConfigLuaTrusted)
+	name := filepath.Base(s.file)
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" && (v == s.file || v == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// setLimitsHook installs the debug hook that checks the limits each n instructions.
+func (s *Script) setLimitsHook(n int) {
+	s.limits.every = n
+	lua.SetDebugHook(s.s, func(st *lua.State, _ lua.Debug) {
+		if err := s.limits.hook(st); err != nil {
+			if s.limits.every != 1 {
+				// make sure the script can't do anything after catching the error
+				s.setLimitsHook(1)
+			}
+			lua.Errorf(st, "%v", err)
+		}
+	}, lua.MaskCount, n)
+}
+
+// resetLimits prepares the script for a new callback.
+func (s *Script) resetLimits() {
+	s.limits.reset(s.h)
+	n := hookInstructions
+	if s.limits.maxMem > 0 {
+		n = 1
+	}
+	if s.limits.every != n {
+		s.setLimitsHook(n)
+	}
+}
+
+// setupSandbox installs the limits hook and removes unsafe functions from the standard library.
+func (s *Script) setupSandbox() {
+	s.setLimitsHook(hookInstructions)
+
+	st := s.s
+	// string.rep and table.concat can allocate a lot of memory in a single instruction
+	st.Global("string")
+	st.Field(-1, "rep")
+	rep := st.ToGoFunction(-1)
+	st.Pop(1)
+	st.PushGoFunction(func(st *lua.State) int {
+		str := lua.CheckString(st, 1)
+		n := lua.CheckInteger(st, 2)
+		sep := lua.OptString(st, 3, "")
+		if err := s.limits.checkAlloc(repSize(int64(n), int64(len(str)), int64(len(sep)))); err != nil {
+			lua.Errorf(st, "%v", err)
+		}
+		return rep(st)
+	})
+	st.SetField(-2, "rep")
+	st.Pop(1)
+
+	st.Global("table")
+	st.Field(-1, "concat")
+	concat := st.ToGoFunction(-1)
+	st.Pop(1)
+	st.PushGoFunction(func(st *lua.State) int {
+		lua.CheckType(st, 1, lua.TypeTable)
+		sep := lua.OptString(st, 2, "")
+		i := lua.OptInteger(st, 3, 1)
+		last := lua.OptInteger(st, 4, lua.LengthEx(st, 1))
+		// the original function reports invalid values, only count the strings here
+		var n, size int64
+		for ; i <= last; i++ {
+			st.RawGetInt(1, i)
+			str, ok := st.ToString(-1)
+			st.Pop(1)
+			if !ok {
+				break
+			}
+			n++
+			size += int64(len(str))
+			if err := s.limits.checkAlloc(joinSize(n, size, int64(len(sep)))); err != nil {
+				lua.Errorf(st, "%v", err)
+			}
+		}
+		return concat(st)
+	})
+	st.SetField(-2, "concat")
+	st.Pop(1)
+
+	// the hook must not be removed by the script
+	st.Global("debug")
+	if st.IsTable(-1) {
+		st.PushNil()
+		st.SetField(-2, "sethook")
+	}
+	st.Pop(1)
+
+	if s.IsTrusted() {
+		return
+	}
+	for _, name := range []string{"io", "dofile", "loadfile", "require"} {
+		st.PushNil()
+		st.SetGlobal(name)
+	}
+	// io is still reachable through the package table, while os is restricted in place below
+	st.Global("package")
+	if st.IsTable(-1) {
+		for _, name := range []string{"loadlib", "searchers", "loaders", "preload"} {
+			st.PushNil()
+			st.SetField(-2, name)
+		}
+		st.Field(-1, "loaded")
+		if st.IsTable(-1) {
+			st.PushNil()
+			st.SetField(-2, "io")
+		}
+		st.Pop(1)
+	}
+	st.Pop(1)
+	// the registry holds another reference to loaded libraries
+	st.Global("debug")
+	if st.IsTable(-1) {
+		st.PushNil()
+		st.SetField(-2, "getregistry")
+	}
+	st.Pop(1)
+	st.Global("os")
+	if st.IsTable(-1) {
+		for _, name := range []string{"execute", "exit", "getenv", "remove", "rename", "tmpname"} {
+			st.PushNil()
+			st.SetField(-2, name)
+		}
+	}
+	st.Pop(1)
+}
+
+func isLimitErr(err error) bool {
+	switch err {
+	case errInstructionLimit, errMemoryLimit, errTimeLimit:
+		return true
+	}
+	return false
+}
+
+// reportViolation reports the limit violation to operators and disables the script after repeated failures.
+func (s *Script) reportViolation(err error) {
+	s.mu.Lock()
+	s.limits.failures++
+	n := s.limits.failures
+	s.mu.Unlock()
+	msg := fmt.Sprintf("lua: %s: callback aborted: %v", s.file, err)
+	s.h.Log(msg)
+	s.h.SendOpChat(msg)
+
+	max := configInt(s.h, ConfigLuaMaxFailures, defaultLuaMaxFailures)
+	if max > 0 && int64(n) >= max {
+		msg = fmt.Sprintf("lua: %s: script disabled after %d failures", s.file, n)
+		s.h.Log(msg)
+		s.h.SendOpChat(msg)
+		s.disable()
+	}
+}
+
+// disable stops all callbacks of the script, but keeps it in the list of loaded scripts.
+func (s *Script) disable() {
+	s.mu.Lock()
+	s.disabled = true
+	s.mu.Unlock()
+	_ = s.scope.Close()
+}
+
+// IsDisabled checks if the script was disabled because of limit violations.
+func (s *Script) IsDisabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disabled
+}
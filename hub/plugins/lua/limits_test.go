@@ -0,0 +1,102 @@
+package lua
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+const testSandboxScript = `
+ok_require = pcall(require, "io")
+has_io = io ~= nil or package.loaded.io ~= nil
+has_loadlib = package.loadlib ~= nil or package.searchers ~= nil or package.loaders ~= nil
+has_exec = os.execute ~= nil or package.loaded.os.execute ~= nil
+`
+
+func TestSandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lua_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sandbox.lua")
+	err = ioutil.WriteFile(path, []byte(testSandboxScript), 0644)
+	require.NoError(t, err)
+
+	h, err := hub.NewHub(hub.Config{}, nil)
+	require.NoError(t, err)
+
+	s, err := LoadScript(h, path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	err = s.exec(func() error {
+		st := s.State()
+		for _, name := range []string{"ok_require", "has_io", "has_loadlib", "has_exec"} {
+			st.Global(name)
+			require.False(t, st.ToBoolean(-1), name)
+			st.Pop(1)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+const testAllocScript = `
+function rep()
+	return string.rep("", 1e9, ("x"):rep(64))
+end
+
+function grow()
+	local s = "x"
+	while true do
+		s = s..s
+	end
+end
+
+function concat()
+	local t = {}
+	for i = 1, 1000 do
+		t[i] = ("x"):rep(1000)
+	end
+	return table.concat(t, ("y"):rep(100000))
+end
+
+function small()
+	return string.rep("x", 10, ",")..table.concat({"a", "b"}, ",")
+end
+`
+
+func TestAllocLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lua_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alloc.lua")
+	err = ioutil.WriteFile(path, []byte(testAllocScript), 0644)
+	require.NoError(t, err)
+
+	h, err := hub.NewHub(hub.Config{}, nil)
+	require.NoError(t, err)
+
+	s, err := LoadScript(h, path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	call := func(name string) error {
+		return s.exec(func() error {
+			st := s.State()
+			st.Global(name)
+			f := s.ToFunc(-1, 1)
+			st.Pop(1)
+			return s.luaCallErr(f.f, 1, nil)
+		})
+	}
+	for _, name := range []string{"rep", "grow", "concat"} {
+		require.Equal(t, errMemoryLimit, call(name), name)
+	}
+	// small allocations are still allowed after the violations
+	require.NoError(t, call("small"))
+}
@@ -0,0 +1,176 @@
+package lua
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	lua "github.com/Shopify/go-lua"
+)
+
+const (
+	// ConfigLuaQueueSize is the max number of pending events for a single script.
+	ConfigLuaQueueSize = "lua.queue"
+	// ConfigLuaHookTimeout is the max time in milliseconds the hub waits for a script to process a blocking hook.
+	// If the script doesn't respond in time, the event is allowed. Zero or negative values mean the default timeout.
+	ConfigLuaHookTimeout = "lua.timeout"
+
+	defaultLuaQueueSize   = 1000
+	defaultLuaHookTimeout = 500 * time.Millisecond
+
+	// closeTimeout is the max time to wait for pending events when the script is unloaded.
+	closeTimeout = 5 * time.Second
+	// execTimeout is the max time to wait for the script to run a function on the event loop.
+	execTimeout = closeTimeout
+)
+
+var errNotResponding = errors.New("lua: script is not responding")
+
+// loop is a single-threaded event loop of the script.
+// All calls to the Lua state happen on the loop goroutine.
+type loop struct {
+	queue chan func()
+	done  chan struct{}
+
+	// fields below are only accessed on the loop goroutine
+
+	depth int     // number of nested Lua calls
+	errs  []error // errors of nested calls, handled after the outer call returns
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+// call is a blocking call to the script that can be abandoned by the caller.
+type call struct {
+	mu        sync.Mutex
+	abandoned bool
+	done      chan struct{}
+}
+
+// startLoop starts the event loop of the script.
+func (s *Script) startLoop() {
+	n := configInt(s.h, ConfigLuaQueueSize, defaultLuaQueueSize)
+	if n <= 0 {
+		n = defaultLuaQueueSize
+	}
+	s.loop.queue = make(chan func(), n)
+	s.loop.done = make(chan struct{})
+	go s.runLoop()
+}
+
+func (s *Script) runLoop() {
+	defer close(s.loop.done)
+	for fnc := range s.loop.queue {
+		if fnc == nil {
+			// stop marker; all events queued before it are already processed
+			return
+		}
+		fnc()
+	}
+}
+
+// post adds an event to the queue without waiting for it to be processed.
+// Events are dropped if the queue is full or the loop is stopped.
+func (s *Script) post(fnc func()) bool {
+	s.loop.mu.Lock()
+	defer s.loop.mu.Unlock()
+	if s.loop.stopped {
+		return false
+	}
+	select {
+	case s.loop.queue <- fnc:
+		return true
+	default:
+		s.h.Logf("lua: %s: event queue is full, dropping the event", s.file)
+		return false
+	}
+}
+
+// exec runs the function on the event loop and waits for it to complete.
+// It must not be called from the event loop; code that already runs there calls the function directly.
+// If it is, the call fails after execTimeout instead of blocking the loop forever.
+func (s *Script) exec(fnc func() error) error {
+	var err error
+	done := make(chan struct{})
+	if !s.post(func() {
+		defer close(done)
+		err = fnc()
+	}) {
+		return errors.New("lua: script is not running")
+	}
+	t := time.NewTimer(execTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return err
+	case <-t.C:
+		s.h.Logf("lua: %s: timeout waiting for the event loop", s.file)
+		return errNotResponding
+	}
+}
+
+// callWait runs the Lua function on the event loop and waits for the result.
+// If the script doesn't respond in time, the call is abandoned and the post function is never called.
+// It must not be called from the event loop, see Func.CallRetOn. If it is, the call is abandoned
+// after the hook timeout, thus the timeout is never disabled.
+func (s *Script) callWait(fnc interface{}, ret int, post func(st *lua.State), args ...interface{}) {
+	c := &call{done: make(chan struct{})}
+	if !s.post(func() {
+		defer close(c.done)
+		c.mu.Lock()
+		abandoned := c.abandoned
+		c.mu.Unlock()
+		if abandoned {
+			return // the caller is no longer interested
+		}
+		s.luaCallRet(fnc, ret, func(st *lua.State) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if !c.abandoned && post != nil {
+				post(st)
+			}
+		}, args...)
+	}) {
+		return
+	}
+	dt := time.Duration(configInt(s.h, ConfigLuaHookTimeout, int64(defaultLuaHookTimeout/time.Millisecond))) * time.Millisecond
+	if dt <= 0 {
+		dt = defaultLuaHookTimeout
+	}
+	t := time.NewTimer(dt)
+	defer t.Stop()
+	select {
+	case <-c.done:
+	case <-t.C:
+		c.mu.Lock()
+		c.abandoned = true
+		c.mu.Unlock()
+		s.h.Logf("lua: %s: callback timed out", s.file)
+	}
+}
+
+// stopLoop processes all pending events and stops the event loop.
+func (s *Script) stopLoop() {
+	s.loop.mu.Lock()
+	if s.loop.stopped || s.loop.queue == nil {
+		s.loop.mu.Unlock()
+		return
+	}
+	s.loop.stopped = true
+	s.loop.mu.Unlock()
+
+	t := time.NewTimer(closeTimeout)
+	defer t.Stop()
+	select {
+	case s.loop.queue <- nil:
+	case <-t.C:
+		s.h.Logf("lua: %s: timeout waiting for pending events", s.file)
+		return
+	}
+	select {
+	case <-s.loop.done:
+	case <-t.C:
+		s.h.Logf("lua: %s: timeout waiting for pending events", s.file)
+	}
+}
@@ -0,0 +1,128 @@
+package lua
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lua "github.com/Shopify/go-lua"
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+const testReentrantScript = `
+function check(v)
+	return v
+end
+
+function run()
+	return trigger()
+end
+`
+
+func TestLoopReentrant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lua_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lua")
+	err = ioutil.WriteFile(path, []byte(testReentrantScript), 0644)
+	require.NoError(t, err)
+
+	h, err := hub.NewHub(hub.Config{}, nil)
+	require.NoError(t, err)
+	h.MergeConfig(hub.Map{
+		ConfigLuaHookTimeout: int64(0),
+	})
+
+	s, err := LoadScript(h, path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var check, run *Func
+	err = s.exec(func() error {
+		st := s.State()
+		st.Global("check")
+		check = s.ToFunc(-1, 1)
+		st.Global("run")
+		run = s.ToFunc(-1, 1)
+		st.Pop(2)
+		// emulates a hub function that calls back into the same script
+		st.Register("trigger", func(st *lua.State) int {
+			var out bool
+			check.CallRetOn(st, func(st *lua.State) {
+				out = st.ToBoolean(-1)
+			}, true)
+			st.PushBoolean(out)
+			return 1
+		})
+		return nil
+	})
+	require.NoError(t, err)
+
+	done := make(chan bool, 1)
+	go run.CallRet(func(st *lua.State) {
+		done <- st.ToBoolean(-1)
+	})
+	select {
+	case out := <-done:
+		require.True(t, out)
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock")
+	}
+}
+
+func TestLoopReentrantWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lua_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lua")
+	err = ioutil.WriteFile(path, []byte(testReentrantScript), 0644)
+	require.NoError(t, err)
+
+	h, err := hub.NewHub(hub.Config{}, nil)
+	require.NoError(t, err)
+	h.MergeConfig(hub.Map{
+		ConfigLuaHookTimeout: int64(0),
+	})
+
+	s, err := LoadScript(h, path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var check, run *Func
+	err = s.exec(func() error {
+		st := s.State()
+		st.Global("check")
+		check = s.ToFunc(-1, 1)
+		st.Global("run")
+		run = s.ToFunc(-1, 1)
+		st.Pop(2)
+		// a hub function that waits for the same script instead of calling it inline
+		st.Register("trigger", func(st *lua.State) int {
+			out := false
+			check.CallRet(func(st *lua.State) {
+				out = st.ToBoolean(-1)
+			}, true)
+			st.PushBoolean(out)
+			return 1
+		})
+		return nil
+	})
+	require.NoError(t, err)
+
+	// zero timeout is treated as the default one, so the nested call is abandoned
+	out := true
+	start := time.Now()
+	err = s.exec(func() error {
+		s.luaCallRet(run.f, 1, func(st *lua.State) {
+			out = st.ToBoolean(-1)
+		})
+		return nil
+	})
+	require.NoError(t, err)
+	require.False(t, out)
+	require.True(t, time.Since(start) < execTimeout)
+}
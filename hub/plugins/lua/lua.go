@@ -1,16 +1,19 @@
 package lua
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lua "github.com/Shopify/go-lua"
@@ -20,6 +23,10 @@ import (
 
 const apiVersion = "0.1.0"
 
+// ConfigLuaScripts is a directory with Lua scripts loaded on startup.
+// By default, scripts are loaded from the "scripts" directory.
+const ConfigLuaScripts = "lua.scripts"
+
 func init() {
 	hub.RegisterPlugin(&plugin{})
 }
@@ -40,14 +47,28 @@ type Instance interface {
 type API interface {
 	Name() string
 	Version() hub.Version
+	// Compatible is called after the script is executed and checks if the script uses this API.
+	// Instances of incompatible APIs are closed without starting.
 	Compatible(s *Script) bool
+	// New is called before the script is executed and should only define globals of the API.
+	// Hooks must be registered in Instance.Start, since the API may turn out to be incompatible with the script.
 	New(s *Script) Instance
 }
 
+type apiInstance struct {
+	Instance
+	api API
+}
+
 type plugin struct {
 	h *hub.Hub
 
+	mu      sync.Mutex // protects scripts
+	dir     string
 	scripts map[string]*Script
+	files   map[string]fileState // scripts directory state, see watchScripts
+
+	errlog errorLog
 }
 
 func (p *plugin) Name() string {
@@ -60,8 +81,9 @@ func (p *plugin) Version() hub.Version {
 
 func (p *plugin) Init(h *hub.Hub, path string) error {
 	p.h = h
+	sc := h.PluginScope(p.Name())
 
-	h.RegisterCommand(hub.Command{
+	sc.RegisterCommand(hub.Command{
 		Menu: []string{"Load Lua script"},
 		Name: "luaload", Aliases: []string{"luaon"},
 		Short: "Load Lua script",
@@ -69,7 +91,7 @@ func (p *plugin) Init(h *hub.Hub, path string) error {
 		Func:  p.cmdLuaLoad,
 	})
 
-	h.RegisterCommand(hub.Command{
+	sc.RegisterCommand(hub.Command{
 		Menu: []string{"Unload Lua script"},
 		Name: "luaunload", Aliases: []string{"luaoff"},
 		Short: "Unload Lua script",
@@ -77,7 +99,7 @@ func (p *plugin) Init(h *hub.Hub, path string) error {
 		Func:  p.cmdLuaUnload,
 	})
 
-	h.RegisterCommand(hub.Command{
+	sc.RegisterCommand(hub.Command{
 		Menu: []string{"Reload Lua script"},
 		Name: "luareload", Aliases: []string{"luare"},
 		Short: "Reload Lua script",
@@ -85,7 +107,7 @@ func (p *plugin) Init(h *hub.Hub, path string) error {
 		Func:  p.cmdLuaReload,
 	})
 
-	h.RegisterCommand(hub.Command{
+	sc.RegisterCommand(hub.Command{
 		Menu: []string{"List loaded Lua scripts"},
 		Name: "lualist", Aliases: []string{"luaall"},
 		Short: "List loaded Lua scripts",
@@ -93,10 +115,32 @@ func (p *plugin) Init(h *hub.Hub, path string) error {
 		Func:  p.cmdLuaList,
 	})
 
-	return p.loadScripts(path)
+	sc.RegisterCommand(hub.Command{
+		Menu: []string{"Show Lua script errors"},
+		Name: "luaerrors", Aliases: []string{"luaerr"},
+		Short: "Show recent errors of Lua scripts",
+		Require: hub.PermOwner,
+		Func:  p.cmdLuaErrors,
+	})
+
+	if err := p.loadScripts(path); err != nil {
+		return err
+	}
+	p.watchScripts(sc)
+	return nil
+}
+
+// scriptPath returns a path of the script. Names without a directory are resolved relative to the scripts directory.
+func (p *plugin) scriptPath(name string) string {
+	if !strings.Contains(name, string(os.PathSeparator)) {
+		return filepath.Join(p.dir, name)
+	}
+	return name
 }
 
 func (p *plugin) cmdLuaLoad(peer hub.Peer, args string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	path := args
 
 	if path == "" {
@@ -104,9 +148,7 @@ func (p *plugin) cmdLuaLoad(peer hub.Peer, args string) error {
 		return nil
 	}
 
-	if !strings.Contains(path, string(os.PathSeparator)) {
-		path = filepath.Join("scripts", path)
-	}
+	path = p.scriptPath(path)
 
 	if p.isScriptLoaded(path) {
 		_ = peer.HubChatMsg(hub.Message{Text: fmt.Sprintf("Lua script already loaded: %s", path)})
@@ -116,6 +158,7 @@ func (p *plugin) cmdLuaLoad(peer hub.Peer, args string) error {
 	s, err := p.loadScript(path)
 
 	if err != nil {
+		p.recordError(path, err)
 		return fmt.Errorf("Failed to load Lua script: %v", err)
 	}
 
@@ -132,6 +175,8 @@ func (p *plugin) cmdLuaLoad(peer hub.Peer, args string) error {
 }
 
 func (p *plugin) cmdLuaUnload(peer hub.Peer, args string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	path := args
 
 	if path == "" {
@@ -139,9 +184,7 @@ func (p *plugin) cmdLuaUnload(peer hub.Peer, args string) error {
 		return nil
 	}
 
-	if !strings.Contains(path, string(os.PathSeparator)) {
-		path = filepath.Join("scripts", path)
-	}
+	path = p.scriptPath(path)
 
 	if !p.isScriptLoaded(path) {
 		_ = peer.HubChatMsg(hub.Message{Text: fmt.Sprintf("Lua script not loaded: %s", path)})
@@ -159,6 +202,8 @@ func (p *plugin) cmdLuaUnload(peer hub.Peer, args string) error {
 }
 
 func (p *plugin) cmdLuaReload(peer hub.Peer, args string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	path := args
 
 	if path == "" {
@@ -166,26 +211,18 @@ func (p *plugin) cmdLuaReload(peer hub.Peer, args string) error {
 		return nil
 	}
 
-	if !strings.Contains(path, string(os.PathSeparator)) {
-		path = filepath.Join("scripts", path)
-	}
+	path = p.scriptPath(path)
 
 	if !p.isScriptLoaded(path) {
 		_ = peer.HubChatMsg(hub.Message{Text: fmt.Sprintf("Lua script not loaded: %s", path)})
 		return nil
 	}
 
-	err := p.unloadScript(path)
+	s, err := p.reloadScript(path)
 
 	if err != nil {
-		return fmt.Errorf("Failed to unload Lua script: %v", err)
-	}
-
-	_ = peer.HubChatMsg(hub.Message{Text: fmt.Sprintf("Lua script successfully unloaded: %s", path)})
-	s, err := p.loadScript(path)
-
-	if err != nil {
-		return fmt.Errorf("Failed to load Lua script: %v", err)
+		p.recordError(path, err)
+		return fmt.Errorf("Failed to reload Lua script, the previous version is still running: %v", err)
 	}
 
 	name := s.getString("script", "name")
@@ -201,6 +238,8 @@ func (p *plugin) cmdLuaReload(peer hub.Peer, args string) error {
 }
 
 func (p *plugin) cmdLuaList(peer hub.Peer, args string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	list := ""
 
 	for _, s := range p.scripts {
@@ -211,6 +250,9 @@ func (p *plugin) cmdLuaList(peer hub.Peer, args string) error {
 		if name != "" && vers != "" {
 			list += " (" + name + " " + vers + ")"
 		}
+		if s.IsDisabled() {
+			list += " [disabled]"
+		}
 
 		list += "\r\n"
 	}
@@ -228,7 +270,12 @@ func (p *plugin) cmdLuaList(peer hub.Peer, args string) error {
 func (p *plugin) loadScripts(path string) error {
 	p.scripts = make(map[string]*Script)
 
-	path = filepath.Join(path, "scripts")
+	if dir, ok := p.h.GetConfigString(ConfigLuaScripts); ok && dir != "" {
+		path = dir
+	} else {
+		path = filepath.Join(path, "scripts")
+	}
+	p.dir = path
 	p.h.Log("lua: loading scripts in:", path)
 	d, err := os.Open(path)
 	if os.IsNotExist(err) {
@@ -266,29 +313,61 @@ func (p *plugin) loadScripts(path string) error {
 }
 
 func (p *plugin) loadScript(path string) (*Script, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.loadSource(path, src)
+}
+
+// loadSource loads the script from the source code. The path is used to identify the script.
+func (p *plugin) loadSource(path string, src []byte) (*Script, error) {
+	s, err := p.newScript(path, src, false)
+	if err != nil {
+		return nil, err
+	}
+	p.scripts[path] = s
+	s.start()
+	return s, nil
+}
+
+// newScript creates a new Lua state and executes the source code, but doesn't start the APIs.
+// If staged is set, storage writes are kept in memory until they are committed with commitStorage.
+func (p *plugin) newScript(path string, src []byte, staged bool) (*Script, error) {
 	state := lua.NewState()
 	s := &Script{
 		p: p, h: p.h, file: path, s: state,
+		scope: p.h.NewScope("lua: " + path),
 	}
+	s.startLoop()
 	s.setupGlobals()
-	if err := s.ExecFile(path); err != nil {
+	s.setupSandbox()
+	if staged {
+		s.storage.staged = make(map[string]*string)
+	}
+	if err := s.exec(func() error {
+		return s.execSource(path, src)
+	}); err != nil {
+		_ = s.Close()
 		return nil, err
 	}
-	p.scripts[path] = s
 	return s, nil
 }
 
+// LoadScript loads a script on the hub without registering it in the plugin.
+// The caller is responsible for closing the script.
+func LoadScript(h *hub.Hub, path string) (*Script, error) {
+	p := &plugin{h: h, scripts: make(map[string]*Script)}
+	return p.loadScript(path)
+}
+
 func (p *plugin) unloadScript(path string) error {
-	if p.isScriptLoaded(path) { // todo: error checks
-		s := p.scripts[path]
-		s.mu.Lock()
-		s.s = nil
-		s.p = nil
-		s.mu.Unlock()
-		delete(p.scripts, path)
+	s, ok := p.scripts[path]
+	if !ok {
+		return nil
 	}
-
-	return nil
+	delete(p.scripts, path)
+	return s.Close()
 }
 
 func (p *plugin) isScriptLoaded(n string) bool {
@@ -304,14 +383,16 @@ func (p *plugin) isScriptLoaded(n string) bool {
 }
 
 func (p *plugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var last error
 	for _, s := range p.scripts {
-		s.mu.Lock()
-		s.s = nil
-		s.p = nil
-		s.mu.Unlock()
+		if err := s.Close(); err != nil {
+			last = err
+		}
 	}
 	p.scripts = nil
-	return nil
+	return last
 }
 
 type M = map[string]interface{}
@@ -321,18 +402,56 @@ type UserData struct {
 }
 
 type Script struct {
-	h    *hub.Hub
-	p    *plugin
-	mu   sync.Mutex
-	file string
-	s    *lua.State
-	apis []Instance
+	h     *hub.Hub
+	p     *plugin
+	mu    sync.Mutex
+	file  string
+	s     *lua.State
+	apis  []apiInstance
+	scope *hub.Scope
+
+	onError []func(err error)
+	inError int32 // set while error handlers are running
+
+	limits   limits
+	disabled bool
+	loop     loop
+	storage  storage
 }
 
 func (s *Script) Hub() *hub.Hub {
 	return s.h
 }
 
+// Scope returns a scope that tracks hooks, commands, bots and timers registered by the script.
+// The scope is closed when the script is unloaded.
+func (s *Script) Scope() *hub.Scope {
+	return s.scope
+}
+
+// Close removes everything registered by the script from the hub and releases the Lua state.
+func (s *Script) Close() error {
+	// must not hold the lock - hooks may still be running
+	_ = s.scope.Close()
+	var last error
+	// APIs may call the script on close
+	_ = s.exec(func() error {
+		for _, api := range s.apis {
+			if err := api.Close(); err != nil {
+				last = err
+			}
+		}
+		return nil
+	})
+	// let the script process pending events, including the ones posted by APIs on close
+	s.stopLoop()
+	s.mu.Lock()
+	s.s = nil
+	s.p = nil
+	s.mu.Unlock()
+	return last
+}
+
 func (s *Script) State() *lua.State {
 	return s.s
 }
@@ -523,15 +642,30 @@ type Func struct {
 	ret int
 }
 
+// CallRet calls the function on the script event loop and waits for the result.
+// If the script doesn't respond in time, the ret function is not called.
 func (f *Func) CallRet(ret func(st *lua.State), args ...interface{}) {
+	f.s.callWait(f.f, f.ret, ret, args...)
+}
+
+// CallRetOn calls the function immediately and waits for the result. It must only be used by Go functions
+// called from the script, which pass their Lua state to indicate they already run on the script event loop.
+// The call is nested into the current one and shares its limits.
+func (f *Func) CallRetOn(st *lua.State, ret func(st *lua.State), args ...interface{}) {
+	if st != f.s.s {
+		panic("lua: state of a different script")
+	}
 	f.s.luaCallRet(f.f, f.ret, ret, args...)
 }
 
+// Call schedules the function call on the script event loop without waiting for it.
 func (f *Func) Call(args ...interface{}) {
 	if f.ret != 0 {
 		panic("use CallRet to handle returns")
 	}
-	f.s.luaCall(f.f, f.ret, args...)
+	f.s.post(func() {
+		f.s.luaCall(f.f, f.ret, args...)
+	})
 }
 
 func (s *Script) ToFuncOn(st *lua.State, index int, ret int) *Func {
@@ -544,26 +678,97 @@ func (s *Script) ToFunc(index int, ret int) *Func {
 }
 
 func (s *Script) luaCallRet(fnc interface{}, ret int, post func(st *lua.State), args ...interface{}) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	err := s.luaCallErr(fnc, ret, post, args...)
+	if s.loop.depth > 0 {
+		// the outer call holds the lock and reports limit violations itself
+		if err != nil && !isLimitErr(err) {
+			s.loop.errs = append(s.loop.errs, err)
+		}
+		return
+	}
+	errs := s.loop.errs
+	s.loop.errs = nil
+	for _, e := range errs {
+		s.handleError(e)
+	}
+	if err != nil {
+		s.handleError(err)
+	}
+}
+
+func (s *Script) luaCall(fnc interface{}, ret int, args ...interface{}) {
+	s.luaCallRet(fnc, ret, nil, args...)
+}
+
+// luaCallErr calls a Lua function in protected mode. Post function is only called if there were no errors.
+//
+// Nested calls (made by Go functions of the script with Func.CallRetOn) share the limits with the outer call.
+func (s *Script) luaCallErr(fnc interface{}, ret int, post func(st *lua.State), args ...interface{}) error {
+	nested := s.loop.depth > 0
+	if !nested {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if s.s == nil || s.disabled {
+		return nil // unloaded
+	}
+	if !nested {
+		s.resetLimits()
+	}
+	s.loop.depth++
+	defer func() {
+		s.loop.depth--
+	}()
+	top := s.s.Top()
 	s.s.PushLightUserData(fnc)
 	for _, arg := range args {
 		s.Push(arg)
 	}
-	s.s.Call(len(args), ret)
+	if err := s.s.ProtectedCall(len(args), ret, 0); err != nil {
+		if v := s.limits.violation; v != nil {
+			s.s.SetTop(top)
+			return v
+		}
+		if msg, ok := s.s.ToString(-1); ok && msg != "" {
+			err = errors.New(msg)
+		}
+		s.s.SetTop(top)
+		return err
+	}
 	if post != nil {
 		post(s.s)
 	}
+	s.s.SetTop(top)
+	return nil
 }
 
-func (s *Script) luaCall(fnc interface{}, ret int, args ...interface{}) {
+// OnError registers a function that is called when a Lua error happens in one of the script callbacks.
+// Errors raised by the error handlers themselves are only logged.
+func (s *Script) OnError(fnc func(err error)) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.s.PushLightUserData(fnc)
-	for _, arg := range args {
-		s.Push(arg)
+	s.onError = append(s.onError, fnc)
+	s.mu.Unlock()
+}
+
+func (s *Script) handleError(err error) {
+	if s.p != nil {
+		s.p.recordError(s.file, err)
+	}
+	if isLimitErr(err) {
+		s.reportViolation(err)
+		return
+	}
+	s.h.Logf("lua: %s: %v", s.file, err)
+	if !atomic.CompareAndSwapInt32(&s.inError, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.inError, 0)
+	s.mu.Lock()
+	list := s.onError
+	s.mu.Unlock()
+	for _, fnc := range list {
+		fnc(err)
 	}
-	s.s.Call(len(args), ret)
 }
 
 func (s *Script) setupGlobals() {
@@ -610,20 +815,16 @@ func (s *Script) setupGlobals() {
 			if dt <= 0 {
 				return 0
 			}
-			ticker := time.NewTicker(dt)
-			go func() {
-				defer ticker.Stop()
-				for range ticker.C {
-					fnc.Call()
-				}
-			}()
+			s.scope.AddTimer(dt, func() {
+				fnc.Call()
+			})
 			return 0
 		},
 		"onConnected": func(_ *lua.State) int {
 			fnc := s.ToFunc(1, 1)
 			s.s.Pop(1)
-			s.h.OnConnected(func(c net.Conn) bool {
-				var out bool
+			s.scope.OnConnected(func(c net.Conn) bool {
+				out := true
 				fnc.CallRet(func(st *lua.State) {
 					out = s.popBool()
 				}, c.RemoteAddr().String())
@@ -634,7 +835,7 @@ func (s *Script) setupGlobals() {
 		"onDisconnected": func(_ *lua.State) int {
 			fnc := s.ToFunc(1, 0)
 			s.s.Pop(1)
-			s.h.OnDisconnected(func(c net.Conn) {
+			s.scope.OnDisconnected(func(c net.Conn) {
 				fnc.Call(c.RemoteAddr().String())
 			})
 			return 0
@@ -642,8 +843,8 @@ func (s *Script) setupGlobals() {
 		"onJoined": func(_ *lua.State) int {
 			fnc := s.ToFunc(1, 1)
 			s.s.Pop(1)
-			s.h.OnJoined(func(p hub.Peer) bool {
-				var out bool
+			s.scope.OnJoined(func(p hub.Peer) bool {
+				out := true
 				fnc.CallRet(func(st *lua.State) {
 					out = s.popBool()
 				}, p)
@@ -654,8 +855,8 @@ func (s *Script) setupGlobals() {
 		"onChat": func(_ *lua.State) int {
 			fnc := s.ToFunc(1, 1)
 			s.s.Pop(1)
-			s.h.OnGlobalChat(func(p hub.Peer, m hub.Message) bool {
-				var out bool
+			s.scope.OnGlobalChat(func(p hub.Peer, m hub.Message) bool {
+				out := true
 				fnc.CallRet(func(st *lua.State) {
 					out = s.popBool()
 				}, M{
@@ -669,25 +870,84 @@ func (s *Script) setupGlobals() {
 			return 0
 		},
 	})
+	s.setupStorage()
+	// scripts may use globals of any API at load time,
+	// so the compatibility is only known after the script is executed
 	for _, a := range apis {
-		if a.Compatible(s) {
-			api := a.New(s)
-			s.apis = append(s.apis, api)
-		}
+		s.apis = append(s.apis, apiInstance{Instance: a.New(s), api: a})
 	}
 }
 
 func (s *Script) ExecFile(path string) error {
-	if err := lua.DoFile(s.s, path); err != nil {
-		if err == lua.SyntaxError {
-			if e, ok := s.s.ToString(1); ok && e != "" {
-				return errors.New(e)
-			}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = s.execSource(path, src); err != nil {
+		return err
+	}
+	s.startAPIs()
+	return nil
+}
+
+// loadChunk loads the source code as a Lua function and pushes it to the stack.
+// The chunk is named the same way as lua.LoadFile does, so errors refer to the script file and line.
+func loadChunk(st *lua.State, path string, src []byte) error {
+	if len(src) != 0 && src[0] == '#' {
+		// skip the shebang line, but keep line numbers
+		if i := bytes.IndexByte(src, '\n'); i >= 0 {
+			src = src[i:]
+		} else {
+			src = nil
+		}
+	}
+	if err := lua.LoadBuffer(st, string(src), "@"+path, ""); err != nil {
+		if e, ok := st.ToString(-1); ok && e != "" {
+			return errors.New(e)
 		}
 		return err
 	}
+	return nil
+}
+
+func (s *Script) execSource(path string, src []byte) error {
+	s.resetLimits()
+	if err := loadChunk(s.s, path, src); err != nil {
+		return err
+	}
+	if err := s.s.ProtectedCall(0, lua.MultipleReturns, 0); err != nil {
+		return err
+	}
+	active := s.apis[:0]
 	for _, api := range s.apis {
-		api.Start()
+		if !api.api.Compatible(s) {
+			_ = api.Close()
+			continue
+		}
+		active = append(active, api)
 	}
+	s.apis = active
 	return nil
 }
+
+// start starts the APIs of the script on the event loop.
+func (s *Script) start() {
+	_ = s.exec(func() error {
+		s.startAPIs()
+		return nil
+	})
+}
+
+func (s *Script) startAPIs() {
+	for _, api := range s.apis {
+		api.Start()
+	}
+}
+
+// IsFunc checks if the script defines a global function with a given name.
+func (s *Script) IsFunc(name string) bool {
+	s.s.Global(name)
+	ok := s.s.IsFunction(-1)
+	s.s.Pop(1)
+	return ok
+}
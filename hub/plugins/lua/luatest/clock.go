@@ -0,0 +1,105 @@
+package luatest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+var _ hub.Clock = (*Clock)(nil)
+
+// Clock is a fake clock that only moves forward when Advance is called.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	seq     int
+	tickers map[*ticker]struct{}
+}
+
+// NewClock creates a fake clock set to a given time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now, tickers: make(map[*ticker]struct{})}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker creates a ticker that fires when the clock is advanced past the next tick.
+func (c *Clock) NewTicker(dt time.Duration) hub.Ticker {
+	if dt <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &ticker{
+		c: c, id: c.seq, dt: dt, next: c.now.Add(dt),
+		ch: make(chan time.Time), done: make(chan struct{}),
+	}
+	c.tickers[t] = struct{}{}
+	return t
+}
+
+// Advance moves the clock forward and fires all the tickers in order.
+// Each tick is delivered before the next one is fired. Ticks of stopped tickers are dropped.
+func (c *Clock) Advance(dt time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(dt)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		var first *ticker
+		for t := range c.tickers {
+			if t.next.After(end) {
+				continue
+			}
+			// tickers created earlier fire first
+			if first == nil || t.next.Before(first.next) || (t.next.Equal(first.next) && t.id < first.id) {
+				first = t
+			}
+		}
+		if first == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		now := first.next
+		c.now = now
+		first.next = now.Add(first.dt)
+		c.mu.Unlock()
+
+		select {
+		case first.ch <- now:
+		case <-first.done:
+		}
+	}
+}
+
+type ticker struct {
+	c    *Clock
+	id   int
+	dt   time.Duration
+	next time.Time // protected by the clock mutex
+
+	ch   chan time.Time
+	stop sync.Once
+	done chan struct{}
+}
+
+func (t *ticker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *ticker) Stop() {
+	t.stop.Do(func() {
+		t.c.mu.Lock()
+		delete(t.c.tickers, t)
+		t.c.mu.Unlock()
+		close(t.done)
+	})
+}
@@ -0,0 +1,138 @@
+package luatest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	_ "github.com/direct-connect/go-dcpp/hub/plugins/lua/px"
+)
+
+const testScript = `
+local ticks = 0
+
+function ChatArrival(user, data)
+	local _, _, text = string.find(data, "^%b<> (.*)|$")
+	if text == "spam" then
+		Core.SendToUser(user, "<Bot> no spam, "..user.sNick.."|")
+		return true
+	elseif text == "ticks" then
+		Core.SendToUser(user, "<Bot> ticks: "..ticks.."|")
+	end
+	return false
+end
+
+function UserConnected(user)
+	Core.SendToUser(user, "<Bot> welcome, "..user.sNick.."|")
+end
+
+function OnTimer(id)
+	ticks = ticks + 1
+end
+
+function OnStartup()
+	TmrMan.AddTimer(1000)
+end
+`
+
+const testScenario = `
+timeout: 2s
+steps:
+  - join: alice
+  - expect:
+      user: alice
+      chat: welcome, alice
+  - join: bob
+    proto: adc
+  - expect:
+      user: bob
+      chat: welcome, bob
+  - join: spambot
+    proto: bot
+  - chat: spam
+    user: alice
+  - expect:
+      user: alice
+      from: Bot
+      chat: no spam, alice
+  - expect:
+      user: bob
+      from: Bot
+      none: true
+      timeout: 100ms
+  - tick: 3500ms
+  - chat: ticks
+    user: alice
+  - expect:
+      user: alice
+      chat: '/^ticks: \d+$/'
+  - leave: alice
+  - chat: hello
+    user: spambot
+`
+
+func writeFile(t testing.TB, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	require.NoError(t, err)
+	return path
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luatest_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := writeFile(t, dir, "test.lua", testScript)
+	sc, err := LoadScenario(writeFile(t, dir, "test.yml", testScenario))
+	require.NoError(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	err = Run(script, sc, buf)
+	require.NoError(t, err, "%s", buf.String())
+
+	// expectations must fail if the script doesn't respond
+	sc.Steps[6].Expect.Chat = "something else"
+	sc.Timeout = 200 * time.Millisecond
+	buf.Reset()
+	err = Run(script, sc, buf)
+	require.Error(t, err)
+	require.Contains(t, buf.String(), "FAIL 7")
+}
+
+func TestClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewClock(start)
+	t1 := c.NewTicker(time.Second)
+	t2 := c.NewTicker(3 * time.Second)
+
+	var ticks []time.Duration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(ticks) < 5 {
+			select {
+			case tm := <-t1.C():
+				ticks = append(ticks, tm.Sub(start))
+			case tm := <-t2.C():
+				ticks = append(ticks, -tm.Sub(start))
+			}
+		}
+	}()
+	c.Advance(4 * time.Second)
+	<-done
+	require.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 3 * time.Second, -3 * time.Second, 4 * time.Second,
+	}, ticks)
+
+	// stopped tickers must not block the clock
+	t1.Stop()
+	t2.Stop()
+	c.Advance(10 * time.Second)
+	require.Equal(t, start.Add(14*time.Second), c.Now())
+}
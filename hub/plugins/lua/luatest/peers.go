@@ -0,0 +1,303 @@
+package luatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	adcp "github.com/direct-connect/go-dc/adc"
+	adctypes "github.com/direct-connect/go-dc/adc/types"
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+	"github.com/direct-connect/go-dc/types"
+
+	"github.com/direct-connect/go-dcpp/adc"
+	adcc "github.com/direct-connect/go-dcpp/adc/client"
+	"github.com/direct-connect/go-dcpp/hub"
+	"github.com/direct-connect/go-dcpp/nmdc"
+	nmdcc "github.com/direct-connect/go-dcpp/nmdc/client"
+	"github.com/direct-connect/go-dcpp/version"
+)
+
+var errNoInbox = errors.New("bots cannot receive messages")
+
+// message is a chat message received by a simulated user.
+type message struct {
+	pm   bool
+	from string
+	text string
+}
+
+func (m message) String() string {
+	if m.pm {
+		return fmt.Sprintf("pm from %q: %q", m.from, m.text)
+	}
+	return fmt.Sprintf("chat from %q: %q", m.from, m.text)
+}
+
+// inbox is an unbounded queue of messages received by a simulated user.
+// It never blocks the client, thus the hub is never blocked by the test either.
+type inbox struct {
+	mu     sync.Mutex
+	msgs   []message
+	notify chan struct{}
+}
+
+func newInbox() *inbox {
+	return &inbox{notify: make(chan struct{}, 1)}
+}
+
+func (b *inbox) push(m message) {
+	b.mu.Lock()
+	b.msgs = append(b.msgs, m)
+	b.mu.Unlock()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take removes all the messages up to the first matching one, including it.
+// It returns the messages that didn't match.
+func (b *inbox) take(match func(m message) bool) (bool, []message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, m := range b.msgs {
+		if match(m) {
+			skipped := b.msgs[:i:i]
+			b.msgs = b.msgs[i+1:]
+			return true, skipped
+		}
+	}
+	skipped := b.msgs
+	b.msgs = nil
+	return false, skipped
+}
+
+// find returns the first matching message without removing it.
+func (b *inbox) find(match func(m message) bool) (message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.msgs {
+		if match(m) {
+			return m, true
+		}
+	}
+	return message{}, false
+}
+
+// wait waits for a matching message. Messages received before it are dropped and returned.
+func (b *inbox) wait(dt time.Duration, match func(m message) bool) (bool, []message) {
+	t := time.NewTimer(dt)
+	defer t.Stop()
+	var skipped []message
+	for {
+		ok, arr := b.take(match)
+		skipped = append(skipped, arr...)
+		if ok {
+			return true, skipped
+		}
+		select {
+		case <-b.notify:
+		case <-t.C:
+			ok, arr = b.take(match)
+			return ok, append(skipped, arr...)
+		}
+	}
+}
+
+// testPeer is a simulated user connected to the hub.
+type testPeer interface {
+	SendChat(text string) error
+	SendPM(to, text string) error
+	Search(pattern string) error
+	// Inbox returns messages received by the user. It returns nil if the peer cannot receive messages.
+	Inbox() *inbox
+	Close() error
+}
+
+// pipeAddr overrides the address of the pipe, so the hub sees the user's IP.
+type pipeAddr struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c pipeAddr) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// dialPipe connects a new in-memory connection to the hub.
+func dialPipe(serve func(c net.Conn, cinfo *hub.ConnInfo) error, addr net.Addr) net.Conn {
+	hc, cc := net.Pipe()
+	go func() {
+		defer hc.Close()
+		_ = serve(pipeAddr{Conn: hc, remote: addr}, nil)
+	}()
+	return cc
+}
+
+type nmdcPeer struct {
+	conn  net.Conn
+	c     *nmdcc.Conn
+	inbox *inbox
+}
+
+func dialNMDC(h *hub.Hub, addr net.Addr, name string) (testPeer, error) {
+	cc := dialPipe(h.ServeNMDC, addr)
+	conn, err := nmdc.NewConn(cc)
+	if err != nil {
+		_ = cc.Close()
+		return nil, err
+	}
+	p := &nmdcPeer{conn: cc, inbox: newInbox()}
+	// handlers must be set before the client starts reading, or join-time messages are lost
+	p.c, err = nmdcc.HubHandshake(conn, &nmdcc.Config{Name: name, Init: func(c *nmdcc.Conn) {
+		c.OnChatMessage(func(m *nmdcp.ChatMessage) error {
+			p.inbox.push(message{from: m.Name, text: m.Text})
+			return nil
+		})
+		c.OnUnhandled(func(m nmdcp.Message) error {
+			if m, ok := m.(*nmdcp.PrivateMessage); ok {
+				p.inbox.push(message{pm: true, from: m.From, text: m.Text})
+			}
+			return nil
+		})
+	}})
+	if err != nil {
+		_ = cc.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *nmdcPeer) SendChat(text string) error {
+	return p.c.SendChatMsg(text)
+}
+
+func (p *nmdcPeer) SendPM(to, text string) error {
+	return p.c.SendPrivateMsg(to, text)
+}
+
+func (p *nmdcPeer) Search(pattern string) error {
+	return p.c.Search(nmdcp.Search{Pattern: pattern, DataType: nmdcp.DataTypeAny})
+}
+
+func (p *nmdcPeer) Inbox() *inbox {
+	return p.inbox
+}
+
+func (p *nmdcPeer) Close() error {
+	// close the pipe first to unblock the reader
+	_ = p.conn.Close()
+	return p.c.Close()
+}
+
+type adcPeer struct {
+	conn  net.Conn
+	c     *adcc.Conn
+	inbox *inbox
+}
+
+func dialADC(h *hub.Hub, addr net.Addr, name string) (testPeer, error) {
+	pid, err := adctypes.NewPID()
+	if err != nil {
+		return nil, err
+	}
+	cc := dialPipe(h.ServeADC, addr)
+	conn, err := adc.NewConn(cc)
+	if err != nil {
+		_ = cc.Close()
+		return nil, err
+	}
+	p := &adcPeer{conn: cc, inbox: newInbox()}
+	p.c, err = adcc.HubHandshake(conn, &adcc.Config{PID: pid, Name: name, Init: func(c *adcc.Conn) {
+		c.OnChatMessage(func(from *adcc.Peer, m adcp.ChatMessage) error {
+			msg := message{pm: m.PM != nil, text: m.Text}
+			if from != nil {
+				msg.from = from.Info().Name
+			}
+			p.inbox.push(msg)
+			return nil
+		})
+	}})
+	if err != nil {
+		_ = cc.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *adcPeer) SendChat(text string) error {
+	return p.c.SendChatMsg(text)
+}
+
+func (p *adcPeer) SendPM(to, text string) error {
+	for _, peer := range p.c.OnlinePeers() {
+		if peer.Info().Name == to {
+			return p.c.SendPrivateMsg(peer, text)
+		}
+	}
+	return adcc.ErrPeerOffline
+}
+
+func (p *adcPeer) Search(pattern string) error {
+	return p.c.Search(adcp.SearchRequest{Token: "luatest", And: strings.Fields(pattern)})
+}
+
+func (p *adcPeer) Inbox() *inbox {
+	return p.inbox
+}
+
+func (p *adcPeer) Close() error {
+	_ = p.conn.Close()
+	return p.c.Close()
+}
+
+type botPeer struct {
+	h      *hub.Hub
+	b      *hub.Bot
+	ctx    context.Context
+	cancel func()
+}
+
+func newBot(h *hub.Hub, name string) (testPeer, error) {
+	b, err := h.NewBot(name, types.Software{Name: "luatest", Version: version.Vers})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &botPeer{h: h, b: b, ctx: ctx, cancel: cancel}, nil
+}
+
+func (p *botPeer) SendChat(text string) error {
+	return p.b.SendGlobal(hub.Message{Text: text})
+}
+
+func (p *botPeer) SendPM(to, text string) error {
+	peer := p.h.PeerByName(to)
+	if peer == nil {
+		return errors.New("user is offline")
+	}
+	return p.b.SendPrivate(peer, hub.Message{Text: text})
+}
+
+func (p *botPeer) Search(pattern string) error {
+	results := p.b.Search(p.ctx, hub.NameSearch{And: strings.Fields(pattern)})
+	go func() {
+		for range results {
+		}
+	}()
+	return nil
+}
+
+func (p *botPeer) Inbox() *inbox {
+	return nil
+}
+
+func (p *botPeer) Close() error {
+	p.cancel()
+	return p.b.Close()
+}
@@ -0,0 +1,250 @@
+package luatest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+)
+
+// Run loads the script on an in-memory hub and executes the scenario.
+// The progress is written to w. If the scenario is nil, the script is only loaded.
+func Run(script string, sc *Scenario, w io.Writer) error {
+	if sc == nil {
+		sc = &Scenario{}
+	}
+	if err := sc.validate(); err != nil {
+		return err
+	}
+	r, err := newRunner(script, sc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fmt.Fprintf(w, "loaded %s\n", script)
+	for i := range sc.Steps {
+		st := &sc.Steps[i]
+		if err := r.step(st); err != nil {
+			fmt.Fprintf(w, "FAIL %d: %s: %v\n", i+1, st, err)
+			return fmt.Errorf("step %d failed: %v", i+1, err)
+		}
+		fmt.Fprintf(w, "ok   %d: %s\n", i+1, st)
+	}
+	return nil
+}
+
+// runner is a hub with a single script and a set of simulated users.
+type runner struct {
+	h       *hub.Hub
+	s       *hlua.Script
+	clock   *Clock
+	dir     string
+	timeout time.Duration
+
+	peers  map[string]testPeer
+	lastIP byte
+}
+
+func newRunner(script string, sc *Scenario) (*runner, error) {
+	r := &runner{
+		clock:   NewClock(time.Now()),
+		timeout: sc.Timeout,
+		peers:   make(map[string]testPeer),
+	}
+	if r.timeout == 0 {
+		r.timeout = defaultTimeout
+	}
+	h, err := hub.NewHub(hub.Config{Name: "Test hub", Clock: r.clock}, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.h = h
+	// the plugin loads scripts on startup, make sure it only sees an empty directory
+	r.dir, err = ioutil.TempDir("", "luatest_")
+	if err != nil {
+		return nil, err
+	}
+	h.MergeConfig(hub.Map{hlua.ConfigLuaScripts: r.dir})
+	h.MergeConfig(sc.Config)
+	if err = h.Start(); err != nil {
+		_ = os.RemoveAll(r.dir)
+		return nil, err
+	}
+	r.s, err = hlua.LoadScript(h, script)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close disconnects all the users, unloads the script and stops the hub.
+func (r *runner) Close() {
+	for _, p := range r.peers {
+		_ = p.Close()
+	}
+	if r.s != nil {
+		_ = r.s.Close()
+	}
+	_ = r.h.Close()
+	_ = os.RemoveAll(r.dir)
+}
+
+func (r *runner) peer(name string) (testPeer, error) {
+	p := r.peers[name]
+	if p == nil {
+		return nil, fmt.Errorf("unknown user: %q", name)
+	}
+	return p, nil
+}
+
+// nextAddr returns a unique address for a new user.
+func (r *runner) nextAddr() net.Addr {
+	r.lastIP++
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, r.lastIP), Port: 1000}
+}
+
+func (r *runner) step(s *Step) error {
+	switch {
+	case s.Join != "":
+		return r.join(s.Join, s.Proto)
+	case s.Leave != "":
+		return r.leave(s.Leave)
+	case s.Chat != "":
+		p, err := r.peer(s.User)
+		if err != nil {
+			return err
+		}
+		return p.SendChat(s.Chat)
+	case s.PM != "":
+		p, err := r.peer(s.User)
+		if err != nil {
+			return err
+		}
+		return p.SendPM(s.To, s.PM)
+	case s.Search != "":
+		p, err := r.peer(s.User)
+		if err != nil {
+			return err
+		}
+		return p.Search(s.Search)
+	case s.Tick != 0:
+		r.clock.Advance(s.Tick)
+		return nil
+	case s.Expect != nil:
+		return r.expect(s.Expect)
+	}
+	return errors.New("empty step")
+}
+
+func (r *runner) join(name, proto string) error {
+	if _, ok := r.peers[name]; ok {
+		return fmt.Errorf("user %q already joined", name)
+	}
+	var (
+		p   testPeer
+		err error
+	)
+	switch proto {
+	case "", ProtoNMDC:
+		p, err = dialNMDC(r.h, r.nextAddr(), name)
+	case ProtoADC:
+		p, err = dialADC(r.h, r.nextAddr(), name)
+	case ProtoBot:
+		p, err = newBot(r.h, name)
+	default:
+		err = fmt.Errorf("unsupported protocol: %q", proto)
+	}
+	if err != nil {
+		return err
+	}
+	r.peers[name] = p
+	return nil
+}
+
+func (r *runner) leave(name string) error {
+	p, err := r.peer(name)
+	if err != nil {
+		return err
+	}
+	delete(r.peers, name)
+	if err = p.Close(); err != nil {
+		return err
+	}
+	// make sure the hub processed the disconnect before the next step
+	if !r.waitOffline(name, r.timeout) {
+		return errors.New("user is still online")
+	}
+	return nil
+}
+
+func (r *runner) waitOffline(name string, dt time.Duration) bool {
+	deadline := time.Now().Add(dt)
+	for r.h.PeerByName(name) != nil {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (r *runner) expect(e *Expect) error {
+	p, err := r.peer(e.User)
+	if err != nil {
+		return err
+	}
+	dt := e.Timeout
+	if dt == 0 {
+		dt = r.timeout
+	}
+	if e.Disconnected {
+		if !r.waitOffline(e.User, dt) {
+			return errors.New("user is still online")
+		}
+		return nil
+	}
+	in := p.Inbox()
+	if in == nil {
+		return errNoInbox
+	}
+	if e.None {
+		// messages checked by previous expectations are already removed from the inbox
+		time.Sleep(dt)
+		got, ok := in.find(func(m message) bool {
+			return e.From == "" || m.from == e.From
+		})
+		if ok {
+			return fmt.Errorf("unexpected message: %v", got)
+		}
+		return nil
+	}
+	match := func(m message) bool {
+		if e.From != "" && m.from != e.From {
+			return false
+		}
+		if e.chat != nil {
+			return !m.pm && e.chat.MatchString(m.text)
+		}
+		return m.pm && e.pm.MatchString(m.text)
+	}
+	if ok, skipped := in.wait(dt, match); !ok {
+		if len(skipped) == 0 {
+			return errors.New("timeout, no messages received")
+		}
+		var buf strings.Builder
+		for _, m := range skipped {
+			buf.WriteString("\n\t")
+			buf.WriteString(m.String())
+		}
+		return fmt.Errorf("timeout, received:%s", buf.String())
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Package luatest runs Lua scripts on an in-memory hub and checks how they react to simulated users.
+package luatest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const defaultTimeout = time.Second
+
+// Peer protocols supported by the scenario.
+const (
+	ProtoNMDC = "nmdc"
+	ProtoADC  = "adc"
+	ProtoBot  = "bot"
+)
+
+// Scenario is a sequence of events the script is tested with.
+type Scenario struct {
+	// Config is merged into the hub config before the script is loaded.
+	Config map[string]interface{}
+	// Timeout is the max time to wait for each expected event. Default is 1s.
+	Timeout time.Duration
+	// Steps are executed one by one. The test stops on the first failed step.
+	Steps []Step
+}
+
+// Step is a single action or an expectation. Only one of Join, Leave, Chat, PM, Search, Tick or Expect can be set.
+type Step struct {
+	// Join connects a new user with a given name.
+	Join string
+	// Proto is a protocol of the joining user: nmdc (default), adc or bot.
+	Proto string
+
+	// Leave disconnects a user with a given name.
+	Leave string
+
+	// Chat sends a main chat message from the User.
+	Chat string
+	// PM sends a private message from the User to To.
+	PM string
+	// Search sends a search for a given pattern from the User.
+	Search string
+	// User is the name of the user that performs an action.
+	User string
+	// To is the name of the PM recipient.
+	To string
+
+	// Tick advances the fake clock, firing all the script timers.
+	Tick time.Duration
+
+	// Expect waits for an event observed by a user.
+	Expect *Expect
+}
+
+// Expect describes an event that a user should observe.
+//
+// Text fields are compared with the message text as-is, unless they are enclosed in slashes,
+// in which case they are used as regular expressions. For example: "/^Welcome/".
+type Expect struct {
+	// User is the name of the user that should receive a message.
+	User string
+	// From is the name of the message sender. If empty, messages from any sender are accepted.
+	From string
+	// Chat is the expected text of the main chat message.
+	Chat string
+	// PM is the expected text of the private message.
+	PM string
+	// None expects no messages, except the ones checked by previous expectations, to be received by the user
+	// until the timeout.
+	None bool
+	// Disconnected expects the user to be disconnected by the hub.
+	Disconnected bool
+	// Timeout overrides the timeout of the scenario.
+	Timeout time.Duration
+
+	chat, pm *regexp.Regexp
+}
+
+// LoadScenario reads a scenario from a file. Any format supported by viper can be used.
+func LoadScenario(path string) (*Scenario, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var sc Scenario
+	if err := v.Unmarshal(&sc); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+func (sc *Scenario) validate() error {
+	if sc.Timeout < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+	for i := range sc.Steps {
+		if err := sc.Steps[i].validate(); err != nil {
+			return fmt.Errorf("step %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *Step) validate() error {
+	n := 0
+	for _, set := range []bool{
+		s.Join != "", s.Leave != "", s.Chat != "", s.PM != "",
+		s.Search != "", s.Tick != 0, s.Expect != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one action should be set")
+	}
+	switch {
+	case s.Join != "":
+		switch s.Proto {
+		case "", ProtoNMDC, ProtoADC, ProtoBot:
+		default:
+			return fmt.Errorf("unsupported protocol: %q", s.Proto)
+		}
+	case s.Chat != "", s.Search != "":
+		if s.User == "" {
+			return errors.New("user should be set")
+		}
+	case s.PM != "":
+		if s.User == "" || s.To == "" {
+			return errors.New("user and recipient should be set")
+		}
+	case s.Tick < 0:
+		return errors.New("cannot move the clock backward")
+	case s.Expect != nil:
+		return s.Expect.validate()
+	}
+	return nil
+}
+
+func (e *Expect) validate() error {
+	if e.User == "" {
+		return errors.New("user should be set")
+	}
+	n := 0
+	for _, set := range []bool{e.Chat != "", e.PM != "", e.None, e.Disconnected} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("expected one of: chat, pm, none, disconnected")
+	}
+	var err error
+	if e.chat, err = compileText(e.Chat); err != nil {
+		return err
+	}
+	if e.pm, err = compileText(e.PM); err != nil {
+		return err
+	}
+	return nil
+}
+
+// compileText compiles the expected text to a regexp. See Expect.
+func compileText(s string) (*regexp.Regexp, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		return regexp.Compile(s[1 : len(s)-1])
+	}
+	return regexp.Compile("^" + regexp.QuoteMeta(s) + "$")
+}
+
+// String returns a short description of the step.
+func (s *Step) String() string {
+	switch {
+	case s.Join != "":
+		proto := s.Proto
+		if proto == "" {
+			proto = ProtoNMDC
+		}
+		return fmt.Sprintf("join %s (%s)", s.Join, proto)
+	case s.Leave != "":
+		return "leave " + s.Leave
+	case s.Chat != "":
+		return fmt.Sprintf("chat %s: %q", s.User, s.Chat)
+	case s.PM != "":
+		return fmt.Sprintf("pm %s -> %s: %q", s.User, s.To, s.PM)
+	case s.Search != "":
+		return fmt.Sprintf("search %s: %q", s.User, s.Search)
+	case s.Tick != 0:
+		return fmt.Sprintf("tick %v", s.Tick)
+	case s.Expect != nil:
+		e := s.Expect
+		switch {
+		case e.Chat != "":
+			return fmt.Sprintf("expect %s chat: %q", e.User, e.Chat)
+		case e.PM != "":
+			return fmt.Sprintf("expect %s pm: %q", e.User, e.PM)
+		case e.None:
+			return fmt.Sprintf("expect %s: no messages", e.User)
+		case e.Disconnected:
+			return fmt.Sprintf("expect %s: disconnected", e.User)
+		}
+	}
+	return "empty step"
+}
@@ -0,0 +1,25 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/direct-connect/go-dc/nmdc"
+)
+
+// ParseNMDC decodes one or more raw NMDC commands separated by '|'.
+// Scripts usually send protocol messages this way.
+func ParseNMDC(data string) ([]nmdc.Message, error) {
+	var out []nmdc.Message
+	for _, cmd := range strings.Split(data, "|") {
+		if cmd == "" {
+			continue
+		}
+		m, err := nmdc.Unmarshal(nil, []byte(cmd+"|"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message: %v (%s)", err, cmd)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
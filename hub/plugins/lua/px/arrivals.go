@@ -0,0 +1,117 @@
+package px
+
+import (
+	"net"
+
+	lua "github.com/Shopify/go-lua"
+	"github.com/direct-connect/go-dc/nmdc"
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+)
+
+// http://wiki.ptokax.org/doku.php?id=luaapi:callbacks
+
+// arrivalFuncs maps NMDC command types to PtokaX arrival callbacks.
+// Chat is handled separately by ChatArrival.
+var arrivalFuncs = map[string]string{
+	(&nmdc.PrivateMessage{}).Type():   "ToArrival",
+	(&nmdc.Search{}).Type():           "SearchArrival",
+	(&nmdc.TTHSearchActive{}).Type():  "SearchArrival",
+	(&nmdc.TTHSearchPassive{}).Type(): "SearchArrival",
+	(&nmdc.SR{}).Type():               "SRArrival",
+	(&nmdc.MyINFO{}).Type():           "MyINFOArrival",
+	(&nmdc.ConnectToMe{}).Type():      "ConnectToMeArrival",
+	(&nmdc.RevConnectToMe{}).Type():   "RevConnectToMeArrival",
+}
+
+// handshakeFuncs maps NMDC handshake commands to PtokaX arrival callbacks.
+var handshakeFuncs = map[string]string{
+	(&nmdc.Supports{}).Type():     "SupportsArrival",
+	(&nmdc.Key{}).Type():          "KeyArrival",
+	(&nmdc.ValidateNick{}).Type(): "ValidateNickArrival",
+	(&nmdc.MyPass{}).Type():       "PasswordArrival",
+}
+
+// lookupArrivals looks up the arrival callbacks defined by the script.
+func (s *Script) lookupArrivals(names map[string]string) map[string]*hlua.Func {
+	out := make(map[string]*hlua.Func)
+	for typ, name := range names {
+		if f := s.globalFunc(name, lua.MultipleReturns); f != nil {
+			out[typ] = f
+		}
+	}
+	return out
+}
+
+// callArrival calls the arrival callback. It returns false if the script wants to stop processing the command.
+func callArrival(f *hlua.Func, u interface{}, m nmdc.Message) bool {
+	data, err := nmdc.Marshal(nil, m)
+	if err != nil {
+		return true
+	}
+	var stop bool
+	f.CallRet(func(st *lua.State) {
+		if top := st.Top(); top != 0 {
+			stop = st.ToBoolean(top)
+		}
+	}, u, string(data))
+	return !stop
+}
+
+// handshakeUserArg returns a user table for a client that hasn't joined yet.
+func handshakeUserArg(c *hub.ConnInfo, name string) hlua.M {
+	m := hlua.M{
+		"iProfile": -1,
+	}
+	if name != "" {
+		m["sNick"] = name
+	}
+	if c == nil {
+		return m
+	}
+	if addr, ok := c.Remote.(*net.TCPAddr); ok {
+		m["sIP"] = addr.IP.String()
+	}
+	return m
+}
+
+func (s *Script) setupArrivals() {
+	funcs := s.lookupArrivals(arrivalFuncs)
+	onUnknown := s.globalFunc("UnknownArrival", lua.MultipleReturns)
+	if len(funcs) != 0 || onUnknown != nil {
+		s.s.Scope().OnNMDCMessage(func(p hub.Peer, m nmdc.Message) bool {
+			typ := m.Type()
+			f := funcs[typ]
+			if f == nil && !nmdc.IsRegistered(typ) {
+				f = onUnknown
+			}
+			if f == nil {
+				return true
+			}
+			return callArrival(f, s.luaUserArg(p, false), m)
+		})
+	}
+
+	hfuncs := s.lookupArrivals(handshakeFuncs)
+	if len(hfuncs) != 0 {
+		s.s.Scope().OnNMDCHandshake(func(c *hub.ConnInfo, name string, m nmdc.Message) bool {
+			f := hfuncs[m.Type()]
+			if f == nil {
+				return true
+			}
+			return callArrival(f, handshakeUserArg(c, name), m)
+		})
+	}
+
+	if onErr := s.globalFunc("OnError", 0); onErr != nil {
+		s.s.OnError(func(err error) {
+			onErr.Call(err.Error())
+		})
+	}
+}
+
+func (s *Script) onExit() {
+	if exit := s.globalFunc("OnExit", 0); exit != nil {
+		exit.Call()
+	}
+}
@@ -0,0 +1,58 @@
+package px
+
+import (
+	"testing"
+
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+	"github.com/stretchr/testify/require"
+)
+
+const testArrivalsScript = `
+function ValidateNickArrival(user, data)
+	return user.sNick == "banned"
+end
+
+function ToArrival(user, data)
+	Core.SendToUser(user, "<Bot> to "..data:match("^%$To: (%S+)").."|")
+	return true
+end
+
+function SearchArrival(user, data)
+	Core.SendToUser(user, "<Bot> search "..user.sNick.."|")
+	return true
+end
+
+function ChatArrival(user, data)
+	if data:match("> fail|$") then
+		error("failed")
+	end
+end
+
+function OnError(msg)
+	Core.SendToAll("<Bot> "..tostring(msg:match("failed$")).."|")
+end
+`
+
+func TestArrivals(t *testing.T) {
+	h, closer := newTestScript(t, testArrivalsScript)
+	defer closer()
+
+	_, err := dialTestClient(h, "banned")
+	require.Error(t, err)
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	require.NoError(t, c.c.SendPrivateMsg("other", "hello"))
+	c.expectChat(t, "to other")
+
+	require.NoError(t, c.c.Search(nmdcp.Search{
+		User: "user", DataType: nmdcp.DataTypeAny, Pattern: "file",
+	}))
+	c.expectChat(t, "search user")
+
+	// errors are reported to OnError and do not affect the hub
+	require.NoError(t, c.c.SendChatMsg("fail"))
+	c.expectChat(t, "failed")
+	require.NotNil(t, h.PeerByName("user"))
+}
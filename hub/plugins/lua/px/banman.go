@@ -0,0 +1,448 @@
+package px
+
+import (
+	"net"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+
+	lua "github.com/Shopify/go-lua"
+)
+
+// http://wiki.ptokax.org/doku.php?id=luaapi:px_banman
+// https://github.com/pavel-pimenov/flylinkdc-hub/blob/master/core/LuaBanManLib.cpp
+
+func (s *Script) setupBanMan() {
+	s.s.SetRawFuncMap("BanMan", map[string]lua.Function{
+		"Save":               s.luaBansSave,
+		"GetBans":            s.luaGetBansFunc("GetBans", false, banAny),
+		"GetTempBans":        s.luaGetBansFunc("GetTempBans", false, banTemp),
+		"GetPermBans":        s.luaGetBansFunc("GetPermBans", false, banPerm),
+		"GetBan":             s.luaGetBanFunc("GetBan", banAny),
+		"GetPermBan":         s.luaGetBanFunc("GetPermBan", banPerm),
+		"GetTempBan":         s.luaGetBanFunc("GetTempBan", banTemp),
+		"GetRangeBans":       s.luaGetBansFunc("GetRangeBans", true, banAny),
+		"GetRangePermBans":   s.luaGetBansFunc("GetRangePermBans", true, banPerm),
+		"GetRangeTempBans":   s.luaGetBansFunc("GetRangeTempBans", true, banTemp),
+		"GetRangeBan":        s.luaGetRangeBanFunc("GetRangeBan", banAny),
+		"GetRangePermBan":    s.luaGetRangeBanFunc("GetRangePermBan", banPerm),
+		"GetRangeTempBan":    s.luaGetRangeBanFunc("GetRangeTempBan", banTemp),
+		"Unban":              s.luaUnbanFunc("Unban", banAny),
+		"UnbanPerm":          s.luaUnbanFunc("UnbanPerm", banPerm),
+		"UnbanTemp":          s.luaUnbanFunc("UnbanTemp", banTemp),
+		"RangeUnban":         s.luaRangeUnbanFunc("RangeUnban", banAny),
+		"RangeUnbanPerm":     s.luaRangeUnbanFunc("RangeUnbanPerm", banPerm),
+		"RangeUnbanTemp":     s.luaRangeUnbanFunc("RangeUnbanTemp", banTemp),
+		"ClearBans":          s.luaClearBansFunc("ClearBans", false, banAny),
+		"ClearPermBans":      s.luaClearBansFunc("ClearPermBans", false, banPerm),
+		"ClearTempBans":      s.luaClearBansFunc("ClearTempBans", false, banTemp),
+		"ClearRangeBans":     s.luaClearBansFunc("ClearRangeBans", true, banAny),
+		"ClearRangePermBans": s.luaClearBansFunc("ClearRangePermBans", true, banPerm),
+		"ClearRangeTempBans": s.luaClearBansFunc("ClearRangeTempBans", true, banTemp),
+		"Ban":                s.luaBan,
+		"BanIP":              s.luaBanIP,
+		"BanNick":            s.luaBanNick,
+		"TempBan":            s.luaTempBan,
+		"TempBanIP":          s.luaTempBanIP,
+		"TempBanNick":        s.luaTempBanNick,
+		"RangeBan":           s.luaRangeBan,
+		"RangeTempBan":       s.luaRangeTempBan,
+	})
+}
+
+// banKind selects permanent, temporary or any bans.
+type banKind int
+
+const (
+	banAny = banKind(iota)
+	banPerm
+	banTemp
+)
+
+func (k banKind) match(b *hub.Ban) bool {
+	switch k {
+	case banPerm:
+		return b.Until.IsZero()
+	case banTemp:
+		return !b.Until.IsZero()
+	}
+	return true
+}
+
+func (s *Script) banTable(b *hub.Ban) hlua.M {
+	reason, by := hub.SplitBanReason(b.Reason)
+	// Unlike PtokaX, the hub never lets registered users bypass IP bans,
+	// thus all IP and range bans are full bans.
+	m := hlua.M{
+		"bFullIpBan": b.Key.Nick() == "",
+	}
+	if reason != "" {
+		m["sReason"] = reason
+	}
+	if by != "" {
+		m["sBy"] = by
+	}
+	if !b.Until.IsZero() {
+		m["iExpireTime"] = b.Until.Unix()
+	}
+	if from, to := b.Key.Range(); from != nil {
+		m["sIPFrom"] = from.String()
+		m["sIPTo"] = to.String()
+		return m
+	}
+	if ip := b.Key.ToIP(); ip != nil {
+		m["sIP"] = ip.String()
+		m["bIpBan"] = true
+		m["bNickBan"] = false
+	} else {
+		m["sNick"] = b.Key.Nick()
+		m["bIpBan"] = false
+		m["bNickBan"] = true
+	}
+	return m
+}
+
+func (s *Script) listBans(rng bool, kind banKind) []hub.Ban {
+	var out []hub.Ban
+	for _, b := range s.h.ListBans() {
+		if from, _ := b.Key.Range(); (from != nil) != rng {
+			continue
+		} else if !rng && b.Key.ToIP() == nil && b.Key.Nick() == "" {
+			continue
+		}
+		if kind.match(&b) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// banKeys returns ban keys for a nick or an IP.
+func banKeys(v string) []hub.BanKey {
+	if ip := net.ParseIP(v); ip != nil {
+		return []hub.BanKey{hub.MinIPKey(ip)}
+	}
+	return []hub.BanKey{hub.NickBanKey(v)}
+}
+
+func (s *Script) getBan(keys []hub.BanKey, kind banKind) *hub.Ban {
+	for _, k := range keys {
+		if b := s.h.GetBan(k); b != nil && kind.match(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *Script) unban(keys []hub.BanKey, kind banKind) bool {
+	ok := false
+	for _, k := range keys {
+		if b := s.h.GetBan(k); b != nil && kind.match(b) {
+			ok = s.h.RemoveBan(k) || ok
+		}
+	}
+	return ok
+}
+
+// addBans adds bans and disconnects online users affected by them.
+func (s *Script) addBans(bans ...hub.Ban) bool {
+	for _, b := range bans {
+		if err := s.h.AddBan(b); err != nil {
+			s.h.Logf("%s: cannot add a ban: %v", s.Name(), err)
+			return false
+		}
+	}
+	for _, p := range s.onlineFilter(func(p hub.Peer) bool {
+		return !hub.IsBot(p) && (s.h.FindBan(p.Name(), p.RemoteAddr()) != nil || s.h.IsHardBlocked(p.RemoteAddr()))
+	}) {
+		_ = p.Close()
+	}
+	return true
+}
+
+func banUntil(min float64) time.Time {
+	return time.Now().Add(time.Duration(min * float64(time.Minute))).UTC()
+}
+
+func (s *Script) luaPushBans(st *lua.State, list []hub.Ban) {
+	st.NewTable()
+	t := st.Top()
+
+	for i := range list {
+		st.PushInteger(i + 1)
+		s.s.Push(s.banTable(&list[i]))
+		st.RawSet(t)
+	}
+}
+
+func (s *Script) luaPushBan(st *lua.State, b *hub.Ban) {
+	if b == nil {
+		st.PushNil()
+		return
+	}
+	s.s.Push(s.banTable(b))
+}
+
+func luaPushOK(st *lua.State, ok bool) {
+	if ok {
+		st.PushBoolean(true)
+	} else {
+		st.PushNil()
+	}
+}
+
+func (s *Script) luaBansSave(st *lua.State) int {
+	if !noArgs(st, "Save") {
+		return 0
+	}
+	// bans are saved to the database immediately
+	return 0
+}
+
+func (s *Script) luaGetBansFunc(fname string, rng bool, kind banKind) lua.Function {
+	return func(st *lua.State) int {
+		if !noArgs(st, fname) {
+			st.PushNil()
+			return 1
+		}
+		s.luaPushBans(st, s.listBans(rng, kind))
+		return 1
+	}
+}
+
+func (s *Script) luaGetBanFunc(fname string, kind banKind) lua.Function {
+	return func(st *lua.State) int {
+		if !assertArgsT(st, fname, lua.TypeString) {
+			st.PushNil()
+			return 1
+		}
+		v, _ := st.ToString(1)
+		st.SetTop(0)
+		s.luaPushBan(st, s.getBan(banKeys(v), kind))
+		return 1
+	}
+}
+
+// luaRangeArgs reads an IP range from the first two arguments.
+func luaRangeArgs(st *lua.State) (hub.BanKey, bool) {
+	sfrom, _ := st.ToString(1)
+	sto, _ := st.ToString(2)
+	from, to := net.ParseIP(sfrom), net.ParseIP(sto)
+	if from == nil || to == nil {
+		return "", false
+	}
+	k := hub.RangeBanKey(from, to)
+	return k, k != ""
+}
+
+func (s *Script) luaGetRangeBanFunc(fname string, kind banKind) lua.Function {
+	return func(st *lua.State) int {
+		if !assertArgsT(st, fname, lua.TypeString, lua.TypeString) {
+			st.PushNil()
+			return 1
+		}
+		k, ok := luaRangeArgs(st)
+		st.SetTop(0)
+		if !ok {
+			st.PushNil()
+			return 1
+		}
+		s.luaPushBan(st, s.getBan([]hub.BanKey{k}, kind))
+		return 1
+	}
+}
+
+func (s *Script) luaUnbanFunc(fname string, kind banKind) lua.Function {
+	return func(st *lua.State) int {
+		if !assertArgsT(st, fname, lua.TypeString) {
+			st.PushNil()
+			return 1
+		}
+		v, _ := st.ToString(1)
+		st.SetTop(0)
+		luaPushOK(st, s.unban(banKeys(v), kind))
+		return 1
+	}
+}
+
+func (s *Script) luaRangeUnbanFunc(fname string, kind banKind) lua.Function {
+	return func(st *lua.State) int {
+		if !assertArgsT(st, fname, lua.TypeString, lua.TypeString) {
+			st.PushNil()
+			return 1
+		}
+		k, ok := luaRangeArgs(st)
+		st.SetTop(0)
+		luaPushOK(st, ok && s.unban([]hub.BanKey{k}, kind))
+		return 1
+	}
+}
+
+func (s *Script) luaClearBansFunc(fname string, rng bool, kind banKind) lua.Function {
+	return func(st *lua.State) int {
+		if !noArgs(st, fname) {
+			return 0
+		}
+		for _, b := range s.listBans(rng, kind) {
+			s.h.RemoveBan(b.Key)
+		}
+		return 0
+	}
+}
+
+// userBans returns an IP and a nick ban for the user.
+//
+// PtokaX full ban flag is ignored by all ban functions, since the hub applies IP bans to registered users as well.
+// It doesn't mean a hard ban that blocks the connection right after it is accepted.
+func userBans(p hub.Peer, until time.Time, reason string) []hub.Ban {
+	bans := []hub.Ban{
+		{Key: hub.NickBanKey(p.Name()), Until: until, Reason: reason},
+	}
+	if addr, ok := p.RemoteAddr().(*net.TCPAddr); ok {
+		bans = append(bans, hub.Ban{Key: hub.MinIPKey(addr.IP), Until: until, Reason: reason})
+	}
+	return bans
+}
+
+func (s *Script) luaBan(st *lua.State) int {
+	if !assertArgsT(st, "Ban", lua.TypeTable, lua.TypeString, lua.TypeString, lua.TypeBoolean) {
+		st.PushNil()
+		return 1
+	}
+	p := s.luaAsUser(st, 1, "Ban")
+	reason, _ := st.ToString(2)
+	by, _ := st.ToString(3)
+	st.SetTop(0)
+	if p == nil {
+		st.PushNil()
+		return 1
+	}
+	luaPushOK(st, s.addBans(userBans(p, time.Time{}, hub.BanReason(reason, by))...))
+	return 1
+}
+
+func (s *Script) luaTempBan(st *lua.State) int {
+	if !assertArgsT(st, "TempBan", lua.TypeTable, lua.TypeNumber, lua.TypeString, lua.TypeString, lua.TypeBoolean) {
+		st.PushNil()
+		return 1
+	}
+	p := s.luaAsUser(st, 1, "TempBan")
+	min, _ := st.ToNumber(2)
+	reason, _ := st.ToString(3)
+	by, _ := st.ToString(4)
+	st.SetTop(0)
+	if p == nil || min <= 0 {
+		st.PushNil()
+		return 1
+	}
+	luaPushOK(st, s.addBans(userBans(p, banUntil(min), hub.BanReason(reason, by))...))
+	return 1
+}
+
+func (s *Script) luaBanIP(st *lua.State) int {
+	if !assertArgsT(st, "BanIP", lua.TypeString, lua.TypeString, lua.TypeString, lua.TypeBoolean) {
+		st.PushNil()
+		return 1
+	}
+	sip, _ := st.ToString(1)
+	reason, _ := st.ToString(2)
+	by, _ := st.ToString(3)
+	st.SetTop(0)
+	ip := net.ParseIP(sip)
+	if ip == nil {
+		st.PushNil()
+		return 1
+	}
+	luaPushOK(st, s.addBans(hub.Ban{Key: hub.MinIPKey(ip), Reason: hub.BanReason(reason, by)}))
+	return 1
+}
+
+func (s *Script) luaTempBanIP(st *lua.State) int {
+	if !assertArgsT(st, "TempBanIP", lua.TypeString, lua.TypeNumber, lua.TypeString, lua.TypeString, lua.TypeBoolean) {
+		st.PushNil()
+		return 1
+	}
+	sip, _ := st.ToString(1)
+	min, _ := st.ToNumber(2)
+	reason, _ := st.ToString(3)
+	by, _ := st.ToString(4)
+	st.SetTop(0)
+	ip := net.ParseIP(sip)
+	if ip == nil || min <= 0 {
+		st.PushNil()
+		return 1
+	}
+	luaPushOK(st, s.addBans(hub.Ban{Key: hub.MinIPKey(ip), Until: banUntil(min), Reason: hub.BanReason(reason, by)}))
+	return 1
+}
+
+func (s *Script) luaBanNick(st *lua.State) int {
+	if !assertArgsT(st, "BanNick", lua.TypeString, lua.TypeString, lua.TypeString) {
+		st.PushNil()
+		return 1
+	}
+	name, _ := st.ToString(1)
+	reason, _ := st.ToString(2)
+	by, _ := st.ToString(3)
+	st.SetTop(0)
+	if name == "" {
+		st.PushNil()
+		return 1
+	}
+	luaPushOK(st, s.addBans(hub.Ban{Key: hub.NickBanKey(name), Reason: hub.BanReason(reason, by)}))
+	return 1
+}
+
+func (s *Script) luaTempBanNick(st *lua.State) int {
+	if !assertArgsT(st, "TempBanNick", lua.TypeString, lua.TypeNumber, lua.TypeString, lua.TypeString) {
+		st.PushNil()
+		return 1
+	}
+	name, _ := st.ToString(1)
+	min, _ := st.ToNumber(2)
+	reason, _ := st.ToString(3)
+	by, _ := st.ToString(4)
+	st.SetTop(0)
+	if name == "" || min <= 0 {
+		st.PushNil()
+		return 1
+	}
+	luaPushOK(st, s.addBans(hub.Ban{Key: hub.NickBanKey(name), Until: banUntil(min), Reason: hub.BanReason(reason, by)}))
+	return 1
+}
+
+func (s *Script) luaRangeBan(st *lua.State) int {
+	if !assertArgsT(st, "RangeBan", lua.TypeString, lua.TypeString, lua.TypeString, lua.TypeString, lua.TypeBoolean) {
+		st.PushNil()
+		return 1
+	}
+	k, ok := luaRangeArgs(st)
+	reason, _ := st.ToString(3)
+	by, _ := st.ToString(4)
+	st.SetTop(0)
+	if !ok {
+		st.PushNil()
+		return 1
+	}
+	luaPushOK(st, s.addBans(hub.Ban{Key: k, Reason: hub.BanReason(reason, by)}))
+	return 1
+}
+
+func (s *Script) luaRangeTempBan(st *lua.State) int {
+	if !assertArgsT(st, "RangeTempBan", lua.TypeString, lua.TypeString, lua.TypeNumber, lua.TypeString, lua.TypeString, lua.TypeBoolean) {
+		st.PushNil()
+		return 1
+	}
+	k, ok := luaRangeArgs(st)
+	min, _ := st.ToNumber(3)
+	reason, _ := st.ToString(4)
+	by, _ := st.ToString(5)
+	st.SetTop(0)
+	if !ok || min <= 0 {
+		st.PushNil()
+		return 1
+	}
+	luaPushOK(st, s.addBans(hub.Ban{Key: k, Until: banUntil(min), Reason: hub.BanReason(reason, by)}))
+	return 1
+}
@@ -0,0 +1,111 @@
+package px
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+const testBanScript = `
+function ChatArrival(user, data)
+	local cmd = data:match("^<[^>]+> (.-)|$")
+	if cmd == "reg" then
+		local ok = RegMan.AddReg("other", "pass", 1)
+		local r = RegMan.GetReg("other")
+		Core.SendToUser(user, "<Bot> "..tostring(ok).." "..r.sNick.." "..r.sPassword.." "..r.iProfile.." "..#RegMan.GetOps().."|")
+	elseif cmd == "reg2" then
+		local ok, pass = RegMan.AddReg("another", 3)
+		local r = RegMan.GetReg("another")
+		Core.SendToUser(user, "<Bot> "..tostring(ok).." "..tostring(#pass == 16 and r.sPassword == pass).."|")
+	elseif cmd == "ban" then
+		local ok = BanMan.TempBanNick("other", 10, "flood", "Bot")
+		local b = BanMan.GetBan("other")
+		Core.SendToUser(user, "<Bot> "..tostring(ok).." "..b.sNick.." "..b.sReason.." "..b.sBy.." "..tostring(b.iExpireTime > os.time()).." "..#BanMan.GetPermBans().."|")
+	elseif cmd == "unban" then
+		Core.SendToUser(user, "<Bot> "..tostring(BanMan.UnbanPerm("other")).." "..tostring(BanMan.Unban("other")).."|")
+	elseif cmd == "country" then
+		Core.SendToUser(user, "<Bot> "..IP2Country.GetCountryCode(user).." "..tostring(IP2Country.GetCountryName("invalid")).."|")
+	elseif cmd == "self" then
+		BanMan.Ban(user, "bye", "Bot", false)
+	else
+		return false
+	end
+	return true
+end
+`
+
+func TestRegMan(t *testing.T) {
+	h, closer := newTestScript(t, testBanScript)
+	defer closer()
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	require.NoError(t, c.c.SendChatMsg("reg"))
+	c.expectChat(t, "true other pass 1 1")
+
+	rec, err := h.GetUserRecord("other")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	require.Equal(t, "pass", rec.Pass)
+
+	require.NoError(t, c.c.SendChatMsg("reg2"))
+	c.expectChat(t, "true true")
+
+	rec, err = h.GetUserRecord("another")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	require.True(t, rec.PassChange)
+}
+
+func TestBanMan(t *testing.T) {
+	h, closer := newTestScript(t, testBanScript)
+	defer closer()
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	require.NoError(t, c.c.SendChatMsg("ban"))
+	c.expectChat(t, "true other flood Bot true 0")
+
+	require.NoError(t, c.c.SendChatMsg("unban"))
+	c.expectChat(t, "nil true")
+
+	require.NoError(t, c.c.SendChatMsg("country"))
+	c.expectChat(t, "?? nil")
+
+	// banned users are disconnected
+	require.NoError(t, c.c.SendChatMsg("self"))
+	waitFor(t, func() bool {
+		return h.PeerByName("user") == nil
+	})
+	require.NotNil(t, h.FindBan("user", nil))
+}
+
+func TestProfileID(t *testing.T) {
+	db := hub.NewDatabase()
+	require.NoError(t, db.PutProfile("vip", hub.Map{hub.ProfileParent: hub.ProfileNameRegistered}))
+	require.NoError(t, db.PutProfile("mod", hub.Map{hub.ProfileParent: hub.ProfileNameOperator}))
+	require.NoError(t, db.PutProfile("admin", hub.Map{hub.ProfileParent: hub.ProfileNameRegistered, hub.PermOwner: true}))
+
+	h, err := hub.NewHub(hub.Config{}, nil)
+	require.NoError(t, err)
+	h.SetDatabase(db)
+	require.NoError(t, h.Start())
+	defer h.Close()
+
+	for name, exp := range map[string]int{
+		hub.ProfileNameRoot:       0,
+		hub.ProfileNameOperator:   1,
+		hub.ProfileNameRegistered: 3,
+		hub.ProfileNameGuest:      -1,
+		"vip":                     3,
+		"mod":                     1,
+		"admin":                   0,
+	} {
+		require.Equal(t, exp, profileID(h.Profile(name)), name)
+	}
+	require.Equal(t, -1, profileID(nil))
+}
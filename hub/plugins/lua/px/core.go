@@ -1,8 +1,9 @@
 package px
 
 import (
+	"fmt"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
@@ -43,27 +44,27 @@ func (s *Script) setupCore() {
 		"GetOnlineOps":         s.luaGetOnlineOps,
 		"GetOnlineRegs":        s.luaGetOnlineRegs,
 		"GetOnlineUsers":       s.luaGetOnlineUsers,
-		//"GetUser":              s.luaGetUser,
-		//"GetUserAllData":       s.luaGetUserAllData,
-		//"GetUserData":          s.luaGetUserData,
-		//"GetUserValue":         s.luaGetUserValue,
-		//"GetUsers":             s.luaGetUsers,
-		//"Disconnect":           s.luaDisconnect,
-		//"Kick":                 s.luaKick,
-		//"Redirect":             s.luaRedirect,
-		//"DefloodWarn":          s.luaDefloodWarn,
-		//"SendToAll":            s.luaSendToAll,
-		//"SendToNick":           s.luaSendToNick,
-		//"SendToOpChat":         s.luaSendToOpChat,
-		//"SendToOps":            s.luaSendToOps,
-		//"SendToProfile":        s.luaSendToProfile,
-		"SendToUser": s.luaSendToUser,
-		//"SendPmToAll":          s.luaSendPmToAll,
-		//"SendPmToNick":         s.luaSendPmToNick,
-		//"SendPmToOps":          s.luaSendPmToOps,
-		//"SendPmToProfile":      s.luaSendPmToProfile,
-		//"SendPmToUser":         s.luaSendPmToUser,
-		//"SetUserInfo":          s.luaSetUserInfo,
+		"GetUser":              s.luaGetUser,
+		"GetUserAllData":       s.luaGetUserAllData,
+		"GetUserData":          s.luaGetUserData,
+		"GetUserValue":         s.luaGetUserValue,
+		"GetUsers":             s.luaGetUsers,
+		"Disconnect":           s.luaDisconnect,
+		"Kick":                 s.luaKick,
+		"Redirect":             s.luaRedirect,
+		"DefloodWarn":          s.luaDefloodWarn,
+		"SendToAll":            s.luaSendToAll,
+		"SendToNick":           s.luaSendToNick,
+		"SendToOpChat":         s.luaSendToOpChat,
+		"SendToOps":            s.luaSendToOps,
+		"SendToProfile":        s.luaSendToProfile,
+		"SendToUser":           s.luaSendToUser,
+		"SendPmToAll":          s.luaSendPmToAll,
+		"SendPmToNick":         s.luaSendPmToNick,
+		"SendPmToOps":          s.luaSendPmToOps,
+		"SendPmToProfile":      s.luaSendPmToProfile,
+		"SendPmToUser":         s.luaSendPmToUser,
+		"SetUserInfo":          s.luaSetUserInfo,
 	}
 	m := make(map[string]interface{}, len(strm)+len(funcm))
 	for k, v := range strm {
@@ -77,7 +78,9 @@ func (s *Script) setupCore() {
 
 type core struct {
 	sync.RWMutex
-	bots map[string]*pxBot
+	bots     map[string]*pxBot
+	warns    map[hub.Peer]int
+	scripted map[hub.Peer]*scriptedInfo
 }
 
 func (s *Script) restart() {
@@ -122,7 +125,7 @@ func (b *pxBot) Close() error {
 }
 
 func (s *Script) regBotName(name, desc, email string) (*pxBot, error) {
-	b, err := s.h.NewBotDesc(name, desc, email, types.Software{
+	b, err := s.s.Scope().NewBotDesc(name, desc, email, types.Software{
 		Name:    apiName,
 		Version: versionString,
 	})
@@ -256,6 +259,196 @@ func (s *Script) onlineFilter(filter func(p hub.Peer) bool) []hub.Peer {
 	return out
 }
 
+// userByName finds an online user by name. Bots are ignored.
+func (s *Script) userByName(name string) hub.Peer {
+	p := s.h.PeerByName(name)
+	if p == nil || hub.IsBot(p) {
+		return nil
+	}
+	return p
+}
+
+func (s *Script) usersByIP(ip net.IP) []hub.Peer {
+	return s.onlineFilter(func(p hub.Peer) bool {
+		return !hub.IsBot(p) && ip.Equal(peerIP(p))
+	})
+}
+
+func (s *Script) profileFilter(profile int) func(p hub.Peer) bool {
+	return func(p hub.Peer) bool {
+		return !hub.IsBot(p) && s.peerProfileID(p) == profile
+	}
+}
+
+func (s *Script) opsFilter(p hub.Peer) bool {
+	return !hub.IsBot(p) && p.User().IsOp()
+}
+
+// forgetUser removes the state associated with the user that left the hub.
+func (s *Script) forgetUser(p hub.Peer) {
+	s.core.Lock()
+	delete(s.core.warns, p)
+	delete(s.core.scripted, p)
+	s.core.Unlock()
+}
+
+// nmdcFlusher is implemented by NMDC peers that can send a message without buffering.
+type nmdcFlusher interface {
+	SendNMDCNow(m ...nmdc.Message) error
+}
+
+// kick disconnects the user and temporarily bans it, as PtokaX does.
+// The ban time is controlled by the DEFAULT_TEMP_BAN_TIME setting.
+func (s *Script) kick(p hub.Peer, kicker, reason string) {
+	msg := &nmdc.ChatMessage{
+		Name: kicker,
+		Text: "You are being kicked because: " + reason,
+	}
+	// make sure the message is delivered before the connection is closed
+	if np, ok := p.(nmdcFlusher); ok {
+		_ = np.SendNMDCNow(msg)
+	} else {
+		_ = s.h.SendNMDCTo(p, msg)
+	}
+	if min, _ := s.getInt(px_SETSHORT_DEFAULT_TEMP_BAN_TIME); min > 0 {
+		s.addBans(userBans(p, banUntil(float64(min)), hub.BanReason(reason, kicker))...)
+	}
+	_ = p.Close()
+}
+
+func (s *Script) redirect(p hub.Peer, addr, reason string) {
+	_ = p.HubChatMsg(hub.Message{
+		Text: "You are being redirected to " + addr + " because: " + reason,
+	})
+	_ = p.Redirect(addr)
+	_ = p.Close()
+}
+
+// defloodWarn increments the number of deflood warnings for the user
+// and disconnects the user if the limit is reached.
+func (s *Script) defloodWarn(p hub.Peer) {
+	max, ok := s.getInt(px_SETSHORT_DEFLOOD_WARNING_COUNT)
+	if !ok || max <= 0 {
+		max = 5
+	}
+	s.core.Lock()
+	if s.core.warns == nil {
+		s.core.warns = make(map[hub.Peer]int)
+	}
+	s.core.warns[p]++
+	n := s.core.warns[p]
+	if n >= max {
+		delete(s.core.warns, p)
+	}
+	s.core.Unlock()
+	if n >= max {
+		s.h.Logf("%s: disconnecting %q: too many deflood warnings", s.Name(), p.Name())
+		_ = p.Close()
+	}
+}
+
+// sendRaw sends raw NMDC commands to all the peers. Delivery errors are ignored.
+func (s *Script) sendRaw(peers []hub.Peer, data string) error {
+	msgs, err := hlua.ParseNMDC(data)
+	if err != nil {
+		return err
+	}
+	for _, p := range peers {
+		_ = s.h.SendNMDCTo(p, msgs...)
+	}
+	return nil
+}
+
+func (s *Script) sendPM(peers []hub.Peer, from, text string) {
+	for _, p := range peers {
+		_ = s.h.SendNMDCTo(p, &nmdc.PrivateMessage{
+			To: p.Name(), From: from,
+			Name: from, Text: text,
+		})
+	}
+}
+
+// setUserInfo changes a part of the user info. The value is either a string, an uint64 share size or nil.
+// Nil value restores the info sent by the user.
+func (s *Script) setUserInfo(p hub.Peer, typ int, val interface{}, perm bool) error {
+	key := ""
+	if perm {
+		key = "px:" + strconv.Itoa(typ)
+	}
+	if val == nil {
+		s.setScriptedInfo(p, typ, nil)
+		return s.h.UpdateNMDCInfo(p, "px:"+strconv.Itoa(typ), nil)
+	}
+	var fnc func(u *nmdc.MyINFO)
+	switch typ {
+	case px_INFO_DESCRIPTION:
+		v := val.(string)
+		fnc = func(u *nmdc.MyINFO) { u.Desc = v }
+	case px_INFO_TAG:
+		var tag nmdc.MyINFO
+		if err := parseNMDCTag(&tag, val.(string)); err != nil {
+			return err
+		}
+		fnc = func(u *nmdc.MyINFO) {
+			u.Client, u.Mode = tag.Client, tag.Mode
+			u.HubsNormal, u.HubsRegistered, u.HubsOperator = tag.HubsNormal, tag.HubsRegistered, tag.HubsOperator
+			u.Slots, u.Extra = tag.Slots, tag.Extra
+		}
+	case px_INFO_CONNECTION:
+		v := val.(string)
+		fnc = func(u *nmdc.MyINFO) { u.Conn = v }
+	case px_INFO_EMAIL:
+		v := val.(string)
+		fnc = func(u *nmdc.MyINFO) { u.Email = v }
+	case px_INFO_SHARE:
+		v := val.(uint64)
+		fnc = func(u *nmdc.MyINFO) { u.ShareSize = v }
+	default:
+		return fmt.Errorf("unknown info type: %d", typ)
+	}
+	if err := s.h.UpdateNMDCInfo(p, key, fnc); err != nil {
+		return err
+	}
+	s.setScriptedInfo(p, typ, val)
+	return nil
+}
+
+func (s *Script) setScriptedInfo(p hub.Peer, typ int, val interface{}) {
+	s.core.Lock()
+	defer s.core.Unlock()
+	si := s.core.scripted[p]
+	if si == nil {
+		if val == nil {
+			return
+		}
+		si = &scriptedInfo{}
+		if s.core.scripted == nil {
+			s.core.scripted = make(map[hub.Peer]*scriptedInfo)
+		}
+		s.core.scripted[p] = si
+	}
+	var str *string
+	if v, ok := val.(string); ok {
+		str = &v
+	}
+	switch typ {
+	case px_INFO_DESCRIPTION:
+		si.desc = str
+	case px_INFO_TAG:
+		si.tag = str
+	case px_INFO_CONNECTION:
+		si.conn = str
+	case px_INFO_EMAIL:
+		si.email = str
+	case px_INFO_SHARE:
+		if v, ok := val.(uint64); ok {
+			si.share = &v
+		} else {
+			si.share = nil
+		}
+	}
+}
+
 func (s *Script) luaRestart(st *lua.State) int {
 	if !noArgs(st, "Restart") {
 		return 0
@@ -518,31 +711,6 @@ func (s *Script) luaGetUpTime(st *lua.State) int {
 	return 1
 }
 
-func (s *Script) luaUserArg(p hub.Peer, full bool) interface{} {
-	if p == nil {
-		return nil
-	}
-	// FIXME: other fields
-	name := p.Name()
-	iprof := -1
-	if u := p.User(); u != nil {
-		// TODO: check if this is valid
-		if u.IsOwner() {
-			iprof = 0
-		} else if u.IsOp() {
-			iprof = 1
-		} else if u.IsRegistered() {
-			iprof = 3
-		}
-	}
-	return hlua.M{
-		"uptr":     hlua.UserData{Ptr: p},
-		"sName":    name,
-		"sNick":    name,
-		"iProfile": iprof,
-	}
-}
-
 func (s *Script) luaPushUser(st *lua.State, u hub.Peer, full bool) {
 	m := s.luaUserArg(u, full)
 	s.s.Push(m)
@@ -682,87 +850,390 @@ func (s *Script) luaGetOnlineUsers(st *lua.State) int {
 	return 1
 }
 
-//func (s *Script) luaGetUser(st *lua.State) int {
-//}
-//
-//func (s *Script) luaGetUserAllData(st *lua.State) int {
-//}
-//
-//func (s *Script) luaGetUserData(st *lua.State) int {
-//}
-//
-//func (s *Script) luaGetUserValue(st *lua.State) int {
-//}
-//
-//func (s *Script) luaGetUsers(st *lua.State) int {
-//}
-//
-//func (s *Script) luaDisconnect(st *lua.State) int {
-//}
-//
-//func (s *Script) luaKick(st *lua.State) int {
-//}
-//
-//func (s *Script) luaRedirect(st *lua.State) int {
-//}
-//
-//func (s *Script) luaDefloodWarn(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendToAll(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendToNick(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendToOpChat(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendToOps(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendToProfile(st *lua.State) int {
-//}
+// luaUserArgs parses arguments in a form of (sArg[, bAll]) and returns the string and the flag.
+func luaUserArgs(st *lua.State, fname string) (string, bool, bool) {
+	switch n := st.Top(); n {
+	case 1:
+		if !assertArgsT(st, fname, lua.TypeString) {
+			return "", false, false
+		}
+		v, _ := st.ToString(1)
+		st.SetTop(0)
+		return v, false, true
+	case 2:
+		if !assertArgsT(st, fname, lua.TypeString, lua.TypeBoolean) {
+			return "", false, false
+		}
+		v, _ := st.ToString(1)
+		full := st.ToBoolean(2)
+		st.SetTop(0)
+		return v, full, true
+	default:
+		lua.Errorf(st, "bad argument count to '%s' (1 or 2 expected, got %d)", fname, n)
+		st.SetTop(0)
+		return "", false, false
+	}
+}
+
+// luaAsUserOrNick returns a user from either the user table or the nick.
+func (s *Script) luaAsUserOrNick(st *lua.State, at int, fname string) hub.Peer {
+	switch tp := st.TypeOf(at); tp {
+	case lua.TypeTable:
+		return s.luaAsUser(st, at, fname)
+	case lua.TypeString:
+		name, _ := st.ToString(at)
+		return s.userByName(name)
+	default:
+		lua.Errorf(st, "bad argument #%d to '%s' (user table or string expected, got %s)", at, fname, lua.TypeNameOf(st, at))
+		return nil
+	}
+}
+
+func (s *Script) luaGetUser(st *lua.State) int {
+	name, full, ok := luaUserArgs(st, "GetUser")
+	if !ok {
+		st.PushNil()
+		return 1
+	}
+	p := s.userByName(name)
+	if p == nil {
+		st.PushNil()
+		return 1
+	}
+	s.luaPushUser(st, p, full)
+	return 1
+}
+
+// luaSetUserField sets a user data field in the user table at a given index.
+func (s *Script) luaSetUserField(st *lua.State, at int, p hub.Peer, info *nmdc.MyINFO, id int) {
+	st.PushString(pxUserFields[id])
+	s.s.Push(s.userValue(p, info, id))
+	st.RawSet(at)
+}
+
+func (s *Script) luaGetUserAllData(st *lua.State) int {
+	if !assertArgsT(st, "GetUserAllData", lua.TypeTable) {
+		st.PushNil()
+		return 1
+	}
+	p := s.luaAsUser(st, 1, "GetUserAllData")
+	if p == nil {
+		st.SetTop(0)
+		st.PushNil()
+		return 1
+	}
+	info := hub.NMDCUserInfo(p)
+	for id := range pxUserFields {
+		s.luaSetUserField(st, 1, p, &info, id)
+	}
+	st.SetTop(0)
+	st.PushBoolean(true)
+	return 1
+}
+
+func (s *Script) luaGetUserData(st *lua.State) int {
+	if !assertArgsT(st, "GetUserData", lua.TypeTable, lua.TypeNumber) {
+		st.PushNil()
+		return 1
+	}
+	id, _ := st.ToInteger(2)
+	p := s.luaAsUser(st, 1, "GetUserData")
+	if p == nil || id < 0 || id >= px_USER_DATA_END {
+		st.SetTop(0)
+		st.PushNil()
+		return 1
+	}
+	info := hub.NMDCUserInfo(p)
+	s.luaSetUserField(st, 1, p, &info, id)
+	st.SetTop(0)
+	st.PushBoolean(true)
+	return 1
+}
+
+func (s *Script) luaGetUserValue(st *lua.State) int {
+	if !assertArgsT(st, "GetUserValue", lua.TypeTable, lua.TypeNumber) {
+		st.PushNil()
+		return 1
+	}
+	id, _ := st.ToInteger(2)
+	p := s.luaAsUser(st, 1, "GetUserValue")
+	st.SetTop(0)
+	if p == nil || id < 0 || id >= px_USER_DATA_END {
+		st.PushNil()
+		return 1
+	}
+	info := hub.NMDCUserInfo(p)
+	s.s.Push(s.userValue(p, &info, id))
+	return 1
+}
+
+func (s *Script) luaGetUsers(st *lua.State) int {
+	sip, full, ok := luaUserArgs(st, "GetUsers")
+	if !ok {
+		st.PushNil()
+		return 1
+	}
+	ip := net.ParseIP(sip)
+	if ip == nil {
+		st.PushNil()
+		return 1
+	}
+	list := s.usersByIP(ip)
+	if len(list) == 0 {
+		st.PushNil()
+		return 1
+	}
+
+	st.NewTable()
+	t := st.Top()
+
+	for i, u := range list {
+		st.PushInteger(i + 1)
+		s.luaPushUser(st, u, full)
+		st.RawSet(t)
+	}
+
+	return 1
+}
+
+func (s *Script) luaDisconnect(st *lua.State) int {
+	if !assertArgsN(st, "Disconnect", 1) {
+		st.PushNil()
+		return 1
+	}
+	p := s.luaAsUserOrNick(st, 1, "Disconnect")
+	st.SetTop(0)
+	if p == nil {
+		st.PushNil()
+		return 1
+	}
+	_ = p.Close()
+	st.PushBoolean(true)
+	return 1
+}
+
+func (s *Script) luaKick(st *lua.State) int {
+	if !assertArgsT(st, "Kick", lua.TypeTable, lua.TypeString, lua.TypeString) {
+		st.PushNil()
+		return 1
+	}
+	p := s.luaAsUser(st, 1, "Kick")
+	kicker, _ := st.ToString(2)
+	reason, _ := st.ToString(3)
+	st.SetTop(0)
+	if p == nil {
+		st.PushNil()
+		return 1
+	}
+	s.kick(p, kicker, reason)
+	st.PushBoolean(true)
+	return 1
+}
+
+func (s *Script) luaRedirect(st *lua.State) int {
+	if !assertArgsT(st, "Redirect", lua.TypeTable, lua.TypeString, lua.TypeString) {
+		st.PushNil()
+		return 1
+	}
+	p := s.luaAsUser(st, 1, "Redirect")
+	addr, _ := st.ToString(2)
+	reason, _ := st.ToString(3)
+	st.SetTop(0)
+	if p == nil {
+		st.PushNil()
+		return 1
+	}
+	s.redirect(p, addr, reason)
+	st.PushBoolean(true)
+	return 1
+}
+
+func (s *Script) luaDefloodWarn(st *lua.State) int {
+	if !assertArgsT(st, "DefloodWarn", lua.TypeTable) {
+		st.PushNil()
+		return 1
+	}
+	p := s.luaAsUser(st, 1, "DefloodWarn")
+	st.SetTop(0)
+	if p == nil {
+		st.PushNil()
+		return 1
+	}
+	s.defloodWarn(p)
+	st.PushBoolean(true)
+	return 1
+}
+
+func (s *Script) luaSendRaw(st *lua.State, peers []hub.Peer, data string) {
+	if err := s.sendRaw(peers, data); err != nil {
+		lua.Errorf(st, "%s", err.Error())
+	}
+}
+
+func (s *Script) luaSendToAll(st *lua.State) int {
+	if !assertArgsT(st, "SendToAll", lua.TypeString) {
+		return 0
+	}
+	data, _ := st.ToString(1)
+	st.SetTop(0)
+	s.luaSendRaw(st, s.h.Peers(), data)
+	return 0
+}
+
+func (s *Script) luaSendToNick(st *lua.State) int {
+	if !assertArgsT(st, "SendToNick", lua.TypeString, lua.TypeString) {
+		return 0
+	}
+	name, _ := st.ToString(1)
+	data, _ := st.ToString(2)
+	st.SetTop(0)
+	p := s.userByName(name)
+	if p == nil {
+		return 0
+	}
+	s.luaSendRaw(st, []hub.Peer{p}, data)
+	return 0
+}
+
+func (s *Script) luaSendToOpChat(st *lua.State) int {
+	if !assertArgsT(st, "SendToOpChat", lua.TypeString) {
+		return 0
+	}
+	data, _ := st.ToString(1)
+	st.SetTop(0)
+	s.h.SendOpChat(data)
+	return 0
+}
+
+func (s *Script) luaSendToOps(st *lua.State) int {
+	if !assertArgsT(st, "SendToOps", lua.TypeString) {
+		return 0
+	}
+	data, _ := st.ToString(1)
+	st.SetTop(0)
+	s.luaSendRaw(st, s.onlineFilter(s.opsFilter), data)
+	return 0
+}
+
+func (s *Script) luaSendToProfile(st *lua.State) int {
+	if !assertArgsT(st, "SendToProfile", lua.TypeNumber, lua.TypeString) {
+		return 0
+	}
+	profile, _ := st.ToInteger(1)
+	data, _ := st.ToString(2)
+	st.SetTop(0)
+	s.luaSendRaw(st, s.onlineFilter(s.profileFilter(profile)), data)
+	return 0
+}
 
 func (s *Script) luaSendToUser(st *lua.State) int {
 	if !assertArgsT(st, "SendToUser", lua.TypeTable, lua.TypeString) {
 		return 0
 	}
 	p := s.luaAsUser(st, 1, "SendToUser")
-	cmd, _ := st.ToString(2)
+	data, _ := st.ToString(2)
 	st.SetTop(0)
 	if p == nil {
 		return 0
 	}
-	if !strings.HasSuffix(cmd, "|") {
-		cmd += "|"
+	s.luaSendRaw(st, []hub.Peer{p}, data)
+	return 0
+}
+
+func (s *Script) luaSendPmToAll(st *lua.State) int {
+	if !assertArgsT(st, "SendPmToAll", lua.TypeString, lua.TypeString) {
+		return 0
 	}
-	m, err := nmdc.Unmarshal(nil, []byte(cmd))
-	if err != nil {
-		lua.Errorf(st, "failed to decode message: %v (%s)", err, cmd)
+	from, _ := st.ToString(1)
+	data, _ := st.ToString(2)
+	st.SetTop(0)
+	s.sendPM(s.h.Peers(), from, data)
+	return 0
+}
+
+func (s *Script) luaSendPmToNick(st *lua.State) int {
+	if !assertArgsT(st, "SendPmToNick", lua.TypeString, lua.TypeString, lua.TypeString) {
 		return 0
 	}
-	err = s.h.SendNMDCTo(p, m)
-	if err != nil {
-		lua.Errorf(st, "%s", err.Error())
+	name, _ := st.ToString(1)
+	from, _ := st.ToString(2)
+	data, _ := st.ToString(3)
+	st.SetTop(0)
+	if p := s.userByName(name); p != nil {
+		s.sendPM([]hub.Peer{p}, from, data)
+	}
+	return 0
+}
+
+func (s *Script) luaSendPmToOps(st *lua.State) int {
+	if !assertArgsT(st, "SendPmToOps", lua.TypeString, lua.TypeString) {
+		return 0
+	}
+	from, _ := st.ToString(1)
+	data, _ := st.ToString(2)
+	st.SetTop(0)
+	s.sendPM(s.onlineFilter(s.opsFilter), from, data)
+	return 0
+}
+
+func (s *Script) luaSendPmToProfile(st *lua.State) int {
+	if !assertArgsT(st, "SendPmToProfile", lua.TypeNumber, lua.TypeString, lua.TypeString) {
+		return 0
+	}
+	profile, _ := st.ToInteger(1)
+	from, _ := st.ToString(2)
+	data, _ := st.ToString(3)
+	st.SetTop(0)
+	s.sendPM(s.onlineFilter(s.profileFilter(profile)), from, data)
+	return 0
+}
+
+func (s *Script) luaSendPmToUser(st *lua.State) int {
+	if !assertArgsT(st, "SendPmToUser", lua.TypeTable, lua.TypeString, lua.TypeString) {
+		return 0
+	}
+	p := s.luaAsUser(st, 1, "SendPmToUser")
+	from, _ := st.ToString(2)
+	data, _ := st.ToString(3)
+	st.SetTop(0)
+	if p != nil {
+		s.sendPM([]hub.Peer{p}, from, data)
 	}
 	return 0
 }
 
-//func (s *Script) luaSendPmToAll(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendPmToNick(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendPmToOps(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendPmToProfile(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSendPmToUser(st *lua.State) int {
-//}
-//
-//func (s *Script) luaSetUserInfo(st *lua.State) int {
-//}
+func (s *Script) luaSetUserInfo(st *lua.State) int {
+	if !assertArgsN(st, "SetUserInfo", 4) {
+		return 0
+	}
+	lua.CheckType(st, 1, lua.TypeTable)
+	typ := lua.CheckInteger(st, 2)
+	lua.CheckType(st, 4, lua.TypeBoolean)
+	if typ < 0 || typ >= px_INFO_END {
+		lua.ArgumentError(st, 2, "invalid info type")
+		return 0
+	}
+	var val interface{}
+	switch {
+	case st.IsNil(3):
+	case typ == px_INFO_SHARE:
+		v := lua.CheckNumber(st, 3)
+		if v < 0 {
+			lua.ArgumentError(st, 3, "share cannot be negative")
+			return 0
+		}
+		val = uint64(v)
+	default:
+		val = lua.CheckString(st, 3)
+	}
+	perm := st.ToBoolean(4)
+	p := s.luaAsUser(st, 1, "SetUserInfo")
+	st.SetTop(0)
+	if p == nil {
+		return 0
+	}
+	if err := s.setUserInfo(p, typ, val, perm); err != nil {
+		lua.Errorf(st, "%s", err.Error())
+	}
+	return 0
+}
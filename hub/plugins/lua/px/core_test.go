@@ -0,0 +1,261 @@
+package px
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+	"github.com/direct-connect/go-dcpp/nmdc"
+	"github.com/direct-connect/go-dcpp/nmdc/client"
+)
+
+// testScript executes Core functions when a user sends a command to the chat.
+// Replies are sent from the "Bot".
+const testScript = `
+function ChatArrival(user, data)
+	local cmd = data:match("^<[^>]+> (.-)|$")
+	if cmd == "kick" then
+		Core.Kick(user, "Bot", "testing")
+	elseif cmd == "pm" then
+		Core.SendPmToUser(user, "Bot", "hello")
+	elseif cmd == "raw" then
+		Core.SendToNick(user.sNick, "<Bot> one|<Bot> two|")
+	elseif cmd == "user" then
+		local u = Core.GetUser(user.sNick, true)
+		local bot = Core.GetUser("Bot")
+		Core.SendToUser(user, "<Bot> "..u.sNick.." "..u.sIP.." "..tostring(u.bConnected).." "..tostring(u.sEmail).." "..tostring(bot).."|")
+	elseif cmd == "value" then
+		Core.SendToUser(user, "<Bot> "..Core.GetUserValue(user, 16).." "..tostring(Core.GetUserValue(user, 100)).."|")
+	elseif cmd == "ip" then
+		local list = Core.GetUsers(user.sIP)
+		Core.SendToUser(user, "<Bot> "..#list.." "..tostring(Core.GetUsers("10.0.0.1")).."|")
+	elseif cmd == "info" then
+		Core.SetUserInfo(user, 0, "scripted", true)
+		Core.SetUserInfo(user, 4, 1024, false)
+		local negative = pcall(Core.SetUserInfo, user, 4, -1, false)
+		Core.GetUserAllData(user)
+		Core.SendToUser(user, "<Bot> "..user.sDescription.." "..tostring(user.bDescriptionChanged).." "..user.iShareSize.." "..tostring(user.bEmailChanged).." "..tostring(negative).."|")
+	elseif cmd == "warn" then
+		Core.DefloodWarn(user)
+		Core.SendToUser(user, "<Bot> "..Core.GetUserValue(user, 23).."|")
+	else
+		return false
+	end
+	return true
+end
+`
+
+func newTestScript(t testing.TB, code string) (*hub.Hub, func()) {
+	h, err := hub.NewHub(hub.Config{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, h.Start())
+
+	dir, err := ioutil.TempDir("", "px_")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "test.lua")
+	err = ioutil.WriteFile(path, []byte(code), 0644)
+	require.NoError(t, err)
+
+	s, err := hlua.LoadScript(h, path)
+	if err != nil {
+		os.RemoveAll(dir)
+		require.NoError(t, err)
+	}
+	return h, func() {
+		_ = s.Close()
+		_ = h.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+type testClient struct {
+	conn net.Conn
+	c    *client.Conn
+	chat chan string
+	pm   chan *nmdcp.PrivateMessage
+}
+
+func (c *testClient) Close() {
+	// close the pipe first to unblock the reader
+	_ = c.conn.Close()
+	_ = c.c.Close()
+}
+
+func (c *testClient) expectChat(t testing.TB, exp string) {
+	select {
+	case text := <-c.chat:
+		require.Equal(t, exp, text)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %q", exp)
+	}
+}
+
+func newTestClient(t testing.TB, h *hub.Hub, name string) *testClient {
+	c, err := dialTestClient(h, name)
+	require.NoError(t, err)
+	return c
+}
+
+func dialTestClient(h *hub.Hub, name string) (*testClient, error) {
+	hc, cc := net.Pipe()
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1000}
+	go func() {
+		defer hc.Close()
+		_ = h.ServeNMDC(pipeAddr{Conn: hc, remote: addr}, nil)
+	}()
+	conn, err := nmdc.NewConn(cc)
+	if err != nil {
+		return nil, err
+	}
+	tc := &testClient{
+		conn: cc,
+		chat: make(chan string, 10),
+		pm:   make(chan *nmdcp.PrivateMessage, 10),
+	}
+	c, err := client.HubHandshake(conn, &client.Config{Name: name, Init: func(c *client.Conn) {
+		c.OnChatMessage(func(m *nmdcp.ChatMessage) error {
+			if m.Name == "Bot" {
+				tc.chat <- m.Text
+			}
+			return nil
+		})
+		c.OnUnhandled(func(m nmdcp.Message) error {
+			if pm, ok := m.(*nmdcp.PrivateMessage); ok {
+				tc.pm <- pm
+			}
+			return nil
+		})
+	}})
+	if err != nil {
+		_ = cc.Close()
+		return nil, err
+	}
+	tc.c = c
+	return tc, nil
+}
+
+// waitFor waits until the condition is true.
+func waitFor(t testing.TB, fnc func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !fnc() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type pipeAddr struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c pipeAddr) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestCoreUsers(t *testing.T) {
+	h, closer := newTestScript(t, testScript)
+	defer closer()
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	require.NoError(t, c.c.SendChatMsg("user"))
+	c.expectChat(t, "user 127.0.0.1 true nil nil")
+
+	p := h.PeerByName("user")
+	require.NotNil(t, p)
+	share := hub.NMDCUserInfo(p).ShareSize
+
+	require.NoError(t, c.c.SendChatMsg("value"))
+	c.expectChat(t, strconv.FormatUint(share, 10)+" nil")
+
+	require.NoError(t, c.c.SendChatMsg("ip"))
+	c.expectChat(t, "1 nil")
+
+	require.NoError(t, c.c.SendChatMsg("info"))
+	c.expectChat(t, "scripted true 1024 false false")
+	info := hub.NMDCUserInfo(p)
+	require.Equal(t, "scripted", info.Desc)
+	require.Equal(t, uint64(1024), info.ShareSize)
+
+	// permanent change survives the user info update, while the temporary one doesn't
+	require.NoError(t, c.c.UpdateInfo(func(u *nmdcp.MyINFO) {
+		u.Desc = "original"
+		u.ShareSize = 10
+	}))
+	waitFor(t, func() bool {
+		return hub.NMDCUserInfo(p).ShareSize == 10
+	})
+	require.Equal(t, "scripted", hub.NMDCUserInfo(p).Desc)
+}
+
+func TestCoreSend(t *testing.T) {
+	h, closer := newTestScript(t, testScript)
+	defer closer()
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	require.NoError(t, c.c.SendChatMsg("raw"))
+	c.expectChat(t, "one")
+	c.expectChat(t, "two")
+
+	require.NoError(t, c.c.SendChatMsg("pm"))
+	select {
+	case pm := <-c.pm:
+		require.Equal(t, "user", pm.To)
+		require.Equal(t, "Bot", pm.From)
+		require.Equal(t, "hello", pm.Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for PM")
+	}
+}
+
+func TestCoreKick(t *testing.T) {
+	h, closer := newTestScript(t, testScript)
+	defer closer()
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	require.NoError(t, c.c.SendChatMsg("kick"))
+	c.expectChat(t, "You are being kicked because: testing")
+	waitFor(t, func() bool {
+		return h.PeerByName("user") == nil
+	})
+
+	// kicked users are temporarily banned
+	b := h.FindBan("user", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NotNil(t, b)
+	require.False(t, b.Until.IsZero())
+	require.Equal(t, "testing (by Bot)", b.Reason)
+}
+
+func TestCoreDefloodWarn(t *testing.T) {
+	h, closer := newTestScript(t, testScript)
+	defer closer()
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	for i := 1; i < 5; i++ {
+		require.NoError(t, c.c.SendChatMsg("warn"))
+		c.expectChat(t, strconv.Itoa(i))
+	}
+	// default limit is 5 warnings
+	require.NoError(t, c.c.SendChatMsg("warn"))
+	waitFor(t, func() bool {
+		return h.PeerByName("user") == nil
+	})
+}
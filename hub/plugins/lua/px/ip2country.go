@@ -0,0 +1,84 @@
+package px
+
+import (
+	"net"
+
+	"github.com/direct-connect/go-dcpp/hub"
+
+	lua "github.com/Shopify/go-lua"
+)
+
+// http://wiki.ptokax.org/doku.php?id=luaapi:px_ip2country
+// https://github.com/pavel-pimenov/flylinkdc-hub/blob/master/core/LuaIP2CountryLib.cpp
+
+func (s *Script) setupIP2Country() {
+	s.s.SetRawFuncMap("IP2Country", map[string]lua.Function{
+		"GetCountryCode": s.luaGetCountryCode,
+		"GetCountryName": s.luaGetCountryName,
+		"Reload":         s.luaReloadIP2Country,
+	})
+}
+
+// luaCountryArg looks up the country for an IP or a user table passed as the first argument.
+// It returns false if the argument is invalid.
+func (s *Script) luaCountryArg(st *lua.State, fname string) (hub.Country, bool) {
+	if st.Top() != 1 {
+		lua.Errorf(st, "bad argument count to '%s' (1 expected, got %d)", fname, st.Top())
+		return hub.Country{}, false
+	}
+	var ip net.IP
+	switch st.TypeOf(1) {
+	case lua.TypeString:
+		sip, _ := st.ToString(1)
+		ip = net.ParseIP(sip)
+	case lua.TypeTable:
+		if p := s.luaAsUser(st, 1, fname); p != nil {
+			ip = peerIP(p)
+		}
+	default:
+		lua.Errorf(st, "bad argument #1 to '%s' (string or table expected, got %s)", fname, lua.TypeNameOf(st, 1))
+		return hub.Country{}, false
+	}
+	if ip == nil {
+		return hub.Country{}, false
+	}
+	c, ok := s.h.LookupCountry(ip)
+	if !ok {
+		c = hub.Country{Code: "??", Name: "Unknown"}
+	} else if c.Name == "" {
+		c.Name = c.Code
+	}
+	return c, true
+}
+
+func (s *Script) luaGetCountryCode(st *lua.State) int {
+	c, ok := s.luaCountryArg(st, "GetCountryCode")
+	st.SetTop(0)
+	if !ok {
+		st.PushNil()
+		return 1
+	}
+	st.PushString(c.Code)
+	return 1
+}
+
+func (s *Script) luaGetCountryName(st *lua.State) int {
+	c, ok := s.luaCountryArg(st, "GetCountryName")
+	st.SetTop(0)
+	if !ok {
+		st.PushNil()
+		return 1
+	}
+	st.PushString(c.Name)
+	return 1
+}
+
+func (s *Script) luaReloadIP2Country(st *lua.State) int {
+	if !noArgs(st, "Reload") {
+		return 0
+	}
+	if err := s.h.ReloadGeoIP(); err != nil {
+		s.h.Logf("%s: cannot reload GeoIP database: %v", s.Name(), err)
+	}
+	return 0
+}
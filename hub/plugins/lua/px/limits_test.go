@@ -0,0 +1,81 @@
+package px
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+)
+
+const testLimitsScript = `
+function ChatArrival(user, data)
+	if data:match("> loop|$") then
+		while true do end
+	elseif data:match("> ping|$") then
+		Core.SendToAll("<Bot> pong|")
+		return true
+	elseif data:match("> catch|$") then
+		pcall(function() while true do end end)
+		Core.SendToAll("<Bot> caught|")
+	elseif data:match("> io|$") then
+		Core.SendToAll("<Bot> "..tostring(io).." "..tostring(dofile).." "..tostring(loadfile).."|")
+		return true
+	elseif data:match("> mem|$") then
+		big = {}
+		for i = 1, 10000000 do big[i] = tostring(i) end
+		Core.SendToAll("<Bot> done|")
+	end
+end
+`
+
+func TestLimits(t *testing.T) {
+	h, closer := newTestScript(t, testLimitsScript)
+	defer closer()
+	h.MergeConfig(hub.Map{
+		hlua.ConfigLuaMaxInstructions: int64(100000),
+		hlua.ConfigLuaMaxFailures:     int64(2),
+	})
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	// unsafe libraries are not available to untrusted scripts
+	require.NoError(t, c.c.SendChatMsg("io"))
+	c.expectChat(t, "nil nil nil")
+
+	// the callback is aborted, but the script still works
+	require.NoError(t, c.c.SendChatMsg("loop"))
+	require.NoError(t, c.c.SendChatMsg("ping"))
+	c.expectChat(t, "pong")
+
+	// the violation cannot be caught by the script,
+	// and the script is disabled after repeated failures
+	require.NoError(t, c.c.SendChatMsg("catch"))
+	require.NoError(t, c.c.SendChatMsg("ping"))
+	select {
+	case text := <-c.chat:
+		t.Fatalf("unexpected message: %q", text)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	h, closer := newTestScript(t, testLimitsScript)
+	defer closer()
+	h.MergeConfig(hub.Map{
+		hlua.ConfigLuaMaxInstructions: int64(0),
+		hlua.ConfigLuaMaxMemory:       int64(1),
+		hlua.ConfigLuaMaxTime:         int64(0),
+	})
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	// the callback is aborted before it allocates too much
+	require.NoError(t, c.c.SendChatMsg("mem"))
+	require.NoError(t, c.c.SendChatMsg("ping"))
+	c.expectChat(t, "pong")
+}
@@ -0,0 +1,48 @@
+package px
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+)
+
+const testLoopScript = `
+function ChatArrival(user, data)
+	if data:match("> slow|$") then
+		local t = os.clock() + 1
+		while os.clock() < t do end
+		return true
+	end
+end
+`
+
+func TestLoopTimeout(t *testing.T) {
+	h, closer := newTestScript(t, testLoopScript)
+	defer closer()
+	h.MergeConfig(hub.Map{
+		hlua.ConfigLuaHookTimeout: int64(50),
+		hlua.ConfigLuaMaxTime:     int64(0),
+	})
+
+	msgs := make(chan string, 1)
+	h.OnGlobalChat(func(p hub.Peer, m hub.Message) bool {
+		msgs <- m.Text
+		return true
+	})
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	// the script is too slow, so the message is allowed
+	require.NoError(t, c.c.SendChatMsg("slow"))
+	select {
+	case text := <-msgs:
+		require.Equal(t, "slow", text)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("hub is blocked by the script")
+	}
+}
@@ -19,13 +19,42 @@ func (s *Script) setupProfiles() {
 		//"MoveUp":                s.luaMoveUp,
 		"GetProfile": s.luaGetProfile,
 		//"GetProfiles":           s.luaGetProfiles,
-		//"GetProfilePermission":  s.luaGetProfilePermission,
-		//"GetProfilePermissions": s.luaGetProfilePermissions,
+		"GetProfilePermission":  s.luaGetProfilePermission,
+		"GetProfilePermissions": s.luaGetProfilePermissions,
 		//"SetProfileName":        s.luaSetProfileName,
 		//"SetProfilePermission":  s.luaSetProfilePermission,
 	})
 }
 
+func init() {
+	for _, p := range hub.PtokaXPermissions {
+		if p.Perm == "" {
+			continue
+		}
+		if _, ok := hub.LookupPermission(p.Perm); !ok {
+			panic("unregistered permission: " + p.Perm)
+		}
+	}
+}
+
+// hasPerm checks if the profile has a given PtokaX permission.
+// Owners have all the permissions, including the ones that are not mapped to the hub.
+func (p *pxProfile) hasPerm(i int) bool {
+	if p.u.IsOwner() {
+		return true
+	}
+	perm := hub.PtokaXPermissions[i].Perm
+	return perm != "" && p.u.Has(perm)
+}
+
+func (p *pxProfile) permissions() hlua.M {
+	m := make(hlua.M, len(hub.PtokaXPermissions))
+	for i, pp := range hub.PtokaXPermissions {
+		m[pp.Field] = p.hasPerm(i)
+	}
+	return m
+}
+
 func (s *Script) saveProfiles() {
 	// TODO
 	s.h.Log("TODO: px.ProfMan.Save()")
@@ -44,16 +73,25 @@ func (s *Script) profileByName(name string) *pxProfile {
 	if u == nil {
 		return nil
 	}
-	id := 4 // FIXME
-	switch name {
-	case hub.ProfileNameRoot:
-		id = 0
-	case hub.ProfileNameOperator:
-		id = 1
-	case hub.ProfileNameRegistered:
-		id = 3
+	return &pxProfile{id: profileID(u), u: u}
+}
+
+// profileID returns the PtokaX profile number of the hub profile, or -1 for unregistered users.
+//
+// Scripts usually compare the number with built-in profiles (0 - Master, 1 - Operator, 3 - Reg),
+// thus custom profiles are reported as the built-in profile they inherit from.
+func profileID(p *hub.UserProfile) int {
+	switch {
+	case p == nil:
+		return -1
+	case p.IsOwner():
+		return 0
+	case p.IsOp():
+		return 1
+	case p.HasParent(hub.ProfileNameRegistered):
+		return 3
 	}
-	return &pxProfile{id: id, u: u}
+	return -1
 }
 
 func (s *Script) profileByID(id int) *pxProfile {
@@ -87,14 +125,46 @@ func (s *Script) luaPushProfile(st *lua.State, p *pxProfile) {
 		st.PushNil()
 		return
 	}
-	// TODO: tProfilePermissions field
 	s.s.Push(hlua.M{
 		"iProfileNumber":      p.id,
 		"sProfileName":        p.u.ID(),
-		"tProfilePermissions": hlua.M{},
+		"tProfilePermissions": p.permissions(),
 	})
 }
 
+func (s *Script) luaGetProfilePermissions(st *lua.State) int {
+	if !assertArgsT(st, "GetProfilePermissions", lua.TypeNumber) {
+		st.PushNil()
+		return 1
+	}
+	id, _ := st.ToInteger(1)
+	st.SetTop(0)
+	p := s.profileByID(id)
+	if p == nil || p.u == nil {
+		st.PushNil()
+		return 1
+	}
+	s.s.Push(p.permissions())
+	return 1
+}
+
+func (s *Script) luaGetProfilePermission(st *lua.State) int {
+	if !assertArgsT(st, "GetProfilePermission", lua.TypeNumber, lua.TypeNumber) {
+		st.PushNil()
+		return 1
+	}
+	id, _ := st.ToInteger(1)
+	perm, _ := st.ToInteger(2)
+	st.SetTop(0)
+	p := s.profileByID(id)
+	if p == nil || p.u == nil || perm < 0 || perm >= len(hub.PtokaXPermissions) {
+		st.PushNil()
+		return 1
+	}
+	st.PushBoolean(p.hasPerm(perm))
+	return 1
+}
+
 func (s *Script) luaGetProfile(st *lua.State) int {
 	if !assertArgsN(st, "GetProfile", 1) {
 		st.PushNil()
@@ -28,8 +28,29 @@ func (pxCompat) Version() hub.Version {
 	return hub.Version{Major: 0, Minor: 1}
 }
 
+// callbacks is a list of PtokaX callbacks, except arrivals.
+var callbacks = []string{
+	"OnStartup", "OnExit", "OnError", "OnTimer",
+	"ChatArrival", "UnknownArrival",
+	"UserConnected", "RegConnected", "OpConnected",
+	"UserDisconnected", "RegDisconnected", "OpDisconnected",
+}
+
+// Compatible checks if the script defines any of PtokaX callbacks.
 func (pxCompat) Compatible(s *hlua.Script) bool {
-	return true // TODO
+	for _, name := range callbacks {
+		if s.IsFunc(name) {
+			return true
+		}
+	}
+	for _, names := range []map[string]string{arrivalFuncs, handshakeFuncs} {
+		for _, name := range names {
+			if s.IsFunc(name) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (pxCompat) New(s *hlua.Script) hlua.Instance {
@@ -61,7 +82,7 @@ func (s *Script) onStartup() {
 
 func (s *Script) setupOnArrival() {
 	if onChat := s.globalFunc("ChatArrival", lua.MultipleReturns); onChat != nil {
-		s.h.OnGlobalChat(func(p hub.Peer, m hub.Message) bool {
+		s.s.Scope().OnGlobalChat(func(p hub.Peer, m hub.Message) bool {
 			u := s.luaUserArg(p, false)
 
 			msg := hub.ToNMDCChatMsg(p, m)
@@ -92,7 +113,7 @@ func (s *Script) setupOnUsers() {
 		onJoinOp = onJoinReg
 	}
 	if onJoinUser != nil || onJoinReg != nil || onJoinOp != nil {
-		s.h.OnJoined(func(p hub.Peer) bool {
+		s.s.Scope().OnJoined(func(p hub.Peer) bool {
 			fnc := onJoinUser
 			if pr := p.User(); pr.IsOp() {
 				fnc = onJoinReg
@@ -125,7 +146,7 @@ func (s *Script) setupOnUsers() {
 		onLeaveOp = onLeaveReg
 	}
 	if onLeaveUser != nil || onLeaveReg != nil || onLeaveOp != nil {
-		s.h.OnLeave(func(p hub.Peer) {
+		s.s.Scope().OnLeave(func(p hub.Peer) {
 			fnc := onLeaveUser
 			if pr := p.User(); pr.IsOp() {
 				fnc = onLeaveOp
@@ -149,9 +170,11 @@ func (s *Script) setupOnUsers() {
 }
 
 func (s *Script) Start() {
+	s.s.Scope().OnLeave(s.forgetUser)
 	s.onStartup()
 	s.setupOnUsers()
 	s.setupOnArrival()
+	s.setupArrivals()
 }
 
 func (s *Script) globalFunc(name string, ret int) *hlua.Func {
@@ -167,7 +190,18 @@ func (s *Script) globalFunc(name string, ret int) *hlua.Func {
 }
 
 func (s *Script) Close() error {
-	return nil // TODO
+	s.onExit()
+	// hooks and bots are removed by the script scope
+	s.timers.Lock()
+	list := make([]*pxTimer, 0, len(s.timers.m))
+	for t := range s.timers.m {
+		list = append(list, t)
+	}
+	s.timers.Unlock()
+	for _, t := range list {
+		t.Stop()
+	}
+	return nil
 }
 
 func (s *Script) setupGlobals() {
@@ -175,4 +209,7 @@ func (s *Script) setupGlobals() {
 	s.setupTimers()
 	s.setupSettings()
 	s.setupProfiles()
+	s.setupRegMan()
+	s.setupBanMan()
+	s.setupIP2Country()
 }
@@ -0,0 +1,300 @@
+package px
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+
+	lua "github.com/Shopify/go-lua"
+)
+
+// http://wiki.ptokax.org/doku.php?id=luaapi:px_regman
+// https://github.com/pavel-pimenov/flylinkdc-hub/blob/master/core/LuaRegManLib.cpp
+
+func (s *Script) setupRegMan() {
+	s.s.SetRawFuncMap("RegMan", map[string]lua.Function{
+		"Save":             s.luaRegsSave,
+		"GetRegsByProfile": s.luaGetRegsByProfile,
+		"GetNonOps":        s.luaGetNonOps,
+		"GetOps":           s.luaGetOps,
+		"GetReg":           s.luaGetReg,
+		"GetRegs":          s.luaGetRegs,
+		"AddReg":           s.luaAddReg,
+		"DelReg":           s.luaDelReg,
+		"ChangeReg":        s.luaChangeReg,
+		"ClrRegBadPass":    s.luaClrRegBadPass,
+	})
+}
+
+// recProfile returns the hub profile of the registered user.
+func (s *Script) recProfile(rec *hub.UserRecord) *hub.UserProfile {
+	if rec.Profile != "" {
+		if p := s.h.Profile(rec.Profile); p != nil {
+			return p
+		}
+	}
+	return s.h.Profile(hub.ProfileNameRegistered)
+}
+
+// recProfileID returns the PtokaX profile number of the registered user.
+func (s *Script) recProfileID(rec *hub.UserRecord) int {
+	return profileID(s.recProfile(rec))
+}
+
+func (s *Script) recIsOp(rec *hub.UserRecord) bool {
+	p := s.recProfile(rec)
+	if p == nil {
+		return false
+	}
+	return p.IsOp()
+}
+
+func (s *Script) regs(filter func(rec *hub.UserRecord) bool) []hub.UserRecord {
+	list, err := s.h.ListUsers()
+	if err != nil {
+		s.h.Logf("%s: cannot list users: %v", s.Name(), err)
+		return nil
+	}
+	out := list[:0]
+	for _, rec := range list {
+		if filter == nil || filter(&rec) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+func (s *Script) regTable(rec *hub.UserRecord) hlua.M {
+	return hlua.M{
+		"sNick":     rec.Name,
+		"sPassword": rec.Pass,
+		"iProfile":  s.recProfileID(rec),
+	}
+}
+
+func (s *Script) luaPushRegs(st *lua.State, list []hub.UserRecord) {
+	st.NewTable()
+	t := st.Top()
+
+	for i := range list {
+		st.PushInteger(i + 1)
+		s.s.Push(s.regTable(&list[i]))
+		st.RawSet(t)
+	}
+}
+
+func (s *Script) luaRegsSave(st *lua.State) int {
+	if !noArgs(st, "Save") {
+		return 0
+	}
+	// registrations are saved to the database immediately
+	return 0
+}
+
+func (s *Script) luaGetRegsByProfile(st *lua.State) int {
+	if !assertArgsT(st, "GetRegsByProfile", lua.TypeNumber) {
+		st.PushNil()
+		return 1
+	}
+	id, _ := st.ToInteger(1)
+	st.SetTop(0)
+	s.luaPushRegs(st, s.regs(func(rec *hub.UserRecord) bool {
+		return s.recProfileID(rec) == id
+	}))
+	return 1
+}
+
+func (s *Script) luaGetNonOps(st *lua.State) int {
+	if !noArgs(st, "GetNonOps") {
+		st.PushNil()
+		return 1
+	}
+	s.luaPushRegs(st, s.regs(func(rec *hub.UserRecord) bool {
+		return !s.recIsOp(rec)
+	}))
+	return 1
+}
+
+func (s *Script) luaGetOps(st *lua.State) int {
+	if !noArgs(st, "GetOps") {
+		st.PushNil()
+		return 1
+	}
+	s.luaPushRegs(st, s.regs(s.recIsOp))
+	return 1
+}
+
+func (s *Script) luaGetRegs(st *lua.State) int {
+	if !noArgs(st, "GetRegs") {
+		st.PushNil()
+		return 1
+	}
+	s.luaPushRegs(st, s.regs(nil))
+	return 1
+}
+
+func (s *Script) luaGetReg(st *lua.State) int {
+	if !assertArgsT(st, "GetReg", lua.TypeString) {
+		st.PushNil()
+		return 1
+	}
+	name, _ := st.ToString(1)
+	st.SetTop(0)
+	rec, err := s.h.GetUserRecord(name)
+	if err != nil || rec == nil {
+		st.PushNil()
+		return 1
+	}
+	s.s.Push(s.regTable(rec))
+	return 1
+}
+
+// profileName returns a hub profile name for a PtokaX profile number.
+func (s *Script) profileName(id int) (string, bool) {
+	p := s.profileByID(id)
+	if p == nil || p.u == nil {
+		return "", false
+	}
+	if p.u.ID() == hub.ProfileNameRegistered {
+		return "", true
+	}
+	return p.u.ID(), true
+}
+
+// newPassword generates a random password for users registered without one.
+func newPassword() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// luaAddReg registers a user. If the password is not set, a random one is generated and returned
+// as the second value, and the user is asked to change it after the first login.
+func (s *Script) luaAddReg(st *lua.State) int {
+	var (
+		name, pass string
+		id         int
+	)
+	switch n := st.Top(); n {
+	case 2:
+		if !assertArgsT(st, "AddReg", lua.TypeString, lua.TypeNumber) {
+			st.PushNil()
+			return 1
+		}
+		name, _ = st.ToString(1)
+		id, _ = st.ToInteger(2)
+	case 3:
+		if !assertArgsT(st, "AddReg", lua.TypeString, lua.TypeString, lua.TypeNumber) {
+			st.PushNil()
+			return 1
+		}
+		name, _ = st.ToString(1)
+		pass, _ = st.ToString(2)
+		id, _ = st.ToInteger(3)
+	default:
+		lua.Errorf(st, "bad argument count to 'AddReg' (2 or 3 expected, got %d)", n)
+		st.SetTop(0)
+		st.PushNil()
+		return 1
+	}
+	st.SetTop(0)
+	prof, ok := s.profileName(id)
+	if !ok {
+		st.PushNil()
+		return 1
+	}
+	gen := pass == ""
+	if gen {
+		var err error
+		if pass, err = newPassword(); err != nil {
+			s.h.Logf("%s: cannot generate a password for %q: %v", s.Name(), name, err)
+			st.PushNil()
+			return 1
+		}
+	}
+	if err := s.h.RegisterUserProfile(name, pass, prof); err != nil {
+		s.h.Logf("%s: cannot register %q: %v", s.Name(), name, err)
+		st.PushNil()
+		return 1
+	}
+	st.PushBoolean(true)
+	if !gen {
+		return 1
+	}
+	if err := s.h.ForcePassChange(name); err != nil {
+		s.h.Logf("%s: cannot force password change for %q: %v", s.Name(), name, err)
+	}
+	st.PushString(pass)
+	return 2
+}
+
+func (s *Script) luaDelReg(st *lua.State) int {
+	if !assertArgsT(st, "DelReg", lua.TypeString) {
+		st.PushNil()
+		return 1
+	}
+	name, _ := st.ToString(1)
+	st.SetTop(0)
+	if ok, err := s.h.IsRegistered(name); err != nil || !ok {
+		st.PushNil()
+		return 1
+	}
+	if err := s.h.DeleteUser(name); err != nil {
+		s.h.Logf("%s: cannot unregister %q: %v", s.Name(), name, err)
+		st.PushNil()
+		return 1
+	}
+	st.PushBoolean(true)
+	return 1
+}
+
+func (s *Script) luaChangeReg(st *lua.State) int {
+	if !assertArgsT(st, "ChangeReg", lua.TypeString, lua.TypeString, lua.TypeNumber) {
+		st.PushNil()
+		return 1
+	}
+	name, _ := st.ToString(1)
+	pass, _ := st.ToString(2)
+	id, _ := st.ToInteger(3)
+	st.SetTop(0)
+	prof, ok := s.profileName(id)
+	if !ok {
+		st.PushNil()
+		return 1
+	}
+	err := s.h.UpdateUser(name, func(u *hub.UserRecord) (bool, error) {
+		u.Pass, u.Profile = pass, prof
+		return true, nil
+	})
+	if err != nil {
+		st.PushNil()
+		return 1
+	}
+	st.PushBoolean(true)
+	return 1
+}
+
+func (s *Script) luaClrRegBadPass(st *lua.State) int {
+	if !assertArgsT(st, "ClrRegBadPass", lua.TypeString) {
+		st.PushNil()
+		return 1
+	}
+	name, _ := st.ToString(1)
+	st.SetTop(0)
+	err := s.h.UpdateUser(name, func(u *hub.UserRecord) (bool, error) {
+		u.FailedLogins = 0
+		u.LockedUntil = time.Time{}
+		return true, nil
+	})
+	if err != nil {
+		st.PushNil()
+		return 1
+	}
+	st.PushBoolean(true)
+	return 1
+}
@@ -11,6 +11,9 @@ import (
 // http://wiki.ptokax.org/doku.php?id=luaapi:px_setman
 // https://github.com/pavel-pimenov/flylinkdc-hub/blob/master/core/LuaSetManLib.cpp
 
+// defaultTempBanMin is the default value of DEFAULT_TEMP_BAN_TIME setting in minutes.
+const defaultTempBanMin = 20
+
 func (s *Script) setupSettings() {
 	s.s.SetRawFuncMap("SetMan", map[string]lua.Function{
 		"Save":            s.luaSettingsSave,
@@ -67,6 +70,8 @@ func (s *Script) setBool(id idBool, v bool) {
 
 func (s *Script) getInt(id idInt) (int, bool) {
 	switch id {
+	case px_SETSHORT_DEFAULT_TEMP_BAN_TIME:
+		return defaultTempBanMin, true
 	default:
 		// TODO
 		s.h.Logf("TODO: px.SetMan.GetNumber(%d)", id)
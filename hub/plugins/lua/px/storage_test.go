@@ -0,0 +1,55 @@
+package px
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+)
+
+const testStorageScript = `
+function ChatArrival(user, data)
+	local cmd = data:match("> (%S+)|$")
+	if cmd == "karma" then
+		local n = hub.storage.incr("karma:"..user.sNick)
+		Core.SendToAll("<Bot> "..n.."|")
+	elseif cmd == "list" then
+		for k, v in hub.storage.iter("karma:") do
+			Core.SendToAll("<Bot> "..k.."="..v.."|")
+		end
+	elseif cmd == "set" then
+		local ok, err = hub.storage.set("other", "value")
+		Core.SendToAll("<Bot> "..tostring(err).."|")
+	end
+	return true
+end
+`
+
+func TestStorage(t *testing.T) {
+	h, closer := newTestScript(t, testStorageScript)
+	defer closer()
+	h.MergeConfig(hub.Map{
+		hlua.ConfigLuaStorageKeys: int64(1),
+	})
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	require.NoError(t, c.c.SendChatMsg("karma"))
+	c.expectChat(t, "1")
+	require.NoError(t, c.c.SendChatMsg("karma"))
+	c.expectChat(t, "2")
+
+	require.NoError(t, c.c.SendChatMsg("list"))
+	c.expectChat(t, "karma:user=2")
+
+	// quota is exceeded
+	require.NoError(t, c.c.SendChatMsg("set"))
+	c.expectChat(t, "storage quota exceeded")
+
+	list, err := h.ListValues("lua:test", "")
+	require.NoError(t, err)
+	require.Equal(t, []hub.KeyValue{{Key: "karma:user", Value: "2"}}, list)
+}
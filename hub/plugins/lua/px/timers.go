@@ -5,6 +5,7 @@ import (
 	"time"
 
 	lua "github.com/Shopify/go-lua"
+	"github.com/direct-connect/go-dcpp/hub"
 	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
 )
 
@@ -26,20 +27,32 @@ type timers struct {
 type pxTimer struct {
 	s      *Script
 	dt     time.Duration
-	ticker *time.Ticker
+	ticker hub.Ticker
+	stop   sync.Once
+	done   chan struct{}
 }
 
 func (t *pxTimer) Start(fnc func(*pxTimer)) {
-	t.ticker = time.NewTicker(t.dt)
+	t.ticker = t.s.h.Clock().NewTicker(t.dt)
 	go func() {
-		for range t.ticker.C {
-			fnc(t)
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-t.ticker.C():
+				fnc(t)
+			}
 		}
 	}()
 }
 
 func (t *pxTimer) Stop() {
-	t.ticker.Stop()
+	t.stop.Do(func() {
+		if t.ticker != nil {
+			t.ticker.Stop()
+		}
+		close(t.done)
+	})
 	t.s.timers.Lock()
 	delete(t.s.timers.m, t)
 	t.s.timers.Unlock()
@@ -48,7 +61,7 @@ func (t *pxTimer) Stop() {
 func (s *Script) setTimer(dt time.Duration) *pxTimer {
 	s.timers.Lock()
 	defer s.timers.Unlock()
-	t := &pxTimer{s: s, dt: dt}
+	t := &pxTimer{s: s, dt: dt, done: make(chan struct{})}
 	if s.timers.m == nil {
 		s.timers.m = make(map[*pxTimer]struct{})
 	}
@@ -0,0 +1,336 @@
+package px
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+
+	"github.com/direct-connect/go-dc/nmdc"
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+)
+
+// http://wiki.ptokax.org/doku.php?id=luaapi:px_core#user_table
+
+// User data IDs as used in Core.GetUserData and Core.GetUserValue.
+const (
+	px_USER_MODE = iota
+	px_USER_MYINFO
+	px_USER_DESCRIPTION
+	px_USER_TAG
+	px_USER_CONNECTION
+	px_USER_EMAIL
+	px_USER_CLIENT
+	px_USER_CLIENT_VERSION
+	px_USER_VERSION
+	px_USER_CONNECTED
+	px_USER_ACTIVE
+	px_USER_OPERATOR
+	px_USER_USER_COMMAND
+	px_USER_QUICK_LIST
+	px_USER_SUSPICIOUS_TAG
+	px_USER_PROFILE
+	px_USER_SHARE
+	px_USER_HUBS
+	px_USER_HUBS_NORMAL
+	px_USER_HUBS_REG
+	px_USER_HUBS_OP
+	px_USER_SLOTS
+	px_USER_LIMIT
+	px_USER_DEFLOOD_WARNS
+	px_USER_MAGIC_BYTE
+	px_USER_LOGIN_TIME
+	px_USER_COUNTRY
+	px_USER_MAC
+	px_USER_DESCRIPTION_CHANGED
+	px_USER_TAG_CHANGED
+	px_USER_CONNECTION_CHANGED
+	px_USER_EMAIL_CHANGED
+	px_USER_SHARE_CHANGED
+	px_USER_SCRIPTED_DESCRIPTION
+	px_USER_SCRIPTED_TAG
+	px_USER_SCRIPTED_CONNECTION
+	px_USER_SCRIPTED_EMAIL
+	px_USER_SCRIPTED_SHARE_SHORT
+	px_USER_SCRIPTED_SHARE_LONG
+	px_USER_IPV4
+	px_USER_IPV6
+	px_USER_DATA_END
+)
+
+// pxUserFields are names of the fields in the full user table, indexed by the user data ID.
+var pxUserFields = [px_USER_DATA_END]string{
+	"sMode",
+	"sMyInfoString",
+	"sDescription",
+	"sTag",
+	"sConnection",
+	"sEmail",
+	"sClient",
+	"sClientVersion",
+	"sVersion",
+	"bConnected",
+	"bActive",
+	"bOperator",
+	"bUserCommand",
+	"bQuickList",
+	"bSuspiciousTag",
+	"iProfile",
+	"iShareSize",
+	"iHubs",
+	"iNormalHubs",
+	"iRegHubs",
+	"iOpHubs",
+	"iSlots",
+	"iLlimit",
+	"iDefloodWarns",
+	"iMagicByte",
+	"iLoginTime",
+	"sCountryCode",
+	"sMac",
+	"bDescriptionChanged",
+	"bTagChanged",
+	"bConnectionChanged",
+	"bEmailChanged",
+	"bShareChanged",
+	"sScriptedDescription",
+	"sScriptedTag",
+	"sScriptedConnection",
+	"sScriptedEmail",
+	"iScriptediShareSizeShort",
+	"iScriptediShareSizeLong",
+	"bIPv4",
+	"bIPv6",
+}
+
+// User info types for Core.SetUserInfo.
+const (
+	px_INFO_DESCRIPTION = iota
+	px_INFO_TAG
+	px_INFO_CONNECTION
+	px_INFO_EMAIL
+	px_INFO_SHARE
+	px_INFO_END
+)
+
+// scriptedInfo holds user info values changed by Core.SetUserInfo.
+type scriptedInfo struct {
+	desc, tag, conn, email *string
+	share                  *uint64
+}
+
+func (s *Script) peerProfileID(p hub.Peer) int {
+	return profileID(p.User().Profile())
+}
+
+func peerIP(p hub.Peer) net.IP {
+	if addr, ok := p.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// nmdcTag returns the tag part of the NMDC user info.
+func nmdcTag(u *nmdc.MyINFO) string {
+	if u.Client.Name == "" {
+		return ""
+	}
+	tu := nmdc.MyINFO{
+		Client: u.Client, Mode: u.Mode,
+		HubsNormal: u.HubsNormal, HubsRegistered: u.HubsRegistered, HubsOperator: u.HubsOperator,
+		Slots: u.Slots, Extra: u.Extra,
+	}
+	var buf bytes.Buffer
+	if err := tu.MarshalNMDC(nil, &buf); err != nil {
+		return ""
+	}
+	data := buf.Bytes()
+	i := bytes.IndexByte(data, '<')
+	j := bytes.IndexByte(data, '>')
+	if i < 0 || j < i {
+		return ""
+	}
+	return string(data[i : j+1])
+}
+
+// parseNMDCTag parses the tag and sets corresponding fields in the user info.
+func parseNMDCTag(u *nmdc.MyINFO, tag string) error {
+	var tu nmdc.MyINFO
+	if err := tu.UnmarshalNMDC(nil, []byte("$ALL x "+tag+"$ $$$0$")); err != nil {
+		return err
+	}
+	u.Client, u.Mode = tu.Client, tu.Mode
+	u.HubsNormal, u.HubsRegistered, u.HubsOperator = tu.HubsNormal, tu.HubsRegistered, tu.HubsOperator
+	u.Slots, u.Extra = tu.Slots, tu.Extra
+	return nil
+}
+
+func optString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func optStringPtr(s *string) interface{} {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
+
+// userValue returns the value for a given user data ID, or nil if the value is not set.
+func (s *Script) userValue(p hub.Peer, info *nmdc.MyINFO, id int) interface{} {
+	switch id {
+	case px_USER_MODE:
+		if info.Mode == nmdc.UserModeUnknown {
+			return nil
+		}
+		return string(info.Mode)
+	case px_USER_MYINFO:
+		data, err := nmdc.Marshal(nil, info)
+		if err != nil {
+			return nil
+		}
+		return string(bytes.TrimSuffix(data, []byte("|")))
+	case px_USER_DESCRIPTION:
+		return optString(info.Desc)
+	case px_USER_TAG:
+		return optString(nmdcTag(info))
+	case px_USER_CONNECTION:
+		return optString(info.Conn)
+	case px_USER_EMAIL:
+		return optString(info.Email)
+	case px_USER_CLIENT:
+		return optString(info.Client.Name)
+	case px_USER_CLIENT_VERSION:
+		return optString(info.Client.Version)
+	case px_USER_VERSION:
+		return optString(info.Client.Version)
+	case px_USER_CONNECTED:
+		return p.Online()
+	case px_USER_ACTIVE:
+		return info.Mode == nmdc.UserModeActive
+	case px_USER_OPERATOR:
+		return p.User().IsOp()
+	case px_USER_USER_COMMAND, px_USER_QUICK_LIST, px_USER_SUSPICIOUS_TAG:
+		return false
+	case px_USER_PROFILE:
+		return s.peerProfileID(p)
+	case px_USER_SHARE:
+		return info.ShareSize
+	case px_USER_HUBS:
+		return info.HubsNormal + info.HubsRegistered + info.HubsOperator
+	case px_USER_HUBS_NORMAL:
+		return info.HubsNormal
+	case px_USER_HUBS_REG:
+		return info.HubsRegistered
+	case px_USER_HUBS_OP:
+		return info.HubsOperator
+	case px_USER_SLOTS:
+		return info.Slots
+	case px_USER_LIMIT:
+		v, _ := strconv.Atoi(info.Extra["L"])
+		return v
+	case px_USER_DEFLOOD_WARNS:
+		s.core.RLock()
+		v := s.core.warns[p]
+		s.core.RUnlock()
+		return v
+	case px_USER_MAGIC_BYTE:
+		return int(info.Flag)
+	case px_USER_LOGIN_TIME:
+		if c := p.ConnInfo(); c != nil && !c.Login.IsZero() {
+			return c.Login.Unix()
+		}
+		return nil
+	case px_USER_COUNTRY:
+		if ip := peerIP(p); ip != nil {
+			if c, ok := s.h.LookupCountry(ip); ok {
+				return c.Code
+			}
+		}
+		return nil
+	case px_USER_MAC:
+		return nil
+	}
+	si := s.scriptedInfo(p)
+	switch id {
+	case px_USER_DESCRIPTION_CHANGED:
+		return si.desc != nil
+	case px_USER_TAG_CHANGED:
+		return si.tag != nil
+	case px_USER_CONNECTION_CHANGED:
+		return si.conn != nil
+	case px_USER_EMAIL_CHANGED:
+		return si.email != nil
+	case px_USER_SHARE_CHANGED:
+		return si.share != nil
+	case px_USER_SCRIPTED_DESCRIPTION:
+		return optStringPtr(si.desc)
+	case px_USER_SCRIPTED_TAG:
+		return optStringPtr(si.tag)
+	case px_USER_SCRIPTED_CONNECTION:
+		return optStringPtr(si.conn)
+	case px_USER_SCRIPTED_EMAIL:
+		return optStringPtr(si.email)
+	case px_USER_SCRIPTED_SHARE_SHORT:
+		if si.share == nil {
+			return nil
+		}
+		return *si.share & 0xffffffff
+	case px_USER_SCRIPTED_SHARE_LONG:
+		if si.share == nil {
+			return nil
+		}
+		return *si.share
+	case px_USER_IPV4:
+		ip := peerIP(p)
+		return ip != nil && ip.To4() != nil
+	case px_USER_IPV6:
+		ip := peerIP(p)
+		return ip != nil && ip.To4() == nil
+	}
+	return nil
+}
+
+func (s *Script) scriptedInfo(p hub.Peer) scriptedInfo {
+	s.core.RLock()
+	defer s.core.RUnlock()
+	if si := s.core.scripted[p]; si != nil {
+		return *si
+	}
+	return scriptedInfo{}
+}
+
+// luaUserArg returns a user table. Basic table contains the nick, IP and profile,
+// while the full table contains all the user data fields.
+func (s *Script) luaUserArg(p hub.Peer, full bool) interface{} {
+	if p == nil {
+		return nil
+	}
+	name := p.Name()
+	m := hlua.M{
+		"uptr":     hlua.UserData{Ptr: p},
+		"sName":    name,
+		"sNick":    name,
+		"iProfile": s.peerProfileID(p),
+	}
+	if ip := peerIP(p); ip != nil {
+		m["sIP"] = ip.String()
+	}
+	if full {
+		s.setUserFields(m, p)
+	}
+	return m
+}
+
+// setUserFields sets all user data fields in the map.
+func (s *Script) setUserFields(m hlua.M, p hub.Peer) {
+	info := hub.NMDCUserInfo(p)
+	for id, name := range pxUserFields {
+		if v := s.userValue(p, &info, id); v != nil {
+			m[name] = v
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lua "github.com/Shopify/go-lua"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+const (
+	// ConfigLuaStorageKeys is the max number of keys a single script can keep in the storage (0 - no limit).
+	ConfigLuaStorageKeys = "lua.storage.keys"
+	// ConfigLuaStorageSize is the max size in bytes of a single key and value in the script storage (0 - no limit).
+	ConfigLuaStorageSize = "lua.storage.size"
+
+	defaultLuaStorageKeys = 10000
+	defaultLuaStorageSize = 64 * 1024
+)
+
+var (
+	errStorageKeys = errors.New("storage quota exceeded")
+	errStorageSize = errors.New("value is too large")
+)
+
+// storage is a persistent key-value storage of the script.
+// It's only accessed from the script event loop.
+type storage struct {
+	ns   string
+	keys int // number of keys in the namespace; -1 if unknown
+	// staged holds the writes made while a new version of the script is loaded, so a failed version
+	// doesn't affect the storage of the running one; nil value means the key is deleted
+	staged map[string]*string
+}
+
+// storageNamespace returns a storage namespace for the script. It doesn't depend on the script location,
+// so the data is preserved when the script is moved.
+func storageNamespace(path string) string {
+	name := filepath.Base(path)
+	return "lua:" + strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// countKeys returns the number of keys in the script storage.
+func (s *Script) countKeys() (int, error) {
+	if s.storage.keys >= 0 {
+		return s.storage.keys, nil
+	}
+	list, err := s.listValues("")
+	if err != nil {
+		return 0, err
+	}
+	s.storage.keys = len(list)
+	return s.storage.keys, nil
+}
+
+// getValue returns the value from the storage, taking staged writes into account.
+func (s *Script) getValue(key string) (string, bool, error) {
+	if v, ok := s.storage.staged[key]; ok {
+		if v == nil {
+			return "", false, nil
+		}
+		return *v, true, nil
+	}
+	return s.h.GetValue(s.storage.ns, key)
+}
+
+// listValues returns all the values with a given key prefix, taking staged writes into account.
+func (s *Script) listValues(prefix string) ([]hub.KeyValue, error) {
+	list, err := s.h.ListValues(s.storage.ns, prefix)
+	if err != nil || len(s.storage.staged) == 0 {
+		return list, err
+	}
+	out := make([]hub.KeyValue, 0, len(list)+len(s.storage.staged))
+	for _, kv := range list {
+		if _, ok := s.storage.staged[kv.Key]; !ok {
+			out = append(out, kv)
+		}
+	}
+	for k, v := range s.storage.staged {
+		if v != nil && strings.HasPrefix(k, prefix) {
+			out = append(out, hub.KeyValue{Key: k, Value: *v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Key < out[j].Key
+	})
+	return out, nil
+}
+
+// updateValue updates the value in the storage and the number of keys.
+// The counter is only updated after the commit, since the callback may be retried.
+func (s *Script) updateValue(key string, fnc func(cur string, ok bool) (string, error)) error {
+	if s.storage.staged != nil {
+		cur, ok, err := s.getValue(key)
+		if err != nil {
+			return err
+		}
+		val, err := fnc(cur, ok)
+		if err != nil {
+			return err
+		}
+		s.storage.staged[key] = &val
+		if !ok {
+			s.storage.keys++
+		}
+		return nil
+	}
+	added := false
+	err := s.h.UpdateValue(s.storage.ns, key, func(cur string, ok bool) (string, error) {
+		added = !ok
+		return fnc(cur, ok)
+	})
+	if err == nil && added {
+		s.storage.keys++
+	}
+	return err
+}
+
+// commitStorage writes staged values to the storage and disables staging.
+func (s *Script) commitStorage() error {
+	staged := s.storage.staged
+	s.storage.staged = nil
+	s.storage.keys = -1 // the previous version may have changed the storage
+	var last error
+	for k, v := range staged {
+		var err error
+		if v == nil {
+			err = s.h.DelValue(s.storage.ns, k)
+		} else {
+			err = s.h.PutValue(s.storage.ns, k, *v)
+		}
+		if err != nil {
+			last = err
+		}
+	}
+	return last
+}
+
+// checkQuota checks if a new key can be added to the storage.
+// It must be called after countKeys, since the database doesn't allow nested transactions.
+func (s *Script) checkQuota(key, val string, exists bool) error {
+	if max := configInt(s.h, ConfigLuaStorageSize, defaultLuaStorageSize); max > 0 && int64(len(key)+len(val)) > max {
+		return errStorageSize
+	}
+	if exists {
+		return nil
+	}
+	max := configInt(s.h, ConfigLuaStorageKeys, defaultLuaStorageKeys)
+	if max <= 0 {
+		return nil
+	}
+	if int64(s.storage.keys) >= max {
+		return errStorageKeys
+	}
+	return nil
+}
+
+// encodeValue encodes a Lua value at a given index for the storage.
+func encodeValue(st *lua.State, i int) (string, error) {
+	var v interface{}
+	switch st.TypeOf(i) {
+	case lua.TypeString:
+		v, _ = st.ToString(i)
+	case lua.TypeNumber:
+		v, _ = st.ToNumber(i)
+	case lua.TypeBoolean:
+		v = st.ToBoolean(i)
+	default:
+		return "", fmt.Errorf("unsupported value type: %s", lua.TypeNameOf(st, i))
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// pushValue decodes the value from the storage and pushes it to the stack.
+func (s *Script) pushValue(val string) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(val), &v); err != nil {
+		s.s.PushNil()
+		return
+	}
+	switch v := v.(type) {
+	case string, float64, bool:
+		s.Push(v)
+	default:
+		s.s.PushNil()
+	}
+}
+
+// pushError pushes nil and an error message, as the Lua convention suggests.
+func pushError(st *lua.State, err error) int {
+	st.PushNil()
+	st.PushString(err.Error())
+	return 2
+}
+
+func (s *Script) setupStorage() {
+	s.storage = storage{ns: storageNamespace(s.file), keys: -1}
+	s.s.Global("hub")
+	s.pushRawFuncMap(map[string]lua.Function{
+		"get": func(st *lua.State) int {
+			key := lua.CheckString(st, 1)
+			val, ok, err := s.getValue(key)
+			if err != nil {
+				return pushError(st, err)
+			} else if !ok {
+				st.PushNil()
+				return 1
+			}
+			s.pushValue(val)
+			return 1
+		},
+		"set": func(st *lua.State) int {
+			key := lua.CheckString(st, 1)
+			if st.IsNoneOrNil(2) {
+				return s.storageDelete(st, key)
+			}
+			val, err := encodeValue(st, 2)
+			if err != nil {
+				lua.ArgumentError(st, 2, err.Error())
+				return 0
+			}
+			if _, err = s.countKeys(); err != nil {
+				return pushError(st, err)
+			}
+			err = s.updateValue(key, func(_ string, ok bool) (string, error) {
+				if err := s.checkQuota(key, val, ok); err != nil {
+					return "", err
+				}
+				return val, nil
+			})
+			if err != nil {
+				return pushError(st, err)
+			}
+			st.PushBoolean(true)
+			return 1
+		},
+		"delete": func(st *lua.State) int {
+			return s.storageDelete(st, lua.CheckString(st, 1))
+		},
+		"incr": func(st *lua.State) int {
+			key := lua.CheckString(st, 1)
+			delta := lua.OptNumber(st, 2, 1)
+			if _, err := s.countKeys(); err != nil {
+				return pushError(st, err)
+			}
+			var out float64
+			err := s.updateValue(key, func(cur string, ok bool) (string, error) {
+				var v float64
+				if ok {
+					if err := json.Unmarshal([]byte(cur), &v); err != nil {
+						return "", fmt.Errorf("value is not a number: %q", key)
+					}
+				}
+				out = v + delta
+				data, err := json.Marshal(out)
+				if err != nil {
+					return "", err
+				}
+				if err = s.checkQuota(key, string(data), ok); err != nil {
+					return "", err
+				}
+				return string(data), nil
+			})
+			if err != nil {
+				return pushError(st, err)
+			}
+			st.PushNumber(out)
+			return 1
+		},
+		"iter": func(st *lua.State) int {
+			prefix := lua.OptString(st, 1, "")
+			list, err := s.listValues(prefix)
+			if err != nil {
+				lua.Errorf(st, "%v", err)
+				return 0
+			}
+			i := 0
+			st.PushGoFunction(func(st *lua.State) int {
+				if i >= len(list) {
+					st.PushNil()
+					return 1
+				}
+				kv := list[i]
+				i++
+				st.PushString(kv.Key)
+				s.pushValue(kv.Value)
+				return 2
+			})
+			return 1
+		},
+	})
+	s.s.SetField(-2, "storage")
+	s.s.Pop(1)
+}
+
+func (s *Script) storageDelete(st *lua.State, key string) int {
+	_, ok, err := s.getValue(key)
+	if err == nil && ok {
+		if s.storage.staged != nil {
+			s.storage.staged[key] = nil
+		} else {
+			err = s.h.DelValue(s.storage.ns, key)
+		}
+		if err == nil && s.storage.keys > 0 {
+			s.storage.keys--
+		}
+	}
+	if err != nil {
+		return pushError(st, err)
+	}
+	st.PushBoolean(true)
+	return 1
+}
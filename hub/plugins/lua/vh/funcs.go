@@ -0,0 +1,324 @@
+package vh
+
+import (
+	"strings"
+	"time"
+
+	lua "github.com/Shopify/go-lua"
+	"github.com/direct-connect/go-dc/nmdc"
+	"github.com/direct-connect/go-dc/types"
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+)
+
+// Ban types as used in VH:Ban.
+const (
+	banNickIP = 0
+	banIP     = 1
+	banNick   = 2
+)
+
+func (s *Script) setupGlobals() {
+	funcs := map[string]lua.Function{
+		"SendToUser":      s.luaSendToUser,
+		"SendToAll":       s.luaSendToAll,
+		"SendToClass":     s.luaSendToAll,
+		"SendPMToAll":     s.luaSendPMToAll,
+		"SendToOpChat":    s.luaSendToOpChat,
+		"GetMyINFO":       s.luaGetMyINFO,
+		"GetUserClass":    s.luaGetUserClass,
+		"GetUserIP":       s.luaGetUserIP,
+		"GetUserCC":       s.luaGetUserCC,
+		"GetNickList":     s.luaGetNickList,
+		"GetUsersCount":   s.luaGetUsersCount,
+		"CloseConnection": s.luaCloseConnection,
+		"KickUser":        s.luaKickUser,
+		"Ban":             s.luaBan,
+		"RegBot":          s.luaRegBot,
+		"UnRegBot":        s.luaUnRegBot,
+		"GetConfig":       s.luaGetConfig,
+	}
+	// older names
+	funcs["SendDataToUser"] = funcs["SendToUser"]
+	funcs["SendDataToAll"] = funcs["SendToAll"]
+	s.s.SetRawFuncMap("VH", funcs)
+}
+
+// firstArg returns the index of the first function argument.
+// Functions are usually called as VH:Func(), so the first argument is the VH table itself.
+func firstArg(st *lua.State) int {
+	if st.TypeOf(1) == lua.TypeTable {
+		return 2
+	}
+	return 1
+}
+
+// pushResult pushes the result flag, followed by an optional value.
+func pushResult(st *lua.State, ok bool, vals ...interface{}) int {
+	st.SetTop(0)
+	st.PushBoolean(ok)
+	for _, v := range vals {
+		switch v := v.(type) {
+		case string:
+			st.PushString(v)
+		case int:
+			st.PushInteger(v)
+		default:
+			st.PushNil()
+		}
+	}
+	return 1 + len(vals)
+}
+
+// userByName finds an online user by name. Bots are ignored.
+func (s *Script) userByName(name string) hub.Peer {
+	p := s.h.PeerByName(name)
+	if p == nil || hub.IsBot(p) {
+		return nil
+	}
+	return p
+}
+
+func (s *Script) usersByClass(min, max int) []hub.Peer {
+	var out []hub.Peer
+	for _, p := range s.h.Peers() {
+		if !hub.IsBot(p) && classRange(p, min, max) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// sendRaw sends raw NMDC commands to all the peers. Delivery errors are ignored.
+func (s *Script) sendRaw(peers []hub.Peer, data string) bool {
+	msgs, err := hlua.ParseNMDC(data)
+	if err != nil {
+		return false
+	}
+	for _, p := range peers {
+		_ = s.h.SendNMDCTo(p, msgs...)
+	}
+	return true
+}
+
+func (s *Script) luaSendToUser(st *lua.State) int {
+	i := firstArg(st)
+	data := lua.CheckString(st, i)
+	p := s.userByName(lua.CheckString(st, i+1))
+	if p == nil {
+		return pushResult(st, false)
+	}
+	return pushResult(st, s.sendRaw([]hub.Peer{p}, data))
+}
+
+func (s *Script) luaSendToAll(st *lua.State) int {
+	i := firstArg(st)
+	data := lua.CheckString(st, i)
+	min := lua.OptInteger(st, i+1, classGuest)
+	max := lua.OptInteger(st, i+2, classMaster)
+	return pushResult(st, s.sendRaw(s.usersByClass(min, max), data))
+}
+
+func (s *Script) luaSendPMToAll(st *lua.State) int {
+	i := firstArg(st)
+	text := lua.CheckString(st, i)
+	from := lua.CheckString(st, i+1)
+	min := lua.OptInteger(st, i+2, classGuest)
+	max := lua.OptInteger(st, i+3, classMaster)
+	for _, p := range s.usersByClass(min, max) {
+		_ = s.h.SendNMDCTo(p, &nmdc.PrivateMessage{
+			To: p.Name(), From: from,
+			Name: from, Text: text,
+		})
+	}
+	return pushResult(st, true)
+}
+
+func (s *Script) luaSendToOpChat(st *lua.State) int {
+	s.h.SendOpChat(lua.CheckString(st, firstArg(st)))
+	return pushResult(st, true)
+}
+
+func (s *Script) luaGetMyINFO(st *lua.State) int {
+	p := s.userByName(lua.CheckString(st, firstArg(st)))
+	if p == nil {
+		return pushResult(st, false)
+	}
+	info := hub.NMDCUserInfo(p)
+	data, err := nmdc.Marshal(nil, &info)
+	if err != nil {
+		return pushResult(st, false)
+	}
+	return pushResult(st, true, strings.TrimSuffix(string(data), "|"))
+}
+
+func (s *Script) luaGetUserClass(st *lua.State) int {
+	p := s.userByName(lua.CheckString(st, firstArg(st)))
+	if p == nil {
+		return pushResult(st, false)
+	}
+	return pushResult(st, true, userClass(p))
+}
+
+func (s *Script) luaGetUserIP(st *lua.State) int {
+	p := s.userByName(lua.CheckString(st, firstArg(st)))
+	if p == nil {
+		return pushResult(st, false)
+	}
+	ip := peerIP(p)
+	if ip == nil {
+		return pushResult(st, false)
+	}
+	return pushResult(st, true, ip.String())
+}
+
+func (s *Script) luaGetUserCC(st *lua.State) int {
+	p := s.userByName(lua.CheckString(st, firstArg(st)))
+	if p == nil {
+		return pushResult(st, false)
+	}
+	ip := peerIP(p)
+	if ip == nil {
+		return pushResult(st, false)
+	}
+	c, ok := s.h.LookupCountry(ip)
+	if !ok {
+		return pushResult(st, true, "--")
+	}
+	return pushResult(st, true, c.Code)
+}
+
+func (s *Script) luaGetNickList(st *lua.State) int {
+	var buf strings.Builder
+	for _, p := range s.h.Peers() {
+		buf.WriteString(p.Name())
+		buf.WriteString("$$")
+	}
+	return pushResult(st, true, buf.String())
+}
+
+func (s *Script) luaGetUsersCount(st *lua.State) int {
+	return pushResult(st, true, len(s.usersByClass(classGuest, -1)))
+}
+
+func (s *Script) luaCloseConnection(st *lua.State) int {
+	p := s.userByName(lua.CheckString(st, firstArg(st)))
+	if p == nil {
+		return pushResult(st, false)
+	}
+	_ = p.Close()
+	return pushResult(st, true)
+}
+
+func (s *Script) kick(p hub.Peer, op, reason string) {
+	_ = s.h.SendNMDCTo(p, &nmdc.ChatMessage{
+		Name: op,
+		Text: "You are being kicked because: " + reason,
+	})
+	_ = p.Close()
+}
+
+func (s *Script) luaKickUser(st *lua.State) int {
+	i := firstArg(st)
+	op := lua.CheckString(st, i)
+	p := s.userByName(lua.CheckString(st, i+1))
+	reason := lua.OptString(st, i+2, "")
+	if p == nil {
+		return pushResult(st, false)
+	}
+	s.kick(p, op, reason)
+	return pushResult(st, true)
+}
+
+func (s *Script) luaBan(st *lua.State) int {
+	i := firstArg(st)
+	op := lua.CheckString(st, i)
+	p := s.userByName(lua.CheckString(st, i+1))
+	reason := lua.OptString(st, i+2, "")
+	sec := lua.OptNumber(st, i+3, 0)
+	typ := lua.OptInteger(st, i+4, banNickIP)
+	if p == nil {
+		return pushResult(st, false)
+	}
+	var until time.Time
+	if sec > 0 {
+		until = s.h.Clock().Now().Add(time.Duration(sec * float64(time.Second)))
+	}
+	var bans []hub.Ban
+	if typ == banNickIP || typ == banNick {
+		bans = append(bans, hub.Ban{Key: hub.NickBanKey(p.Name()), Until: until, Reason: reason})
+	}
+	if ip := peerIP(p); ip != nil && (typ == banNickIP || typ == banIP) {
+		bans = append(bans, hub.Ban{Key: hub.MinIPKey(ip), Until: until, Reason: reason})
+	}
+	if len(bans) == 0 {
+		return pushResult(st, false)
+	}
+	for _, b := range bans {
+		if err := s.h.AddBan(b); err != nil {
+			return pushResult(st, false)
+		}
+	}
+	s.kick(p, op, reason)
+	return pushResult(st, true)
+}
+
+func (s *Script) luaRegBot(st *lua.State) int {
+	i := firstArg(st)
+	name := lua.CheckString(st, i)
+	desc := lua.OptString(st, i+2, "")
+	email := lua.OptString(st, i+4, "")
+	b, err := s.s.Scope().NewBotDesc(name, desc, email, types.Software{
+		Name:    apiName,
+		Version: versionString,
+	})
+	if err != nil {
+		return pushResult(st, false, err.Error())
+	}
+	s.bots.Lock()
+	if s.bots.m == nil {
+		s.bots.m = make(map[string]*hub.Bot)
+	}
+	s.bots.m[name] = b
+	s.bots.Unlock()
+	return pushResult(st, true)
+}
+
+func (s *Script) luaUnRegBot(st *lua.State) int {
+	name := lua.CheckString(st, firstArg(st))
+	s.bots.Lock()
+	b, ok := s.bots.m[name]
+	delete(s.bots.m, name)
+	s.bots.Unlock()
+	if !ok {
+		return pushResult(st, false)
+	}
+	_ = b.Close()
+	return pushResult(st, true)
+}
+
+func (s *Script) luaGetConfig(st *lua.State) int {
+	i := firstArg(st)
+	file := lua.CheckString(st, i)
+	name := lua.CheckString(st, i+1)
+	if file != "config" {
+		return pushResult(st, false)
+	}
+	info := s.h.Stats()
+	var v string
+	switch name {
+	case "hub_name":
+		v = info.Name
+	case "hub_desc":
+		v = info.Desc
+	case "hub_owner":
+		v = info.Owner
+	case "hub_security":
+		v = info.BotName
+	case "opchat_name":
+		v = info.OpChatName
+	default:
+		return pushResult(st, false)
+	}
+	return pushResult(st, true, v)
+}
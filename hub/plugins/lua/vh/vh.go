@@ -0,0 +1,285 @@
+package vh
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/Shopify/go-lua"
+	"github.com/direct-connect/go-dc/nmdc"
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+)
+
+// https://github.com/verlihub/verlihub/tree/master/plugins/lua
+
+func init() {
+	hlua.RegisterAPI(vhCompat{})
+}
+
+const (
+	apiName = "Verlihub"
+
+	versionString = "1.2.0.0"
+
+	// timerPeriod is the interval between VH_OnTimer calls.
+	timerPeriod = time.Second
+)
+
+// Verlihub user classes.
+const (
+	classGuest    = 0
+	classReg      = 1
+	classVIP      = 2
+	classOperator = 3
+	classCheef    = 4
+	classAdmin    = 5
+	classMaster   = 10
+)
+
+// callbacks is a list of Verlihub callbacks.
+var callbacks = []string{
+	"Main", "UnLoad",
+	"VH_OnNewConn", "VH_OnCloseConn",
+	"VH_OnUserLogin", "VH_OnUserLogout",
+	"VH_OnParsedMsgChat", "VH_OnParsedMsgPM",
+	"VH_OnParsedMsgMyINFO", "VH_OnParsedMsgSearch", "VH_OnParsedMsgSR",
+	"VH_OnParsedMsgConnectToMe", "VH_OnParsedMsgRevConnectToMe",
+	"VH_OnUserCommand", "VH_OnOperatorCommand",
+	"VH_OnTimer",
+}
+
+type vhCompat struct{}
+
+func (vhCompat) Name() string {
+	return apiName
+}
+
+func (vhCompat) Version() hub.Version {
+	return hub.Version{Major: 0, Minor: 1}
+}
+
+// Compatible checks if the script defines any of Verlihub callbacks.
+func (vhCompat) Compatible(s *hlua.Script) bool {
+	for _, name := range callbacks {
+		if s.IsFunc(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (vhCompat) New(s *hlua.Script) hlua.Instance {
+	return New(s)
+}
+
+func New(s *hlua.Script) *Script {
+	vs := &Script{s: s, h: s.Hub()}
+	vs.setupGlobals()
+	return vs
+}
+
+type Script struct {
+	s *hlua.Script
+	h *hub.Hub
+
+	bots struct {
+		sync.Mutex
+		m map[string]*hub.Bot
+	}
+}
+
+func (s *Script) Name() string {
+	return s.s.Name()
+}
+
+func (s *Script) Start() {
+	if f := s.globalFunc("Main", 0); f != nil {
+		f.Call(s.s.Name())
+	}
+	s.setupConnCallbacks()
+	s.setupUserCallbacks()
+	s.setupMsgCallbacks()
+	if f := s.globalFunc("VH_OnTimer", 0); f != nil {
+		s.s.Scope().AddTimer(timerPeriod, func() {
+			f.Call(float64(s.h.Clock().Now().UnixNano() / int64(time.Millisecond)))
+		})
+	}
+}
+
+func (s *Script) Close() error {
+	if f := s.globalFunc("UnLoad", 0); f != nil {
+		f.Call()
+	}
+	// hooks, timers and bots are removed by the script scope
+	return nil
+}
+
+func (s *Script) globalFunc(name string, ret int) *hlua.Func {
+	st := s.s.State()
+	st.Global(name)
+	i := st.Top()
+	if !st.IsFunction(i) {
+		st.Pop(1)
+		return nil
+	}
+	f := s.s.ToFunc(i, ret)
+	st.Pop(1)
+	return f
+}
+
+// callAllow calls a Verlihub callback and checks if the event is allowed by the script.
+// Callbacks return false or 0 to block the event.
+func callAllow(f *hlua.Func, args ...interface{}) bool {
+	allow := true
+	f.CallRet(func(st *lua.State) {
+		top := st.Top()
+		if top == 0 {
+			return
+		}
+		switch st.TypeOf(top) {
+		case lua.TypeBoolean:
+			allow = st.ToBoolean(top)
+		case lua.TypeNumber:
+			n, _ := st.ToNumber(top)
+			allow = n != 0
+		}
+	}, args...)
+	return allow
+}
+
+func connIP(c net.Conn) string {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return c.RemoteAddr().String()
+}
+
+func peerIP(p hub.Peer) net.IP {
+	if addr, ok := p.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// userClass returns a Verlihub class of the user.
+func userClass(p hub.Peer) int {
+	u := p.User()
+	switch {
+	case u.IsOwner():
+		return classMaster
+	case u.IsOp():
+		return classOperator
+	case u.IsRegistered():
+		return classReg
+	}
+	return classGuest
+}
+
+func (s *Script) setupConnCallbacks() {
+	if f := s.globalFunc("VH_OnNewConn", lua.MultipleReturns); f != nil {
+		s.s.Scope().OnConnected(func(c net.Conn) bool {
+			return callAllow(f, connIP(c))
+		})
+	}
+	if f := s.globalFunc("VH_OnCloseConn", 0); f != nil {
+		s.s.Scope().OnDisconnected(func(c net.Conn) {
+			f.Call(connIP(c))
+		})
+	}
+}
+
+func (s *Script) setupUserCallbacks() {
+	if f := s.globalFunc("VH_OnUserLogin", lua.MultipleReturns); f != nil {
+		s.s.Scope().OnJoined(func(p hub.Peer) bool {
+			if hub.IsBot(p) {
+				return true
+			}
+			return callAllow(f, p.Name())
+		})
+	}
+	if f := s.globalFunc("VH_OnUserLogout", 0); f != nil {
+		s.s.Scope().OnLeave(func(p hub.Peer) {
+			if hub.IsBot(p) {
+				return
+			}
+			f.Call(p.Name())
+		})
+	}
+}
+
+func (s *Script) setupMsgCallbacks() {
+	if f := s.globalFunc("VH_OnParsedMsgChat", lua.MultipleReturns); f != nil {
+		s.s.Scope().OnGlobalChat(func(p hub.Peer, m hub.Message) bool {
+			return callAllow(f, p.Name(), m.Text)
+		})
+	}
+	if f := s.globalFunc("VH_OnParsedMsgPM", lua.MultipleReturns); f != nil {
+		s.s.Scope().OnPM(func(from, to hub.Peer, m hub.Message) bool {
+			return callAllow(f, from.Name(), m.Text, to.Name())
+		})
+	}
+
+	raw := make(map[string]*hlua.Func)
+	for typ, name := range map[string]string{
+		(&nmdc.MyINFO{}).Type():           "VH_OnParsedMsgMyINFO",
+		(&nmdc.Search{}).Type():           "VH_OnParsedMsgSearch",
+		(&nmdc.TTHSearchActive{}).Type():  "VH_OnParsedMsgSearch",
+		(&nmdc.TTHSearchPassive{}).Type(): "VH_OnParsedMsgSearch",
+		(&nmdc.SR{}).Type():               "VH_OnParsedMsgSR",
+	} {
+		if f := s.globalFunc(name, lua.MultipleReturns); f != nil {
+			raw[typ] = f
+		}
+	}
+	onCTM := s.globalFunc("VH_OnParsedMsgConnectToMe", lua.MultipleReturns)
+	onRCTM := s.globalFunc("VH_OnParsedMsgRevConnectToMe", lua.MultipleReturns)
+	onUserCmd := s.globalFunc("VH_OnUserCommand", lua.MultipleReturns)
+	onOpCmd := s.globalFunc("VH_OnOperatorCommand", lua.MultipleReturns)
+	if len(raw) == 0 && onCTM == nil && onRCTM == nil && onUserCmd == nil && onOpCmd == nil {
+		return
+	}
+	s.s.Scope().OnNMDCMessage(func(p hub.Peer, m nmdc.Message) bool {
+		switch m := m.(type) {
+		case *nmdc.ConnectToMe:
+			if onCTM != nil {
+				host, port, _ := net.SplitHostPort(m.Address)
+				return callAllow(onCTM, p.Name(), m.Targ, host, port)
+			}
+		case *nmdc.RevConnectToMe:
+			if onRCTM != nil {
+				return callAllow(onRCTM, p.Name(), m.To)
+			}
+		case *nmdc.ChatMessage:
+			if len(m.Text) < 2 {
+				return true
+			}
+			switch m.Text[0] {
+			case '+':
+				if onUserCmd != nil {
+					return callAllow(onUserCmd, p.Name(), m.Text)
+				}
+			case '!':
+				if onOpCmd != nil && p.User().IsOp() {
+					return callAllow(onOpCmd, p.Name(), m.Text)
+				}
+			}
+		default:
+			if f := raw[m.Type()]; f != nil {
+				data, err := nmdc.Marshal(nil, m)
+				if err != nil {
+					return true
+				}
+				return callAllow(f, p.Name(), strings.TrimSuffix(string(data), "|"))
+			}
+		}
+		return true
+	})
+}
+
+// classRange checks if the user class is in the range. Negative max value means no limit.
+func classRange(p hub.Peer, min, max int) bool {
+	c := userClass(p)
+	return c >= min && (max < 0 || c <= max)
+}
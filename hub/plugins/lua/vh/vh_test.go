@@ -0,0 +1,146 @@
+package vh
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+	"github.com/direct-connect/go-dcpp/nmdc"
+	"github.com/direct-connect/go-dcpp/nmdc/client"
+)
+
+const testScript = `
+function VH_OnParsedMsgChat(nick, data)
+	if data == "blocked" then
+		return 0
+	elseif data == "class" then
+		local ok, class = VH:GetUserClass(nick)
+		VH:SendToUser("<Bot> class "..class.."|", nick)
+		return false
+	end
+	return 1
+end
+`
+
+func newTestScript(t testing.TB, code string) (*hub.Hub, *hlua.Script, func()) {
+	h, err := hub.NewHub(hub.Config{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, h.Start())
+
+	dir, err := ioutil.TempDir("", "vh_")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "test.lua")
+	err = ioutil.WriteFile(path, []byte(code), 0644)
+	require.NoError(t, err)
+
+	s, err := hlua.LoadScript(h, path)
+	if err != nil {
+		os.RemoveAll(dir)
+		require.NoError(t, err)
+	}
+	return h, s, func() {
+		_ = s.Close()
+		_ = h.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+type pipeAddr struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c pipeAddr) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type testClient struct {
+	conn net.Conn
+	c    *client.Conn
+	chat chan string
+}
+
+func (c *testClient) Close() {
+	// close the pipe first to unblock the reader
+	_ = c.conn.Close()
+	_ = c.c.Close()
+}
+
+func (c *testClient) expectChat(t testing.TB, exp string) {
+	select {
+	case text := <-c.chat:
+		require.Equal(t, exp, text)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %q", exp)
+	}
+}
+
+func newTestClient(t testing.TB, h *hub.Hub, name string) *testClient {
+	hc, cc := net.Pipe()
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1000}
+	go func() {
+		defer hc.Close()
+		_ = h.ServeNMDC(pipeAddr{Conn: hc, remote: addr}, nil)
+	}()
+	conn, err := nmdc.NewConn(cc)
+	require.NoError(t, err)
+	tc := &testClient{conn: cc, chat: make(chan string, 10)}
+	tc.c, err = client.HubHandshake(conn, &client.Config{Name: name, Init: func(c *client.Conn) {
+		c.OnChatMessage(func(m *nmdcp.ChatMessage) error {
+			if m.Name == "Bot" {
+				tc.chat <- m.Text
+			}
+			return nil
+		})
+	}})
+	if err != nil {
+		_ = cc.Close()
+		require.NoError(t, err)
+	}
+	return tc
+}
+
+func TestCompatible(t *testing.T) {
+	_, s, closer := newTestScript(t, testScript)
+	defer closer()
+	require.True(t, vhCompat{}.Compatible(s))
+
+	_, s, closer2 := newTestScript(t, `function ChatArrival(user, data) end`)
+	defer closer2()
+	require.False(t, vhCompat{}.Compatible(s))
+}
+
+func TestChat(t *testing.T) {
+	h, _, closer := newTestScript(t, testScript)
+	defer closer()
+
+	msgs := make(chan string, 1)
+	h.OnGlobalChat(func(p hub.Peer, m hub.Message) bool {
+		msgs <- m.Text
+		return true
+	})
+
+	c := newTestClient(t, h, "user")
+	defer c.Close()
+
+	require.NoError(t, c.c.SendChatMsg("class"))
+	c.expectChat(t, "class 0")
+
+	// blocked messages are not passed to other hooks
+	require.NoError(t, c.c.SendChatMsg("blocked"))
+	require.NoError(t, c.c.SendChatMsg("hello"))
+	select {
+	case text := <-msgs:
+		require.Equal(t, "hello", text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,125 @@
+package lua
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/direct-connect/go-dcpp/hub"
+)
+
+// ConfigLuaWatch is the interval in milliseconds between checks of the scripts directory (0 - disabled).
+// Loaded scripts are reloaded automatically when changed. If the new version fails to load, the previous one
+// keeps running. New scripts and scripts unloaded by the owner are not loaded by the watcher.
+const ConfigLuaWatch = "lua.watch"
+
+// fileState is used to detect changes of the script files.
+type fileState struct {
+	mod  time.Time
+	size int64
+}
+
+func (f fileState) Equal(f2 fileState) bool {
+	return f.size == f2.size && f.mod.Equal(f2.mod)
+}
+
+// watchScripts starts polling the scripts directory, if it's enabled in the config.
+// The watcher is stopped when the plugin scope is closed.
+func (p *plugin) watchScripts(sc *hub.Scope) {
+	dt := time.Duration(configInt(p.h, ConfigLuaWatch, 0)) * time.Millisecond
+	if dt <= 0 {
+		return
+	}
+	files, err := p.scanScripts()
+	if err != nil {
+		p.h.Logf("lua: cannot watch %s: %v", p.dir, err)
+	}
+	p.mu.Lock()
+	p.files = files
+	p.mu.Unlock()
+	p.h.Logf("lua: watching scripts in: %s", p.dir)
+	sc.AddTimer(dt, p.checkScripts)
+}
+
+// scanScripts returns the state of all the scripts in the scripts directory.
+func (p *plugin) scanScripts() (map[string]fileState, error) {
+	list, err := ioutil.ReadDir(p.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	files := make(map[string]fileState, len(list))
+	for _, fi := range list {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".lua") {
+			continue
+		}
+		files[filepath.Join(p.dir, fi.Name())] = fileState{mod: fi.ModTime(), size: fi.Size()}
+	}
+	return files, nil
+}
+
+// checkScripts reloads changed scripts. Load errors are reported to the op chat.
+func (p *plugin) checkScripts() {
+	files, err := p.scanScripts()
+	if err != nil {
+		p.h.Logf("lua: cannot watch %s: %v", p.dir, err)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.scripts == nil {
+		return // plugin is closed
+	}
+	for path, st := range files {
+		if old, ok := p.files[path]; ok && old.Equal(st) {
+			continue
+		}
+		if _, ok := p.scripts[path]; !ok {
+			continue // not loaded or unloaded by the owner
+		}
+		p.h.Log("lua: reloading script:", path)
+		if _, err := p.reloadScript(path); err != nil {
+			p.reportError(path, fmt.Sprintf("Failed to reload Lua script %s, the previous version is still running", path), err)
+		}
+	}
+	p.files = files
+}
+
+// reloadScript loads a new version of the script from the same file.
+//
+// The new version is executed in a fresh state while the previous one keeps running, and storage writes
+// of the new version are staged. The versions are swapped only if the new one loads successfully,
+// otherwise the previous version is not affected.
+func (p *plugin) reloadScript(path string) (*Script, error) {
+	if _, ok := p.scripts[path]; !ok {
+		return p.loadScript(path)
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := p.newScript(path, src, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.unloadScript(path); err != nil {
+		p.h.Logf("lua: %s: %v", path, err)
+	}
+	if err = s.exec(s.commitStorage); err != nil {
+		p.h.Logf("lua: %s: cannot save the storage: %v", path, err)
+	}
+	p.scripts[path] = s
+	s.start()
+	return s, nil
+}
+
+// reportError records the error and posts it to the op chat.
+func (p *plugin) reportError(path, msg string, err error) {
+	p.recordError(path, err)
+	p.h.Logf("lua: %s: %v", msg, err)
+	p.h.SendOpChat(fmt.Sprintf("%s:\r\n%v", msg, err))
+}
@@ -0,0 +1,102 @@
+package lua_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/direct-connect/go-dcpp/hub"
+	hlua "github.com/direct-connect/go-dcpp/hub/plugins/lua"
+	"github.com/direct-connect/go-dcpp/hub/plugins/lua/luatest"
+)
+
+func waitFor(t testing.TB, fnc func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !fnc() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchScripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lua_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.lua")
+
+	write := func(code string) {
+		err := ioutil.WriteFile(path, []byte(code), 0644)
+		require.NoError(t, err)
+	}
+	write(`hub.storage.set("version", 1)`)
+
+	clock := luatest.NewClock(time.Now())
+	h, err := hub.NewHub(hub.Config{Clock: clock}, nil)
+	require.NoError(t, err)
+	h.MergeConfig(hub.Map{
+		hlua.ConfigLuaScripts: dir,
+		hlua.ConfigLuaWatch:   int64(100),
+	})
+	opchat := make(chan string, 10)
+	h.OnChat(func(r *hub.Room, p hub.Peer, m hub.Message) bool {
+		opchat <- m.Text
+		return true
+	})
+	require.NoError(t, h.Start())
+	defer h.Close()
+
+	version := func() string {
+		v, _, err := h.GetValue("lua:test", "version")
+		require.NoError(t, err)
+		return v
+	}
+	require.Equal(t, "1", version())
+
+	loads := func() string {
+		v, _, err := h.GetValue("lua:test", "loads")
+		require.NoError(t, err)
+		return v
+	}
+
+	// changed scripts are reloaded, but new scripts are not loaded automatically
+	err = ioutil.WriteFile(filepath.Join(dir, "other.lua"), []byte(`hub.storage.set("loaded", true)`), 0644)
+	require.NoError(t, err)
+	write(`hub.storage.set("version", 2) hub.storage.incr("loads")`)
+	clock.Advance(100 * time.Millisecond)
+	waitFor(t, func() bool {
+		return version() == "2"
+	})
+	require.Equal(t, "1", loads())
+
+	expectError := func(line string) {
+		select {
+		case text := <-opchat:
+			require.True(t, strings.Contains(text, path+":"+line+":"), "%q", text)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// syntax errors are reported and the previous version keeps running
+	write("hub.storage.set(\"version\", 3)\nlocal x = = 3\n")
+	clock.Advance(100 * time.Millisecond)
+	expectError("2")
+	require.Equal(t, "2", version())
+	_, ok, err := h.GetValue("lua:other", "loaded")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// runtime errors don't affect the previous version, storage writes of the new one are discarded
+	write("hub.storage.set(\"version\", 4)\n\nerror(\"boom\")\n")
+	clock.Advance(100 * time.Millisecond)
+	expectError("3")
+	require.Equal(t, "2", version())
+	require.Equal(t, "1", loads())
+}
@@ -24,7 +24,8 @@ func (*myIP) Version() hub.Version {
 
 func (p *myIP) Init(h *hub.Hub, path string) error {
 	p.h = h
-	h.RegisterCommand(hub.Command{
+	sc := h.PluginScope(p.Name())
+	sc.RegisterCommand(hub.Command{
 		Menu: []string{"My IP"},
 		Name: "myip", Aliases: []string{"ip"},
 		Short: "shows your current ip address",
@@ -44,7 +44,8 @@ func (p *hubUpdatesChecker) Init(h *hub.Hub, path string) error {
 	} else {
 		p.built = time.Now().Add(-h.Uptime())
 	}
-	h.OnJoined(func(peer hub.Peer) bool {
+	sc := h.PluginScope(p.Name())
+	sc.OnJoined(func(peer hub.Peer) bool {
 		if !peer.User().IsOwner() {
 			if p.veryOld.Get() {
 				p.complainToUser(peer)
@@ -54,17 +55,13 @@ func (p *hubUpdatesChecker) Init(h *hub.Hub, path string) error {
 		go p.checkUpdates(peer)
 		return true
 	})
-	go func() {
-		ticker := time.NewTicker(day * 7)
-		defer ticker.Stop()
-		for range ticker.C {
-			if r, _ := p.check(); r != nil {
-				if !p.veryOld.Get() && time.Since(p.built) > complainToAll {
-					p.veryOld.Set(true)
-				}
+	sc.AddTimer(day*7, func() {
+		if r, _ := p.check(); r != nil {
+			if !p.veryOld.Get() && time.Since(p.built) > complainToAll {
+				p.veryOld.Set(true)
 			}
 		}
-	}()
+	})
 	return nil
 }
 
@@ -1,6 +1,8 @@
 package hub
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -19,30 +21,40 @@ const (
 const (
 	FlagOpIcon  = "icon.op"
 	FlagRegIcon = "icon.reg"
+	// FlagTLSRequired requires users to connect via TLS.
+	// Insecure clients that support TLS are redirected, others are rejected.
+	FlagTLSRequired = "tls.required"
 )
 
 func DefaultProfiles() map[string]Map {
 	return map[string]Map{
 		ProfileNameRoot: {
-			PermOwner:  true,
-			FlagOpIcon: true,
+			PermOwner:       true,
+			FlagOpIcon:      true,
+			FlagTLSRequired: true,
 		},
 		ProfileNameOperator: {
-			ProfileParent: ProfileNameRegistered,
-			FlagOpIcon:    true,
-
-			PermRoomsList:   true,
-			PermBroadcast:   true,
-			PermRoomsOpChat: true,
-			PermDrop:        true,
-			PermRegister:    true,
-			PermRedirect:    true,
-			PermIP:          true,
-			PermBanIP:       true,
+			ProfileParent:   ProfileNameRegistered,
+			FlagOpIcon:      true,
+			FlagTLSRequired: true,
+
+			PermRoomsList:    true,
+			PermBroadcast:    true,
+			PermRoomsOpChat:  true,
+			PermDrop:         true,
+			PermRegister:     true,
+			PermRedirect:     true,
+			PermIP:           true,
+			PermBanIP:        true,
+			PermProtos:       true,
+			PermUserInfo:     true,
+			PermUserManage:   true,
+			PermLimitsBypass: true,
 		},
 		ProfileNameRegistered: {
-			ProfileParent: ProfileNameGuest,
-			FlagRegIcon:   true,
+			ProfileParent:   ProfileNameGuest,
+			FlagRegIcon:     true,
+			FlagTLSRequired: true,
 
 			PermRoomsJoin: true,
 			PermRoomsNew:  true,
@@ -106,6 +118,11 @@ func (h *Hub) loadProfiles() error {
 			p.parent = par
 		}
 	}
+	for id, p := range m {
+		if err := ValidateProfile(p.m); err != nil {
+			h.Logf("profile %q: %v", id, err)
+		}
+	}
 	return nil
 }
 
@@ -116,6 +133,60 @@ func (h *Hub) Profile(id string) *UserProfile {
 	return p
 }
 
+// Profiles returns IDs of all user profiles, sorted by name.
+func (h *Hub) Profiles() []string {
+	h.profiles.RLock()
+	list := make([]string, 0, len(h.profiles.m))
+	for id := range h.profiles.m {
+		list = append(list, id)
+	}
+	h.profiles.RUnlock()
+	sort.Strings(list)
+	return list
+}
+
+// SetProfilePerm sets a permission in a given profile and saves the profile to the database.
+// The permission must be registered with RegisterPermission.
+func (h *Hub) SetProfilePerm(id, perm string, val bool) error {
+	if _, ok := LookupPermission(perm); !ok {
+		return fmt.Errorf("unknown permission: %q", perm)
+	}
+	return h.updateProfile(id, func(m Map) {
+		m[perm] = val
+	})
+}
+
+// UnsetProfilePerm removes a permission from a given profile, so it is inherited from the parent profile.
+// Permissions of built-in profiles are reset to their default values.
+func (h *Hub) UnsetProfilePerm(id, perm string) error {
+	def := DefaultProfiles()[id]
+	return h.updateProfile(id, func(m Map) {
+		if v, ok := def[perm]; ok {
+			m[perm] = v
+		} else {
+			delete(m, perm)
+		}
+	})
+}
+
+func (h *Hub) updateProfile(id string, fnc func(m Map)) error {
+	p := h.Profile(id)
+	if p == nil {
+		return fmt.Errorf("profile %q does not exist", id)
+	}
+	p.mu.Lock()
+	if p.m == nil {
+		p.m = make(Map)
+	}
+	fnc(p.m)
+	m := p.m.Clone()
+	p.mu.Unlock()
+	if h.db == nil {
+		return nil
+	}
+	return h.db.PutProfile(id, m)
+}
+
 type UserProfile struct {
 	id string
 
@@ -131,6 +202,14 @@ func (p *UserProfile) ID() string {
 	return p.id
 }
 
+// Map returns a copy of permissions set directly in this profile, excluding inherited ones.
+func (p *UserProfile) Map() Map {
+	p.mu.RLock()
+	m := p.m.Clone()
+	p.mu.RUnlock()
+	return m
+}
+
 func (p *UserProfile) Parent() *UserProfile {
 	p.mu.RLock()
 	par := p.parent
@@ -205,3 +284,26 @@ func (p *UserProfile) Has(flag string) bool {
 func (p *UserProfile) IsOwner() bool {
 	return p.ID() == ProfileNameRoot || p.Has(PermOwner)
 }
+
+// IsOp checks if the profile has operator or owner privileges.
+func (p *UserProfile) IsOp() bool {
+	return p.IsOwner() || p.HasParent(ProfileNameOperator)
+}
+
+// CanManage checks if users with this profile are allowed to manage accounts with a given profile.
+// Only owners can manage operators, and other users can only manage accounts without any permissions they lack.
+func (p *UserProfile) CanManage(target *UserProfile) bool {
+	if p.IsOwner() {
+		return true
+	} else if target == nil {
+		return false
+	} else if target.IsOp() {
+		return false
+	}
+	for _, perm := range Permissions() {
+		if target.GetBool(perm.Name) && !p.GetBool(perm.Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package hub
+
+// PtokaXPermission is a PtokaX profile permission and the corresponding go-hub permission, if any.
+type PtokaXPermission struct {
+	Name  string // name used in Profiles.xml
+	Field string // field name in tProfilePermissions of the Lua API
+	Perm  string // registered hub permission
+}
+
+// PtokaXPermissions lists PtokaX profile permissions in the order of their numeric IDs,
+// which is also the order they are stored in Profiles.xml.
+//
+// Permissions to restart the hub or scripts are only granted to owners, thus they are not mapped.
+var PtokaXPermissions = []PtokaXPermission{
+	{"HASKEYICON", "bIsOP", FlagOpIcon},
+	{"NODEFLOODGETNICKLIST", "bDefloodGetNickList", ""},
+	{"NODEFLOODMYINFO", "bDefloodNMyINFO", ""},
+	{"NODEFLOODSEARCH", "bDefloodSearch", ""},
+	{"NODEFLOODPM", "bDefloodPM", ""},
+	{"NODEFLOODMAINCHAT", "bDefloodMainChat", ""},
+	{"MASSMSG", "bMassMsg", PermBroadcast},
+	{"TOPIC", "bTopic", PermTopic},
+	{"TEMP_BAN", "bTempBan", PermBanIP},
+	{"REFRESHTXT", "bReloadTxtFiles", ""},
+	{"NOTAGCHECK", "bNoTagCheck", ""},
+	{"TEMP_UNBAN", "bTempUnban", PermBanIP},
+	{"DELREGUSER", "bDelRegUser", PermRegister},
+	{"ALLOWEDOPCHAT", "bAllowedOPChat", PermRoomsOpChat},
+	{"CLRPERMBAN", "bClearPermBan", PermBanIP},
+	{"CLRTEMPBAN", "bClearTempBan", PermBanIP},
+	{"GETINFO", "bGetInfo", PermIP},
+	{"GETBANLIST", "bGetBans", PermBanIP},
+	{"RSTSCRIPTS", "bRestartScripts", ""},
+	{"RSTHUB", "bRestartHub", ""},
+	{"TEMPOP", "bTempOP", ""},
+	{"GAG", "bGag", ""},
+	{"REDIRECT", "bRedirect", PermRedirect},
+	{"BAN", "bBan", PermBanIP},
+	{"KICK", "bKick", PermDrop},
+	{"DROP", "bDrop", PermDrop},
+	{"ENTERFULLHUB", "bEnterFullHub", ""},
+	{"ENTERIFIPBAN", "bEnterIfIPBan", ""},
+}
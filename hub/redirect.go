@@ -0,0 +1,181 @@
+package hub
+
+import (
+	"errors"
+
+	adcp "github.com/direct-connect/go-dc/adc"
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+)
+
+// errRedirected is returned by the handshake functions when the client was redirected to a different address.
+var errRedirected = errors.New("client redirected")
+
+// clientCaps describes hub protocols supported by a client.
+type clientCaps struct {
+	TLS bool // nmdcs:// or adcs://
+	ADC bool // adc://
+}
+
+// knownClients maps client names reported in NMDC tag or ADC INF to protocols they are known to support.
+//
+// Clients not listed here are only upgraded to TLS if they advertise it explicitly.
+var knownClients = map[string]clientCaps{
+	"++":           {TLS: true, ADC: true},
+	"DC++":         {TLS: true, ADC: true},
+	"AirDC++":      {TLS: true, ADC: true},
+	"AirDC++w":     {TLS: true, ADC: true},
+	"ApexDC++":     {TLS: true, ADC: true},
+	"BCDC++":       {TLS: true, ADC: true},
+	"EiskaltDC++":  {TLS: true, ADC: true},
+	"FlylinkDC++":  {TLS: true, ADC: true},
+	"LinuxDC++":    {TLS: true, ADC: true},
+	"ncdc":         {TLS: true, ADC: true},
+	"GreylynkDC++": {ADC: true},
+	"StrgDC++":     {ADC: true},
+}
+
+// nmdcClientCaps detects client capabilities from NMDC $Supports and MyINFO.
+// MyINFO may be nil if it wasn't received yet.
+func nmdcClientCaps(fea nmdcp.Extensions, u *nmdcp.MyINFO) clientCaps {
+	var c clientCaps
+	if u != nil {
+		c = knownClients[u.Client.Name]
+		if u.Flag.IsSet(nmdcp.FlagTLS) {
+			c.TLS = true
+		}
+	}
+	if fea.Has(nmdcp.ExtTLS) {
+		c.TLS = true
+	}
+	return c
+}
+
+// adcClientCaps detects client capabilities from ADC INF.
+func adcClientCaps(u *adcp.UserInfo) clientCaps {
+	c := knownClients[u.Application]
+	c.ADC = true
+	if u.Features.Has(adcp.FeaADC0) || u.Features.Has(adcp.FeaADCS) {
+		c.TLS = true
+	}
+	return c
+}
+
+func (p *nmdcPeer) clientCaps() clientCaps {
+	u := p.Info()
+	return nmdcClientCaps(p.fea, &u)
+}
+
+func (p *adcPeer) clientCaps() clientCaps {
+	p.info.RLock()
+	defer p.info.RUnlock()
+	return adcClientCaps(&p.info.user)
+}
+
+// redirectAddr returns an address of this hub with a given protocol.
+func redirectAddr(proto string, c *ConnInfo) string {
+	// TODO: use the hostname somehow?
+	// TODO: use the keyprint
+	return proto + "://" + c.Local.String()
+}
+
+// tlsRequired checks if the user with a given profile must use a secure connection.
+// Profiles without an explicit setting require it, unless insecure logins are allowed in the config.
+func (h *Hub) tlsRequired(c *ConnInfo, p *UserProfile) bool {
+	if c == nil || c.Secure || h.getAllowInsecure() {
+		return false
+	}
+	v, ok := p.Get(FlagTLSRequired)
+	if !ok {
+		return true
+	}
+	b, _ := v.(bool)
+	return b
+}
+
+// canRedirectTLS checks if the client can be redirected to a secure connection.
+func (h *Hub) canRedirectTLS(caps clientCaps) bool {
+	return h.tls != nil && caps.TLS
+}
+
+// nmdcRedirectAddr returns an address an NMDC client should be redirected to, according to the hub policy
+// and client capabilities. It returns an empty string if the client should stay on this connection.
+func (h *Hub) nmdcRedirectAddr(c *ConnInfo, caps clientCaps) string {
+	if c == nil {
+		return ""
+	}
+	force := h.getRedirectForce()
+	toTLS := h.getRedirectNMDCToTLS() && (caps.TLS || force)
+	if h.getRedirectNMDCToADC() && (caps.ADC || force) {
+		// account for currently set TLS redirects
+		if c.Secure || toTLS || (h.getRedirectADCToTLS() && (caps.TLS || force)) {
+			return redirectAddr("adcs", c)
+		}
+		return redirectAddr("adc", c)
+	}
+	if !c.Secure && toTLS {
+		return redirectAddr("nmdcs", c)
+	}
+	return ""
+}
+
+// adcRedirectAddr is the same as nmdcRedirectAddr, but for ADC clients.
+func (h *Hub) adcRedirectAddr(c *ConnInfo, caps clientCaps) string {
+	if c == nil {
+		return ""
+	}
+	if !c.Secure && h.getRedirectADCToTLS() && (caps.TLS || h.getRedirectForce()) {
+		return redirectAddr("adcs", c)
+	}
+	return ""
+}
+
+// protoStats is a summary of protocols used by online users.
+type protoStats struct {
+	Total     int
+	NMDC      int
+	NMDCS     int
+	ADC       int
+	ADCS      int
+	Other     int
+	ToTLS     int // insecure, but supports TLS
+	NMDCToADC int // NMDC, but supports ADC
+}
+
+func (h *Hub) protoStats() protoStats {
+	var st protoStats
+	for _, p := range h.Peers() {
+		if IsBot(p) {
+			continue
+		}
+		st.Total++
+		c := p.ConnInfo()
+		secure := c != nil && c.Secure
+		var caps clientCaps
+		switch p := p.(type) {
+		case *nmdcPeer:
+			caps = p.clientCaps()
+			if secure {
+				st.NMDCS++
+			} else {
+				st.NMDC++
+			}
+			if caps.ADC {
+				st.NMDCToADC++
+			}
+		case *adcPeer:
+			caps = p.clientCaps()
+			if secure {
+				st.ADCS++
+			} else {
+				st.ADC++
+			}
+		default:
+			st.Other++
+			continue
+		}
+		if !secure && caps.TLS {
+			st.ToTLS++
+		}
+	}
+	return st
+}
@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+	dctypes "github.com/direct-connect/go-dc/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNMDCRedirectAddr(t *testing.T) {
+	plain := &ConnInfo{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 411}}
+	secure := &ConnInfo{Local: plain.Local, Secure: true}
+
+	oldClient := nmdcClientCaps(nil, &nmdcp.MyINFO{
+		Client: dctypes.Software{Name: "oDC", Version: "5.3"},
+	})
+	newClient := nmdcClientCaps(nmdcp.Extensions{nmdcp.ExtTLS: {}}, &nmdcp.MyINFO{
+		Client: dctypes.Software{Name: "++", Version: "0.868"},
+	})
+	require.Equal(t, clientCaps{}, oldClient)
+	require.Equal(t, clientCaps{TLS: true, ADC: true}, newClient)
+
+	var cases = []struct {
+		name   string
+		tls    bool
+		adc    bool
+		adcTLS bool
+		force  bool
+		conn   *ConnInfo
+		caps   clientCaps
+		exp    string
+	}{
+		{name: "no redirect", conn: plain, caps: newClient},
+		{name: "old client tls", tls: true, conn: plain, caps: oldClient},
+		{name: "old client forced", tls: true, force: true, conn: plain, caps: oldClient, exp: "nmdcs://127.0.0.1:411"},
+		{name: "tls", tls: true, conn: plain, caps: newClient, exp: "nmdcs://127.0.0.1:411"},
+		{name: "already secure", tls: true, conn: secure, caps: newClient},
+		{name: "old client adc", adc: true, conn: plain, caps: oldClient},
+		{name: "adc", adc: true, conn: plain, caps: newClient, exp: "adc://127.0.0.1:411"},
+		{name: "adc secure", adc: true, conn: secure, caps: newClient, exp: "adcs://127.0.0.1:411"},
+		{name: "adc tls", adc: true, adcTLS: true, conn: plain, caps: newClient, exp: "adcs://127.0.0.1:411"},
+		{name: "adc only", adc: true, adcTLS: true, conn: plain, caps: clientCaps{ADC: true}, exp: "adc://127.0.0.1:411"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := &Hub{}
+			h.setRedirectNMDCToTLS(c.tls)
+			h.setRedirectNMDCToADC(c.adc)
+			h.setRedirectADCToTLS(c.adcTLS)
+			h.setRedirectForce(c.force)
+			require.Equal(t, c.exp, h.nmdcRedirectAddr(c.conn, c.caps))
+		})
+	}
+}
+
+func TestTLSRequired(t *testing.T) {
+	plain := &ConnInfo{Local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 411}}
+	secure := &ConnInfo{Local: plain.Local, Secure: true}
+
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, h.loadProfiles())
+	user := h.Profile(ProfileNameRegistered)
+	op := h.Profile(ProfileNameOperator)
+	guest := h.Profile(ProfileNameGuest)
+
+	// required even if the hub cannot redirect to TLS
+	require.True(t, h.tlsRequired(plain, user))
+	require.True(t, h.tlsRequired(plain, op))
+	// no explicit setting
+	require.True(t, h.tlsRequired(plain, guest))
+	require.False(t, h.tlsRequired(secure, op))
+	require.False(t, h.canRedirectTLS(clientCaps{TLS: true}))
+
+	h.tls = &tls.Config{}
+	require.True(t, h.canRedirectTLS(clientCaps{TLS: true}))
+	require.False(t, h.canRedirectTLS(clientCaps{}))
+
+	h.setAllowInsecure(true)
+	require.False(t, h.tlsRequired(plain, user))
+	require.False(t, h.tlsRequired(plain, op))
+}
@@ -258,6 +258,11 @@ func (r *Room) SendChat(from Peer, m Message) {
 	if m.Name == "" {
 		m.Name = from.Name()
 	}
+	if from.User().MustChangePass() {
+		r.h.cmdOutput(from, errPassChangeRequired.Error())
+		cntChatMsgDropped.Add(1)
+		return
+	}
 
 	if r.h.globalChat == r {
 		if !r.h.callOnGlobalChat(from, m) {
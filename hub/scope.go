@@ -0,0 +1,201 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	nmdcp "github.com/direct-connect/go-dc/nmdc"
+	"github.com/direct-connect/go-dc/types"
+)
+
+var errScopeClosed = errors.New("scope is closed")
+
+// Scope tracks hooks, commands, bots and timers registered by a single owner (plugin or script).
+// Closing the scope removes all of them from the hub.
+type Scope struct {
+	h    *Hub
+	name string
+
+	mu      sync.Mutex
+	closed  bool
+	closers []func()
+}
+
+// NewScope creates a new scope with a given name. The name is only used for logging.
+func (h *Hub) NewScope(name string) *Scope {
+	return &Scope{h: h, name: name}
+}
+
+// Name returns the name of the scope.
+func (s *Scope) Name() string {
+	return s.name
+}
+
+// Hub returns the hub associated with this scope.
+func (s *Scope) Hub() *Hub {
+	return s.h
+}
+
+// Defer registers a function that will be called when the scope is closed.
+// Functions are called in the reverse order. If the scope is already closed, the function is called immediately.
+func (s *Scope) Defer(fnc func()) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		fnc()
+		return
+	}
+	s.closers = append(s.closers, fnc)
+	s.mu.Unlock()
+}
+
+// Closed checks if the scope was closed.
+func (s *Scope) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close removes everything that was registered in this scope.
+func (s *Scope) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i]()
+	}
+	return nil
+}
+
+// RegisterCommand registers a command on the hub. See Hub.RegisterCommand.
+func (s *Scope) RegisterCommand(cmd Command) {
+	c := s.h.registerCommand(cmd)
+	s.Defer(func() {
+		s.h.unregisterCommand(c)
+	})
+}
+
+// NewBot creates a bot on the hub. See Hub.NewBot.
+func (s *Scope) NewBot(name string, soft types.Software) (*Bot, error) {
+	return s.NewBotDesc(name, "", "", soft)
+}
+
+// NewBotDesc creates a bot on the hub. See Hub.NewBotDesc.
+func (s *Scope) NewBotDesc(name, desc, email string, soft types.Software) (*Bot, error) {
+	if s.Closed() {
+		return nil, errScopeClosed
+	}
+	b, err := s.h.NewBotDesc(name, desc, email, soft)
+	if err != nil {
+		return nil, err
+	}
+	s.Defer(func() {
+		if err := b.Close(); err != nil {
+			s.h.Logf("%s: failed to close bot %q: %v", s.name, b.Name(), err)
+		}
+	})
+	return b, nil
+}
+
+// AddTimer calls the function periodically, until the returned function is called or the scope is closed.
+func (s *Scope) AddTimer(dt time.Duration, fnc func()) func() {
+	ticker := s.h.clock.NewTicker(dt)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				fnc()
+			}
+		}
+	}()
+	s.Defer(stop)
+	return stop
+}
+
+func (s *Scope) hook(remove func()) func() {
+	s.Defer(remove)
+	return remove
+}
+
+// OnConnected is the same as Hub.OnConnected, but the trigger is removed when the scope is closed.
+func (s *Scope) OnConnected(fnc func(c net.Conn) bool) func() {
+	return s.hook(s.h.OnConnected(fnc))
+}
+
+// OnConnectedIP4 is the same as Hub.OnConnectedIP4, but the trigger is removed when the scope is closed.
+func (s *Scope) OnConnectedIP4(fnc func(c net.Conn, ip net.IP) bool) func() {
+	return s.hook(s.h.OnConnectedIP4(fnc))
+}
+
+// OnConnectedIP6 is the same as Hub.OnConnectedIP6, but the trigger is removed when the scope is closed.
+func (s *Scope) OnConnectedIP6(fnc func(c net.Conn, ip net.IP) bool) func() {
+	return s.hook(s.h.OnConnectedIP6(fnc))
+}
+
+// OnDisconnected is the same as Hub.OnDisconnected, but the trigger is removed when the scope is closed.
+func (s *Scope) OnDisconnected(fnc func(c net.Conn)) func() {
+	return s.hook(s.h.OnDisconnected(fnc))
+}
+
+// OnJoined is the same as Hub.OnJoined, but the trigger is removed when the scope is closed.
+func (s *Scope) OnJoined(fnc func(p Peer) bool) func() {
+	return s.hook(s.h.OnJoined(fnc))
+}
+
+// OnPermJoined is the same as Hub.OnPermJoined, but the trigger is removed when the scope is closed.
+func (s *Scope) OnPermJoined(perm string, fnc func(p Peer) bool) func() {
+	return s.hook(s.h.OnPermJoined(perm, fnc))
+}
+
+// OnLeave is the same as Hub.OnLeave, but the trigger is removed when the scope is closed.
+func (s *Scope) OnLeave(fnc func(p Peer)) func() {
+	return s.hook(s.h.OnLeave(fnc))
+}
+
+// OnPermLeave is the same as Hub.OnPermLeave, but the trigger is removed when the scope is closed.
+func (s *Scope) OnPermLeave(perm string, fnc func(p Peer)) func() {
+	return s.hook(s.h.OnPermLeave(perm, fnc))
+}
+
+// OnGlobalChat is the same as Hub.OnGlobalChat, but the trigger is removed when the scope is closed.
+func (s *Scope) OnGlobalChat(fnc func(p Peer, m Message) bool) func() {
+	return s.hook(s.h.OnGlobalChat(fnc))
+}
+
+// OnChat is the same as Hub.OnChat, but the trigger is removed when the scope is closed.
+func (s *Scope) OnChat(fnc func(r *Room, p Peer, m Message) bool) func() {
+	return s.hook(s.h.OnChat(fnc))
+}
+
+// OnPM is the same as Hub.OnPM, but the trigger is removed when the scope is closed.
+func (s *Scope) OnPM(fnc func(from, to Peer, m Message) bool) func() {
+	return s.hook(s.h.OnPM(fnc))
+}
+
+// OnNMDCHandshake is the same as Hub.OnNMDCHandshake, but the trigger is removed when the scope is closed.
+func (s *Scope) OnNMDCHandshake(fnc func(c *ConnInfo, name string, m nmdcp.Message) bool) func() {
+	return s.hook(s.h.OnNMDCHandshake(fnc))
+}
+
+// OnNMDCMessage is the same as Hub.OnNMDCMessage, but the trigger is removed when the scope is closed.
+func (s *Scope) OnNMDCMessage(fnc func(p Peer, m nmdcp.Message) bool) func() {
+	return s.hook(s.h.OnNMDCMessage(fnc))
+}
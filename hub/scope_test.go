@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"testing"
+
+	dctypes "github.com/direct-connect/go-dc/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScopeClose(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+
+	sc := h.NewScope("test")
+	var joined int
+	sc.OnJoined(func(p Peer) bool {
+		joined++
+		return true
+	})
+	remove := h.OnJoined(func(p Peer) bool {
+		joined++
+		return true
+	})
+	sc.RegisterCommand(Command{
+		Name: "scoped", Aliases: []string{"sc"},
+		Func: func(p Peer, args string) error { return nil },
+	})
+	b, err := sc.NewBot("scopebot", dctypes.Software{})
+	require.NoError(t, err)
+
+	require.True(t, h.callOnJoined(h.hubUser.p))
+	require.Equal(t, 2, joined)
+	require.NotNil(t, h.getCommand("sc"))
+	require.NotNil(t, h.PeerByName(b.Name()))
+
+	remove()
+	remove()
+	require.True(t, h.callOnJoined(h.hubUser.p))
+	require.Equal(t, 3, joined)
+
+	require.NoError(t, sc.Close())
+	require.True(t, h.callOnJoined(h.hubUser.p))
+	require.Equal(t, 3, joined)
+	require.Nil(t, h.getCommand("scoped"))
+	require.Nil(t, h.getCommand("sc"))
+	require.Nil(t, h.PeerByName("scopebot"))
+	require.NotNil(t, h.getCommand("help"))
+
+	// registering in a closed scope is undone immediately
+	sc.OnJoined(func(p Peer) bool {
+		joined++
+		return true
+	})
+	require.True(t, h.callOnJoined(h.hubUser.p))
+	require.Equal(t, 3, joined)
+}
+
+func TestScopeCommandOverride(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	builtin := h.getCommand("help")
+	require.NotNil(t, builtin)
+
+	newCmd := func(sc *Scope) {
+		sc.RegisterCommand(Command{
+			Name: "help", Func: func(p Peer, args string) error { return nil },
+		})
+	}
+	sc1, sc2 := h.NewScope("test1"), h.NewScope("test2")
+	newCmd(sc1)
+	c1 := h.getCommand("help")
+	require.True(t, c1 != builtin)
+	newCmd(sc2)
+	require.True(t, h.getCommand("help") != c1)
+
+	// overridden commands are restored
+	require.NoError(t, sc2.Close())
+	require.True(t, h.getCommand("help") == c1)
+	require.NoError(t, sc1.Close())
+	require.True(t, h.getCommand("help") == builtin)
+
+	// the same in a different order
+	sc1, sc2 = h.NewScope("test1"), h.NewScope("test2")
+	newCmd(sc1)
+	newCmd(sc2)
+	c2 := h.getCommand("help")
+	require.NoError(t, sc1.Close())
+	require.True(t, h.getCommand("help") == c2)
+	require.NoError(t, sc2.Close())
+	require.True(t, h.getCommand("help") == builtin)
+	require.Len(t, h.listCommands(), len(h.cmds.names))
+}
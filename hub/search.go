@@ -2,6 +2,11 @@ package hub
 
 import (
 	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/direct-connect/go-dc/tiger"
 )
@@ -29,7 +34,18 @@ type NameSearch struct {
 
 func (NameSearch) isSearchReq() {}
 func (f NameSearch) MatchName(name string) bool {
-	return true // TODO
+	name = strings.ToLower(name)
+	for _, s := range f.And {
+		if !strings.Contains(name, strings.ToLower(s)) {
+			return false
+		}
+	}
+	for _, s := range f.Not {
+		if s != "" && strings.Contains(name, strings.ToLower(s)) {
+			return false
+		}
+	}
+	return true
 }
 func (f NameSearch) Match(r SearchResult) bool {
 	switch r := r.(type) {
@@ -76,11 +92,18 @@ func (FileSearch) isSearchReq() {}
 func (s FileSearch) Match(r SearchResult) bool {
 	switch r := r.(type) {
 	case File:
-		if s.MinSize != 0 && s.MaxSize != 0 {
-			if s.MinSize != 0 && r.Size < s.MinSize {
+		if s.MinSize != 0 && r.Size < s.MinSize {
+			return false
+		}
+		if s.MaxSize != 0 && r.Size > s.MaxSize {
+			return false
+		}
+		if len(s.Ext) != 0 || len(s.NoExt) != 0 {
+			ext := strings.TrimPrefix(path.Ext(r.Path), ".")
+			if len(s.Ext) != 0 && !containsFold(s.Ext, ext) {
 				return false
 			}
-			if s.MaxSize != 0 && r.Size > s.MaxSize {
+			if containsFold(s.NoExt, ext) {
 				return false
 			}
 		}
@@ -89,6 +112,15 @@ func (s FileSearch) Match(r SearchResult) bool {
 	return false
 }
 
+func containsFold(arr []string, s string) bool {
+	for _, v := range arr {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
 var _ SearchRequest = DirSearch{}
 
 type DirSearch struct {
@@ -137,22 +169,193 @@ type Search interface {
 	Close() error
 }
 
+const (
+	// defaultSearchResults is the default max number of results for a single search.
+	defaultSearchResults = 500
+	// defaultSearchPerSource is the default max number of results from a single user for a single search.
+	defaultSearchPerSource = 50
+)
+
+var errSearchLimit = errors.New("search result limit reached")
+
+// searchRun tracks the search context, result limits and caching for a single search.
+// It is embedded into protocol-specific search implementations.
+type searchRun struct {
+	h   *Hub
+	ctx context.Context
+	key string // cache key
+
+	mu        sync.Mutex
+	total     int
+	perSource map[Peer]int
+}
+
+func (s *searchRun) bindSearch(h *Hub, ctx context.Context, key string) {
+	s.h, s.ctx, s.key = h, ctx, key
+}
+
+// Context returns a context of the search. It is cancelled when the searching peer leaves or the search times out.
+func (s *searchRun) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// acceptResult checks if the result can be sent to the searching peer and caches the result.
+// It returns false if the result should be ignored, and an error if the search is no longer active.
+func (s *searchRun) acceptResult(r SearchResult) (bool, error) {
+	if s.h == nil {
+		// not started by the hub
+		return true, nil
+	}
+	if err := s.ctx.Err(); err != nil {
+		return false, err
+	}
+	max, maxSource := s.h.getSearchLimits()
+	s.mu.Lock()
+	if max > 0 && s.total >= max {
+		s.mu.Unlock()
+		cntSearchResultsDropped.Add(1)
+		return false, errSearchLimit
+	}
+	if maxSource > 0 {
+		from := r.From()
+		if s.perSource[from] >= maxSource {
+			s.mu.Unlock()
+			cntSearchResultsDropped.Add(1)
+			return false, nil
+		}
+		if s.perSource == nil {
+			s.perSource = make(map[Peer]int)
+		}
+		s.perSource[from]++
+	}
+	s.total++
+	s.mu.Unlock()
+	if s.key != "" {
+		s.h.search.add(s.key, r)
+	}
+	return true, nil
+}
+
+// boundSearch is implemented by searches that embed searchRun.
+type boundSearch interface {
+	Search
+	bindSearch(h *Hub, ctx context.Context, key string)
+	acceptResult(r SearchResult) (bool, error)
+}
+
+// limitedSearch wraps an arbitrary search implementation to enforce search limits.
+type limitedSearch struct {
+	Search
+	searchRun
+}
+
+func (s *limitedSearch) SendResult(r SearchResult) error {
+	if ok, err := s.acceptResult(r); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+	return s.Search.SendResult(r)
+}
+
+// searchContext returns a new context for a search started by a given peer.
+// The context is cancelled when the peer leaves, when the search timeout expires or when the parent context is cancelled.
+func (h *Hub) searchContext(parent context.Context, peer Peer) context.Context {
+	ctx, cancel := context.WithTimeout(parent, h.getSearchTimeout())
+	var done <-chan struct{}
+	if peer != nil {
+		done = peer.base().close.done
+	}
+	go func() {
+		defer cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}()
+	return ctx
+}
+
 func (h *Hub) Search(req SearchRequest, s Search, peers []Peer) {
+	h.startSearch(context.Background(), req, s, peers)
+}
+
+// isPassiveSearch checks if all search results are delivered to the searching peer through the hub.
+func isPassiveSearch(s Search) bool {
+	switch s := s.(type) {
+	case *adcSearch:
+		return !s.p.isActive()
+	case *limitedSearch:
+		return isPassiveSearch(s.Search)
+	}
+	// NMDC searches are always delivered as passive, bots receive results from the hub as well
+	return true
+}
+
+// collectSearch finishes the cache entry when the collection window ends or when the search stops.
+func (h *Hub) collectSearch(ctx context.Context, key string, window time.Duration) {
+	t := time.NewTimer(window)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		h.search.finish(key, true)
+	case <-ctx.Done():
+		h.search.finish(key, ctx.Err() == context.DeadlineExceeded)
+	}
+}
+
+// startSearch sends the search request to peers and returns the context of the search.
+// It returns nil if the search was suppressed as a duplicate.
+func (h *Hub) startSearch(parent context.Context, req SearchRequest, s Search, peers []Peer) context.Context {
 	cntSearch.Add(1)
 	defer measure(durSearch)()
 
 	peer := s.Peer()
+	key := ""
+	if peers == nil {
+		// global search - check for duplicates
+		key = searchKey(req)
+		if key != "" && !IsBot(peer) && h.search.isDup(peer, key) {
+			cntSearchDup.Add(1)
+			return nil
+		}
+	}
+	ctx := h.searchContext(parent, peer)
+	bs, ok := s.(boundSearch)
+	if !ok {
+		bs = &limitedSearch{Search: s}
+	}
+	if key != "" && !isPassiveSearch(bs) {
+		// results of active searches are sent directly to the peer, thus they cannot be cached
+		key = ""
+	}
+	if key != "" {
+		// serve from cache if possible
+		if res, ok := h.search.lookup(key); ok {
+			cntSearchCacheHit.Add(1)
+			bs.bindSearch(h, ctx, "")
+			h.searchFromCache(bs, res)
+			return ctx
+		}
+		cntSearchCacheMiss.Add(1)
+	}
+	bs.bindSearch(h, ctx, key)
+	if key != "" {
+		go h.collectSearch(ctx, key, searchCacheCollect)
+	}
 	if peers == nil {
 		peers = h.Peers()
 	}
-	// FIXME: should be bound to the close channel of the peer
-	ctx := context.TODO()
 	for _, p := range peers {
 		if p == peer {
 			continue
 		} else if !p.Searchable() {
 			continue
 		}
-		_ = p.Search(ctx, req, s)
+		_ = p.Search(ctx, req, bs)
 	}
+	return ctx
 }
@@ -0,0 +1,216 @@
+package hub
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// searchCacheTTL is the time while search results are served from the cache.
+	searchCacheTTL = 30 * time.Second
+	// searchDupWindow is the time while the same search request from the same peer is ignored.
+	searchDupWindow = 10 * time.Second
+	// searchCacheResults is the max number of results cached for a single request.
+	searchCacheResults = 50
+	// searchCacheMax is the max number of requests in the cache.
+	searchCacheMax = 10000
+)
+
+// searchCacheCollect is the time while results of a search are collected into the cache entry.
+// It must be shorter than searchCacheTTL, otherwise the entry expires before it can be served.
+var searchCacheCollect = 10 * time.Second
+
+// searchKey returns a normalized key for the search request.
+// It returns an empty string if the request cannot be cached.
+func searchKey(req SearchRequest) string {
+	switch req := req.(type) {
+	case TTHSearch:
+		return "T:" + TTH(req).Base32()
+	case NameSearch:
+		return "N:" + req.key()
+	case DirSearch:
+		return "D:" + req.NameSearch.key()
+	case FileSearch:
+		return "F:" + req.NameSearch.key() +
+			":" + strconv.Itoa(int(req.FileType)) +
+			":" + strconv.FormatUint(req.MinSize, 10) +
+			":" + strconv.FormatUint(req.MaxSize, 10) +
+			":" + normSearchTerms(req.Ext) +
+			":" + normSearchTerms(req.NoExt)
+	}
+	return ""
+}
+
+func (f NameSearch) key() string {
+	return normSearchTerms(f.And) + ":" + normSearchTerms(f.Not)
+}
+
+// normSearchTerms converts search terms to lower case, removes duplicates and sorts them.
+func normSearchTerms(terms []string) string {
+	if len(terms) == 0 {
+		return ""
+	}
+	arr := make([]string, 0, len(terms))
+	for _, s := range terms {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "" {
+			arr = append(arr, s)
+		}
+	}
+	sort.Strings(arr)
+	out := arr[:0]
+	for i, s := range arr {
+		if i == 0 || s != arr[i-1] {
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+type searchCacheEntry struct {
+	created time.Time
+	results []SearchResult
+	// running is the number of searches that populate the entry
+	running int
+	// done is set when one of the searches that populate the entry has finished collecting results
+	done bool
+}
+
+type searchOrigin struct {
+	peer Peer
+	key  string
+}
+
+// searchCache holds recent search results and tracks recent search requests.
+type searchCache struct {
+	mu      sync.Mutex
+	entries map[string]*searchCacheEntry
+	recent  map[searchOrigin]time.Time
+	lastGC  time.Time
+}
+
+// gc removes expired entries. Should be called under the write lock.
+func (c *searchCache) gc(now time.Time) {
+	if now.Sub(c.lastGC) < searchCacheTTL && len(c.entries) < searchCacheMax {
+		return
+	}
+	c.lastGC = now
+	for key, e := range c.entries {
+		if now.Sub(e.created) > searchCacheTTL {
+			delete(c.entries, key)
+		}
+	}
+	for o, t := range c.recent {
+		if now.Sub(t) > searchDupWindow {
+			delete(c.recent, o)
+		}
+	}
+}
+
+// isDup checks if the peer sent the same request recently and records the current one.
+func (c *searchCache) isDup(p Peer, key string) bool {
+	now := time.Now()
+	o := searchOrigin{peer: p, key: key}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.recent[o]; ok && now.Sub(t) < searchDupWindow {
+		return true
+	}
+	if c.recent == nil {
+		c.recent = make(map[searchOrigin]time.Time)
+	}
+	c.gc(now)
+	c.recent[o] = now
+	return false
+}
+
+// lookup returns cached results for the key. If there are no results in the cache,
+// it starts a new entry that will be populated by the add function.
+//
+// The entry is only considered a hit if the search that populates it has finished.
+// Otherwise, the caller should send the search to peers and call finish when it ends.
+func (c *searchCache) lookup(key string) ([]SearchResult, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[key]; e != nil && now.Sub(e.created) < searchCacheTTL {
+		if e.done {
+			return append([]SearchResult{}, e.results...), true
+		}
+		// still in progress, results of this search will be added to the same entry
+		e.running++
+		return nil, false
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*searchCacheEntry)
+	}
+	c.gc(now)
+	if len(c.entries) >= searchCacheMax {
+		return nil, false
+	}
+	c.entries[key] = &searchCacheEntry{created: now, running: 1}
+	return nil, false
+}
+
+// add a search result to the cache entry, if it exists.
+func (c *searchCache) add(key string, r SearchResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil || len(e.results) >= searchCacheResults {
+		return
+	}
+	for _, r2 := range e.results {
+		if sameSearchResult(r, r2) {
+			return
+		}
+	}
+	e.results = append(e.results, r)
+}
+
+// finish is called when the search that populates the entry stops collecting results. If all searches
+// were interrupted before the end of the collection window, the entry is removed, so the next search
+// is sent to peers.
+func (c *searchCache) finish(key string, completed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		return
+	}
+	e.running--
+	if completed {
+		e.done = true
+	} else if !e.done && e.running <= 0 {
+		delete(c.entries, key)
+	}
+}
+
+func sameSearchResult(r1, r2 SearchResult) bool {
+	switch r1 := r1.(type) {
+	case File:
+		r2, ok := r2.(File)
+		return ok && r1.Peer == r2.Peer && r1.Path == r2.Path
+	case Dir:
+		r2, ok := r2.(Dir)
+		return ok && r1.Peer == r2.Peer && r1.Path == r2.Path
+	}
+	return false
+}
+
+// searchFromCache sends cached results to the search.
+func (h *Hub) searchFromCache(s Search, results []SearchResult) {
+	peer := s.Peer()
+	for _, r := range results {
+		if p := r.From(); p == peer || !p.Online() {
+			continue
+		}
+		if err := s.SendResult(r); err != nil {
+			_ = s.Close()
+			return
+		}
+	}
+}
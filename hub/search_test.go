@@ -0,0 +1,280 @@
+package hub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dctypes "github.com/direct-connect/go-dc/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameSearchMatch(t *testing.T) {
+	var cases = []struct {
+		name  string
+		req   SearchRequest
+		res   SearchResult
+		match bool
+	}{
+		{
+			name:  "empty",
+			req:   NameSearch{},
+			res:   File{Path: "dir/file.txt"},
+			match: true,
+		},
+		{
+			name:  "and",
+			req:   NameSearch{And: []string{"Dir", "FILE"}},
+			res:   File{Path: "some/dir/file.txt"},
+			match: true,
+		},
+		{
+			name:  "and missing",
+			req:   NameSearch{And: []string{"dir", "movie"}},
+			res:   File{Path: "some/dir/file.txt"},
+			match: false,
+		},
+		{
+			name:  "not",
+			req:   NameSearch{And: []string{"file"}, Not: []string{"TXT"}},
+			res:   File{Path: "some/dir/file.txt"},
+			match: false,
+		},
+		{
+			name:  "dir search",
+			req:   DirSearch{NameSearch{And: []string{"dir"}}},
+			res:   File{Path: "some/dir/file.txt"},
+			match: false,
+		},
+		{
+			name:  "file ext",
+			req:   FileSearch{NameSearch: NameSearch{And: []string{"file"}}, Ext: []string{"txt"}},
+			res:   File{Path: "some/dir/file.TXT"},
+			match: true,
+		},
+		{
+			name:  "file no ext",
+			req:   FileSearch{NameSearch: NameSearch{And: []string{"file"}}, NoExt: []string{"txt"}},
+			res:   File{Path: "some/dir/file.txt"},
+			match: false,
+		},
+		{
+			name:  "file max size",
+			req:   FileSearch{MaxSize: 10},
+			res:   File{Path: "file.txt", Size: 20},
+			match: false,
+		},
+		{
+			name:  "file min size",
+			req:   FileSearch{MinSize: 10},
+			res:   File{Path: "file.txt", Size: 20},
+			match: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.match, c.req.Match(c.res))
+		})
+	}
+}
+
+func TestSearchKey(t *testing.T) {
+	k1 := searchKey(NameSearch{And: []string{"Foo", "bar", "foo"}})
+	k2 := searchKey(NameSearch{And: []string{"bar", "FOO"}})
+	require.Equal(t, k1, k2)
+	k3 := searchKey(DirSearch{NameSearch{And: []string{"bar", "foo"}}})
+	require.NotEqual(t, k1, k3)
+	k4 := searchKey(FileSearch{NameSearch: NameSearch{And: []string{"bar", "foo"}}, MaxSize: 10})
+	require.NotEqual(t, k1, k4)
+}
+
+func TestSearchCache(t *testing.T) {
+	var c searchCache
+	p := &botPeer{}
+	const key = "N:foo:"
+
+	require.False(t, c.isDup(p, key))
+	require.True(t, c.isDup(p, key))
+	require.False(t, c.isDup(p, "N:bar:"))
+
+	_, ok := c.lookup(key)
+	require.False(t, ok)
+	// search is still in progress
+	_, ok = c.lookup(key)
+	require.False(t, ok)
+
+	r := File{Peer: p, Path: "foo.txt", Size: 1}
+	c.add(key, r)
+	c.add(key, r)
+	// partial results are not served
+	_, ok = c.lookup(key)
+	require.False(t, ok)
+	c.finish(key, false)
+	c.finish(key, true)
+	res, ok := c.lookup(key)
+	require.True(t, ok)
+	require.Equal(t, []SearchResult{r}, res)
+
+	// interrupted searches are not cached
+	const key2 = "N:bar:"
+	_, ok = c.lookup(key2)
+	require.False(t, ok)
+	c.add(key2, r)
+	c.finish(key2, false)
+	_, ok = c.lookup(key2)
+	require.False(t, ok)
+
+	// completed searches are cached, even without results
+	c.finish(key2, true)
+	res, ok = c.lookup(key2)
+	require.True(t, ok)
+	require.Empty(t, res)
+}
+
+func TestSearchLimits(t *testing.T) {
+	h := &Hub{}
+	h.setSearchLimits(3, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var s searchRun
+	s.bindSearch(h, ctx, "")
+
+	p1, p2 := &botPeer{}, &botPeer{}
+	accept := func(p Peer) (bool, error) {
+		return s.acceptResult(File{Peer: p, Path: "foo.txt"})
+	}
+	ok, err := accept(p1)
+	require.True(t, ok)
+	require.NoError(t, err)
+	ok, _ = accept(p1)
+	require.True(t, ok)
+	ok, err = accept(p1)
+	require.False(t, ok)
+	require.NoError(t, err)
+	ok, _ = accept(p2)
+	require.True(t, ok)
+	_, err = accept(p2)
+	require.Equal(t, errSearchLimit, err)
+
+	cancel()
+	s = searchRun{}
+	s.bindSearch(h, ctx, "")
+	_, err = accept(p2)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestBotSearch(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+
+	b1, err := h.NewBot("searcher", dctypes.Software{})
+	require.NoError(t, err)
+	b2, err := h.NewBot("sharer", dctypes.Software{})
+	require.NoError(t, err)
+	require.False(t, b2.p.Searchable())
+
+	var tth TTH
+	tth[0] = 1
+	b2.SetSearchHandler(ShareSearch([]SearchResult{
+		File{Path: "dir/file.txt", Size: 10, TTH: &tth},
+		File{Path: "dir/other.txt", Size: 20},
+	}))
+	require.True(t, b2.p.Searchable())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := b1.Search(ctx, NameSearch{And: []string{"file"}})
+	r := <-ch
+	require.Equal(t, File{Peer: b2.p, Path: "dir/file.txt", Size: 10, TTH: &tth}, r)
+	cancel()
+	for range ch {
+	}
+}
+
+func TestBotSearchDrop(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	b, err := h.NewBot("searcher", dctypes.Software{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &botSearch{p: b.p, out: make(chan SearchResult, 1)}
+	s.bindSearch(h, ctx, "")
+
+	dropped := testutil.ToFloat64(cntSearchBotDropped)
+	p := &botPeer{}
+	require.NoError(t, s.SendResult(File{Peer: p, Path: "a.txt"}))
+	// the buffer is full, the result is dropped instead of blocking the sender
+	require.NoError(t, s.SendResult(File{Peer: p, Path: "b.txt"}))
+	require.Equal(t, dropped+1, testutil.ToFloat64(cntSearchBotDropped))
+	require.Equal(t, File{Peer: p, Path: "a.txt"}, <-s.out)
+}
+
+func TestSearchCacheSecondSearcher(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+
+	b1, err := h.NewBot("searcher1", dctypes.Software{})
+	require.NoError(t, err)
+	b2, err := h.NewBot("searcher2", dctypes.Software{})
+	require.NoError(t, err)
+	sharer, err := h.NewBot("sharer", dctypes.Software{})
+	require.NoError(t, err)
+
+	// delay the results, so the second search starts before anything is cached
+	release := make(chan struct{})
+	share := ShareSearch([]SearchResult{File{Path: "dir/file.txt", Size: 10}})
+	sharer.SetSearchHandler(func(ctx context.Context, req SearchRequest) []SearchResult {
+		<-release
+		return share(ctx, req)
+	})
+	exp := File{Peer: sharer.p, Path: "dir/file.txt", Size: 10}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := NameSearch{And: []string{"file"}}
+	ch1 := b1.Search(ctx, req)
+	ch2 := b2.Search(ctx, req)
+	close(release)
+	require.Equal(t, exp, <-ch1)
+	require.Equal(t, exp, <-ch2)
+
+	// the first search has not finished yet, so the third one is sent to peers as well
+	ch3 := b1.Search(ctx, req)
+	require.Equal(t, exp, <-ch3)
+}
+
+func TestSearchCacheHit(t *testing.T) {
+	defer func(d time.Duration) {
+		searchCacheCollect = d
+	}(searchCacheCollect)
+	searchCacheCollect = 50 * time.Millisecond
+
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, searchTimeout, h.getSearchTimeout())
+
+	b1, err := h.NewBot("searcher1", dctypes.Software{})
+	require.NoError(t, err)
+	b2, err := h.NewBot("searcher2", dctypes.Software{})
+	require.NoError(t, err)
+	sharer, err := h.NewBot("sharer", dctypes.Software{})
+	require.NoError(t, err)
+	sharer.SetSearchHandler(ShareSearch([]SearchResult{File{Path: "dir/file.txt", Size: 10}}))
+	exp := File{Peer: sharer.p, Path: "dir/file.txt", Size: 10}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := NameSearch{And: []string{"file"}}
+	ch1 := b1.Search(ctx, req)
+	require.Equal(t, exp, <-ch1)
+
+	// the first search is still running, but the collection window has ended
+	time.Sleep(4 * searchCacheCollect)
+	hits := testutil.ToFloat64(cntSearchCacheHit)
+	ch2 := b2.Search(ctx, req)
+	require.Equal(t, exp, <-ch2)
+	require.Equal(t, hits+1, testutil.ToFloat64(cntSearchCacheHit))
+}
@@ -0,0 +1,145 @@
+package hub
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrStorageDisabled = errors.New("storage is disabled")
+
+// KeyValue is a single record in the plugin storage.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// StorageDatabase is a key-value storage for plugins and scripts.
+// Each plugin or script uses its own namespace.
+type StorageDatabase interface {
+	// GetValue returns a value for the key. Boolean flag indicates if the key exists.
+	GetValue(ns, key string) (string, bool, error)
+	// PutValue sets the value for the key.
+	PutValue(ns, key, val string) error
+	// DelValue removes the key.
+	DelValue(ns, key string) error
+	// UpdateValue atomically replaces the value for the key. The function receives the current value
+	// and a flag indicating if the key exists.
+	UpdateValue(ns, key string, fnc func(val string, ok bool) (string, error)) error
+	// ListValues returns all the records in the namespace with a given key prefix, sorted by key.
+	ListValues(ns, prefix string) ([]KeyValue, error)
+	// ListNamespaces returns all non-empty namespaces.
+	ListNamespaces() ([]string, error)
+}
+
+// GetValue returns a value for the key from the plugin storage.
+func (h *Hub) GetValue(ns, key string) (string, bool, error) {
+	if h.db == nil {
+		return "", false, nil
+	}
+	return h.db.GetValue(ns, key)
+}
+
+// PutValue sets the value for the key in the plugin storage.
+func (h *Hub) PutValue(ns, key, val string) error {
+	if h.db == nil {
+		return ErrStorageDisabled
+	}
+	return h.db.PutValue(ns, key, val)
+}
+
+// DelValue removes the key from the plugin storage.
+func (h *Hub) DelValue(ns, key string) error {
+	if h.db == nil {
+		return nil
+	}
+	return h.db.DelValue(ns, key)
+}
+
+// UpdateValue atomically replaces the value for the key in the plugin storage.
+func (h *Hub) UpdateValue(ns, key string, fnc func(val string, ok bool) (string, error)) error {
+	if h.db == nil {
+		return ErrStorageDisabled
+	}
+	return h.db.UpdateValue(ns, key, fnc)
+}
+
+// ListValues returns all the records in the plugin storage with a given key prefix, sorted by key.
+func (h *Hub) ListValues(ns, prefix string) ([]KeyValue, error) {
+	if h.db == nil {
+		return nil, nil
+	}
+	return h.db.ListValues(ns, prefix)
+}
+
+func (db *memDB) GetValue(ns, key string) (string, bool, error) {
+	db.mu.RLock()
+	v, ok := db.storage[ns][key]
+	db.mu.RUnlock()
+	return v, ok, nil
+}
+
+func (db *memDB) PutValue(ns, key, val string) error {
+	db.mu.Lock()
+	db.putValue(ns, key, val)
+	db.mu.Unlock()
+	return nil
+}
+
+func (db *memDB) putValue(ns, key, val string) {
+	m := db.storage[ns]
+	if m == nil {
+		m = make(map[string]string)
+		db.storage[ns] = m
+	}
+	m[key] = val
+}
+
+func (db *memDB) DelValue(ns, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	m := db.storage[ns]
+	delete(m, key)
+	if len(m) == 0 {
+		delete(db.storage, ns)
+	}
+	return nil
+}
+
+func (db *memDB) UpdateValue(ns, key string, fnc func(val string, ok bool) (string, error)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	v, ok := db.storage[ns][key]
+	v, err := fnc(v, ok)
+	if err != nil {
+		return err
+	}
+	db.putValue(ns, key, v)
+	return nil
+}
+
+func (db *memDB) ListValues(ns, prefix string) ([]KeyValue, error) {
+	db.mu.RLock()
+	var out []KeyValue
+	for k, v := range db.storage[ns] {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, KeyValue{Key: k, Value: v})
+		}
+	}
+	db.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Key < out[j].Key
+	})
+	return out, nil
+}
+
+func (db *memDB) ListNamespaces() ([]string, error) {
+	db.mu.RLock()
+	list := make([]string, 0, len(db.storage))
+	for ns := range db.storage {
+		list = append(list, ns)
+	}
+	db.mu.RUnlock()
+	sort.Strings(list)
+	return list, nil
+}
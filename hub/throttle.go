@@ -0,0 +1,174 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// ConfigThrottleIP is the max number of accepted connections per second from a single IP (0 - no limit).
+	ConfigThrottleIP = "throttle.ip"
+	// ConfigThrottleGlobal is the max number of accepted connections per second for the whole hub (0 - no limit).
+	ConfigThrottleGlobal = "throttle.global"
+	// ConfigThrottleAttack is the time in seconds the hub stays in "under attack" mode
+	// after the global accept rate was exceeded (0 - never enter the mode).
+	ConfigThrottleAttack = "throttle.attack"
+
+	defaultThrottleAttack = time.Minute
+
+	// throttleBackoff is the initial time an IP is blocked for after exceeding the accept rate.
+	// It is doubled on each subsequent violation, up to throttleBackoffMax.
+	throttleBackoff    = time.Second
+	throttleBackoffMax = 10 * time.Minute
+	// throttleForget is the time after which an idle IP is removed from the throttle state.
+	throttleForget = 10 * time.Minute
+
+	blockReasonBan     = "ban"
+	blockReasonPlugin  = "plugin"
+	blockReasonRateIP  = "rate_ip"
+	blockReasonRate    = "rate_global"
+	blockReasonBackoff = "backoff"
+	blockReasonAttack  = "attack"
+)
+
+var errUnderAttack = errors.New("hub is under heavy load, only registered users can join now, try again later")
+
+type acceptRate struct {
+	window  int64 // unix sec
+	n       int
+	level   uint
+	blocked time.Time
+	last    time.Time
+}
+
+type throttle struct {
+	sync.Mutex
+	byIP      map[BanKey]*acceptRate
+	global    acceptRate
+	lastSweep time.Time
+	attack    time.Time // under attack mode end
+}
+
+// count adds a connection to the rate window and returns the number of connections in it.
+func (r *acceptRate) count(now time.Time) int {
+	if sec := now.Unix(); sec != r.window {
+		r.window, r.n = sec, 0
+	}
+	r.n++
+	r.last = now
+	return r.n
+}
+
+// sweep removes idle entries. Must be called with the lock held.
+func (t *throttle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for k, r := range t.byIP {
+		if now.Sub(r.last) > throttleForget && now.After(r.blocked) {
+			delete(t.byIP, k)
+		}
+	}
+}
+
+// throttleAccept checks accept rate limits for a new connection.
+// It returns a non-empty reason if the connection must be dropped.
+//
+// Per-IP limits are checked first, so connections dropped by them are not counted
+// toward the global rate and a single flooding IP cannot lock out everyone else.
+func (h *Hub) throttleAccept(a net.Addr, now time.Time) string {
+	maxIP, _ := h.GetConfigInt(ConfigThrottleIP)
+	maxGlobal, _ := h.GetConfigInt(ConfigThrottleGlobal)
+	if maxIP <= 0 && maxGlobal <= 0 {
+		return ""
+	}
+	t := &h.throttle
+	t.Lock()
+	defer t.Unlock()
+	if maxIP > 0 {
+		if reason := h.throttleIP(a, now, maxIP); reason != "" {
+			return reason
+		}
+	}
+	if maxGlobal > 0 && int64(t.global.count(now)) > maxGlobal {
+		if !h.underAttack(now) {
+			if d := h.attackDuration(); d > 0 {
+				t.attack = now.Add(d)
+				h.Logf("accept rate exceeded, entering under attack mode for %v", d)
+				go h.SendOpChat("accept rate exceeded, only registered users can join for " + d.String())
+			}
+		}
+		return blockReasonRate
+	}
+	return ""
+}
+
+// throttleIP checks the accept rate and the backoff for a single IP. Must be called with the lock held.
+func (h *Hub) throttleIP(a net.Addr, now time.Time, max int64) string {
+	t := &h.throttle
+	t.sweep(now)
+	if t.byIP == nil {
+		t.byIP = make(map[BanKey]*acceptRate)
+	}
+	key := MinAddrKey(a)
+	r := t.byIP[key]
+	if r == nil {
+		r = &acceptRate{}
+		t.byIP[key] = r
+	} else if now.Sub(r.last) > throttleForget {
+		// forgive old violations
+		r.level = 0
+	}
+	if now.Before(r.blocked) {
+		r.last = now
+		return blockReasonBackoff
+	}
+	if int64(r.count(now)) <= max {
+		return ""
+	}
+	backoff := throttleBackoff << r.level
+	if backoff <= 0 || backoff > throttleBackoffMax {
+		backoff = throttleBackoffMax
+	} else {
+		r.level++
+	}
+	r.blocked = now.Add(backoff)
+	if r.level > 1 {
+		h.Logf("%s: accept rate exceeded, blocked for %v", addrString(a), backoff)
+	}
+	return blockReasonRateIP
+}
+
+func (h *Hub) attackDuration() time.Duration {
+	if v, ok := h.GetConfigInt(ConfigThrottleAttack); ok {
+		return time.Duration(v) * time.Second
+	}
+	return defaultThrottleAttack
+}
+
+// underAttack checks if the hub is in "under attack" mode. Must be called with the lock held.
+func (h *Hub) underAttack(now time.Time) bool {
+	return now.Before(h.throttle.attack)
+}
+
+// UnderAttack checks if the hub is in "under attack" mode.
+// In this mode only registered users are allowed to join the hub.
+func (h *Hub) UnderAttack() bool {
+	h.throttle.Lock()
+	defer h.throttle.Unlock()
+	return h.underAttack(time.Now())
+}
+
+// SetUnderAttack enables "under attack" mode for a given duration. Zero duration disables it.
+func (h *Hub) SetUnderAttack(dt time.Duration) {
+	h.throttle.Lock()
+	defer h.throttle.Unlock()
+	if dt <= 0 {
+		h.throttle.attack = time.Time{}
+		return
+	}
+	h.throttle.attack = time.Now().Add(dt)
+}
@@ -0,0 +1,84 @@
+package hub
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottleAccept(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	h.setConfigInt(ConfigThrottleIP, 2)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 411}
+	now := time.Unix(1000, 0)
+
+	require.Empty(t, h.throttleAccept(addr, now))
+	require.Empty(t, h.throttleAccept(addr, now))
+	require.Equal(t, blockReasonRateIP, h.throttleAccept(addr, now))
+	require.Equal(t, blockReasonBackoff, h.throttleAccept(addr, now.Add(time.Second/2)))
+
+	// backoff is doubled for repeat offenders
+	now = now.Add(time.Second)
+	require.Empty(t, h.throttleAccept(addr, now))
+	require.Empty(t, h.throttleAccept(addr, now))
+	require.Equal(t, blockReasonRateIP, h.throttleAccept(addr, now))
+	require.Equal(t, blockReasonBackoff, h.throttleAccept(addr, now.Add(3*time.Second/2)))
+	require.Empty(t, h.throttleAccept(addr, now.Add(2*time.Second)))
+
+	// global limit enables under attack mode
+	h.setConfigInt(ConfigThrottleIP, 0)
+	h.setConfigInt(ConfigThrottleGlobal, 1)
+	now = time.Now()
+	require.Empty(t, h.throttleAccept(addr, now))
+	require.False(t, h.UnderAttack())
+	require.Equal(t, blockReasonRate, h.throttleAccept(addr, now))
+	require.True(t, h.UnderAttack())
+	h.SetUnderAttack(0)
+	require.False(t, h.UnderAttack())
+}
+
+func TestThrottleFlood(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	h.setConfigInt(ConfigThrottleIP, 1)
+	h.setConfigInt(ConfigThrottleGlobal, 2)
+
+	flood := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 411}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 411}
+	now := time.Unix(1000, 0)
+
+	require.Empty(t, h.throttleAccept(flood, now))
+	require.Equal(t, blockReasonRateIP, h.throttleAccept(flood, now))
+	for i := 0; i < 10; i++ {
+		require.Equal(t, blockReasonBackoff, h.throttleAccept(flood, now))
+	}
+	// throttled connections are not counted toward the global rate
+	require.Empty(t, h.throttleAccept(other, now))
+	require.False(t, h.UnderAttack())
+}
+
+func TestThrottleServe(t *testing.T) {
+	h, err := NewHub(Config{}, nil)
+	require.NoError(t, err)
+	h.setConfigInt(ConfigThrottleIP, 1)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 411}
+	require.Empty(t, h.throttleAccept(addr, time.Now()))
+
+	// connections are dropped before the protocol is detected
+	accepted := testutil.ToFloat64(cntConnAccepted)
+	hc, cc := net.Pipe()
+	defer cc.Close()
+	err = h.Serve(addrOverride{Conn: hc, remote: addr})
+	require.NoError(t, err)
+	_, err = cc.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	// and are not counted as accepted
+	require.Equal(t, accepted, testutil.ToFloat64(cntConnAccepted))
+}
@@ -33,9 +33,10 @@ type Ban struct {
 type User struct {
 	aname atomic.Value // string
 
-	mu      sync.RWMutex
-	ban     *Ban
-	profile *UserProfile
+	mu         sync.RWMutex
+	ban        *Ban
+	profile    *UserProfile
+	passChange bool
 }
 
 func (u *User) Name() string {
@@ -71,6 +72,23 @@ func (u *User) BanUntil(t time.Time, reason string) {
 	u.mu.Unlock()
 }
 
+// MustChangePass reports if the user must change the password before using the hub.
+func (u *User) MustChangePass() bool {
+	if u == nil {
+		return false
+	}
+	u.mu.RLock()
+	v := u.passChange
+	u.mu.RUnlock()
+	return v
+}
+
+func (u *User) setPassChange(v bool) {
+	u.mu.Lock()
+	u.passChange = v
+	u.mu.Unlock()
+}
+
 func (u *User) Profile() *UserProfile {
 	if u == nil {
 		return nil
@@ -106,7 +124,7 @@ func (u *User) IsOp() bool {
 	if p == nil {
 		return false
 	}
-	return p.IsOwner() || p.HasParent(ProfileNameOperator)
+	return p.IsOp()
 }
 
 func (u *User) IsRegistered() bool {
@@ -128,6 +146,7 @@ type Database interface {
 	UserDatabase
 	ProfileDatabase
 	BanDatabase
+	StorageDatabase
 	Close() error
 }
 
@@ -135,6 +154,27 @@ type UserRecord struct {
 	Name    string
 	Pass    string
 	Profile string
+	// Keyprint of the TLS client certificate bound to this account.
+	// ADC clients presenting this certificate are logged in without a password.
+	Keyprint string
+	// KeyprintPass requires both the keyprint and the password to match.
+	KeyprintPass bool
+
+	Registered   time.Time // registration time
+	RegisteredBy string    // name of the user who registered this account
+	LastLogin    time.Time
+	LastSeen     time.Time // last time the user left the hub
+	LastIP       string
+	LastClient   string // client software used during the last login
+	Email        string
+	Notes        string // operator notes
+
+	Locked       bool      // account is locked by an operator
+	LockedUntil  time.Time // account is locked after too many failed logins
+	FailedLogins int       // number of consecutive failed logins
+	PassChange   bool      // user must change the password after the next login
+	ResetToken   string    // one-time password issued by an operator
+	ResetExpires time.Time // expiration time of the reset token
 }
 
 type UserDatabase interface {
@@ -231,10 +271,74 @@ func (h *Hub) validatePass(pass string) error {
 }
 
 func (h *Hub) RegisterUser(name, pass string) error {
+	return h.registerUser(UserRecord{Name: name, Pass: pass})
+}
+
+// RegisterUserProfile registers a new user with a given profile. Empty profile means a regular registered user.
+func (h *Hub) RegisterUserProfile(name, pass, profile string) error {
+	if err := h.validateUserName(name); err != nil {
+		return err
+	}
+	if profile != "" && h.Profile(profile) == nil {
+		return fmt.Errorf("profile %q does not exist", profile)
+	}
+	return h.registerUser(UserRecord{Name: name, Pass: pass, Profile: profile})
+}
+
+// registerUser creates a new user record and sets the registration time.
+func (h *Hub) registerUser(rec UserRecord) error {
 	if h.db == nil {
 		return ErrUserRegDisabled
 	}
-	return h.db.CreateUser(UserRecord{Name: name, Pass: pass})
+	if rec.Registered.IsZero() {
+		rec.Registered = time.Now().UTC()
+	}
+	return h.db.CreateUser(rec)
+}
+
+// userLogin updates the last login time, IP and client of a registered user.
+func (h *Hub) userLogin(peer Peer) {
+	if h.db == nil || peer.User() == nil || IsBot(peer) {
+		return
+	}
+	now := time.Now().UTC()
+	ip := ""
+	if a := peer.RemoteAddr(); a != nil {
+		ip = addrString(a)
+	}
+	app := peer.UserInfo().App
+	client := strings.TrimSpace(app.Name + " " + app.Version)
+	err := h.db.UpdateUser(peer.Name(), func(u *UserRecord) (bool, error) {
+		if u == nil {
+			return false, nil
+		}
+		u.LastLogin, u.LastIP, u.LastClient = now, ip, client
+		return true, nil
+	})
+	if err != nil {
+		h.Logf("cannot update user %q: %v", peer.Name(), err)
+	}
+	if peer.User().MustChangePass() {
+		h.cmdOutput(peer, errPassChangeRequired.Error())
+	}
+}
+
+// userLeave updates the last seen time of a registered user.
+func (h *Hub) userLeave(peer Peer) {
+	if h.db == nil || peer.User() == nil || IsBot(peer) {
+		return
+	}
+	now := time.Now().UTC()
+	err := h.db.UpdateUser(peer.Name(), func(u *UserRecord) (bool, error) {
+		if u == nil {
+			return false, nil
+		}
+		u.LastSeen = now
+		return true, nil
+	})
+	if err != nil {
+		h.Logf("cannot update user %q: %v", peer.Name(), err)
+	}
 }
 
 func (h *Hub) DeleteUser(name string) error {
@@ -254,7 +358,7 @@ func (h *Hub) UpdateUser(name string, fnc func(u *UserRecord) (bool, error)) err
 		}
 		ok, err := fnc(u)
 		if err != nil {
-			return false, nil
+			return false, err
 		} else if u.Name != name {
 			return false, errors.New("user name cannot be changed")
 		}
@@ -262,6 +366,22 @@ func (h *Hub) UpdateUser(name string, fnc func(u *UserRecord) (bool, error)) err
 	})
 }
 
+// GetUserRecord returns a record of the registered user, or nil if the user is not registered.
+func (h *Hub) GetUserRecord(name string) (*UserRecord, error) {
+	if h.db == nil {
+		return nil, nil
+	}
+	return h.db.GetUser(name)
+}
+
+// ListUsers returns records of all registered users.
+func (h *Hub) ListUsers() ([]UserRecord, error) {
+	if h.db == nil {
+		return nil, nil
+	}
+	return h.db.ListUsers()
+}
+
 func (h *Hub) IsRegistered(name string) (bool, error) {
 	if h.db == nil {
 		return false, nil
@@ -278,7 +398,7 @@ func (h *Hub) getUser(name string) (*User, *UserRecord, error) {
 	if err != nil || rec == nil {
 		return nil, nil, err
 	}
-	u := &User{profile: h.Profile(rec.Profile)}
+	u := &User{profile: h.Profile(rec.Profile), passChange: rec.PassChange}
 	if u.profile == nil {
 		u.profile = h.Profile(ProfileNameRegistered)
 	}
@@ -292,6 +412,7 @@ func NewDatabase() Database {
 		users:    make(map[string]UserRecord),
 		profiles: make(map[string]Map),
 		bans:     make(map[BanKey]Ban),
+		storage:  make(map[string]map[string]string),
 	}
 }
 
@@ -300,6 +421,7 @@ type memDB struct {
 	users    map[string]UserRecord
 	profiles map[string]Map
 	bans     map[BanKey]Ban
+	storage  map[string]map[string]string // namespace -> key -> value
 }
 
 func (*memDB) Close() error {
@@ -31,6 +31,9 @@ func DialHub(addr string, info *Config) (*Conn, error) {
 type Config struct {
 	Name string
 	Ext  []string
+	// Init is called when the handshake is complete, but before the connection starts reading messages.
+	// Callbacks like OnChatMessage should be set here, so no messages are missed.
+	Init func(c *Conn)
 }
 
 func (c *Config) validate() error {
@@ -63,6 +66,9 @@ func HubHandshake(conn *nmdc.Conn, conf *Config) (*Conn, error) {
 		conn.Close()
 		return nil, err
 	}
+	if conf.Init != nil {
+		conf.Init(c)
+	}
 	//conn.KeepAlive(time.Minute / 2)
 	go c.readLoop()
 	return c, nil
@@ -220,16 +226,18 @@ func (c *Conn) Close() error {
 	return err
 }
 
+// OnChatMessage sets a callback for main chat messages. It should be called from Config.Init.
 func (c *Conn) OnChatMessage(fnc func(m *nmdcp.ChatMessage) error) {
 	c.on.chat = fnc
 }
 
+// OnUnhandled sets a callback for all the messages not handled by the client. It should be called from Config.Init.
 func (c *Conn) OnUnhandled(fnc func(m nmdcp.Message) error) {
 	c.on.unhandled = fnc
 }
 
 func (c *Conn) OnlinePeers() []*Peer {
-	c.peers.RUnlock()
+	c.peers.RLock()
 	defer c.peers.RUnlock()
 	list := make([]*Peer, 0, len(c.peers.byName))
 	for _, peer := range c.peers.byName {
@@ -238,15 +246,52 @@ func (c *Conn) OnlinePeers() []*Peer {
 	return list
 }
 
-func (c *Conn) SendChatMsg(msg string) error {
+// Name returns the name of the current user.
+func (c *Conn) Name() string {
 	c.imu.RLock()
 	name := c.user.Name
 	c.imu.RUnlock()
+	return name
+}
+
+func (c *Conn) SendChatMsg(msg string) error {
 	return c.conn.WriteOneMsg(&nmdcp.ChatMessage{
-		Name: name, Text: msg,
+		Name: c.Name(), Text: msg,
+	})
+}
+
+// SendPrivateMsg sends a private message to a given user.
+func (c *Conn) SendPrivateMsg(to, msg string) error {
+	name := c.Name()
+	return c.conn.WriteOneMsg(&nmdcp.PrivateMessage{
+		To: to, From: name, Name: name, Text: msg,
 	})
 }
 
+// Search sends a passive search request. Results are delivered to the OnUnhandled callback as $SR.
+func (c *Conn) Search(s nmdcp.Search) error {
+	s.Address = ""
+	s.User = c.Name()
+	return c.conn.WriteOneMsg(&s)
+}
+
+// SendSearchResult sends a search result to a passive user via the hub.
+func (c *Conn) SendSearchResult(sr nmdcp.SR) error {
+	sr.From = c.Name()
+	return c.conn.WriteOneMsg(&sr)
+}
+
+// UpdateInfo changes user info and sends it to the hub.
+func (c *Conn) UpdateInfo(fnc func(u *nmdcp.MyINFO)) error {
+	c.imu.Lock()
+	name := c.user.Name
+	fnc(&c.user)
+	c.user.Name = name
+	u := c.user
+	c.imu.Unlock()
+	return c.conn.WriteOneMsg(&u)
+}
+
 func (c *Conn) readLoop() {
 	defer close(c.closed)
 	for {
@@ -257,10 +257,11 @@ func (c *Conn) Close() error {
 	if err := c.w.Close(); err != nil {
 		last = err
 	}
+	// then close the connection so it unblocks the reader,
+	// it may hold the read lock while waiting for the data
+	_ = c.conn.Close()
 	c.rmu.Lock()
 	defer c.rmu.Unlock()
-	// then close the connection so it unblocks the reader
-	_ = c.conn.Close()
 	// finally close the reader
 	if err := c.r.Close(); err != nil {
 		last = err